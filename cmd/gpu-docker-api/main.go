@@ -7,16 +7,28 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/judwhite/go-svc"
 	"github.com/ngaut/log"
 	flag "github.com/spf13/pflag"
 
+	"github.com/mayooot/gpu-docker-api/internal/booking"
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/fairshare"
+	"github.com/mayooot/gpu-docker-api/internal/lease"
+	"github.com/mayooot/gpu-docker-api/internal/monitor"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/priority"
+	"github.com/mayooot/gpu-docker-api/internal/queue"
+	"github.com/mayooot/gpu-docker-api/internal/quota"
 	"github.com/mayooot/gpu-docker-api/internal/routers"
+	"github.com/mayooot/gpu-docker-api/internal/schedule"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/usage"
 	"github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/utils"
@@ -35,11 +47,42 @@ var (
 	etcdAddr  = flag.StringP("etcd", "e", "0.0.0.0:2379", "Address of etcd server, format: ip:port")
 	portRange = flag.StringP("portRange", "p", "40000-65535", "Port range of docker container, format: startPort-endPort")
 	logLevel  = flag.StringP("logLevel", "l", "debug", "Log level, optional: release")
+
+	portStrategy       = flag.String("portStrategy", "random", "Strategy of allocating host ports, optional: random, sequential, lowest-free")
+	reservedPorts      = flag.String("reservedPorts", "", "Host ports that will never be used by containers, format: 22,80,443,8000-8100")
+	reservedCpus       = flag.String("reservedCpus", "", "CPUs reserved for the system that will never be used by containers, format: 0-1,8")
+	sharedCpus         = flag.String("sharedCpus", "", "CPUs shared by containers in shared cpu mode, format: 2-7")
+	reservedMemory     = flag.String("reservedMemory", "0GB", "Memory reserved for the system that will never be used by containers, format: 16GB")
+	reservedDisk       = flag.String("reservedDisk", "0GB", "Disk of docker's data root reserved for images and logs that will never be promised to containers, format: 100GB")
+	cpuOvercommitRatio = flag.Float64("cpuOvercommitRatio", 1, "Overcommit ratio of the shared cpus, must be greater than or equal to 1")
+
+	gpuHealthInterval = flag.Duration("gpuHealthInterval", time.Minute, "Interval of gpu health check, 0 means disabled")
+	gpuRescanInterval = flag.Duration("gpuRescanInterval", 10*time.Minute, "Interval of gpu rediscovery, 0 means disabled")
+	gpuMaxTemperature = flag.Int("gpuMaxTemperature", 90, "GPU whose temperature reaches this value is considered unhealthy, 0 means no limit")
+	queueInterval     = flag.Duration("queueInterval", 30*time.Second, "Interval of retrying the pending queue besides when resources are given back, 0 means disabled")
+	queuePolicy       = flag.String("queuePolicy", "fifo", "Policy of ordering the pending queue, optional: fifo, fair-share")
+	fairShareHalfLife = flag.Duration("fairShareHalfLife", 7*24*time.Hour, "Half-life of the gpu-hours used by the fair-share policy, 0 means never decayed")
+	fairShareWindow   = flag.Duration("fairShareWindow", 30*24*time.Hour, "Window of the usage records that the fair-share policy counts the gpu-hours of")
+	fairShareInterval = flag.Duration("fairShareInterval", time.Minute, "Interval of computing the gpu-hours of each owner from the usage records for the fair-share policy")
+	bookingInterval   = flag.Duration("bookingInterval", time.Minute, "Interval of starting and stopping the booked containers")
+	bookingLeadTime   = flag.Duration("bookingLeadTime", time.Hour, "How long before a booking starts its gpus are no longer given to others")
+	gpuIdleInterval   = flag.Duration("gpuIdleInterval", time.Minute, "Interval of sampling the gpu utilization of the running containers")
+	gpuIdleThreshold  = flag.Int("gpuIdleThreshold", 5, "GPU whose utilization in percent is below this value is considered idle")
+	gpuIdleTimeout    = flag.Duration("gpuIdleTimeout", 0, "Containers whose gpus are all idle for this long are stopped, 0 means disabled")
+	gpuIdleWarning    = flag.Duration("gpuIdleWarning", 30*time.Minute, "How long before an idle container is stopped its owner is warned")
+	leaseInterval     = flag.Duration("leaseInterval", time.Minute, "Interval of stopping or deleting the containers whose leases end")
+	leaseWarning      = flag.Duration("leaseWarning", time.Hour, "How long before a lease ends its owner is warned, 0 means no warning")
+	scheduleInterval  = flag.Duration("scheduleInterval", time.Minute, "Interval of running the scheduled stop, continue and restart actions")
+	usageRetention    = flag.Duration("usageRetention", 400*24*time.Hour, "How long the closed usage records are kept, 0 means forever")
+	reconcileMode     = flag.String("reconcileMode", "report", "How the schedulers and versions are reconciled with docker at startup, optional: report, repair, off")
+	walPath           = flag.String("walPath", "/var/lib/gpu-docker-api/workqueue.wal", "Path of the write-ahead log of the etcd work queue, the writes left in it are replayed at startup, those that fail are moved to <walPath>.dead")
+	notifyWebhook     = flag.String("notifyWebhook", "", "Webhook that the notifications to the owners of containers are posted to as json, empty means only logged")
 )
 
 type program struct {
-	ctx context.Context
-	wg  sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func main() {
@@ -53,7 +96,7 @@ func main() {
 func (p *program) Init(svc.Environment) (err error) {
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	flag.Parse()
-	p.ctx = context.Background()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 	log.SetLevelByString(*logLevel)
 
 	if err = docker.InitDockerClient(); err != nil {
@@ -64,17 +107,27 @@ func (p *program) Init(svc.Environment) (err error) {
 		return
 	}
 
-	workQueue.InitWorkQueue()
+	if err = workQueue.InitWorkQueue(*walPath); err != nil {
+		return
+	}
 
 	if err = schedulers.InitGPuScheduler(); err != nil {
 		return
 	}
 
-	if err = schedulers.InitCpuScheduler(); err != nil {
+	if err = schedulers.InitCpuScheduler(*reservedCpus, *sharedCpus, *cpuOvercommitRatio); err != nil {
+		return
+	}
+
+	if err = schedulers.InitMemoryScheduler(*reservedMemory); err != nil {
 		return
 	}
 
-	if err = schedulers.InitPortScheduler(*portRange); err != nil {
+	if err = schedulers.InitDiskScheduler(*reservedDisk); err != nil {
+		return
+	}
+
+	if err = schedulers.InitPortScheduler(*portRange, *portStrategy, *reservedPorts); err != nil {
 		return
 	}
 
@@ -86,6 +139,70 @@ func (p *program) Init(svc.Environment) (err error) {
 		return
 	}
 
+	if err = services.InitStoppedContainers(); err != nil {
+		return
+	}
+
+	if err = fairshare.InitFairShare(*fairShareHalfLife, *fairShareWindow, *fairShareInterval); err != nil {
+		return
+	}
+
+	if err = queue.InitPendingQueue(*queuePolicy); err != nil {
+		return
+	}
+
+	if err = priority.InitPriorityClasses(); err != nil {
+		return
+	}
+
+	if err = booking.InitBookings(); err != nil {
+		return
+	}
+
+	if err = quota.InitQuotas(); err != nil {
+		return
+	}
+
+	if err = lease.InitLeases(); err != nil {
+		return
+	}
+
+	if err = usage.InitUsageLedger(*usageRetention); err != nil {
+		return
+	}
+	// the containers that were running before the ledger was added are counted from now
+	new(services.ReplicaSetService).SyncUsage()
+
+	// the state in etcd may be lost or stale after a crash, compare it with the containers in docker
+	if *reconcileMode != "off" {
+		var report *services.ReconcileReport
+		if report, err = new(services.ReplicaSetService).Reconcile(*reconcileMode); err != nil {
+			return
+		}
+		log.Infof("reconcile with docker, mode: %s, %d version drifts, %d orphans, %d resource drifts",
+			report.Mode, len(report.Versions), len(report.Orphans), len(report.Resources))
+		for _, drift := range report.Resources {
+			log.Warnf("reconcile with docker, %s: %s is %s in the scheduler but %s in docker", drift.Resource, drift.ID, drift.Recorded, drift.Actual)
+		}
+	}
+
+	if err = schedule.InitSchedules(); err != nil {
+		return
+	}
+
+	if err = monitor.InitGpuIdleMonitor(*gpuIdleInterval, *gpuIdleTimeout, *gpuIdleWarning, *gpuIdleThreshold); err != nil {
+		return
+	}
+
+	notify.InitNotifier(*notifyWebhook)
+
+	monitor.InitGpuHealthChecker(*gpuHealthInterval, *gpuMaxTemperature)
+	monitor.InitGpuRescanner(*gpuRescanInterval)
+	queue.InitDispatcher(*queueInterval)
+	booking.InitRunner(*bookingInterval, *bookingLeadTime)
+	lease.InitExpirer(*leaseInterval, *leaseWarning)
+	schedule.InitRunner(*scheduleInterval)
+
 	//  create merges dir, that used to store container merged layer
 	layer := "merges"
 	if err = utils.IsDir(layer); err != nil {
@@ -101,10 +218,27 @@ func (p *program) Start() error {
 		ch routers.ReplicaSetHandler
 		vh routers.VolumeHandler
 		gh routers.Resource
+		ah routers.AdminHandler
+		qh routers.QueueHandler
+		bh routers.BookingHandler
+		lh routers.LeaseHandler
+		sh routers.ScheduleHandler
+		ph routers.UsageHandler
+		uh routers.QuotaHandler
 	)
 
-	fmt.Printf("CONFIG\n addr: %s\n etcdAddr: %s\n portRange: %s\n logLevel: %s\n\n", *addr, *etcdAddr, *portRange, *logLevel)
+	fmt.Println("CONFIG")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Printf(" %s: %s\n", f.Name, f.Value)
+	})
+	fmt.Println()
 	log.Infof("The number of available gpus is %d", schedulers.GpuScheduler.AvailableGpuNums)
+	log.Infof("The number of available cpus is %d", schedulers.CpuScheduler.AvailableCpuNums)
+	if !schedulers.CpuScheduler.SharedEnabled() {
+		log.Warn("The shared cpu pool is empty, shared cpu mode is disabled, set -sharedCpus to enable it")
+	}
+	log.Infof("The available memory is %d bytes", schedulers.MemoryScheduler.AvailableMemory)
+	log.Infof("The available disk is %d bytes", schedulers.DiskScheduler.AvailableDisk)
 	log.Infof("The range of available ports is %d-%d, and the available number is %d",
 		schedulers.PortScheduler.StartPort,
 		schedulers.PortScheduler.EndPort,
@@ -126,28 +260,62 @@ func (p *program) Start() error {
 	ch.RegisterRoute(apiv1)
 	vh.RegisterRoute(apiv1)
 	gh.RegisterRoute(apiv1)
+	ah.RegisterRoute(apiv1)
+	qh.RegisterRoute(apiv1)
+	bh.RegisterRoute(apiv1)
+	lh.RegisterRoute(apiv1)
+	sh.RegisterRoute(apiv1)
+	ph.RegisterRoute(apiv1)
+	uh.RegisterRoute(apiv1)
 
 	go func() {
 		_ = r.Run(*addr)
 	}()
 
-	go workQueue.SyncLoop(p.ctx, &p.wg)
+	workQueue.SyncLoop(p.ctx, &p.wg)
+	p.run(monitor.GpuHealthChecker.Loop)
+	p.run(monitor.GpuRescanner.Loop)
+	p.run(queue.Dispatcher.Loop)
+	p.run(fairshare.Tracker.Loop)
+	p.run(booking.Runner.Loop)
+	p.run(monitor.GpuIdleMonitor.Loop)
+	p.run(lease.Expirer.Loop)
+	p.run(schedule.Runner.Loop)
+	p.run(usage.Ledger.Loop)
 
 	return nil
 }
 
+// run starts the loop in the background, Stop waits for it to return
+func (p *program) run(loop func(ctx context.Context)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		loop(p.ctx)
+	}()
+}
+
 func (p *program) Stop() error {
 	log.Info("gpu-docker-routers is stopping...")
-	p.ctx.Done()
+	// the loops return once the context is cancelled, the work queue is closed after all of them are done
+	p.cancel()
 	p.wg.Wait()
 
 	workQueue.Close()
 	docker.CloseDockerClient()
-	_ = schedulers.CloseCpuScheduler()
-	_ = schedulers.CloseGpuScheduler()
-	_ = schedulers.ClosePortScheduler()
+	_ = schedulers.CloseSchedulers()
 	_ = version.CloseVersionMap()
 	_ = version.CloseMergedMap()
+	_ = services.CloseStoppedContainers()
+	_ = queue.ClosePendingQueue()
+	_ = fairshare.CloseFairShare()
+	_ = priority.ClosePriorityClasses()
+	_ = booking.CloseBookings()
+	_ = quota.CloseQuotas()
+	_ = monitor.CloseGpuIdleMonitor()
+	_ = lease.CloseLeases()
+	_ = schedule.CloseSchedules()
+	_ = usage.CloseUsageLedger()
 	_ = etcd.CloseEtcdClient()
 	log.Info("gpu-docker-routers stopped successfully!")
 	return nil
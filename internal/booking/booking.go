@@ -0,0 +1,323 @@
+package booking
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// the single key that older versions stored all bookings in
+	bookingMapKey = "bookingMapKey"
+	// one etcd key per booking, e.g. /gpu-docker-api/apis/v1/bookings/bookings/<name>
+	bookingDir = "bookings"
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+var Bookings *bookingMap
+
+// bookingMap holds the gpu bookings keyed by the booking name, the finished ones are kept for the calendar
+type bookingMap struct {
+	sync.RWMutex
+
+	Items map[string]*models.GpuBooking `json:"items"`
+	store *etcd.Store
+}
+
+func InitBookings() error {
+	var err error
+	Bookings, err = initBookingMapFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	return nil
+}
+
+func CloseBookings() error {
+	return etcd.Stores{Bookings.store}.Sync()
+}
+
+// initBookingMapFormEtcd reads the keys under the directory, or the blob key of older versions if there is no key yet
+func initBookingMapFormEtcd() (*bookingMap, error) {
+	bm := &bookingMap{
+		Items: make(map[string]*models.GpuBooking),
+	}
+	bm.store = etcd.NewStore(etcd.Bookings, bookingDir, bm.items)
+
+	err := etcd.LoadJSON(bm.store, bookingMapKey, bm.Items, func(blob []byte) error {
+		return json.Unmarshal(blob, bm)
+	})
+	return bm, err
+}
+
+// ParseTime parses the time format of bookings in the local time zone
+func ParseTime(value string) (time.Time, error) {
+	return time.ParseInLocation(timeLayout, value, time.Local)
+}
+
+// ParseWindow returns the window of the booking, it must end after it starts
+func ParseWindow(b *models.GpuBooking) (start, end time.Time, err error) {
+	if start, err = ParseTime(b.StartTime); err != nil {
+		return start, end, errors.Wrapf(err, "invalid start time: %s", b.StartTime)
+	}
+	if end, err = ParseTime(b.EndTime); err != nil {
+		return start, end, errors.Wrapf(err, "invalid end time: %s", b.EndTime)
+	}
+	if !end.After(start) {
+		return start, end, errors.Errorf("end time: %s must be after start time: %s", b.EndTime, b.StartTime)
+	}
+	return start, end, nil
+}
+
+// Create books the gpus for the window, pinned gpus must not be booked by others in the window,
+// otherwise the healthy gpus that are not booked by others are picked by index.
+func (bm *bookingMap) Create(b models.GpuBooking) (*models.GpuBooking, error) {
+	start, end, err := ParseWindow(&b)
+	if err != nil {
+		return nil, err
+	}
+
+	bm.Lock()
+	defer bm.Unlock()
+
+	if _, ok := bm.Items[b.Name]; ok {
+		return nil, errors.Wrapf(xerrors.NewBookingExistedError(), "booking: %s", b.Name)
+	}
+	gpus, err := bm.assign(&b, start, end)
+	if err != nil {
+		return nil, errors.WithMessage(err, "assign gpus failed")
+	}
+
+	b.Gpus = gpus
+	b.GpuCount = len(gpus)
+	b.Status = models.BookingPending
+	b.Started = false
+	b.Message = ""
+	b.CreateTime = time.Now().Format(timeLayout)
+	bm.Items[b.Name] = &b
+
+	go bm.putToEtcd()
+
+	return copyBooking(&b), nil
+}
+
+// Update replaces the window, gpus and spec of a booking that has not started
+func (bm *bookingMap) Update(name string, b models.GpuBooking) (*models.GpuBooking, error) {
+	start, end, err := ParseWindow(&b)
+	if err != nil {
+		return nil, err
+	}
+
+	bm.Lock()
+	defer bm.Unlock()
+
+	old, ok := bm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewBookingNotFoundError(), "booking: %s", name)
+	}
+	if old.Status != models.BookingPending {
+		return nil, errors.Wrapf(xerrors.NewBookingNotPendingError(), "booking: %s is %s", name, old.Status)
+	}
+
+	b.Name = name
+	gpus, err := bm.assign(&b, start, end)
+	if err != nil {
+		return nil, errors.WithMessage(err, "assign gpus failed")
+	}
+
+	b.Gpus = gpus
+	b.GpuCount = len(gpus)
+	b.Status = models.BookingPending
+	b.Started = false
+	b.Message = ""
+	b.CreateTime = old.CreateTime
+	bm.Items[name] = &b
+
+	go bm.putToEtcd()
+
+	return copyBooking(&b), nil
+}
+
+// assign picks the gpus for the booking in the window, the booking itself is ignored when it is updated
+func (bm *bookingMap) assign(b *models.GpuBooking, start, end time.Time) ([]string, error) {
+	// uuid -> the booking that holds it in the window
+	booked := make(map[string]string)
+	for name, other := range bm.Items {
+		if name == b.Name || other.Status == models.BookingFinished {
+			continue
+		}
+		otherStart, otherEnd, err := ParseWindow(other)
+		if err != nil || !otherStart.Before(end) || !start.Before(otherEnd) {
+			continue
+		}
+		for _, uuid := range other.Gpus {
+			booked[uuid] = name
+		}
+	}
+
+	if len(b.Gpus) != 0 {
+		uuids, err := schedulers.GpuScheduler.Resolve(b.Gpus)
+		if err != nil {
+			return nil, errors.WithMessage(err, "GpuScheduler.Resolve failed")
+		}
+		for _, uuid := range uuids {
+			if other, ok := booked[uuid]; ok {
+				return nil, errors.Wrapf(xerrors.NewBookingGpuNotEnoughError(), "gpu: %s is booked by %s", uuid, other)
+			}
+		}
+		return uuids, nil
+	}
+
+	var gpus []string
+	for _, gpu := range schedulers.GpuScheduler.GetGpuInventory() {
+		if len(gpus) == b.GpuCount {
+			break
+		}
+		if gpu.Health != nil {
+			continue
+		}
+		if _, ok := booked[*gpu.UUID]; ok {
+			continue
+		}
+		gpus = append(gpus, *gpu.UUID)
+	}
+	if len(gpus) < b.GpuCount {
+		return nil, errors.Wrapf(xerrors.NewBookingGpuNotEnoughError(), "only %d gpus are not booked from %s to %s",
+			len(gpus), b.StartTime, b.EndTime)
+	}
+	return gpus, nil
+}
+
+func (bm *bookingMap) Get(name string) (*models.GpuBooking, error) {
+	bm.RLock()
+	defer bm.RUnlock()
+
+	b, ok := bm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewBookingNotFoundError(), "booking: %s", name)
+	}
+	return copyBooking(b), nil
+}
+
+// List returns all bookings ordered by the start time
+func (bm *bookingMap) List() []*models.GpuBooking {
+	bm.RLock()
+	defer bm.RUnlock()
+
+	resp := make([]*models.GpuBooking, 0, len(bm.Items))
+	for _, b := range bm.Items {
+		resp = append(resp, copyBooking(b))
+	}
+	sortBookings(resp)
+	return resp
+}
+
+// Remove deletes the booking and returns it, the containers of it are stopped by the caller
+func (bm *bookingMap) Remove(name string) (*models.GpuBooking, error) {
+	bm.Lock()
+	defer bm.Unlock()
+
+	b, ok := bm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewBookingNotFoundError(), "booking: %s", name)
+	}
+	delete(bm.Items, name)
+
+	go bm.putToEtcd()
+
+	return b, nil
+}
+
+// Calendar returns the bookings of each gpu that overlap [from, to)
+func (bm *bookingMap) Calendar(from, to time.Time) []*models.GpuCalendar {
+	bm.RLock()
+	defer bm.RUnlock()
+
+	slots := make(map[string][]models.BookingSlot)
+	for _, b := range bm.Items {
+		start, end, err := ParseWindow(b)
+		if err != nil || !start.Before(to) || !from.Before(end) {
+			continue
+		}
+		for _, uuid := range b.Gpus {
+			slots[uuid] = append(slots[uuid], models.BookingSlot{
+				Booking:   b.Name,
+				Owner:     b.Owner,
+				StartTime: b.StartTime,
+				EndTime:   b.EndTime,
+				Status:    b.Status,
+			})
+		}
+	}
+
+	inventory := schedulers.GpuScheduler.GetGpuInventory()
+	resp := make([]*models.GpuCalendar, 0, len(inventory))
+	for _, gpu := range inventory {
+		gpuSlots := slots[*gpu.UUID]
+		if gpuSlots == nil {
+			gpuSlots = make([]models.BookingSlot, 0)
+		}
+		sort.Slice(gpuSlots, func(i, j int) bool {
+			return gpuSlots[i].StartTime < gpuSlots[j].StartTime
+		})
+		resp = append(resp, &models.GpuCalendar{
+			Index: gpu.Index,
+			UUID:  *gpu.UUID,
+			Model: gpu.Model,
+			Slots: gpuSlots,
+		})
+	}
+	return resp
+}
+
+// update changes the booking in place, it does nothing if the booking has been removed
+func (bm *bookingMap) update(name string, fn func(b *models.GpuBooking)) {
+	bm.Lock()
+	defer bm.Unlock()
+
+	b, ok := bm.Items[name]
+	if !ok {
+		return
+	}
+	fn(b)
+
+	go bm.putToEtcd()
+}
+
+// items one key per booking, name -> booking
+func (bm *bookingMap) items() map[string]string {
+	bm.RLock()
+	defer bm.RUnlock()
+
+	return etcd.JSONItems(bm.Items)
+}
+
+func (bm *bookingMap) putToEtcd() {
+	workQueue.Add(etcd.Stores{bm.store})
+}
+
+func copyBooking(b *models.GpuBooking) *models.GpuBooking {
+	tmp := *b
+	tmp.Gpus = append([]string(nil), b.Gpus...)
+	return &tmp
+}
+
+// sortBookings orders the bookings by the start time, the layout sorts as strings
+func sortBookings(bookings []*models.GpuBooking) {
+	sort.Slice(bookings, func(i, j int) bool {
+		if bookings[i].StartTime != bookings[j].StartTime {
+			return bookings[i].StartTime < bookings[j].StartTime
+		}
+		return bookings[i].Name < bookings[j].Name
+	})
+}
@@ -0,0 +1,197 @@
+package booking
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/lease"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+)
+
+var (
+	Runner *runner
+
+	cs services.ReplicaSetService
+)
+
+// runner holds the booked gpus shortly before the windows start, stops the others still holding them
+// and runs the specs when the windows start, and stops the containers when the windows end
+type runner struct {
+	sync.Mutex
+
+	interval time.Duration
+	// leadTime is how long before the start the booked gpus are no longer given to others
+	leadTime time.Duration
+}
+
+func InitRunner(interval, leadTime time.Duration) {
+	Runner = &runner{
+		interval: interval,
+		leadTime: leadTime,
+	}
+}
+
+func (r *runner) Loop(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.Sync()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sync moves the bookings forward to the current time, it is also called after the bookings are changed
+func (r *runner) Sync() {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	bookings := Bookings.List()
+
+	// hold the gpus first, so that the specs started below can use them
+	booked := make(map[string]string)
+	for _, b := range bookings {
+		start, end, err := ParseWindow(b)
+		if err != nil || b.Status == models.BookingFinished {
+			continue
+		}
+		if now.Before(start.Add(-r.leadTime)) || !now.Before(end) {
+			continue
+		}
+		for _, uuid := range b.Gpus {
+			booked[uuid] = b.Name
+		}
+	}
+	schedulers.GpuScheduler.SetBookedGpus(booked)
+
+	// the holders of gpus are read once, only if a booking is in its window
+	var holders []models.ReplicaSetGpus
+	loaded := false
+	for _, b := range bookings {
+		start, end, err := ParseWindow(b)
+		if err != nil || b.Status == models.BookingFinished {
+			continue
+		}
+		switch {
+		case !now.Before(end):
+			r.finish(b)
+		case !now.Before(start):
+			if b.Status == models.BookingPending {
+				Bookings.update(b.Name, func(b *models.GpuBooking) { b.Status = models.BookingActive })
+				log.Infof("booking.Runner, booking: %s is active, gpus: %+v", b.Name, b.Gpus)
+			}
+			if !loaded {
+				holders, loaded = cs.GpuHoldingReplicaSets(), true
+			}
+			r.reclaim(b, holders)
+			if b.Spec != nil && !b.Started {
+				r.start(b)
+			}
+		}
+	}
+}
+
+// start runs the spec on the booked gpus, it is retried in the next sync if it fails
+func (r *runner) start(b *models.GpuBooking) {
+	spec := *b.Spec
+	spec.Gpus = b.Gpus
+	spec.GpuCount = len(b.Gpus)
+	spec.Booking = b.Name
+	if spec.Owner == "" {
+		spec.Owner = b.Owner
+	}
+
+	_, containerName, err := cs.RunGpuContainer(&spec)
+	if err != nil {
+		log.Errorf("booking.Runner, booking: %s failed to run replicaSet: %s, original error: %T %v",
+			b.Name, spec.ReplicaSetName, errors.Cause(err), err)
+		// notified once, the same failure is retried in every sync
+		if b.Message != err.Error() {
+			notify.Notifier.Notify(models.NotificationBookingFailed, spec.ReplicaSetName, spec.Owner,
+				fmt.Sprintf("booking %s failed to run, it is retried until the window ends: %v", b.Name, err))
+		}
+		Bookings.update(b.Name, func(b *models.GpuBooking) { b.Message = err.Error() })
+		return
+	}
+
+	Bookings.update(b.Name, func(b *models.GpuBooking) {
+		b.Started = true
+		b.Message = ""
+	})
+	log.Infof("booking.Runner, booking: %s runs replicaSet: %s, container: %s", b.Name, spec.ReplicaSetName, containerName)
+	if _, err = lease.Leases.Start(&spec); err != nil {
+		log.Errorf("lease.Start failed, original error: %T %v", errors.Cause(err), err)
+	}
+}
+
+// reclaim stops the replicaSets of others that still hold the booked gpus when the window starts,
+// e.g. the ones that started before the gpus were held and are still running
+func (r *runner) reclaim(b *models.GpuBooking, holders []models.ReplicaSetGpus) {
+	booked := make(map[string]struct{}, len(b.Gpus))
+	for _, uuid := range b.Gpus {
+		booked[uuid] = struct{}{}
+	}
+	for _, h := range holders {
+		if h.Booking == b.Name || !holdsAny(h.Gpus, booked) {
+			continue
+		}
+		if err := cs.StopContainer(h.Name, true, true, true, true); err != nil {
+			log.Errorf("booking.Runner, booking: %s failed to stop replicaSet: %s that holds the booked gpus, original error: %T %v",
+				b.Name, h.Name, errors.Cause(err), err)
+			continue
+		}
+		log.Infof("booking.Runner, booking: %s stops replicaSet: %s that holds the booked gpus: %+v", b.Name, h.Name, h.Gpus)
+		notify.Notifier.Notify(models.NotificationBookingReclaimed, h.Name, h.Owner,
+			fmt.Sprintf("stopped because its gpus are booked by %s from %s", b.Name, b.StartTime))
+	}
+}
+
+func holdsAny(gpus []string, booked map[string]struct{}) bool {
+	for _, uuid := range gpus {
+		if _, ok := booked[uuid]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// finish stops the containers running on the booking and gives the gpus back
+func (r *runner) finish(b *models.GpuBooking) {
+	stopped := Stop(b.Name)
+	Bookings.update(b.Name, func(b *models.GpuBooking) {
+		b.Status = models.BookingFinished
+		b.Started = false
+	})
+	log.Infof("booking.Runner, booking: %s is finished, stopped replicaSets: %+v", b.Name, stopped)
+
+	for _, name := range stopped {
+		notify.Notifier.Notify(models.NotificationBookingEnded, name, b.Owner,
+			fmt.Sprintf("stopped because booking %s ended at %s", b.Name, b.EndTime))
+	}
+}
+
+// Stop stops the replicaSets running with the booking and returns them
+func Stop(name string) []string {
+	var stopped []string
+	for _, replicaSet := range cs.RunningReplicaSetsWithLabel(models.BookingLabel, name) {
+		if err := cs.StopContainer(replicaSet, true, true, true, true); err != nil {
+			log.Errorf("booking.Stop, booking: %s failed to stop replicaSet: %s, original error: %T %v",
+				name, replicaSet, errors.Cause(err), err)
+			continue
+		}
+		stopped = append(stopped, replicaSet)
+	}
+	return stopped
+}
@@ -27,8 +27,25 @@ const (
 	Cpus       Resource = "cpus"
 	Gpus       Resource = "gpus"
 	Ports      Resource = "ports"
+	Memory     Resource = "memory"
+	Disks      Resource = "disks"
+	Queues     Resource = "queues"
+	Priorities Resource = "priorities"
+	Bookings   Resource = "bookings"
+	Quotas     Resource = "quotas"
+	FairShare  Resource = "fairShare"
+	Idle       Resource = "idle"
+	Leases     Resource = "leases"
+	Schedules  Resource = "schedules"
+	Usage      Resource = "usage"
+	Stopped    Resource = "stopped"
 
 	operationDuration = 1 * time.Second
+
+	// MaxRequestBytes is the default --max-request-bytes of etcd, a larger put is refused by the server
+	MaxRequestBytes = 3 << 19
+	// requestOverhead leaves room for the header and the encoding of a request
+	requestOverhead = 1 << 10
 )
 
 type PutKeyValue struct {
@@ -37,6 +54,20 @@ type PutKeyValue struct {
 	Resource Resource
 }
 
+// KeepsHistory reports whether every value put to the keys of the resource matters,
+// the history of a replicaSet or volume is read from the revisions of its key.
+func KeepsHistory(resource Resource) bool {
+	return resource == Containers || resource == Volumes
+}
+
+// CheckSize returns an error if a put of the value to the key of the resource can never be accepted by etcd
+func CheckSize(resource Resource, key, value string) error {
+	if size := len(ResourcePrefix(resource, key)) + len(value); size > MaxRequestBytes-requestOverhead {
+		return errors.Wrapf(xerrors.NewEtcdTooLargeError(), "resource: %s, key: %s, %d bytes", resource, key, size)
+	}
+	return nil
+}
+
 type DelKey struct {
 	Resource Resource
 	Key      string
@@ -0,0 +1,62 @@
+package etcd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// rangeDuration is longer than operationDuration, a range may read many keys
+const rangeDuration = 5 * time.Second
+
+// KeyValue is a key under a directory and its value
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// GetRange reads the keys under the directory in [from, end) in key order,
+// the keys are relative to the directory, the empty end means all keys from from.
+func GetRange(resource Resource, dir, from, end string) ([]KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rangeDuration)
+	defer cancel()
+
+	prefix := ResourcePrefix(resource, dir) + "/"
+	resp, err := cli.Get(ctx, prefix+from, clientv3.WithRange(rangeEnd(prefix, end)),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.Get failed, prefix: %s, from: %s, end: %s", prefix, from, end)
+	}
+
+	kvs := make([]KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, KeyValue{
+			Key:   strings.TrimPrefix(string(kv.Key), prefix),
+			Value: kv.Value,
+		})
+	}
+	return kvs, nil
+}
+
+// DelRange deletes the keys under the directory in [from, end) and returns how many are deleted
+func DelRange(resource Resource, dir, from, end string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rangeDuration)
+	defer cancel()
+
+	prefix := ResourcePrefix(resource, dir) + "/"
+	resp, err := cli.Delete(ctx, prefix+from, clientv3.WithRange(rangeEnd(prefix, end)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "etcd.Delete failed, prefix: %s, from: %s, end: %s", prefix, from, end)
+	}
+	return resp.Deleted, nil
+}
+
+func rangeEnd(prefix, end string) string {
+	if end == "" {
+		return clientv3.GetPrefixRangeEnd(prefix)
+	}
+	return prefix + end
+}
@@ -0,0 +1,396 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// maxTxnOps is the default --max-txn-ops of etcd, more changes are written in several transactions
+	maxTxnOps = 128
+	// maxConflicts is how many times a sync is retried after the keys were modified by others
+	maxConflicts = 3
+)
+
+// Store mirrors the items of a map in memory to one etcd key per item under a directory,
+// e.g. /gpu-docker-api/apis/v1/gpus/state/<uuid>, so the state can be inspected with etcdctl.
+// It remembers the value and mod revision of every key it has read or written,
+// only the changed keys are written, and each of them is compared with the revision it remembers,
+// so an older snapshot can never overwrite a newer one.
+type Store struct {
+	sync.Mutex
+
+	resource Resource
+	dir      string
+	// snapshot returns the items in memory when the store is synced, key -> value
+	snapshot func() map[string]string
+
+	values map[string]string
+	revs   map[string]int64
+}
+
+func NewStore(resource Resource, dir string, snapshot func() map[string]string) *Store {
+	return &Store{
+		resource: resource,
+		dir:      dir,
+		snapshot: snapshot,
+		values:   make(map[string]string),
+		revs:     make(map[string]int64),
+	}
+}
+
+// Load reads all keys under the directory, key -> value, it is empty if nothing has been written
+func (s *Store) Load() (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	items := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		items[k] = v
+	}
+	return items, nil
+}
+
+// LoadOrBlob reads all keys under the directory like Load, if there is no key yet,
+// blob is the value of the single key that older versions stored the whole map in, it is nil if there is none.
+func (s *Store) LoadOrBlob(blobKey string) (items map[string]string, blob []byte, err error) {
+	items, err = s.Load()
+	if err != nil || len(items) != 0 {
+		return items, nil, err
+	}
+	blob, err = GetValue(s.resource, blobKey)
+	if xerrors.IsNotExistInEtcdError(err) {
+		err = nil
+	}
+	return items, blob, err
+}
+
+// LoadJSON reads the keys of a store whose values are the JSON of the items into items,
+// if there is no key yet, the blob key of older versions is decoded by decodeBlob and migrated to the keys.
+// The snapshot of the store must return JSONItems of the same map.
+func LoadJSON[T any](s *Store, blobKey string, items map[string]T, decodeBlob func([]byte) error) error {
+	values, blob, err := s.LoadOrBlob(blobKey)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		var item T
+		if err = json.Unmarshal([]byte(value), &item); err != nil {
+			return errors.Wrapf(err, "json.Unmarshal failed, key: %s", s.prefix()+key)
+		}
+		items[key] = item
+	}
+	if len(blob) == 0 {
+		return nil
+	}
+
+	if err = decodeBlob(blob); err != nil {
+		return errors.Wrapf(err, "decode %s failed", blobKey)
+	}
+	if err = s.Migrate(blobKey); err != nil {
+		return err
+	}
+	log.Infof("the items in %s are migrated to one etcd key per item", blobKey)
+	return nil
+}
+
+// JSONItems is the snapshot of a store whose values are the JSON of the items, key -> JSON
+func JSONItems[T any](items map[string]T) map[string]string {
+	values := make(map[string]string, len(items))
+	for key, item := range items {
+		bytes, err := json.Marshal(item)
+		if err != nil {
+			log.Errorf("json.Marshal failed, key: %s, err: %v", key, err)
+			continue
+		}
+		values[key] = string(bytes)
+	}
+	return values
+}
+
+// Migrate writes the items loaded from the blob key of older versions to one key per item,
+// the blob key is deleted once they are written.
+func (s *Store) Migrate(blobKey string) error {
+	if err := (Stores{s}).Sync(); err != nil {
+		return errors.WithMessage(err, "Stores.Sync failed")
+	}
+	if err := Del(s.resource, blobKey); err != nil {
+		return errors.Wrapf(err, "etcd.Del failed, resource: %s, key: %s", s.resource, blobKey)
+	}
+	return nil
+}
+
+// Increment increases the integer value of the key by one in a compare-and-swap and returns it,
+// it starts from floor if floor is greater than the value in etcd, e.g. the value in memory that has not been synced yet.
+// Concurrent increments never return the same value, even from other processes sharing the etcd.
+// applied is called with the new value before the store is unlocked, so a sync never writes an older value over it.
+func (s *Store) Increment(key string, floor int64, applied func(int64)) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for conflicts := 0; ; {
+		current := floor
+		if value, ok := s.values[key]; ok {
+			stored, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return 0, errors.Wrapf(err, "strconv.ParseInt failed, key: %s, value: %s", key, value)
+			}
+			if stored > current {
+				current = stored
+			}
+		}
+
+		next := strconv.FormatInt(current+1, 10)
+		succeeded, rev, err := commit([]change{{store: s, key: key, value: &next, rev: s.revs[key]}})
+		if err != nil {
+			return 0, err
+		}
+		if succeeded {
+			s.values[key] = next
+			s.revs[key] = rev
+			applied(current + 1)
+			return current + 1, nil
+		}
+
+		if conflicts++; conflicts > maxConflicts {
+			return 0, errors.Wrapf(xerrors.NewEtcdConflictError(), "key: %s", s.prefix()+key)
+		}
+		if err = s.reload(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *Store) prefix() string {
+	return ResourcePrefix(s.resource, s.dir) + "/"
+}
+
+// reload replaces the values and revisions with the ones in etcd
+func (s *Store) reload() error {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+	resp, err := cli.Get(ctx, s.prefix(), clientv3.WithPrefix())
+	if err != nil {
+		return errors.Wrapf(err, "etcd.Get failed, prefix: %s", s.prefix())
+	}
+
+	s.values = make(map[string]string, len(resp.Kvs))
+	s.revs = make(map[string]int64, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), s.prefix())
+		s.values[key] = string(kv.Value)
+		s.revs[key] = kv.ModRevision
+	}
+	return nil
+}
+
+// Stores are synced in a single transaction
+type Stores []*Store
+
+// change is a put or, if value is nil, a delete of a key that was last modified at rev
+type change struct {
+	store *Store
+	key   string
+	value *string
+	rev   int64
+}
+
+// Sync writes the items of the stores that differ from what is in etcd.
+// The snapshots are taken when it runs instead of when it is queued, so the latest sync always writes the latest state.
+// If the keys were modified by others, the revisions are reloaded and the sync is retried.
+func (ss Stores) Sync() error {
+	stores := ss.sorted()
+	for _, s := range stores {
+		s.Lock()
+	}
+	defer func() {
+		for _, s := range stores {
+			s.Unlock()
+		}
+	}()
+
+	for conflicts := 0; ; {
+		changes := changesOf(stores)
+		if len(changes) == 0 {
+			return nil
+		}
+		changes = firstTxn(changes)
+
+		succeeded, rev, err := commit(changes)
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			for _, c := range changes {
+				if c.value == nil {
+					delete(c.store.values, c.key)
+					delete(c.store.revs, c.key)
+					continue
+				}
+				c.store.values[c.key] = *c.value
+				c.store.revs[c.key] = rev
+			}
+			continue
+		}
+
+		if conflicts++; conflicts > maxConflicts {
+			return errors.Wrapf(xerrors.NewEtcdConflictError(), "prefixes: %s", ss)
+		}
+		log.Warnf("etcd keys under %s were modified by others, reload and sync again", ss)
+		for _, s := range stores {
+			if err = s.reload(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// String returns the prefixes of the stores
+func (ss Stores) String() string {
+	return strings.Join(ss.Prefixes(), ",")
+}
+
+// Prefixes returns the prefix of the keys of each store
+func (ss Stores) Prefixes() []string {
+	prefixes := make([]string, 0, len(ss))
+	for _, s := range ss {
+		prefixes = append(prefixes, s.prefix())
+	}
+	return prefixes
+}
+
+// StoreState is the items of a store at a point in time, the work queue logs it so a sync is not lost on crash
+type StoreState struct {
+	Resource Resource          `json:"resource"`
+	Dir      string            `json:"dir"`
+	Items    map[string]string `json:"items"`
+}
+
+// States returns the items of the stores in memory right now
+func (ss Stores) States() []StoreState {
+	states := make([]StoreState, 0, len(ss))
+	for _, s := range ss {
+		states = append(states, StoreState{
+			Resource: s.resource,
+			Dir:      s.dir,
+			Items:    s.snapshot(),
+		})
+	}
+	return states
+}
+
+// Restore makes the keys under the directory the same as the items, it is used before the stores are loaded
+func (st StoreState) Restore() error {
+	s := NewStore(st.Resource, st.Dir, func() map[string]string { return st.Items })
+	if _, err := s.Load(); err != nil {
+		return err
+	}
+	return Stores{s}.Sync()
+}
+
+// sorted returns the distinct stores ordered by prefix, they are always locked in this order
+func (ss Stores) sorted() []*Store {
+	seen := make(map[*Store]struct{}, len(ss))
+	stores := make([]*Store, 0, len(ss))
+	for _, s := range ss {
+		if _, ok := seen[s]; ok || s == nil {
+			continue
+		}
+		seen[s] = struct{}{}
+		stores = append(stores, s)
+	}
+	sort.Slice(stores, func(i, j int) bool {
+		return stores[i].prefix() < stores[j].prefix()
+	})
+	return stores
+}
+
+func changesOf(stores []*Store) []change {
+	var changes []change
+	for _, s := range stores {
+		items := s.snapshot()
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := items[key]
+			if old, ok := s.values[key]; ok && old == value {
+				continue
+			}
+			if err := CheckSize(s.resource, path.Join(s.dir, key), value); err != nil {
+				// it can never be written, the other keys are still synced
+				log.Errorf("etcd.Store skips a key, original error: %T %v", errors.Cause(err), err)
+				continue
+			}
+			changes = append(changes, change{store: s, key: key, value: &value, rev: s.revs[key]})
+		}
+
+		var deleted []string
+		for key := range s.values {
+			if _, ok := items[key]; !ok {
+				deleted = append(deleted, key)
+			}
+		}
+		sort.Strings(deleted)
+		for _, key := range deleted {
+			changes = append(changes, change{store: s, key: key, rev: s.revs[key]})
+		}
+	}
+	return changes
+}
+
+// firstTxn returns the changes that fit in one transaction, at most maxTxnOps and MaxRequestBytes
+func firstTxn(changes []change) []change {
+	size := requestOverhead
+	for i, c := range changes {
+		size += len(c.store.prefix()) + len(c.key)
+		if c.value != nil {
+			size += len(*c.value)
+		}
+		if i == maxTxnOps || (i > 0 && size > MaxRequestBytes) {
+			return changes[:i]
+		}
+	}
+	return changes
+}
+
+// commit puts and deletes the keys if none of them has been modified since its revision,
+// the revision of the transaction is returned.
+func commit(changes []change) (bool, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+
+	cmps := make([]clientv3.Cmp, 0, len(changes))
+	ops := make([]clientv3.Op, 0, len(changes))
+	for _, c := range changes {
+		key := c.store.prefix() + c.key
+		// the mod revision of a key that does not exist is 0
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", c.rev))
+		if c.value == nil {
+			ops = append(ops, clientv3.OpDelete(key))
+		} else {
+			ops = append(ops, clientv3.OpPut(key, *c.value))
+		}
+	}
+	resp, err := cli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return false, 0, errors.Wrapf(err, "etcd.Txn failed, %d changes", len(changes))
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
@@ -0,0 +1,50 @@
+package etcd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChangesOf(t *testing.T) {
+	items := map[string]string{"a": "1", "b": "changed", "c": "new"}
+	s := NewStore(Ports, "state", func() map[string]string { return items })
+	s.values = map[string]string{"a": "1", "b": "2", "d": "4"}
+	s.revs = map[string]int64{"a": 10, "b": 11, "d": 12}
+
+	changes := changesOf([]*Store{s})
+	if len(changes) != 3 {
+		t.Fatalf("changes = %d, want b, c and d", len(changes))
+	}
+	// the puts are compared with the revisions they were read at, the deletes come last
+	if c := changes[0]; c.key != "b" || *c.value != "changed" || c.rev != 11 {
+		t.Fatalf("change = %+v, want b put at revision 11", c)
+	}
+	if c := changes[1]; c.key != "c" || *c.value != "new" || c.rev != 0 {
+		t.Fatalf("change = %+v, want c created", c)
+	}
+	if c := changes[2]; c.key != "d" || c.value != nil || c.rev != 12 {
+		t.Fatalf("change = %+v, want d deleted at revision 12", c)
+	}
+}
+
+func TestFirstTxnSplitsLargeChanges(t *testing.T) {
+	s := NewStore(Ports, "state", nil)
+	value := strings.Repeat("x", MaxRequestBytes/3)
+
+	var changes []change
+	for i := 0; i < 5; i++ {
+		changes = append(changes, change{store: s, key: "big", value: &value})
+	}
+	if n := len(firstTxn(changes)); n != 2 {
+		t.Fatalf("first transaction = %d changes, want 2 under MaxRequestBytes", n)
+	}
+
+	small := "1"
+	changes = changes[:0]
+	for i := 0; i < maxTxnOps+10; i++ {
+		changes = append(changes, change{store: s, key: "small", value: &small})
+	}
+	if n := len(firstTxn(changes)); n != maxTxnOps {
+		t.Fatalf("first transaction = %d changes, want %d", n, maxTxnOps)
+	}
+}
@@ -0,0 +1,239 @@
+package fairshare
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/usage"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// the single key that older versions stored the weights and the sampled usage in
+	fairShareKey = "fairShareKey"
+	// one etcd key per group weight, e.g. /gpu-docker-api/apis/v1/fairShare/weights/<group>
+	weightDir = "weights"
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+var Tracker *tracker
+
+// tracker orders the pending requests by the gpu-hours of each owner in the window,
+// which are computed from the usage ledger, so the fair-share and the usage report never disagree.
+// The usage decays by half every halfLife, so that the usage long ago matters less.
+type tracker struct {
+	sync.RWMutex
+
+	// group -> weight
+	Weights map[string]float64 `json:"weights"`
+	store   *etcd.Store
+
+	// principal -> the decayed gpu-hours at the refresh time, it is computed again every interval
+	usage       map[string]float64
+	refreshTime time.Time
+
+	halfLife time.Duration
+	window   time.Duration
+	interval time.Duration
+}
+
+func InitFairShare(halfLife, window, interval time.Duration) error {
+	var err error
+	Tracker, err = initTrackerFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	Tracker.halfLife = halfLife
+	Tracker.window = window
+	Tracker.interval = interval
+	return nil
+}
+
+func CloseFairShare() error {
+	return etcd.Stores{Tracker.store}.Sync()
+}
+
+// initTrackerFormEtcd reads the weights under the directory, or the blob key of older versions if there is no key yet
+func initTrackerFormEtcd() (*tracker, error) {
+	t := &tracker{
+		Weights: make(map[string]float64),
+		usage:   make(map[string]float64),
+	}
+	t.store = etcd.NewStore(etcd.FairShare, weightDir, t.items)
+
+	err := etcd.LoadJSON(t.store, fairShareKey, t.Weights, func(blob []byte) error {
+		// the sampled usage of older versions is ignored, it is computed from the ledger instead
+		return json.Unmarshal(blob, t)
+	})
+	if t.Weights == nil {
+		t.Weights = make(map[string]float64)
+	}
+	return t, err
+}
+
+// Loop computes the usage once the ledger is loaded, and again every interval
+func (t *tracker) Loop(ctx context.Context) {
+	t.Refresh()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh computes the decayed gpu-hours of each principal from the usage records in the window,
+// the last usage is kept if the records can't be read.
+func (t *tracker) Refresh() {
+	now := time.Now()
+	records, err := usage.Ledger.Records(now.Add(-t.window), now)
+	if err != nil {
+		log.Errorf("usage.Records failed, original error: %T %v", errors.Cause(err), err)
+		return
+	}
+	computed := GpuHours(records, now, t.window, t.halfLife)
+
+	t.Lock()
+	defer t.Unlock()
+	t.usage = computed
+	t.refreshTime = now
+	log.Debugf("fairshare.Refresh, decayed gpu-hours by principal: %+v", computed)
+}
+
+// GpuHours sums the gpu-hours of the records in (now-window, now] by principal,
+// every hour is weighted by 0.5^(age/halfLife), halfLife 0 means never decayed.
+func GpuHours(records []models.UsageRecord, now time.Time, window, halfLife time.Duration) map[string]float64 {
+	hours := make(map[string]float64)
+	for _, r := range records {
+		if r.Gpus == 0 {
+			continue
+		}
+		start, end, ok := usage.Clip(r, now.Add(-window), now, now)
+		if !ok {
+			continue
+		}
+		hours[Principal(r.Owner, r.ReplicaSet)] += float64(r.Gpus) * decayedHours(now.Sub(end), now.Sub(start), halfLife)
+	}
+	return hours
+}
+
+// decayedHours integrates 0.5^(age/halfLife) over the ages from newest to oldest
+func decayedHours(newest, oldest, halfLife time.Duration) float64 {
+	if halfLife <= 0 {
+		return (oldest - newest).Hours()
+	}
+	h := halfLife.Hours()
+	return h / math.Ln2 * (math.Pow(0.5, newest.Hours()/h) - math.Pow(0.5, oldest.Hours()/h))
+}
+
+// Principal is who the usage is counted for, the replicaSets without an owner are counted on their own
+// instead of sharing the usage of everyone without an owner.
+func Principal(owner, replicaSet string) string {
+	if owner != "" {
+		return owner
+	}
+	return "replicaSet/" + replicaSet
+}
+
+// Score orders the pending requests, the lower score goes first.
+// It is the decayed gpu-hours of the principal divided by the weight of the group.
+func (t *tracker) Score(owner, group, replicaSet string) float64 {
+	t.RLock()
+	defer t.RUnlock()
+
+	weight := 1.0
+	if w, ok := t.Weights[group]; ok {
+		weight = w
+	}
+	return t.usage[Principal(owner, replicaSet)] / weight
+}
+
+// Usages returns the decayed gpu-hours of all principals from the highest to the lowest
+func (t *tracker) Usages() []models.ShareUsage {
+	t.RLock()
+	defer t.RUnlock()
+
+	resp := make([]models.ShareUsage, 0, len(t.usage))
+	for principal, hours := range t.usage {
+		resp = append(resp, models.ShareUsage{
+			Owner:      principal,
+			GpuHours:   hours,
+			UpdateTime: t.refreshTime.Format(timeLayout),
+		})
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].GpuHours != resp[j].GpuHours {
+			return resp[i].GpuHours > resp[j].GpuHours
+		}
+		return resp[i].Owner < resp[j].Owner
+	})
+	return resp
+}
+
+// SetWeight sets the weight of the group, it must be greater than 0
+func (t *tracker) SetWeight(group string, weight float64) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.Weights[group] = weight
+
+	go t.putToEtcd()
+}
+
+// RemoveWeight puts the group back to the default weight
+func (t *tracker) RemoveWeight(group string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.Weights[group]; !ok {
+		return errors.Wrapf(xerrors.NewGroupWeightNotFoundError(), "group: %s", group)
+	}
+	delete(t.Weights, group)
+
+	go t.putToEtcd()
+
+	return nil
+}
+
+// GetWeights returns the weights of all groups ordered by the group
+func (t *tracker) GetWeights() []models.GroupWeight {
+	t.RLock()
+	defer t.RUnlock()
+
+	resp := make([]models.GroupWeight, 0, len(t.Weights))
+	for group, weight := range t.Weights {
+		resp = append(resp, models.GroupWeight{Group: group, Weight: weight})
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].Group < resp[j].Group
+	})
+	return resp
+}
+
+// items one key per group, group -> weight
+func (t *tracker) items() map[string]string {
+	t.RLock()
+	defer t.RUnlock()
+
+	return etcd.JSONItems(t.Weights)
+}
+
+func (t *tracker) putToEtcd() {
+	workQueue.Add(etcd.Stores{t.store})
+}
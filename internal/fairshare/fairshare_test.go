@@ -0,0 +1,76 @@
+package fairshare
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+const layout = "2006-01-02 15:04:05"
+
+func TestGpuHours(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)
+	at := func(d time.Duration) string {
+		return now.Add(-d).Format(layout)
+	}
+	records := []models.UsageRecord{
+		// 2 gpus for the last 2 hours, still open
+		{ReplicaSet: "foo", Owner: "alice", Gpus: 2, StartTime: at(2 * time.Hour)},
+		// 1 gpu for 1 hour, ended 1 day ago
+		{ReplicaSet: "bar", Owner: "alice", Gpus: 1, StartTime: at(25 * time.Hour), EndTime: at(24 * time.Hour)},
+		// only the last 24 hours of it are in the window
+		{ReplicaSet: "baz", Owner: "bob", Gpus: 1, StartTime: at(48 * time.Hour), EndTime: at(0)},
+		// no owner, counted on its own
+		{ReplicaSet: "qux", Gpus: 4, StartTime: at(time.Hour), EndTime: at(0)},
+		// no gpus
+		{ReplicaSet: "cpu", Owner: "carol", Cpus: 8, StartTime: at(time.Hour)},
+	}
+
+	hours := GpuHours(records, now, 24*time.Hour, 0)
+	want := map[string]float64{"alice": 4, "bob": 24, "replicaSet/qux": 4}
+	if len(hours) != len(want) {
+		t.Fatalf("gpu hours = %v, want %v", hours, want)
+	}
+	for principal, h := range want {
+		if math.Abs(hours[principal]-h) > 1e-9 {
+			t.Errorf("%s: gpu hours = %v, want %v", principal, hours[principal], h)
+		}
+	}
+
+	// the hour that ended a half-life ago counts about half
+	decayed := GpuHours(records[1:2], now, 48*time.Hour, 24*time.Hour)
+	if h := decayed["alice"]; h < 0.49 || h > 0.52 {
+		t.Fatalf("decayed gpu hours = %v, want about 0.5", h)
+	}
+}
+
+func TestDecayedHoursWithoutDecay(t *testing.T) {
+	if h := decayedHours(time.Hour, 3*time.Hour, 0); h != 2 {
+		t.Fatalf("hours = %v, want 2", h)
+	}
+	// the decayed hours never exceed the hours
+	if h := decayedHours(0, 3*time.Hour, time.Hour); h >= 3 || h <= 0 {
+		t.Fatalf("hours = %v, want in (0, 3)", h)
+	}
+}
+
+func TestScoreDividesByGroupWeight(t *testing.T) {
+	tr := &tracker{
+		Weights: map[string]float64{"vision": 2},
+		usage:   map[string]float64{"alice": 10, "replicaSet/foo": 3},
+	}
+	if s := tr.Score("alice", "vision", "bar"); s != 5 {
+		t.Fatalf("score = %v, want 5", s)
+	}
+	if s := tr.Score("alice", "", "bar"); s != 10 {
+		t.Fatalf("score = %v, want 10", s)
+	}
+	if s := tr.Score("", "", "foo"); s != 3 {
+		t.Fatalf("score without owner = %v, want the usage of the replicaSet", s)
+	}
+	if s := tr.Score("", "", "bar"); s != 0 {
+		t.Fatalf("score of another replicaSet without owner = %v, want 0", s)
+	}
+}
@@ -0,0 +1,121 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+)
+
+var (
+	Expirer *expirer
+
+	cs services.ReplicaSetService
+)
+
+// expirer warns the owners before the leases end, and stops or deletes the replicaSets when they end,
+// the leases of the stopped replicaSets are kept as expired until they are extended
+type expirer struct {
+	sync.Mutex
+
+	interval time.Duration
+	// warning is how long before the end the owner is warned
+	warning time.Duration
+}
+
+func InitExpirer(interval, warning time.Duration) {
+	Expirer = &expirer{
+		interval: interval,
+		warning:  warning,
+	}
+}
+
+func (e *expirer) Loop(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.Expire()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Expire checks all leases once, the resources of the expired replicaSets are given back by the services
+func (e *expirer) Expire() {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+	for _, l := range Leases.List() {
+		if l.Expired {
+			continue
+		}
+		expiry, err := ParseTime(l.ExpiresAt)
+		if err != nil {
+			log.Errorf("lease.Expirer, replicaSet: %s has an invalid expiresAt: %s", l.ReplicaSet, l.ExpiresAt)
+			continue
+		}
+
+		if !now.Before(expiry) {
+			// the lease may be extended since it was listed
+			if current, err := Leases.Get(l.ReplicaSet); err != nil || current.ExpiresAt != l.ExpiresAt {
+				continue
+			}
+			if err = e.expire(l); err != nil {
+				// keep the lease, it is retried at the next check
+				log.Errorf("lease.Expirer, replicaSet: %s failed to %s, original error: %T %v",
+					l.ReplicaSet, l.OnExpiry, errors.Cause(err), err)
+				continue
+			}
+			if !Leases.expired(l.ReplicaSet, l.ExpiresAt) {
+				log.Warnf("lease.Expirer, the lease of replicaSet: %s is extended while it is %s, it can be restarted",
+					l.ReplicaSet, expiredState(l.OnExpiry))
+				continue
+			}
+			notify.Notifier.Notify(models.NotificationLeaseExpired, l.ReplicaSet, l.Owner,
+				fmt.Sprintf("the lease of replicaSet: %s ended at %s, it is %s", l.ReplicaSet, l.ExpiresAt, expiredState(l.OnExpiry)))
+			continue
+		}
+
+		if !l.Warned && e.warning > 0 && !now.Before(expiry.Add(-e.warning)) {
+			Leases.markWarned(l.ReplicaSet)
+			notify.Notifier.Notify(models.NotificationLeaseWarning, l.ReplicaSet, l.Owner,
+				fmt.Sprintf("the lease of replicaSet: %s ends at %s, it will be %s", l.ReplicaSet, l.ExpiresAt, expiredState(l.OnExpiry)))
+		}
+	}
+}
+
+// expire stops or deletes the replicaSet, a replicaSet that is already stopped or deleted is left as it is
+func (e *expirer) expire(l *models.Lease) error {
+	if l.OnExpiry == models.LeaseActionDelete {
+		if !cs.ReplicaSetExist(l.ReplicaSet) {
+			return nil
+		}
+		log.Infof("lease.Expirer, the lease of replicaSet: %s ended at %s, delete it", l.ReplicaSet, l.ExpiresAt)
+		return cs.DeleteContainer(l.ReplicaSet)
+	}
+
+	running, err := cs.ReplicaSetRunning(l.ReplicaSet)
+	if err != nil || !running {
+		return nil
+	}
+	log.Infof("lease.Expirer, the lease of replicaSet: %s ended at %s, stop it", l.ReplicaSet, l.ExpiresAt)
+	return cs.StopContainer(l.ReplicaSet, true, true, true, true)
+}
+
+func expiredState(action string) string {
+	if action == models.LeaseActionDelete {
+		return "deleted"
+	}
+	return "stopped"
+}
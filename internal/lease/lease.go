@@ -0,0 +1,277 @@
+package lease
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// the single key that older versions stored all leases in
+	leaseMapKey = "leaseMapKey"
+	// one etcd key per lease, e.g. /gpu-docker-api/apis/v1/leases/leases/<replicaSet>
+	leaseDir = "leases"
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+var Leases *leaseMap
+
+// leaseMap holds the leases keyed by the replicaSet name, a lease is kept as expired after the replicaSet is stopped
+type leaseMap struct {
+	sync.RWMutex
+
+	Items map[string]*models.Lease `json:"items"`
+	store *etcd.Store
+}
+
+func InitLeases() error {
+	var err error
+	Leases, err = initLeaseMapFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	return nil
+}
+
+func CloseLeases() error {
+	return etcd.Stores{Leases.store}.Sync()
+}
+
+// initLeaseMapFormEtcd reads the keys under the directory, or the blob key of older versions if there is no key yet
+func initLeaseMapFormEtcd() (*leaseMap, error) {
+	lm := &leaseMap{
+		Items: make(map[string]*models.Lease),
+	}
+	lm.store = etcd.NewStore(etcd.Leases, leaseDir, lm.items)
+
+	err := etcd.LoadJSON(lm.store, leaseMapKey, lm.Items, func(blob []byte) error {
+		return json.Unmarshal(blob, lm)
+	})
+	return lm, err
+}
+
+// ParseTime parses the time format of leases in the local time zone
+func ParseTime(value string) (time.Time, error) {
+	return time.ParseInLocation(timeLayout, value, time.Local)
+}
+
+// Expiry returns when the lease ends, either ttl after the time from or at expiresAt, only one of them can be set
+func Expiry(ttl, expiresAt string, from time.Time) (time.Time, error) {
+	switch {
+	case ttl != "" && expiresAt != "":
+		return from, errors.Errorf("ttl: %s and expiresAt: %s can't be set at the same time", ttl, expiresAt)
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return from, errors.Wrapf(err, "invalid ttl: %s", ttl)
+		}
+		if d <= 0 {
+			return from, errors.Errorf("ttl: %s must be greater than 0", ttl)
+		}
+		return from.Add(d), nil
+	case expiresAt != "":
+		t, err := ParseTime(expiresAt)
+		if err != nil {
+			return from, errors.Wrapf(err, "invalid expiresAt: %s", expiresAt)
+		}
+		if !t.After(time.Now()) {
+			return from, errors.Errorf("expiresAt: %s must be in the future", expiresAt)
+		}
+		return t, nil
+	}
+	return from, errors.New("ttl or expiresAt must be set")
+}
+
+// Leased reports whether the spec asks for a lease
+func Leased(spec *models.ContainerRun) bool {
+	return spec.Ttl != "" || spec.ExpiresAt != ""
+}
+
+// Start leases the replicaSet from now if the spec asks for it,
+// it is called when the container runs, a queued request is not leased until then.
+func (lm *leaseMap) Start(spec *models.ContainerRun) (*models.Lease, error) {
+	if !Leased(spec) {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var (
+		expiry time.Time
+		err    error
+	)
+	if spec.ExpiresAt != "" {
+		// a queued request may run after it expires, it is stopped at the next expiry check
+		expiry, err = ParseTime(spec.ExpiresAt)
+	} else {
+		expiry, err = Expiry(spec.Ttl, "", now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &models.Lease{
+		ReplicaSet: spec.ReplicaSetName,
+		Owner:      spec.Owner,
+		ExpiresAt:  expiry.Format(timeLayout),
+		OnExpiry:   spec.OnExpiry,
+		CreateTime: now.Format(timeLayout),
+	}
+	if l.OnExpiry == "" {
+		l.OnExpiry = models.LeaseActionStop
+	}
+
+	lm.Lock()
+	defer lm.Unlock()
+
+	lm.Items[l.ReplicaSet] = l
+
+	go lm.putToEtcd()
+
+	return copyLease(l), nil
+}
+
+// Extend moves the end of the lease, ttl is added to when it expires now, or to now if it has expired,
+// and the owner is warned again before the new end.
+func (lm *leaseMap) Extend(name string, spec models.LeaseExtend) (*models.Lease, error) {
+	lm.Lock()
+	defer lm.Unlock()
+
+	l, ok := lm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewLeaseNotFoundError(), "replicaSet: %s", name)
+	}
+	now := time.Now()
+	current, err := ParseTime(l.ExpiresAt)
+	if err != nil || current.Before(now) {
+		current = now
+	}
+	expiry, err := Expiry(spec.Ttl, spec.ExpiresAt, current)
+	if err != nil {
+		return nil, err
+	}
+
+	l.ExpiresAt = expiry.Format(timeLayout)
+	l.Warned = false
+	l.Expired = false
+
+	go lm.putToEtcd()
+
+	return copyLease(l), nil
+}
+
+// Check returns the lease expired error if the replicaSet has a lease that ends before now,
+// the replicaSet can't be restarted or continued until the lease is extended.
+func (lm *leaseMap) Check(name string, now time.Time) error {
+	lm.RLock()
+	defer lm.RUnlock()
+
+	l, ok := lm.Items[name]
+	if !ok {
+		return nil
+	}
+	if expiry, err := ParseTime(l.ExpiresAt); l.Expired || (err == nil && !now.Before(expiry)) {
+		return errors.Wrapf(xerrors.NewLeaseExpiredError(), "replicaSet: %s, expiresAt: %s", name, l.ExpiresAt)
+	}
+	return nil
+}
+
+func (lm *leaseMap) Get(name string) (*models.Lease, error) {
+	lm.RLock()
+	defer lm.RUnlock()
+
+	l, ok := lm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewLeaseNotFoundError(), "replicaSet: %s", name)
+	}
+	return copyLease(l), nil
+}
+
+// List returns all leases, the one that expires first is the first one
+func (lm *leaseMap) List() []*models.Lease {
+	lm.RLock()
+	defer lm.RUnlock()
+
+	leases := make([]*models.Lease, 0, len(lm.Items))
+	for _, l := range lm.Items {
+		leases = append(leases, copyLease(l))
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].ExpiresAt != leases[j].ExpiresAt {
+			return leases[i].ExpiresAt < leases[j].ExpiresAt
+		}
+		return leases[i].ReplicaSet < leases[j].ReplicaSet
+	})
+	return leases
+}
+
+// Remove ends the lease, the replicaSet is no longer stopped or deleted by the expirer
+func (lm *leaseMap) Remove(name string) (*models.Lease, error) {
+	lm.Lock()
+	defer lm.Unlock()
+
+	l, ok := lm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewLeaseNotFoundError(), "replicaSet: %s", name)
+	}
+	delete(lm.Items, name)
+
+	go lm.putToEtcd()
+
+	return l, nil
+}
+
+// expired marks the lease expired after the replicaSet is stopped, or removes it after the replicaSet is deleted.
+// Nothing is changed if the lease is extended since it was read at expiresAt, false is returned then.
+func (lm *leaseMap) expired(name, expiresAt string) bool {
+	lm.Lock()
+	defer lm.Unlock()
+
+	l, ok := lm.Items[name]
+	if !ok || l.ExpiresAt != expiresAt {
+		return false
+	}
+	if l.OnExpiry == models.LeaseActionDelete {
+		delete(lm.Items, name)
+	} else {
+		l.Expired = true
+	}
+
+	go lm.putToEtcd()
+
+	return true
+}
+
+func (lm *leaseMap) markWarned(name string) {
+	lm.Lock()
+	defer lm.Unlock()
+
+	if l, ok := lm.Items[name]; ok {
+		l.Warned = true
+		go lm.putToEtcd()
+	}
+}
+
+// items one key per lease, replicaSet -> lease
+func (lm *leaseMap) items() map[string]string {
+	lm.RLock()
+	defer lm.RUnlock()
+
+	return etcd.JSONItems(lm.Items)
+}
+
+func (lm *leaseMap) putToEtcd() {
+	workQueue.Add(etcd.Stores{lm.store})
+}
+
+func copyLease(l *models.Lease) *models.Lease {
+	tmp := *l
+	return &tmp
+}
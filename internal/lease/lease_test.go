@@ -0,0 +1,31 @@
+package lease
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestCheckRefusesExpiredLeases(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	lm := &leaseMap{Items: map[string]*models.Lease{
+		"foo": {ReplicaSet: "foo", ExpiresAt: "2024-01-10 13:00:00"},
+		"bar": {ReplicaSet: "bar", ExpiresAt: "2024-01-10 11:00:00"},
+		// stopped by the expirer, the time is not checked
+		"baz": {ReplicaSet: "baz", ExpiresAt: "2024-01-10 13:00:00", Expired: true},
+	}}
+
+	if err := lm.Check("foo", now); err != nil {
+		t.Fatalf("foo: err = %v, want nil", err)
+	}
+	if err := lm.Check("qux", now); err != nil {
+		t.Fatalf("a replicaSet without lease: err = %v, want nil", err)
+	}
+	for _, name := range []string{"bar", "baz"} {
+		if err := lm.Check(name, now); !xerrors.IsLeaseExpiredError(err) {
+			t.Fatalf("%s: err = %v, want expired", name, err)
+		}
+	}
+}
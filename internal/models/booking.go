@@ -0,0 +1,47 @@
+package models
+
+const (
+	// BookingPending waits for the window to start, the gpus are held for it shortly before the start
+	BookingPending = "pending"
+	// BookingActive is in the window, the spec is running if there is one
+	BookingActive = "active"
+	// BookingFinished has ended, the containers of it are stopped
+	BookingFinished = "finished"
+
+	// BookingLabel keeps the booking with the container, so that patch and restart can use the booked gpus
+	// and the container is stopped when the window ends
+	BookingLabel = "gpu-docker-api.booking"
+)
+
+// GpuBooking books gpus for a time window, the time format is 2006-01-02 15:04:05 in the local time zone
+type GpuBooking struct {
+	Name     string   `json:"name"`
+	Owner    string   `json:"owner,omitempty"`
+	GpuCount int      `json:"gpuCount,omitempty"`
+	Gpus     []string `json:"gpus,omitempty"` // pinned gpu indexes or uuids, they are replaced by the booked uuids
+	// StartTime and EndTime make the window [StartTime, EndTime)
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+	// Spec is run on the booked gpus when the window starts, and stopped when it ends
+	Spec       *ContainerRun `json:"spec,omitempty"`
+	Status     string        `json:"status"`
+	Started    bool          `json:"started"` // whether the spec is running
+	Message    string        `json:"message,omitempty"`
+	CreateTime string        `json:"createTime"`
+}
+
+// GpuCalendar is the bookings of a gpu in a time range
+type GpuCalendar struct {
+	Index int           `json:"index"`
+	UUID  string        `json:"uuid"`
+	Model string        `json:"model"`
+	Slots []BookingSlot `json:"slots"`
+}
+
+type BookingSlot struct {
+	Booking   string `json:"booking"`
+	Owner     string `json:"owner,omitempty"`
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+	Status    string `json:"status"`
+}
@@ -1,29 +1,97 @@
 package models
 
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CpuPolicyNumaPrefer prefers the cpus local to the allocated gpus, it is the default policy
+	CpuPolicyNumaPrefer = "numa-prefer"
+	// CpuPolicyNumaStrict only uses the cpus local to the allocated gpus
+	CpuPolicyNumaStrict = "numa-strict"
+
+	// CpuPolicyLabel keeps the cpu policy with the container, so that patch and restart can preserve it
+	CpuPolicyLabel = "gpu-docker-api.cpuPolicy"
+
+	// CpuModeExclusive binds the container to dedicated cpus, it is the default mode
+	CpuModeExclusive = "exclusive"
+	// CpuModeShared limits the container by cpu quota on the shared pool
+	CpuModeShared = "shared"
+
+	// CpuModeLabel keeps the cpu mode with the container, so that patch and restart can preserve it
+	CpuModeLabel = "gpu-docker-api.cpuMode"
+
+	// DefaultRootfsSize is used when the rootfs size is not specified
+	DefaultRootfsSize = "30GB"
+
+	// GpuModelLabel and MinGpuMemoryLabel keep the gpu selectors asked by the user with the container,
+	// so that patch and restart apply for the same kind of gpus, any gpu is used if they are not asked
+	GpuModelLabel     = "gpu-docker-api.gpuModel"
+	MinGpuMemoryLabel = "gpu-docker-api.minGpuMemory"
+
+	// FixedPortsLabel keeps the container ports whose host ports are specified by the user, e.g. 22/tcp,8888/tcp,
+	// so that patch and restart keep the same host ports for them
+	FixedPortsLabel = "gpu-docker-api.fixedPorts"
+)
+
 type ContainerRun struct {
 	ImageName      string   `json:"imageName"`
 	ReplicaSetName string   `json:"replicaSetName"`
 	GpuCount       int      `json:"gpuCount,omitempty"`
+	Gpus           []string `json:"gpus,omitempty"`         // pinned gpu indexes or uuids
+	ExcludeGpus    []string `json:"excludeGpus,omitempty"`  // gpu indexes or uuids that must not be used
+	GpuModel       string   `json:"gpuModel,omitempty"`     // e.g. A100-80GB, RTX 4090
+	MinGpuMemory   string   `json:"minGpuMemory,omitempty"` // KB, MB, GB, TB
 	CpuCount       int      `json:"cpuCount,omitempty"`
-	Memory         string   `json:"memory,omitempty"` // KB, MB, GB, TB
+	CpuPolicy      string   `json:"cpuPolicy,omitempty"`  // numa-prefer, numa-strict
+	CpuMode        string   `json:"cpuMode,omitempty"`    // exclusive, shared
+	Memory         string   `json:"memory,omitempty"`     // KB, MB, GB, TB
+	RootfsSize     string   `json:"rootfsSize,omitempty"` // KB, MB, GB, TB, default 30GB
 	Binds          []Bind   `json:"binds,omitempty"`
 	Env            []string `json:"env,omitempty"`
 	Cmd            []string `json:"cmd,omitempty"`
-	ContainerPorts []string `json:"containerPorts,omitempty"`
+	ContainerPorts []string `json:"containerPorts,omitempty"` // e.g. 8888, 5000/udp, 22/tcp=40022
+	// Queue puts the request into the pending queue instead of failing when resources are not enough
+	Queue bool `json:"queue,omitempty"`
+	// PriorityClass is defined by the admin, lower preemptible containers are stopped if resources are not enough
+	PriorityClass string `json:"priorityClass,omitempty"`
+	// Owner is notified when the container is stopped by the system, e.g. username or email
+	Owner string `json:"owner,omitempty"`
+	// Owner and Group are limited by their quotas
+	Group string `json:"group,omitempty"`
+	// Booking runs the container on the gpus booked for the window, it is stopped when the window ends
+	Booking string `json:"booking,omitempty"`
+	// Ttl or ExpiresAt leases the replicaSet, it is stopped or deleted by OnExpiry when the lease ends
+	Ttl       string `json:"ttl,omitempty"`       // e.g. 48h, counted from when the container runs
+	ExpiresAt string `json:"expiresAt,omitempty"` // e.g. 2024-01-02 15:04:05
+	OnExpiry  string `json:"onExpiry,omitempty"`  // stop, delete, default stop
 }
 
 type GpuPatch struct {
-	GpuCount int `json:"gpuCount"`
+	GpuCount     int      `json:"gpuCount"`
+	Gpus         []string `json:"gpus,omitempty"`         // pinned gpu indexes or uuids
+	ExcludeGpus  []string `json:"excludeGpus,omitempty"`  // gpu indexes or uuids that must not be used
+	GpuModel     string   `json:"gpuModel,omitempty"`     // e.g. A100-80GB, RTX 4090
+	MinGpuMemory string   `json:"minGpuMemory,omitempty"` // KB, MB, GB, TB
 }
 
 type CpuPatch struct {
-	CpuCount int `json:"cpuCount"`
+	CpuCount  int    `json:"cpuCount"`
+	CpuPolicy string `json:"cpuPolicy,omitempty"` // numa-prefer, numa-strict
+	CpuMode   string `json:"cpuMode,omitempty"`   // exclusive, shared
 }
 
 type MemoryPatch struct {
 	Memory string `json:"memory"` // KB, MB, GB, TB
 }
 
+type RootfsPatch struct {
+	RootfsSize string `json:"rootfsSize"` // KB, MB, GB, TB
+}
+
 type VolumePatch struct {
 	OldBind *Bind `json:"oldBind"`
 	NewBind *Bind `json:"newBind"`
@@ -34,6 +102,7 @@ type PatchRequest struct {
 	CpuPatch    *CpuPatch    `json:"cpuPatch"`
 	MemoryPatch *MemoryPatch `json:"memoryPatch"`
 	VolumePatch *VolumePatch `json:"volumePatch"`
+	RootfsPatch *RootfsPatch `json:"rootfsPatch"`
 }
 
 type RollbackRequest struct {
@@ -54,3 +123,50 @@ type ContainerHistoryItem struct {
 	CreateTime string            `json:"createTime"`
 	Status     EtcdContainerInfo `json:"status"`
 }
+
+// ContainerPort is parsed from the format: port[/protocol][=hostPort], the protocol defaults to tcp
+type ContainerPort struct {
+	Port     string
+	Protocol string
+	HostPort string
+}
+
+func ParseContainerPort(origin string) (*ContainerPort, error) {
+	p := &ContainerPort{Protocol: "tcp"}
+	port := origin
+	if i := strings.Index(port, "="); i != -1 {
+		port, p.HostPort = port[:i], port[i+1:]
+		if !validPortNumber(p.HostPort) {
+			return nil, errors.Errorf("invalid host port: %s", origin)
+		}
+	}
+	if i := strings.Index(port, "/"); i != -1 {
+		port, p.Protocol = port[:i], strings.ToLower(port[i+1:])
+		if p.Protocol != "tcp" && p.Protocol != "udp" {
+			return nil, errors.Errorf("invalid protocol: %s", origin)
+		}
+	}
+	if !validPortNumber(port) {
+		return nil, errors.Errorf("invalid container port: %s", origin)
+	}
+	p.Port = port
+	return p, nil
+}
+
+func validPortNumber(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// ResourceChanges reports the resources that changed when a container is recreated,
+// the unchanged ones are omitted
+type ResourceChanges struct {
+	Gpus  *ResourceChange            `json:"gpus,omitempty"`
+	Cpus  *ResourceChange            `json:"cpus,omitempty"`
+	Ports map[string]*ResourceChange `json:"ports,omitempty"` // key is the container port, e.g. 22/tcp
+}
+
+type ResourceChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
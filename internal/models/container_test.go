@@ -0,0 +1,27 @@
+package models
+
+import "testing"
+
+func TestParseContainerPort(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   ContainerPort
+	}{
+		{"22", ContainerPort{Port: "22", Protocol: "tcp"}},
+		{"53/UDP", ContainerPort{Port: "53", Protocol: "udp"}},
+		{"8888=40088", ContainerPort{Port: "8888", Protocol: "tcp", HostPort: "40088"}},
+		{"53/udp=40053", ContainerPort{Port: "53", Protocol: "udp", HostPort: "40053"}},
+	}
+	for _, tt := range tests {
+		p, err := ParseContainerPort(tt.origin)
+		if err != nil || *p != tt.want {
+			t.Errorf("ParseContainerPort(%q) = %+v, %v, want %+v", tt.origin, p, err, tt.want)
+		}
+	}
+
+	for _, origin := range []string{"", "0", "65536", "22/sctp", "22=", "22=ssh", "ssh"} {
+		if _, err := ParseContainerPort(origin); err == nil {
+			t.Errorf("ParseContainerPort(%q) succeeded, want an error", origin)
+		}
+	}
+}
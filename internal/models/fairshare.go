@@ -0,0 +1,23 @@
+package models
+
+const (
+	// QueuePolicyFifo runs the pending requests in the order they are queued, it is the default policy
+	QueuePolicyFifo = "fifo"
+	// QueuePolicyFairShare runs the pending requests of the owners that used fewer gpu-hours first
+	QueuePolicyFairShare = "fair-share"
+)
+
+// ShareUsage is the decayed gpu-hours of an owner in the fair-share window,
+// the replicaSets without an owner are counted on their own as replicaSet/<name>
+type ShareUsage struct {
+	Owner      string  `json:"owner"`
+	GpuHours   float64 `json:"gpuHours"`
+	UpdateTime string  `json:"updateTime"`
+}
+
+// GroupWeight divides the gpu-hours of the group members when the pending requests are ordered,
+// a group with a higher weight gets a larger share, the default weight is 1
+type GroupWeight struct {
+	Group  string  `json:"group"`
+	Weight float64 `json:"weight"`
+}
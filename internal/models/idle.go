@@ -0,0 +1,14 @@
+package models
+
+// ReplicaSetGpus is a running replicaSet with the gpus of its latest version
+type ReplicaSetGpus struct {
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner,omitempty"`
+	Booking string   `json:"booking,omitempty"`
+	Gpus    []string `json:"gpus"`
+}
+
+// IdleStopPatch enables or disables stopping the replicaSet when its gpus are idle
+type IdleStopPatch struct {
+	Enabled bool `json:"enabled"`
+}
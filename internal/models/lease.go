@@ -0,0 +1,26 @@
+package models
+
+const (
+	// LeaseActionStop stops the replicaSet when the lease ends, it is the default action
+	LeaseActionStop = "stop"
+	// LeaseActionDelete deletes the replicaSet when the lease ends, it can't be recovered
+	LeaseActionDelete = "delete"
+)
+
+// Lease is the time a replicaSet is allowed to run, it starts when the container runs
+type Lease struct {
+	ReplicaSet string `json:"replicaSet"`
+	Owner      string `json:"owner,omitempty"`
+	ExpiresAt  string `json:"expiresAt"`
+	OnExpiry   string `json:"onExpiry"` // stop, delete
+	Warned     bool   `json:"warned"`
+	// Expired means the replicaSet is stopped by the expirer, it can't be restarted until the lease is extended
+	Expired    bool   `json:"expired"`
+	CreateTime string `json:"createTime"`
+}
+
+// LeaseExtend either extends the lease by ttl from when it expires, or sets when it expires
+type LeaseExtend struct {
+	Ttl       string `json:"ttl,omitempty"`       // e.g. 24h
+	ExpiresAt string `json:"expiresAt,omitempty"` // e.g. 2024-01-02 15:04:05
+}
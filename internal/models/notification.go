@@ -0,0 +1,23 @@
+package models
+
+const (
+	NotificationPreempted    = "preempted"
+	NotificationBookingEnded = "bookingEnded"
+	// NotificationBookingReclaimed is sent to the replicaSet stopped because its gpus are booked by others from now
+	NotificationBookingReclaimed = "bookingReclaimed"
+	// NotificationBookingFailed is sent to the owner of the booking whose spec failed to run
+	NotificationBookingFailed = "bookingFailed"
+	NotificationIdleWarning   = "idleWarning"
+	NotificationIdleStopped   = "idleStopped"
+	NotificationLeaseWarning  = "leaseWarning"
+	NotificationLeaseExpired  = "leaseExpired"
+)
+
+// Notification tells the owner of a replicaSet that the system did something to it
+type Notification struct {
+	Event      string `json:"event"`
+	ReplicaSet string `json:"replicaSet"`
+	Owner      string `json:"owner"`
+	Message    string `json:"message"`
+	Time       string `json:"time"`
+}
@@ -0,0 +1,22 @@
+package models
+
+const (
+	// PriorityClassLabel keeps the priority class with the container, so that it can be found as a preemption victim
+	PriorityClassLabel = "gpu-docker-api.priorityClass"
+	// OwnerLabel keeps the owner with the container, who is notified when the container is stopped by the system
+	OwnerLabel = "gpu-docker-api.owner"
+)
+
+// PriorityClass is defined by the admin, requests of a higher value can preempt the preemptible containers of lower values.
+// The requests without a priority class have the value 0 and never preempt others.
+type PriorityClass struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+	// Preemptible means the containers of this class can be stopped for requests of higher values
+	Preemptible bool `json:"preemptible"`
+	// CommitOnPreempt commits the container as an image before it is stopped by preemption
+	CommitOnPreempt bool `json:"commitOnPreempt"`
+	// Owners and Groups may use the class, the class is open to everyone if both are empty
+	Owners []string `json:"owners,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
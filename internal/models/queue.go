@@ -0,0 +1,13 @@
+package models
+
+// QueuedRequest is a run request waiting in the pending queue, it is keyed by the replicaSet name
+type QueuedRequest struct {
+	Spec       ContainerRun `json:"spec"`
+	CreateTime string       `json:"createTime"`
+	// Position starts from 1 in the order the requests will be run, it is filled when the request is listed
+	Position int `json:"position"`
+}
+
+type QueueMove struct {
+	Position int `json:"position"`
+}
@@ -0,0 +1,48 @@
+package models
+
+const (
+	QuotaKindUser  = "user"
+	QuotaKindGroup = "group"
+
+	// GroupLabel keeps the group with the container and the volume, their usage counts against the quota of the group
+	GroupLabel = "gpu-docker-api.group"
+)
+
+// Quota limits the resources used by the containers and volumes of an owner or a group, 0 means unlimited.
+// Gpus, cpus, memory and replicaSets count the running containers, volumes count the latest version of each volume.
+type Quota struct {
+	Kind           string `json:"kind"` // user, group
+	Name           string `json:"name"` // the owner or the group
+	MaxGpus        int    `json:"maxGpus,omitempty"`
+	MaxCpus        int    `json:"maxCpus,omitempty"`
+	MaxMemory      string `json:"maxMemory,omitempty"` // KB, MB, GB, TB
+	MaxVolumes     int    `json:"maxVolumes,omitempty"`
+	MaxVolumeSize  string `json:"maxVolumeSize,omitempty"` // KB, MB, GB, TB, the total size of volumes
+	MaxReplicaSets int    `json:"maxReplicaSets,omitempty"`
+}
+
+type QuotaUsage struct {
+	Gpus        int   `json:"gpus"`
+	Cpus        int   `json:"cpus"`
+	Memory      int64 `json:"memory"` // bytes
+	Volumes     int   `json:"volumes"`
+	VolumeSize  int64 `json:"volumeSize"` // bytes
+	ReplicaSets int   `json:"replicaSets"`
+}
+
+func (u QuotaUsage) Add(other QuotaUsage) QuotaUsage {
+	return QuotaUsage{
+		Gpus:        u.Gpus + other.Gpus,
+		Cpus:        u.Cpus + other.Cpus,
+		Memory:      u.Memory + other.Memory,
+		Volumes:     u.Volumes + other.Volumes,
+		VolumeSize:  u.VolumeSize + other.VolumeSize,
+		ReplicaSets: u.ReplicaSets + other.ReplicaSets,
+	}
+}
+
+// QuotaStatus is the quota with the current usage against it
+type QuotaStatus struct {
+	Quota Quota      `json:"quota"`
+	Usage QuotaUsage `json:"usage"`
+}
@@ -0,0 +1,8 @@
+package models
+
+type GpuRescanResult struct {
+	Added   []string `json:"added"`
+	Retired []string `json:"retired"`
+	// retired gpus that are still used by the latest version of replicaSets
+	Pinned map[string][]string `json:"pinned"`
+}
@@ -0,0 +1,36 @@
+package models
+
+const (
+	// ScheduleActionStop stops the replicaSet and gives its resources back, like PATCH /replicaSet/:name/stop
+	ScheduleActionStop = "stop"
+	// ScheduleActionContinue calls `docker restart` on the replicaSet, like PATCH /replicaSet/:name/continue,
+	// it is recreated like restart if its resources were given back by a stop
+	ScheduleActionContinue = "continue"
+	// ScheduleActionRestart recreates the replicaSet with resources applied again, like PATCH /replicaSet/:name/restart
+	ScheduleActionRestart = "restart"
+
+	// MissedRunsLatest runs the latest action missed while the server was down, it is the default policy
+	MissedRunsLatest = "latest"
+	// MissedRunsSkip skips the actions missed while the server was down
+	MissedRunsSkip = "skip"
+)
+
+// ScheduleRule runs the action at the times matched by the cron expression, e.g. 0 19 * * mon-fri
+type ScheduleRule struct {
+	Action  string `json:"action"` // stop, continue, restart
+	Cron    string `json:"cron"`
+	NextRun string `json:"nextRun,omitempty"`
+}
+
+// Schedule runs actions on a replicaSet at the times of its rules
+type Schedule struct {
+	ReplicaSet string         `json:"replicaSet"`
+	Rules      []ScheduleRule `json:"rules"`
+	MissedRuns string         `json:"missedRuns,omitempty"` // latest, skip
+	// CheckTime is the last time the rules are checked, the runs between it and now are missed
+	CheckTime  string `json:"checkTime"`
+	LastAction string `json:"lastAction,omitempty"`
+	LastRun    string `json:"lastRun,omitempty"`
+	Message    string `json:"message,omitempty"`
+	CreateTime string `json:"createTime"`
+}
@@ -0,0 +1,28 @@
+package models
+
+const (
+	UsageGroupByOwner      = "owner"
+	UsageGroupByReplicaSet = "replicaSet"
+)
+
+// UsageRecord is an interval that the resources are allocated to a version of the replicaSet,
+// it is opened when the resources are applied and closed when they are restored.
+type UsageRecord struct {
+	ReplicaSet string `json:"replicaSet"`
+	Container  string `json:"container"`
+	Owner      string `json:"owner,omitempty"`
+	Group      string `json:"group,omitempty"`
+	Gpus       int    `json:"gpus"`
+	Cpus       int    `json:"cpus"`
+	Memory     int64  `json:"memory"` // bytes
+	StartTime  string `json:"startTime"`
+	EndTime    string `json:"endTime,omitempty"` // empty means the resources are still allocated
+}
+
+// UsageReport is the resources used by an owner or a replicaSet in a time range
+type UsageReport struct {
+	Key           string  `json:"key"` // owner or replicaSet
+	GpuHours      float64 `json:"gpuHours"`
+	CpuHours      float64 `json:"cpuHours"`
+	MemoryGBHours float64 `json:"memoryGBHours"`
+}
@@ -26,6 +26,9 @@ func (b *Bind) Format() string {
 type VolumeCreate struct {
 	Name string `json:"name,omitempty"`
 	Size string `json:"size,omitempty"`
+	// Owner and Group are limited by their quotas
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
 }
 
 type VolumeSize struct {
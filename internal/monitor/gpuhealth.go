@@ -0,0 +1,348 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	gpuHealthCommand = "nvidia-smi --query-gpu=uuid,pci.bus_id,temperature.gpu,ecc.errors.uncorrected.volatile.total --format=csv,noheader,nounits"
+	// the errors of dmesg are kept, e.g. dmesg: read kernel buffer failed: Operation not permitted
+	gpuXidCommand = "dmesg --time-format iso 2>&1 | grep -e 'NVRM: Xid' -e '^dmesg:' || true"
+	// e.g. 2024-01-10T10:00:00,123456+08:00
+	xidTimeLayout = "2006-01-02T15:04:05,999999-07:00"
+	// xidRecovery is how long a fatal xid keeps the gpu unhealthy, the gpu is expected to be reset in the meantime,
+	// nvidia-smi still reports it if it is not
+	xidRecovery = 30 * time.Minute
+
+	maxGpuHealthEvents = 100
+
+	GpuHealthEventUnhealthy = "unhealthy"
+	GpuHealthEventRecovered = "recovered"
+)
+
+// xid errors that mean the gpu can no longer be trusted until it is reset,
+// see https://docs.nvidia.com/deploy/xid-errors/index.html
+var fatalXids = map[int]string{
+	48:  "double bit ecc error",
+	62:  "internal micro-controller halt",
+	64:  "ecc page retirement or row remapping failure",
+	74:  "nvlink error",
+	79:  "gpu has fallen off the bus",
+	92:  "high single-bit ecc error rate",
+	94:  "contained ecc error",
+	95:  "uncontained ecc error",
+	119: "gsp rpc timeout",
+	120: "gsp error",
+}
+
+// e.g. 2024-01-10T10:00:00,123456+08:00 NVRM: Xid (PCI:0000:3b:00): 79, pid=1234, GPU has fallen off the bus.
+var xidRegexp = regexp.MustCompile(`^(\S+) .*NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+)`)
+
+var (
+	GpuHealthChecker *gpuHealthChecker
+
+	cs services.ReplicaSetService
+)
+
+type GpuHealthEvent struct {
+	Time        string   `json:"time"`
+	UUID        string   `json:"uuid"`
+	Type        string   `json:"type"`
+	Reason      string   `json:"reason,omitempty"`
+	ReplicaSets []string `json:"replicaSets,omitempty"`
+}
+
+type gpuHealthSample struct {
+	uuid        string
+	busID       string
+	temperature int
+	eccErrors   int
+	lost        bool
+}
+
+// xidEvent is a fatal xid in the kernel log
+type xidEvent struct {
+	xid  int
+	time time.Time
+}
+
+type gpuHealthChecker struct {
+	sync.RWMutex
+
+	runner         utils.CommandRunner
+	interval       time.Duration
+	maxTemperature int
+
+	// bus id -> gpu name, the xid errors in the kernel log only contain the bus id
+	busIDs map[string]string
+	// bus id -> the last fatal xid, it is forgotten after xidRecovery
+	xids map[string]xidEvent
+	// the time of the last processed line of the kernel log, the lines before it are skipped
+	lastXid time.Time
+	// the kernel log can't be read, it is warned once
+	xidUnavailable bool
+	events         []*GpuHealthEvent
+}
+
+// InitGpuHealthChecker the checker will not run if the interval is 0
+func InitGpuHealthChecker(interval time.Duration, maxTemperature int) {
+	GpuHealthChecker = &gpuHealthChecker{
+		runner:         newCommandRunner(),
+		interval:       interval,
+		maxTemperature: maxTemperature,
+		busIDs:         make(map[string]string),
+		xids:           make(map[string]xidEvent),
+		events:         make([]*GpuHealthEvent, 0, maxGpuHealthEvents),
+	}
+}
+
+// SetRunner replaces the command runner, it is used to mock nvidia-smi
+func (hc *gpuHealthChecker) SetRunner(runner utils.CommandRunner) {
+	hc.Lock()
+	defer hc.Unlock()
+	hc.runner = runner
+}
+
+func (hc *gpuHealthChecker) Loop(ctx context.Context) {
+	if hc.interval <= 0 {
+		log.Info("gpu health checker is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	for {
+		hc.Check()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check queries the health of all gpus once,
+// unhealthy gpus are excluded from scheduling and recovered gpus are returned to the free pool.
+func (hc *gpuHealthChecker) Check() {
+	reasons := hc.collect()
+
+	for uuid := range schedulers.GpuScheduler.GetGpuStatus() {
+		reason, unhealthy := reasons[uuid]
+		if unhealthy {
+			if schedulers.GpuScheduler.MarkUnhealthy(uuid, reason) {
+				replicaSets := cs.ReplicaSetsUsingGpu(uuid)
+				log.Warnf("monitor.GpuHealthChecker, gpu: %s is unhealthy, reason: %s, affected replicaSets: %+v",
+					uuid, reason, replicaSets)
+				hc.addEvent(uuid, GpuHealthEventUnhealthy, reason, replicaSets)
+			}
+			continue
+		}
+		if schedulers.GpuScheduler.MarkHealthy(uuid) {
+			log.Infof("monitor.GpuHealthChecker, gpu: %s recovered", uuid)
+			hc.addEvent(uuid, GpuHealthEventRecovered, "", nil)
+		}
+	}
+}
+
+// collect returns the gpus that are unhealthy and the reason
+func (hc *gpuHealthChecker) collect() map[string]string {
+	hc.Lock()
+	defer hc.Unlock()
+
+	reasons := make(map[string]string)
+
+	output, err := hc.runner.Run(gpuHealthCommand)
+	if err != nil && len(output) == 0 {
+		// nvidia-smi itself is broken, there is no way to tell which gpu is healthy
+		log.Errorf("monitor.GpuHealthChecker, query gpu health failed, err: %v", err)
+		return reasons
+	}
+
+	samples, lostBusIDs := parseGpuHealthOutput(output)
+	for _, sample := range samples {
+		hc.busIDs[sample.busID] = sample.uuid
+	}
+	reported := make(map[string]struct{}, len(samples))
+	for _, sample := range samples {
+		reported[sample.uuid] = struct{}{}
+		switch {
+		case sample.lost:
+			reasons[sample.uuid] = "gpu has fallen off the bus"
+		case sample.eccErrors > 0:
+			reasons[sample.uuid] = fmt.Sprintf("%d uncorrected ecc errors", sample.eccErrors)
+		case hc.maxTemperature > 0 && sample.temperature >= hc.maxTemperature:
+			reasons[sample.uuid] = fmt.Sprintf("temperature %d exceeds %d", sample.temperature, hc.maxTemperature)
+		}
+	}
+	for _, busID := range lostBusIDs {
+		if uuid, ok := hc.busIDs[busID]; ok {
+			reasons[uuid] = "gpu has fallen off the bus"
+		}
+	}
+	for uuid := range schedulers.GpuScheduler.GetGpuStatus() {
+		if _, ok := reported[uuid]; !ok {
+			if _, ok := reasons[uuid]; !ok {
+				reasons[uuid] = "gpu is not reported by nvidia-smi"
+			}
+		}
+	}
+
+	hc.collectXids(time.Now())
+	for busID, e := range hc.xids {
+		uuid, ok := hc.busIDs[busID]
+		if !ok {
+			continue
+		}
+		if _, ok := reasons[uuid]; !ok {
+			reasons[uuid] = fmt.Sprintf("xid %d: %s", e.xid, fatalXids[e.xid])
+		}
+	}
+
+	return reasons
+}
+
+// collectXids reads the fatal xids logged since the last check and forgets the ones older than xidRecovery
+func (hc *gpuHealthChecker) collectXids(now time.Time) {
+	output, err := hc.runner.Run(gpuXidCommand)
+	if err == nil {
+		var xids map[string]xidEvent
+		xids, hc.lastXid, err = parseXidOutput(output, hc.lastXid)
+		for busID, e := range xids {
+			hc.xids[busID] = e
+		}
+	}
+	if err != nil && !hc.xidUnavailable {
+		// e.g. dmesg_restrict is set and the container lacks CAP_SYSLOG
+		log.Warnf("monitor.GpuHealthChecker, query xid events failed, xid errors are not checked, err: %v", err)
+	}
+	hc.xidUnavailable = err != nil
+
+	for busID, e := range hc.xids {
+		if now.Sub(e.time) >= xidRecovery {
+			delete(hc.xids, busID)
+		}
+	}
+}
+
+func (hc *gpuHealthChecker) addEvent(uuid, typ, reason string, replicaSets []string) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	if len(hc.events) == maxGpuHealthEvents {
+		hc.events = hc.events[1:]
+	}
+	hc.events = append(hc.events, &GpuHealthEvent{
+		Time:        time.Now().Format("2006-01-02 15:04:05"),
+		UUID:        uuid,
+		Type:        typ,
+		Reason:      reason,
+		ReplicaSets: replicaSets,
+	})
+}
+
+// GetEvents returns the latest gpu health events, the newest is the last one
+func (hc *gpuHealthChecker) GetEvents() []GpuHealthEvent {
+	hc.RLock()
+	defer hc.RUnlock()
+
+	events := make([]GpuHealthEvent, 0, len(hc.events))
+	for _, e := range hc.events {
+		events = append(events, *e)
+	}
+	return events
+}
+
+// parseGpuHealthOutput parses the output of gpuHealthCommand,
+// a gpu that has fallen off the bus is reported as a line without uuid, only the bus id can be found.
+func parseGpuHealthOutput(output string) (samples []*gpuHealthSample, lostBusIDs []string) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ", ")
+		if len(fields) != 4 {
+			if strings.Contains(line, "Unable to determine the device handle") {
+				// e.g. Unable to determine the device handle for GPU 0000:3B:00.0: GPU is lost.
+				if i := strings.Index(line, "GPU "); i != -1 {
+					if busID := strings.Fields(line[i+4:]); len(busID) > 0 {
+						lostBusIDs = append(lostBusIDs, normalizeBusID(strings.TrimSuffix(busID[0], ":")))
+					}
+				}
+			}
+			continue
+		}
+
+		sample := &gpuHealthSample{
+			uuid:  schedulers.GpuDeviceName(fields[0]),
+			busID: normalizeBusID(fields[1]),
+		}
+		if strings.Contains(line, "GPU is lost") || strings.Contains(line, "Unknown Error") {
+			sample.lost = true
+		}
+		// [N/A] means not supported, e.g. ecc is disabled
+		sample.temperature, _ = strconv.Atoi(fields[2])
+		sample.eccErrors, _ = strconv.Atoi(fields[3])
+		samples = append(samples, sample)
+	}
+	return
+}
+
+// parseXidOutput returns the last fatal xid of each bus id logged after the time and the time of the last line,
+// the error of dmesg is returned if the kernel log can't be read.
+func parseXidOutput(output string, after time.Time) (xids map[string]xidEvent, last time.Time, err error) {
+	xids = make(map[string]xidEvent)
+	last = after
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "dmesg:") {
+			return xids, after, errors.New(line)
+		}
+		matches := xidRegexp.FindStringSubmatch(line)
+		if len(matches) != 4 {
+			continue
+		}
+		t, err := time.Parse(xidTimeLayout, matches[1])
+		if err != nil || !t.After(after) {
+			continue
+		}
+		if t.After(last) {
+			last = t
+		}
+		xid, err := strconv.Atoi(matches[3])
+		if err != nil {
+			continue
+		}
+		if _, ok := fatalXids[xid]; ok {
+			xids[normalizeBusID(matches[2])] = xidEvent{xid: xid, time: t}
+		}
+	}
+	return xids, last, nil
+}
+
+// normalizeBusID converts both 00000000:3B:00.0 (nvidia-smi) and 0000:3b:00 (kernel log) to 3b:00
+func normalizeBusID(busID string) string {
+	busID = strings.ToLower(busID)
+	if i := strings.LastIndex(busID, "."); i != -1 {
+		busID = busID[:i]
+	}
+	parts := strings.Split(busID, ":")
+	if len(parts) >= 2 {
+		return strings.Join(parts[len(parts)-2:], ":")
+	}
+	return busID
+}
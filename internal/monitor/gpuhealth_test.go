@@ -0,0 +1,82 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+)
+
+// fakeRunner returns the output of each command
+type fakeRunner map[string]string
+
+func (r fakeRunner) Run(command string) (string, error) {
+	return r[command], nil
+}
+
+func TestParseGpuHealthOutput(t *testing.T) {
+	output := `GPU-aaa, 00000000:3B:00.0, 45, 0
+GPU-bbb, 00000000:5E:00.0, [N/A], 2
+Unable to determine the device handle for GPU 0000:86:00.0: GPU is lost.  Reboot the system to recover this GPU
+`
+	samples, lost := parseGpuHealthOutput(output)
+	if len(samples) != 2 {
+		t.Fatalf("samples = %d, want 2", len(samples))
+	}
+	if s := samples[0]; s.uuid != schedulers.GpuDeviceName("GPU-aaa") || s.busID != "3b:00" || s.temperature != 45 || s.eccErrors != 0 {
+		t.Fatalf("sample = %+v", s)
+	}
+	if s := samples[1]; s.temperature != 0 || s.eccErrors != 2 {
+		t.Fatalf("sample without temperature = %+v", s)
+	}
+	if len(lost) != 1 || lost[0] != "86:00" {
+		t.Fatalf("lost bus ids = %v, want 86:00", lost)
+	}
+}
+
+func TestParseXidOutputSkipsProcessedLines(t *testing.T) {
+	output := `2024-01-10T10:00:00,000000+08:00 NVRM: Xid (PCI:0000:3b:00): 79, pid=1234, GPU has fallen off the bus.
+2024-01-10T10:05:00,000000+08:00 NVRM: Xid (PCI:0000:5e:00): 13, pid=1234, Graphics Exception
+2024-01-10T10:10:00,500000+08:00 NVRM: Xid (PCI:0000:5e:00): 48, pid=1234, DBE
+`
+	xids, last, err := parseXidOutput(output, time.Time{})
+	if err != nil {
+		t.Fatalf("parseXidOutput: %v", err)
+	}
+	if len(xids) != 2 || xids["3b:00"].xid != 79 || xids["5e:00"].xid != 48 {
+		t.Fatalf("xids = %+v, want the fatal 79 and 48", xids)
+	}
+
+	// the same kernel log is read again in the next check
+	again, next, err := parseXidOutput(output, last)
+	if err != nil || len(again) != 0 || !next.Equal(last) {
+		t.Fatalf("xids = %+v, last = %s, err = %v, want nothing new", again, next, err)
+	}
+}
+
+func TestParseXidOutputReturnsTheDmesgError(t *testing.T) {
+	after := time.Now()
+	_, last, err := parseXidOutput("dmesg: read kernel buffer failed: Operation not permitted\n", after)
+	if err == nil || !last.Equal(after) {
+		t.Fatalf("last = %s, err = %v, want the dmesg error", last, err)
+	}
+}
+
+func TestCollectXidsForgetsOldXids(t *testing.T) {
+	hc := &gpuHealthChecker{
+		runner: fakeRunner{
+			gpuXidCommand: "2024-01-10T10:00:00,000000+00:00 NVRM: Xid (PCI:0000:3b:00): 79, pid=1, GPU has fallen off the bus.\n",
+		},
+		xids: make(map[string]xidEvent),
+	}
+	logged := time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC)
+
+	hc.collectXids(logged.Add(time.Minute))
+	if _, ok := hc.xids["3b:00"]; !ok {
+		t.Fatal("the new xid is not kept")
+	}
+	hc.collectXids(logged.Add(xidRecovery))
+	if len(hc.xids) != 0 {
+		t.Fatalf("xids = %+v, want the xid forgotten after %s", hc.xids, xidRecovery)
+	}
+}
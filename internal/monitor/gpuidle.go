@@ -0,0 +1,327 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	gpuIdleCommand = "nvidia-smi --query-gpu=uuid,utilization.gpu,memory.used --format=csv,noheader,nounits"
+
+	// the single key that older versions stored the exempt replicaSets in
+	gpuIdleKey = "gpuIdleKey"
+	// one etcd key per exempt replicaSet, e.g. /gpu-docker-api/apis/v1/idle/exempt/<replicaSet>
+	exemptDir = "exempt"
+)
+
+var GpuIdleMonitor *gpuIdleMonitor
+
+// GpuUsage is the utilization in percent and the memory used in MiB of a gpu
+type GpuUsage struct {
+	UUID        string `json:"uuid"`
+	Utilization int    `json:"utilization"`
+	MemoryUsed  int    `json:"memoryUsed"`
+}
+
+// GpuIdleState is a replicaSet whose gpus are all below the utilization threshold
+type GpuIdleState struct {
+	ReplicaSet string     `json:"replicaSet"`
+	Owner      string     `json:"owner,omitempty"`
+	Gpus       []GpuUsage `json:"gpus"`
+	IdleSince  string     `json:"idleSince"`
+	Warned     bool       `json:"warned"`
+}
+
+// gpuIdleMonitor stops the replicaSets that hold gpus without using them,
+// the owner is warned before the replicaSet is stopped.
+type gpuIdleMonitor struct {
+	sync.RWMutex
+
+	// replicaSets that are never stopped by the monitor
+	Exempt map[string]bool `json:"exempt"`
+	store  *etcd.Store
+
+	runner    utils.CommandRunner
+	interval  time.Duration
+	timeout   time.Duration
+	warning   time.Duration
+	threshold int
+
+	// replicaSet -> idle state, it is not persisted, the idle time starts again after the server restarts
+	states map[string]*gpuIdleState
+}
+
+type gpuIdleState struct {
+	GpuIdleState
+	since time.Time
+}
+
+// InitGpuIdleMonitor the monitor will not run if the interval or the timeout is 0
+func InitGpuIdleMonitor(interval, timeout, warning time.Duration, threshold int) error {
+	var err error
+	GpuIdleMonitor, err = initGpuIdleMonitorFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	GpuIdleMonitor.runner = newCommandRunner()
+	GpuIdleMonitor.interval = interval
+	GpuIdleMonitor.timeout = timeout
+	GpuIdleMonitor.warning = warning
+	GpuIdleMonitor.threshold = threshold
+	return nil
+}
+
+func CloseGpuIdleMonitor() error {
+	return etcd.Stores{GpuIdleMonitor.store}.Sync()
+}
+
+// initGpuIdleMonitorFormEtcd reads the keys under the directory, or the blob key of older versions if there is no key yet
+func initGpuIdleMonitorFormEtcd() (*gpuIdleMonitor, error) {
+	im := &gpuIdleMonitor{
+		Exempt: make(map[string]bool),
+		states: make(map[string]*gpuIdleState),
+	}
+	im.store = etcd.NewStore(etcd.Idle, exemptDir, im.items)
+
+	err := etcd.LoadJSON(im.store, gpuIdleKey, im.Exempt, func(blob []byte) error {
+		return json.Unmarshal(blob, im)
+	})
+	if im.Exempt == nil {
+		im.Exempt = make(map[string]bool)
+	}
+	return im, err
+}
+
+// SetRunner replaces the command runner, it is used to mock nvidia-smi
+func (im *gpuIdleMonitor) SetRunner(runner utils.CommandRunner) {
+	im.Lock()
+	defer im.Unlock()
+	im.runner = runner
+}
+
+func (im *gpuIdleMonitor) Loop(ctx context.Context) {
+	if im.interval <= 0 || im.timeout <= 0 {
+		log.Info("gpu idle monitor is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(im.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			im.Check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check samples the gpus once, warns the owners of the replicaSets that are about to time out,
+// and stops the replicaSets that have been idle for the timeout.
+func (im *gpuIdleMonitor) Check() {
+	im.RLock()
+	runner := im.runner
+	im.RUnlock()
+
+	output, err := runner.Run(gpuIdleCommand)
+	if err != nil {
+		log.Errorf("monitor.GpuIdleMonitor, query gpu utilization failed, err: %v", err)
+		return
+	}
+	usages := parseGpuIdleOutput(output)
+
+	warn, stop := im.update(cs.RunningGpuReplicaSets(), usages, time.Now())
+	for _, state := range warn {
+		message := fmt.Sprintf("gpus of replicaSet: %s have been idle since %s, it will be stopped at %s",
+			state.ReplicaSet, state.IdleSince, state.since.Add(im.timeout).Format("2006-01-02 15:04:05"))
+		notify.Notifier.Notify(models.NotificationIdleWarning, state.ReplicaSet, state.Owner, message)
+	}
+	for _, state := range stop {
+		if err := cs.StopContainer(state.ReplicaSet, true, true, true, true); err != nil {
+			// keep the state, it is stopped at the next check
+			log.Errorf("services.StopContainer failed, original error: %T %v", errors.Cause(err), err)
+			continue
+		}
+		im.Lock()
+		delete(im.states, state.ReplicaSet)
+		im.Unlock()
+
+		message := fmt.Sprintf("replicaSet: %s is stopped because its gpus have been idle since %s",
+			state.ReplicaSet, state.IdleSince)
+		notify.Notifier.Notify(models.NotificationIdleStopped, state.ReplicaSet, state.Owner, message)
+	}
+}
+
+// update records the idle time of the replicaSets, and returns the ones to warn and to stop.
+// A replicaSet is idle only if all of its gpus are reported and below the threshold.
+func (im *gpuIdleMonitor) update(replicaSets []models.ReplicaSetGpus, usages map[string]GpuUsage,
+	now time.Time) (warn, stop []gpuIdleState) {
+	im.Lock()
+	defer im.Unlock()
+
+	running := make(map[string]struct{}, len(replicaSets))
+	for _, replicaSet := range replicaSets {
+		running[replicaSet.Name] = struct{}{}
+		if im.Exempt[replicaSet.Name] {
+			delete(im.states, replicaSet.Name)
+			continue
+		}
+
+		gpus, idle := make([]GpuUsage, 0, len(replicaSet.Gpus)), true
+		for _, uuid := range replicaSet.Gpus {
+			usage, ok := usages[uuid]
+			if !ok || usage.Utilization >= im.threshold {
+				idle = false
+				break
+			}
+			gpus = append(gpus, usage)
+		}
+		if !idle {
+			delete(im.states, replicaSet.Name)
+			continue
+		}
+
+		state, ok := im.states[replicaSet.Name]
+		if !ok {
+			state = &gpuIdleState{
+				GpuIdleState: GpuIdleState{
+					ReplicaSet: replicaSet.Name,
+					IdleSince:  now.Format("2006-01-02 15:04:05"),
+				},
+				since: now,
+			}
+			im.states[replicaSet.Name] = state
+		}
+		state.Owner = replicaSet.Owner
+		state.Gpus = gpus
+
+		idleFor := now.Sub(state.since)
+		switch {
+		case idleFor >= im.timeout:
+			log.Warnf("monitor.GpuIdleMonitor, replicaSet: %s has been idle since %s, it will be stopped",
+				replicaSet.Name, state.IdleSince)
+			stop = append(stop, *state)
+		case !state.Warned && idleFor >= im.timeout-im.warning:
+			log.Infof("monitor.GpuIdleMonitor, replicaSet: %s has been idle since %s, warn the owner: %s",
+				replicaSet.Name, state.IdleSince, replicaSet.Owner)
+			state.Warned = true
+			warn = append(warn, *state)
+		}
+	}
+	for name := range im.states {
+		if _, ok := running[name]; !ok {
+			delete(im.states, name)
+		}
+	}
+	return
+}
+
+// GetIdleStates returns the replicaSets that are idle now, the longest idle is the first one
+func (im *gpuIdleMonitor) GetIdleStates() []GpuIdleState {
+	im.RLock()
+	defer im.RUnlock()
+
+	states := make([]*gpuIdleState, 0, len(im.states))
+	for _, state := range im.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if !states[i].since.Equal(states[j].since) {
+			return states[i].since.Before(states[j].since)
+		}
+		return states[i].ReplicaSet < states[j].ReplicaSet
+	})
+
+	resp := make([]GpuIdleState, 0, len(states))
+	for _, state := range states {
+		resp = append(resp, state.GpuIdleState)
+	}
+	return resp
+}
+
+// SetIdleStop enables or disables stopping the replicaSet when its gpus are idle, it is enabled by default
+func (im *gpuIdleMonitor) SetIdleStop(name string, enabled bool) {
+	im.Lock()
+	defer im.Unlock()
+
+	if enabled {
+		delete(im.Exempt, name)
+	} else {
+		im.Exempt[name] = true
+		delete(im.states, name)
+	}
+
+	go im.putToEtcd()
+}
+
+// GetExempt returns the replicaSets that are never stopped by the monitor
+func (im *gpuIdleMonitor) GetExempt() []string {
+	im.RLock()
+	defer im.RUnlock()
+
+	names := make([]string, 0, len(im.Exempt))
+	for name := range im.Exempt {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// items one key per exempt replicaSet, replicaSet -> true
+func (im *gpuIdleMonitor) items() map[string]string {
+	im.RLock()
+	defer im.RUnlock()
+
+	return etcd.JSONItems(im.Exempt)
+}
+
+func (im *gpuIdleMonitor) putToEtcd() {
+	workQueue.Add(etcd.Stores{im.store})
+}
+
+// parseGpuIdleOutput parses the output of gpuIdleCommand, the gpus that can't be parsed are not reported
+func parseGpuIdleOutput(output string) map[string]GpuUsage {
+	usages := make(map[string]GpuUsage)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ", ")
+		if len(fields) != 3 {
+			continue
+		}
+		utilization, err := strconv.Atoi(fields[1])
+		if err != nil {
+			// e.g. [N/A] or [Unknown Error], the gpu is handled by the health checker
+			continue
+		}
+		memoryUsed, _ := strconv.Atoi(fields[2])
+
+		uuid := schedulers.GpuDeviceName(fields[0])
+		usages[uuid] = GpuUsage{
+			UUID:        uuid,
+			Utilization: utilization,
+			MemoryUsed:  memoryUsed,
+		}
+	}
+	return usages
+}
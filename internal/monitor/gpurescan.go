@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/ngaut/log"
+
+	"github.com/mayooot/gpu-docker-api/internal/services"
+)
+
+var GpuRescanner *gpuRescanner
+
+type gpuRescanner struct {
+	interval time.Duration
+	service  services.ResourceService
+}
+
+// InitGpuRescanner the rescanner will not run if the interval is 0
+func InitGpuRescanner(interval time.Duration) {
+	GpuRescanner = &gpuRescanner{
+		interval: interval,
+	}
+}
+
+func (gr *gpuRescanner) Loop(ctx context.Context) {
+	if gr.interval <= 0 {
+		log.Info("gpu rescanner is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(gr.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := gr.service.RescanGpus(); err != nil {
+				log.Errorf("monitor.GpuRescanner, rescan gpus failed, err: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
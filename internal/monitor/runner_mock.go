@@ -0,0 +1,32 @@
+//go:build mock
+
+package monitor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// mockRunner pretends that all mock gpus are healthy and idle
+type mockRunner struct{}
+
+func newCommandRunner() utils.CommandRunner {
+	return mockRunner{}
+}
+
+func (mockRunner) Run(command string) (string, error) {
+	var sb strings.Builder
+	switch command {
+	case gpuHealthCommand:
+		for i := 0; i < 8; i++ {
+			sb.WriteString(fmt.Sprintf("MockGPU-%d, 00000000:%02X:00.0, 40, 0\n", i, i+1))
+		}
+	case gpuIdleCommand:
+		for i := 0; i < 8; i++ {
+			sb.WriteString(fmt.Sprintf("MockGPU-%d, 0, 0\n", i))
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,11 @@
+//go:build !mock
+
+package monitor
+
+import (
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+func newCommandRunner() utils.CommandRunner {
+	return utils.ShellRunner{}
+}
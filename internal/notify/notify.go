@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ngaut/log"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+const webhookTimeout = 5 * time.Second
+
+var Notifier *notifier
+
+// notifier tells the owners what the system did to their replicaSets,
+// the notifications are always logged and posted to the webhook as json if it is set
+type notifier struct {
+	webhook string
+	client  *http.Client
+}
+
+func InitNotifier(webhook string) {
+	Notifier = &notifier{
+		webhook: webhook,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Notify never blocks the caller, a failed notification is only logged
+func (n *notifier) Notify(event, replicaSet, owner, message string) {
+	notification := models.Notification{
+		Event:      event,
+		ReplicaSet: replicaSet,
+		Owner:      owner,
+		Message:    message,
+		Time:       time.Now().Format("2006-01-02 15:04:05"),
+	}
+	log.Warnf("notify.Notify, event: %s, replicaSet: %s, owner: %s, message: %s", event, replicaSet, owner, message)
+
+	if n.webhook == "" {
+		return
+	}
+	go n.post(notification)
+}
+
+func (n *notifier) post(notification models.Notification) {
+	body, _ := json.Marshal(notification)
+	resp, err := n.client.Post(n.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("notify.post failed, webhook: %s, err: %v", n.webhook, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Errorf("notify.post failed, webhook: %s, status: %s", n.webhook, resp.Status)
+	}
+}
@@ -0,0 +1,153 @@
+package priority
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// the single key that older versions stored all classes in
+	priorityClassesKey = "priorityClassesKey"
+	// one etcd key per class, e.g. /gpu-docker-api/apis/v1/priorities/classes/<name>
+	classDir = "classes"
+)
+
+var Classes *classMap
+
+// classMap holds the priority classes defined by the admin, keyed by the class name
+type classMap struct {
+	sync.RWMutex
+
+	Items map[string]*models.PriorityClass `json:"items"`
+	store *etcd.Store
+}
+
+func InitPriorityClasses() error {
+	var err error
+	Classes, err = initClassMapFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	return nil
+}
+
+func ClosePriorityClasses() error {
+	return etcd.Stores{Classes.store}.Sync()
+}
+
+// initClassMapFormEtcd reads the keys under the directory, or the blob key of older versions if there is no key yet
+func initClassMapFormEtcd() (*classMap, error) {
+	cm := &classMap{
+		Items: make(map[string]*models.PriorityClass),
+	}
+	cm.store = etcd.NewStore(etcd.Priorities, classDir, cm.items)
+
+	err := etcd.LoadJSON(cm.store, priorityClassesKey, cm.Items, func(blob []byte) error {
+		return json.Unmarshal(blob, cm)
+	})
+	return cm, err
+}
+
+// Set creates or replaces the priority class
+func (cm *classMap) Set(class models.PriorityClass) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.Items[class.Name] = &class
+
+	go cm.putToEtcd()
+}
+
+func (cm *classMap) Get(name string) (models.PriorityClass, error) {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	class, ok := cm.Items[name]
+	if !ok {
+		return models.PriorityClass{}, errors.Wrapf(xerrors.NewPriorityClassNotFoundError(), "priority class: %s", name)
+	}
+	return *class, nil
+}
+
+// Allowed checks that the owner or the group may use the class
+func (cm *classMap) Allowed(name, owner, group string) error {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	class, ok := cm.Items[name]
+	if !ok {
+		return errors.Wrapf(xerrors.NewPriorityClassNotFoundError(), "priority class: %s", name)
+	}
+	if len(class.Owners) == 0 && len(class.Groups) == 0 {
+		return nil
+	}
+	if (owner != "" && slices.Contains(class.Owners, owner)) || (group != "" && slices.Contains(class.Groups, group)) {
+		return nil
+	}
+	return errors.Wrapf(xerrors.NewPriorityClassNotAllowedError(), "priority class: %s, owner: %s, group: %s", name, owner, group)
+}
+
+// Value returns the priority value of the class, the empty or unknown class has the value 0
+func (cm *classMap) Value(name string) int {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	if class, ok := cm.Items[name]; ok {
+		return class.Value
+	}
+	return 0
+}
+
+// List returns all priority classes from the highest value to the lowest
+func (cm *classMap) List() []models.PriorityClass {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	resp := make([]models.PriorityClass, 0, len(cm.Items))
+	for _, class := range cm.Items {
+		resp = append(resp, *class)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].Value != resp[j].Value {
+			return resp[i].Value > resp[j].Value
+		}
+		return resp[i].Name < resp[j].Name
+	})
+	return resp
+}
+
+// Remove deletes the priority class, the containers of it are treated as no priority class afterwards
+func (cm *classMap) Remove(name string) error {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if _, ok := cm.Items[name]; !ok {
+		return errors.Wrapf(xerrors.NewPriorityClassNotFoundError(), "priority class: %s", name)
+	}
+	delete(cm.Items, name)
+
+	go cm.putToEtcd()
+
+	return nil
+}
+
+// items one key per class, name -> class
+func (cm *classMap) items() map[string]string {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	return etcd.JSONItems(cm.Items)
+}
+
+func (cm *classMap) putToEtcd() {
+	workQueue.Add(etcd.Stores{cm.store})
+}
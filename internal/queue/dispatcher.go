@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/lease"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+var (
+	Dispatcher *dispatcher
+
+	cs services.ReplicaSetService
+)
+
+// dispatcher runs the queued requests in order whenever resources are given back
+type dispatcher struct {
+	sync.Mutex
+
+	interval time.Duration
+}
+
+// InitDispatcher the dispatcher also retries every interval, 0 means it only runs when resources are given back
+func InitDispatcher(interval time.Duration) {
+	Dispatcher = &dispatcher{
+		interval: interval,
+	}
+}
+
+func (d *dispatcher) Loop(ctx context.Context) {
+	var tick <-chan time.Time
+	if d.interval > 0 {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		d.Dispatch()
+		select {
+		case <-schedulers.Released():
+		case <-tick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Dispatch runs the requests from the head until one of them still doesn't fit,
+// so that a request is never overtaken by the ones queued after it.
+// A request that fails for other reasons is dropped, otherwise it would block the queue forever.
+func (d *dispatcher) Dispatch() {
+	d.Lock()
+	defer d.Unlock()
+
+	for {
+		req := PendingQueue.Head()
+		if req == nil {
+			return
+		}
+
+		spec := req.Spec
+		_, containerName, err := cs.RunGpuContainer(&spec)
+		if err != nil && xerrors.IsResourceNotEnoughError(err) {
+			log.Debugf("queue.Dispatcher, replicaSet: %s is still waiting, err: %v", spec.ReplicaSetName, err)
+			return
+		}
+		if e := PendingQueue.Remove(spec.ReplicaSetName); e != nil {
+			log.Warnf("queue.Dispatcher, replicaSet: %s was cancelled while it was being run, err: %v", spec.ReplicaSetName, e)
+		}
+		if err != nil {
+			log.Errorf("queue.Dispatcher, replicaSet: %s is dropped from the queue, original error: %T %v",
+				spec.ReplicaSetName, errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			continue
+		}
+		log.Infof("queue.Dispatcher, replicaSet: %s queued at %s is running, container: %s",
+			spec.ReplicaSetName, req.CreateTime, containerName)
+		// the lease starts when the container runs
+		if _, err = lease.Leases.Start(&spec); err != nil {
+			log.Errorf("lease.Start failed, original error: %T %v", errors.Cause(err), err)
+		}
+	}
+}
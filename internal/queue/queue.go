@@ -0,0 +1,277 @@
+package queue
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/fairshare"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// the single key that older versions stored the whole queue in
+	pendingQueueKey = "pendingQueueKey"
+	// one etcd key per request, e.g. /gpu-docker-api/apis/v1/queues/requests/<replicaSet>
+	requestDir = "requests"
+)
+
+var PendingQueue *pendingQueue
+
+// pendingQueue is a persistent queue of run requests that are waiting for resources,
+// the requests are kept in the order they are queued and ordered by the policy when they are read
+type pendingQueue struct {
+	sync.RWMutex
+
+	Requests []*models.QueuedRequest `json:"requests"`
+
+	policy string
+	store  *etcd.Store
+}
+
+// queuedRequest is the value of the key of a request, index keeps the order they are queued in
+type queuedRequest struct {
+	Index   int                   `json:"index"`
+	Request *models.QueuedRequest `json:"request"`
+}
+
+func InitPendingQueue(policy string) error {
+	if policy != models.QueuePolicyFifo && policy != models.QueuePolicyFairShare {
+		return errors.Errorf("queue policy: %s is not supported", policy)
+	}
+
+	var err error
+	PendingQueue, err = initPendingQueueFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	PendingQueue.policy = policy
+	return nil
+}
+
+func ClosePendingQueue() error {
+	return etcd.Stores{PendingQueue.store}.Sync()
+}
+
+// initPendingQueueFormEtcd reads the keys under the directory, or the blob key of older versions if there is no key yet
+func initPendingQueueFormEtcd() (*pendingQueue, error) {
+	q := &pendingQueue{
+		Requests: make([]*models.QueuedRequest, 0),
+	}
+	q.store = etcd.NewStore(etcd.Queues, requestDir, q.items)
+
+	items := make(map[string]queuedRequest)
+	err := etcd.LoadJSON(q.store, pendingQueueKey, items, func(blob []byte) error {
+		return json.Unmarshal(blob, q)
+	})
+	if err != nil {
+		return q, err
+	}
+
+	if len(items) != 0 {
+		q.Requests = requestsOf(items)
+	}
+	return q, nil
+}
+
+// requestsOf returns the requests read from the keys in the order they were queued
+func requestsOf(items map[string]queuedRequest) []*models.QueuedRequest {
+	ordered := make([]queuedRequest, 0, len(items))
+	for _, item := range items {
+		if item.Request != nil {
+			ordered = append(ordered, item)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].Index < ordered[j].Index
+	})
+
+	requests := make([]*models.QueuedRequest, 0, len(ordered))
+	for _, item := range ordered {
+		requests = append(requests, item.Request)
+	}
+	return requests
+}
+
+// Push appends the request to the tail and returns its position
+func (q *pendingQueue) Push(spec models.ContainerRun) *models.QueuedRequest {
+	q.Lock()
+	defer q.Unlock()
+
+	req := &models.QueuedRequest{
+		Spec:       spec,
+		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	q.Requests = append(q.Requests, req)
+
+	go q.putToEtcd()
+
+	resp := *req
+	resp.Position = q.position(req)
+	return &resp
+}
+
+// Head returns the request at the head, it is nil if the queue is empty
+func (q *pendingQueue) Head() *models.QueuedRequest {
+	q.RLock()
+	defer q.RUnlock()
+
+	if len(q.Requests) == 0 {
+		return nil
+	}
+	resp := *q.ordered()[0]
+	resp.Position = 1
+	return &resp
+}
+
+func (q *pendingQueue) Len() int {
+	q.RLock()
+	defer q.RUnlock()
+
+	return len(q.Requests)
+}
+
+func (q *pendingQueue) Exist(name string) bool {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.index(name) >= 0
+}
+
+// Get returns the request of the replicaSet with its position
+func (q *pendingQueue) Get(name string) (*models.QueuedRequest, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	i := q.index(name)
+	if i < 0 {
+		return nil, errors.Wrapf(xerrors.NewQueuedRequestNotFoundError(), "replicaSet: %s", name)
+	}
+	resp := *q.Requests[i]
+	resp.Position = q.position(q.Requests[i])
+	return &resp, nil
+}
+
+// List returns all requests in order with their positions
+func (q *pendingQueue) List() []*models.QueuedRequest {
+	q.RLock()
+	defer q.RUnlock()
+
+	ordered := q.ordered()
+	resp := make([]*models.QueuedRequest, 0, len(ordered))
+	for i := range ordered {
+		req := *ordered[i]
+		req.Position = i + 1
+		resp = append(resp, &req)
+	}
+	return resp
+}
+
+// Move puts the request to the position, the position out of range means the head or the tail.
+// The position is decided by the usage of the owners under the fair-share policy, so it can't be moved.
+func (q *pendingQueue) Move(name string, position int) (*models.QueuedRequest, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.policy == models.QueuePolicyFairShare {
+		return nil, errors.Wrapf(xerrors.NewQueueOrderedByFairShareError(), "replicaSet: %s", name)
+	}
+
+	i := q.index(name)
+	if i < 0 {
+		return nil, errors.Wrapf(xerrors.NewQueuedRequestNotFoundError(), "replicaSet: %s", name)
+	}
+	req := q.Requests[i]
+	q.Requests = append(q.Requests[:i], q.Requests[i+1:]...)
+
+	j := position - 1
+	if j < 0 {
+		j = 0
+	}
+	if j > len(q.Requests) {
+		j = len(q.Requests)
+	}
+	q.Requests = append(q.Requests[:j], append([]*models.QueuedRequest{req}, q.Requests[j:]...)...)
+
+	go q.putToEtcd()
+
+	resp := *req
+	resp.Position = j + 1
+	return &resp, nil
+}
+
+// Remove takes the request out of the queue, it is used when the request is cancelled or dispatched
+func (q *pendingQueue) Remove(name string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	i := q.index(name)
+	if i < 0 {
+		return errors.Wrapf(xerrors.NewQueuedRequestNotFoundError(), "replicaSet: %s", name)
+	}
+	q.Requests = append(q.Requests[:i], q.Requests[i+1:]...)
+
+	go q.putToEtcd()
+
+	return nil
+}
+
+// ordered returns the requests in the order they will be run,
+// the fair-share policy puts the owners that used fewer gpu-hours first and keeps the queued order among equals
+func (q *pendingQueue) ordered() []*models.QueuedRequest {
+	ordered := make([]*models.QueuedRequest, len(q.Requests))
+	copy(ordered, q.Requests)
+	if q.policy != models.QueuePolicyFairShare {
+		return ordered
+	}
+
+	scores := make(map[*models.QueuedRequest]float64, len(ordered))
+	for _, req := range ordered {
+		scores[req] = fairshare.Tracker.Score(req.Spec.Owner, req.Spec.Group, req.Spec.ReplicaSetName)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return scores[ordered[i]] < scores[ordered[j]]
+	})
+	return ordered
+}
+
+// position returns the position of the request in the order they will be run, it starts from 1
+func (q *pendingQueue) position(req *models.QueuedRequest) int {
+	for i, r := range q.ordered() {
+		if r == req {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (q *pendingQueue) index(name string) int {
+	for i := range q.Requests {
+		if q.Requests[i].Spec.ReplicaSetName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// items one key per request, replicaSet -> the request and its index in the queued order
+func (q *pendingQueue) items() map[string]string {
+	q.RLock()
+	defer q.RUnlock()
+
+	items := make(map[string]queuedRequest, len(q.Requests))
+	for i, req := range q.Requests {
+		items[req.Spec.ReplicaSetName] = queuedRequest{Index: i, Request: req}
+	}
+	return etcd.JSONItems(items)
+}
+
+func (q *pendingQueue) putToEtcd() {
+	workQueue.Add(etcd.Stores{q.store})
+}
@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+func newTestQueue(names ...string) *pendingQueue {
+	q := &pendingQueue{policy: models.QueuePolicyFifo}
+	for _, name := range names {
+		q.Requests = append(q.Requests, &models.QueuedRequest{Spec: models.ContainerRun{ReplicaSetName: name}})
+	}
+	return q
+}
+
+func namesOf(requests []*models.QueuedRequest) []string {
+	names := make([]string, 0, len(requests))
+	for _, req := range requests {
+		names = append(names, req.Spec.ReplicaSetName)
+	}
+	return names
+}
+
+func TestFifoKeepsTheQueuedOrder(t *testing.T) {
+	q := newTestQueue("foo", "bar", "baz")
+	got := namesOf(q.ordered())
+	want := []string{"foo", "bar", "baz"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("ordered = %v, want %v", got, want)
+		}
+	}
+	if p := q.position(q.Requests[2]); p != 3 {
+		t.Fatalf("position of baz = %d, want 3", p)
+	}
+	if i := q.index("qux"); i != -1 {
+		t.Fatalf("index of a missing request = %d, want -1", i)
+	}
+}
+
+func TestKeysKeepTheQueuedOrder(t *testing.T) {
+	q := newTestQueue("foo", "bar", "baz", "qux", "quux", "corge", "grault", "garply", "waldo", "fred", "plugh")
+
+	// the keys are read back in the order of etcd, which is not the queued order
+	items := make(map[string]queuedRequest)
+	for name, value := range q.items() {
+		var item queuedRequest
+		if err := json.Unmarshal([]byte(value), &item); err != nil {
+			t.Fatalf("json.Unmarshal %s: %v", name, err)
+		}
+		items[name] = item
+	}
+	items["broken"] = queuedRequest{Index: 0}
+
+	got, want := namesOf(requestsOf(items)), namesOf(q.Requests)
+	if len(got) != len(want) {
+		t.Fatalf("requests = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("requests = %v, want %v", got, want)
+		}
+	}
+}
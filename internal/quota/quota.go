@@ -0,0 +1,184 @@
+package quota
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	// the single key that older versions stored all quotas in
+	quotaMapKey = "quotaMapKey"
+	// one etcd key per quota, e.g. /gpu-docker-api/apis/v1/quotas/quotas/user/alice
+	quotaDir = "quotas"
+)
+
+var Quotas *quotaMap
+
+// quotaMap holds the quotas keyed by kind/name, e.g. user/alice, group/vision
+type quotaMap struct {
+	sync.RWMutex
+
+	Items map[string]*models.Quota `json:"items"`
+	store *etcd.Store
+}
+
+func InitQuotas() error {
+	var err error
+	Quotas, err = initQuotaMapFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	return nil
+}
+
+func CloseQuotas() error {
+	return etcd.Stores{Quotas.store}.Sync()
+}
+
+// initQuotaMapFormEtcd reads the keys under the directory, or the blob key of older versions if there is no key yet
+func initQuotaMapFormEtcd() (*quotaMap, error) {
+	qm := &quotaMap{
+		Items: make(map[string]*models.Quota),
+	}
+	qm.store = etcd.NewStore(etcd.Quotas, quotaDir, qm.items)
+
+	err := etcd.LoadJSON(qm.store, quotaMapKey, qm.Items, func(blob []byte) error {
+		return json.Unmarshal(blob, qm)
+	})
+	return qm, err
+}
+
+func key(kind, name string) string {
+	return kind + "/" + name
+}
+
+// Set creates or replaces the quota
+func (qm *quotaMap) Set(q models.Quota) {
+	qm.Lock()
+	defer qm.Unlock()
+
+	qm.Items[key(q.Kind, q.Name)] = &q
+
+	go qm.putToEtcd()
+}
+
+func (qm *quotaMap) Get(kind, name string) (models.Quota, error) {
+	qm.RLock()
+	defer qm.RUnlock()
+
+	q, ok := qm.Items[key(kind, name)]
+	if !ok {
+		return models.Quota{}, errors.Wrapf(xerrors.NewQuotaNotFoundError(), "quota: %s", key(kind, name))
+	}
+	return *q, nil
+}
+
+// Exist reports whether the quota of the kind is set, the empty name never has a quota
+func (qm *quotaMap) Exist(kind, name string) bool {
+	if name == "" {
+		return false
+	}
+
+	qm.RLock()
+	defer qm.RUnlock()
+
+	_, ok := qm.Items[key(kind, name)]
+	return ok
+}
+
+// RequireOwner returns the no owner error if any quota is set but neither the owner nor the group is given,
+// otherwise the resources created without them would be counted by no quota.
+func (qm *quotaMap) RequireOwner(owner, group string) error {
+	if owner != "" || group != "" {
+		return nil
+	}
+
+	qm.RLock()
+	defer qm.RUnlock()
+
+	if len(qm.Items) != 0 {
+		return xerrors.NewQuotaNoOwnerError()
+	}
+	return nil
+}
+
+// List returns all quotas ordered by kind and name
+func (qm *quotaMap) List() []models.Quota {
+	qm.RLock()
+	defer qm.RUnlock()
+
+	resp := make([]models.Quota, 0, len(qm.Items))
+	for _, q := range qm.Items {
+		resp = append(resp, *q)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return key(resp[i].Kind, resp[i].Name) < key(resp[j].Kind, resp[j].Name)
+	})
+	return resp
+}
+
+func (qm *quotaMap) Remove(kind, name string) error {
+	qm.Lock()
+	defer qm.Unlock()
+
+	if _, ok := qm.Items[key(kind, name)]; !ok {
+		return errors.Wrapf(xerrors.NewQuotaNotFoundError(), "quota: %s", key(kind, name))
+	}
+	delete(qm.Items, key(kind, name))
+
+	go qm.putToEtcd()
+
+	return nil
+}
+
+// Check returns the quota exceeded error if the usage is over the quota in a resource that the request increases,
+// so that a request that gives resources back is allowed even if the quota has been lowered below the usage.
+// others is the usage except the replicaSet or volume being changed, current is what it uses now,
+// and demand is what it will use after the request.
+func Check(q models.Quota, others, current, demand models.QuotaUsage) error {
+	total := others.Add(demand)
+	maxMemory, _ := utils.ToBytes(q.MaxMemory)
+	maxVolumeSize, _ := utils.ToBytes(q.MaxVolumeSize)
+
+	exceeded := func(resource string, used, max int64, increased bool) error {
+		if max <= 0 || used <= max || !increased {
+			return nil
+		}
+		return errors.Wrapf(xerrors.NewQuotaExceededError(), "%s %s: %s %d exceeds %d", q.Kind, q.Name, resource, used, max)
+	}
+
+	for _, err := range []error{
+		exceeded("gpus", int64(total.Gpus), int64(q.MaxGpus), demand.Gpus > current.Gpus),
+		exceeded("cpus", int64(total.Cpus), int64(q.MaxCpus), demand.Cpus > current.Cpus),
+		exceeded("memory", total.Memory, maxMemory, demand.Memory > current.Memory),
+		exceeded("volumes", int64(total.Volumes), int64(q.MaxVolumes), demand.Volumes > current.Volumes),
+		exceeded("volume size", total.VolumeSize, maxVolumeSize, demand.VolumeSize > current.VolumeSize),
+		exceeded("replicaSets", int64(total.ReplicaSets), int64(q.MaxReplicaSets), demand.ReplicaSets > current.ReplicaSets),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// items one key per quota, kind/name -> quota
+func (qm *quotaMap) items() map[string]string {
+	qm.RLock()
+	defer qm.RUnlock()
+
+	return etcd.JSONItems(qm.Items)
+}
+
+func (qm *quotaMap) putToEtcd() {
+	workQueue.Add(etcd.Stores{qm.store})
+}
@@ -0,0 +1,47 @@
+package quota
+
+import (
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestCheck(t *testing.T) {
+	q := models.Quota{Kind: models.QuotaKindUser, Name: "alice", MaxGpus: 4, MaxMemory: "16GB"}
+
+	tests := []struct {
+		name                    string
+		others, current, demand models.QuotaUsage
+		exceeded                bool
+	}{
+		{"within", models.QuotaUsage{Gpus: 2}, models.QuotaUsage{}, models.QuotaUsage{Gpus: 2}, false},
+		{"over", models.QuotaUsage{Gpus: 3}, models.QuotaUsage{}, models.QuotaUsage{Gpus: 2}, true},
+		{"memory over", models.QuotaUsage{Memory: 8 << 30}, models.QuotaUsage{}, models.QuotaUsage{Memory: 9 << 30}, true},
+		// the quota was lowered below the usage, giving gpus back is still allowed
+		{"decreased", models.QuotaUsage{Gpus: 4}, models.QuotaUsage{Gpus: 2}, models.QuotaUsage{Gpus: 1}, false},
+		// the gpus are unchanged, more cpus are not limited by the quota
+		{"unchanged", models.QuotaUsage{Gpus: 4}, models.QuotaUsage{Gpus: 1}, models.QuotaUsage{Gpus: 1, Cpus: 8}, false},
+	}
+	for _, tt := range tests {
+		err := Check(q, tt.others, tt.current, tt.demand)
+		if xerrors.IsQuotaExceededError(err) != tt.exceeded {
+			t.Errorf("%s: err = %v, want exceeded %v", tt.name, err, tt.exceeded)
+		}
+	}
+}
+
+func TestRequireOwner(t *testing.T) {
+	qm := &quotaMap{Items: make(map[string]*models.Quota)}
+	if err := qm.RequireOwner("", ""); err != nil {
+		t.Fatalf("err = %v, want nil without quotas", err)
+	}
+
+	qm.Items[key(models.QuotaKindGroup, "vision")] = &models.Quota{Kind: models.QuotaKindGroup, Name: "vision"}
+	if err := qm.RequireOwner("", ""); !xerrors.IsQuotaNoOwnerError(err) {
+		t.Fatalf("err = %v, want no owner", err)
+	}
+	if err := qm.RequireOwner("alice", ""); err != nil {
+		t.Fatalf("err = %v, want nil with an owner", err)
+	}
+}
@@ -0,0 +1,186 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/fairshare"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/priority"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type AdminHandler struct{}
+
+var rs services.ResourceService
+
+func (ah *AdminHandler) RegisterRoute(g *gin.RouterGroup) {
+	// discover gpus again after hardware changes or driver upgrades
+	g.POST("/admin/gpus/rescan", ah.RescanGpus)
+	// priority classes, requests of a higher value can preempt the preemptible containers of lower values
+	g.GET("/admin/priorityClasses", ah.ListPriorityClasses)
+	g.PUT("/admin/priorityClasses", ah.SetPriorityClass)
+	g.DELETE("/admin/priorityClasses/:name", ah.DeletePriorityClass)
+	// the decayed gpu-hours of the owners and the weights of the groups that order the pending queue
+	g.GET("/admin/fairShare", ah.GetFairShare)
+	g.PUT("/admin/fairShare/weights", ah.SetGroupWeight)
+	g.DELETE("/admin/fairShare/weights/:group", ah.DeleteGroupWeight)
+	// compare the schedulers and the version map with the containers in docker, repair rebuilds them from docker
+	g.POST("/admin/reconcile", ah.Reconcile)
+	// the depth, age and counters of the queue that writes to etcd in the background
+	g.GET("/admin/workQueue", ah.GetWorkQueue)
+}
+
+func (ah *AdminHandler) RescanGpus(c *gin.Context) {
+	result, err := rs.RescanGpus()
+	if err != nil {
+		log.Errorf("services.RescanGpus failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeGpuRescanFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"result": result,
+	})
+}
+
+func (ah *AdminHandler) ListPriorityClasses(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"priorityClasses": priority.Classes.List(),
+	})
+}
+
+func (ah *AdminHandler) SetPriorityClass(c *gin.Context) {
+	var spec models.PriorityClass
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to set priority class, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.Name) == 0 {
+		log.Error("failed to set priority class, name is empty")
+		ResponseError(c, CodePriorityClassNameCannotBeEmpty)
+		return
+	}
+
+	if spec.Value <= 0 {
+		log.Errorf("failed to set priority class, value: %d must be greater than 0", spec.Value)
+		ResponseError(c, CodePriorityValueMustBeGreaterThanZero)
+		return
+	}
+
+	priority.Classes.Set(spec)
+	log.Infof("admin.SetPriorityClass, priority class: %+v is set", spec)
+	ResponseSuccess(c, gin.H{
+		"priorityClass": spec,
+	})
+}
+
+func (ah *AdminHandler) DeletePriorityClass(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete priority class, name is empty")
+		ResponseError(c, CodePriorityClassNameCannotBeEmpty)
+		return
+	}
+
+	if err := priority.Classes.Remove(name); err != nil {
+		log.Errorf("priority.Remove failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodePriorityClassNotFound)
+		return
+	}
+
+	log.Infof("admin.DeletePriorityClass, priority class: %s is deleted", name)
+	ResponseSuccess(c, nil)
+}
+
+func (ah *AdminHandler) GetFairShare(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"usage":   fairshare.Tracker.Usages(),
+		"weights": fairshare.Tracker.GetWeights(),
+	})
+}
+
+func (ah *AdminHandler) SetGroupWeight(c *gin.Context) {
+	var spec models.GroupWeight
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to set group weight, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.Group) == 0 {
+		log.Error("failed to set group weight, group is empty")
+		ResponseError(c, CodeGroupNameCannotBeEmpty)
+		return
+	}
+
+	if spec.Weight <= 0 {
+		log.Errorf("failed to set group weight, weight: %v must be greater than 0", spec.Weight)
+		ResponseError(c, CodeGroupWeightMustBeGreaterThanZero)
+		return
+	}
+
+	fairshare.Tracker.SetWeight(spec.Group, spec.Weight)
+	log.Infof("admin.SetGroupWeight, group: %s weight: %v is set", spec.Group, spec.Weight)
+	ResponseSuccess(c, gin.H{
+		"weight": spec,
+	})
+}
+
+func (ah *AdminHandler) DeleteGroupWeight(c *gin.Context) {
+	group := c.Param("group")
+	if len(group) == 0 {
+		log.Error("failed to delete group weight, group is empty")
+		ResponseError(c, CodeGroupNameCannotBeEmpty)
+		return
+	}
+
+	if err := fairshare.Tracker.RemoveWeight(group); err != nil {
+		log.Errorf("fairshare.RemoveWeight failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeGroupWeightNotFound)
+		return
+	}
+
+	log.Infof("admin.DeleteGroupWeight, group: %s weight is deleted", group)
+	ResponseSuccess(c, nil)
+}
+
+func (ah *AdminHandler) Reconcile(c *gin.Context) {
+	mode := c.DefaultQuery("mode", services.ReconcileModeReport)
+	if mode != services.ReconcileModeReport && mode != services.ReconcileModeRepair {
+		log.Errorf("failed to reconcile, mode: %s is not supported", mode)
+		ResponseError(c, CodeReconcileModeNotSupported)
+		return
+	}
+
+	report, err := cs.Reconcile(mode)
+	if err != nil {
+		if xerrors.IsReservationsInProgressError(err) {
+			log.Errorf("services.Reconcile failed, original error: %T %v", errors.Cause(err), err)
+			ResponseError(c, CodeReconcileBusy)
+			return
+		}
+		log.Errorf("services.Reconcile failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeReconcileFailed)
+		return
+	}
+
+	log.Infof("admin.Reconcile, mode: %s, %d version drifts, %d orphans, %d resource drifts",
+		mode, len(report.Versions), len(report.Orphans), len(report.Resources))
+	ResponseSuccess(c, gin.H{
+		"report": report,
+	})
+}
+
+func (ah *AdminHandler) GetWorkQueue(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"workQueue": workQueue.GetStats(),
+	})
+}
@@ -0,0 +1,252 @@
+package routers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/booking"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// defaultCalendarRange is the range of the calendar if it is not specified
+const defaultCalendarRange = 7 * 24 * time.Hour
+
+type BookingHandler struct{}
+
+func (bh *BookingHandler) RegisterRoute(g *gin.RouterGroup) {
+	// book gpus for a time window, the spec is run when the window starts
+	g.POST("/bookings", bh.Create)
+	g.GET("/bookings", bh.List)
+	g.GET("/bookings/:name", bh.Get)
+	// change the window, gpus and spec of a booking that has not started
+	g.PATCH("/bookings/:name", bh.Update)
+	// cancel the booking, the containers running with it are stopped
+	g.DELETE("/bookings/:name", bh.Delete)
+	// the bookings of each gpu in a time range, e.g. ?from=2024-01-01 00:00:00&to=2024-01-08 00:00:00
+	g.GET("/calendar", bh.Calendar)
+}
+
+func (bh *BookingHandler) Create(c *gin.Context) {
+	var spec models.GpuBooking
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to create booking, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.Name) == 0 {
+		log.Error("failed to create booking, name is empty")
+		ResponseError(c, CodeBookingNameCannotBeEmpty)
+		return
+	}
+
+	if code, ok := bh.validate(&spec); !ok {
+		ResponseError(c, code)
+		return
+	}
+
+	b, err := booking.Bookings.Create(spec)
+	if err != nil {
+		log.Errorf("booking.Create failed, original error: %T %v", errors.Cause(err), err)
+		switch {
+		case xerrors.IsBookingExistedError(err):
+			ResponseError(c, CodeBookingExisted)
+		case xerrors.IsBookingGpuNotEnoughError(err):
+			ResponseError(c, CodeBookingGpuNotEnough)
+		case xerrors.IsGpuNotFoundError(err):
+			ResponseError(c, CodeContainerGpuNotFound)
+		default:
+			ResponseError(c, CodeBookingCreateFailed)
+		}
+		return
+	}
+
+	// the window may have started already
+	go booking.Runner.Sync()
+
+	log.Infof("booking.Create, booking: %s of %d gpus from %s to %s is created", b.Name, b.GpuCount, b.StartTime, b.EndTime)
+	ResponseSuccess(c, gin.H{
+		"booking": b,
+	})
+}
+
+func (bh *BookingHandler) List(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"bookings": booking.Bookings.List(),
+	})
+}
+
+func (bh *BookingHandler) Get(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get booking, name is empty")
+		ResponseError(c, CodeBookingNameCannotBeEmpty)
+		return
+	}
+
+	b, err := booking.Bookings.Get(name)
+	if err != nil {
+		log.Errorf("booking.Get failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeBookingNotFound)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"booking": b,
+	})
+}
+
+func (bh *BookingHandler) Update(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to update booking, name is empty")
+		ResponseError(c, CodeBookingNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.GpuBooking
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to update booking, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if code, ok := bh.validate(&spec); !ok {
+		ResponseError(c, code)
+		return
+	}
+
+	b, err := booking.Bookings.Update(name, spec)
+	if err != nil {
+		log.Errorf("booking.Update failed, original error: %T %v", errors.Cause(err), err)
+		switch {
+		case xerrors.IsBookingNotFoundError(err):
+			ResponseError(c, CodeBookingNotFound)
+		case xerrors.IsBookingNotPendingError(err):
+			ResponseError(c, CodeBookingNotPending)
+		case xerrors.IsBookingGpuNotEnoughError(err):
+			ResponseError(c, CodeBookingGpuNotEnough)
+		case xerrors.IsGpuNotFoundError(err):
+			ResponseError(c, CodeContainerGpuNotFound)
+		default:
+			ResponseError(c, CodeBookingUpdateFailed)
+		}
+		return
+	}
+
+	go booking.Runner.Sync()
+
+	log.Infof("booking.Update, booking: %s of %d gpus from %s to %s is updated", b.Name, b.GpuCount, b.StartTime, b.EndTime)
+	ResponseSuccess(c, gin.H{
+		"booking": b,
+	})
+}
+
+func (bh *BookingHandler) Delete(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete booking, name is empty")
+		ResponseError(c, CodeBookingNameCannotBeEmpty)
+		return
+	}
+
+	b, err := booking.Bookings.Remove(name)
+	if err != nil {
+		log.Errorf("booking.Remove failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeBookingNotFound)
+		return
+	}
+
+	var stopped []string
+	if b.Status == models.BookingActive {
+		stopped = booking.Stop(name)
+	}
+	// give the held gpus back
+	go booking.Runner.Sync()
+
+	log.Infof("booking.Delete, booking: %s is deleted, stopped replicaSets: %+v", name, stopped)
+	ResponseSuccess(c, gin.H{
+		"stopped": stopped,
+	})
+}
+
+func (bh *BookingHandler) Calendar(c *gin.Context) {
+	from := time.Now()
+	if value := c.Query("from"); value != "" {
+		t, err := booking.ParseTime(value)
+		if err != nil {
+			log.Errorf("failed to get calendar, from: %s is invalid, err: %v", value, err)
+			ResponseError(c, CodeBookingTimeInvalid)
+			return
+		}
+		from = t
+	}
+	to := from.Add(defaultCalendarRange)
+	if value := c.Query("to"); value != "" {
+		t, err := booking.ParseTime(value)
+		if err != nil || !t.After(from) {
+			log.Errorf("failed to get calendar, to: %s is invalid, err: %v", value, err)
+			ResponseError(c, CodeBookingTimeInvalid)
+			return
+		}
+		to = t
+	}
+
+	ResponseSuccess(c, gin.H{
+		"from": from.Format("2006-01-02 15:04:05"),
+		"to":   to.Format("2006-01-02 15:04:05"),
+		"gpus": booking.Bookings.Calendar(from, to),
+	})
+}
+
+// validate checks the gpus, window and spec of the booking
+func (bh *BookingHandler) validate(spec *models.GpuBooking) (ResCode, bool) {
+	if spec.GpuCount < 0 {
+		log.Error("failed to validate booking, gpu count must be greater than 0")
+		return CodeGpuCountMustBeGreaterThanOrEqualZero, false
+	}
+
+	if len(spec.Gpus) > 0 {
+		if spec.GpuCount != 0 && spec.GpuCount != len(spec.Gpus) {
+			log.Errorf("failed to validate booking, gpu count: %d doesn't match pinned gpus: %+v", spec.GpuCount, spec.Gpus)
+			return CodeGpuCountNotMatchPinnedGpus, false
+		}
+		spec.GpuCount = len(spec.Gpus)
+	}
+
+	if spec.GpuCount == 0 {
+		log.Error("failed to validate booking, no gpu is booked")
+		return CodeBookingGpuCountIsZero, false
+	}
+
+	_, end, err := booking.ParseWindow(spec)
+	if err != nil {
+		log.Errorf("failed to validate booking, err: %v", err)
+		return CodeBookingTimeInvalid, false
+	}
+	if !end.After(time.Now()) {
+		log.Errorf("failed to validate booking, end time: %s has passed", spec.EndTime)
+		return CodeBookingTimeInvalid, false
+	}
+
+	if spec.Spec != nil {
+		if len(spec.Spec.ImageName) == 0 {
+			log.Error("failed to validate booking, image name is empty")
+			return CodeImageNameCannotBeEmpty, false
+		}
+		if len(spec.Spec.ReplicaSetName) == 0 {
+			log.Error("failed to validate booking, container name is empty")
+			return CodeContainerNameCannotBeEmpty, false
+		}
+		if strings.Contains(spec.Spec.ReplicaSetName, "-") {
+			log.Error("failed to validate booking, container name cannot contain dash")
+			return CodeContainerNameCannotContainDash, false
+		}
+	}
+	return CodeSuccess, true
+}
@@ -33,6 +33,19 @@ const (
 	CodeContainerCpuNotEnough                        ResCode = 1023
 	CodeCpuCountMustBeGreaterThanOrEqualZero         ResCode = 1024
 	CodeContainerMemorySizeNotSupported              ResCode = 1025
+	CodeContainerGpuConflict                         ResCode = 1026
+	CodeContainerGpuNotFound                         ResCode = 1027
+	CodeGpuCountNotMatchPinnedGpus                   ResCode = 1028
+	CodeGpuMemorySizeNotSupported                    ResCode = 1029
+	CodeCpuPolicyNotSupported                        ResCode = 1030
+	CodeCpuModeNotSupported                          ResCode = 1031
+	CodeContainerMemoryNotEnough                     ResCode = 1032
+	CodeContainerDiskNotEnough                       ResCode = 1033
+	CodeContainerRootfsSizeNotSupported              ResCode = 1034
+	CodeContainerRootfsSizeUsedGreaterThanReduce     ResCode = 1035
+	CodeContainerPortNotSupported                    ResCode = 1036
+	CodeContainerPortConflict                        ResCode = 1037
+	CodeCpuSharedModeDisabled                        ResCode = 1038
 
 	CodeVolumeCreateFailed                 ResCode = 1100
 	CodeVolumeNameCannotBeEmpty            ResCode = 1101
@@ -47,6 +60,59 @@ const (
 	CodeVolumeGetInfoFailed                ResCode = 1110
 	CodeVolumeGetHistoryFailed             ResCode = 1111
 	CodeVolumePatchFailed                  ResCode = 1112
+
+	CodeGpuRescanFailed                    ResCode = 1200
+	CodePriorityClassNotFound              ResCode = 1201
+	CodePriorityClassNameCannotBeEmpty     ResCode = 1202
+	CodePriorityValueMustBeGreaterThanZero ResCode = 1203
+	CodeGroupNameCannotBeEmpty             ResCode = 1204
+	CodeGroupWeightNotFound                ResCode = 1205
+	CodeGroupWeightMustBeGreaterThanZero   ResCode = 1206
+	CodeReconcileModeNotSupported          ResCode = 1207
+	CodeReconcileFailed                    ResCode = 1208
+	CodePriorityClassNotAllowed            ResCode = 1209
+	CodeReconcileBusy                      ResCode = 1210
+
+	CodeQueuedRequestNotFound              ResCode = 1300
+	CodeQueuePositionMustBeGreaterThanZero ResCode = 1301
+	CodeQueueOrderedByFairShare            ResCode = 1302
+
+	CodeBookingCreateFailed      ResCode = 1400
+	CodeBookingNameCannotBeEmpty ResCode = 1401
+	CodeBookingNotFound          ResCode = 1402
+	CodeBookingExisted           ResCode = 1403
+	CodeBookingTimeInvalid       ResCode = 1404
+	CodeBookingGpuNotEnough      ResCode = 1405
+	CodeBookingNotPending        ResCode = 1406
+	CodeBookingUpdateFailed      ResCode = 1407
+	CodeBookingNotActive         ResCode = 1408
+	CodeBookingGpuCountIsZero    ResCode = 1409
+	CodeBookingGpuCountExceeded  ResCode = 1410
+
+	CodeQuotaExceeded                          ResCode = 1500
+	CodeQuotaNotFound                          ResCode = 1501
+	CodeQuotaKindNotSupported                  ResCode = 1502
+	CodeQuotaNameCannotBeEmpty                 ResCode = 1503
+	CodeQuotaSizeNotSupported                  ResCode = 1504
+	CodeQuotaLimitMustBeGreaterThanOrEqualZero ResCode = 1505
+	CodeQuotaOwnerRequired                     ResCode = 1506
+
+	CodeLeaseNotFound           ResCode = 1600
+	CodeLeaseTimeInvalid        ResCode = 1601
+	CodeLeaseActionNotSupported ResCode = 1602
+	CodeLeaseExpired            ResCode = 1603
+
+	CodeScheduleNotFound               ResCode = 1700
+	CodeScheduleReplicaSetNotFound     ResCode = 1701
+	CodeScheduleRulesCannotBeEmpty     ResCode = 1702
+	CodeScheduleActionNotSupported     ResCode = 1703
+	CodeScheduleCronInvalid            ResCode = 1704
+	CodeScheduleMissedRunsNotSupported ResCode = 1705
+
+	CodeUsageTimeInvalid         ResCode = 1800
+	CodeUsageGroupByNotSupported ResCode = 1801
+	CodeUsageFormatNotSupported  ResCode = 1802
+	CodeUsageReportFailed        ResCode = 1803
 )
 
 var codeMsgMap = map[ResCode]string{
@@ -80,6 +146,19 @@ var codeMsgMap = map[ResCode]string{
 	CodeContainerNoNeedRollback:                      "Container doesn't need rollback, the current version is the same as the requested version",
 	CodeCpuCountMustBeGreaterThanOrEqualZero:         "CPU count must be greater than or equal to 0",
 	CodeContainerMemorySizeNotSupported:              "Memory size units are not supported, supported units: KB, MB, GB, TB",
+	CodeContainerGpuConflict:                         "The pinned GPUs are held by other replicaSets",
+	CodeContainerGpuNotFound:                         "GPU not found",
+	CodeGpuCountNotMatchPinnedGpus:                   "GPU count doesn't match the number of pinned GPUs",
+	CodeGpuMemorySizeNotSupported:                    "GPU memory size units are not supported, supported units: KB, MB, GB, TB",
+	CodeCpuPolicyNotSupported:                        "CPU policy is not supported, supported policies: numa-prefer, numa-strict",
+	CodeCpuModeNotSupported:                          "CPU mode is not supported, supported modes: exclusive, shared",
+	CodeContainerMemoryNotEnough:                     "Not enough memory resources",
+	CodeContainerDiskNotEnough:                       "Not enough disk resources",
+	CodeContainerRootfsSizeNotSupported:              "Rootfs size is not supported, supported units: KB, MB, GB, TB",
+	CodeContainerRootfsSizeUsedGreaterThanReduce:     "Failed to patch rootfs size, the patch size is smaller than the used size",
+	CodeContainerPortNotSupported:                    "Container port is not supported, format: port[/tcp|udp][=hostPort]",
+	CodeContainerPortConflict:                        "Host port is reserved or already in use",
+	CodeCpuSharedModeDisabled:                        "Shared CPU mode is disabled, the server is started without -sharedCpus",
 
 	CodeVolumeCreateFailed:                 "Failed to create volume",
 	CodeVolumeNameCannotBeEmpty:            "Volume name cannot be empty",
@@ -94,6 +173,59 @@ var codeMsgMap = map[ResCode]string{
 	CodeVolumeGetInfoFailed:                "Failed to get volume info",
 	CodeVolumeGetHistoryFailed:             "Failed to get volume history",
 	CodeVolumePatchFailed:                  "Failed to patch volume",
+
+	CodeGpuRescanFailed:                    "Failed to rescan gpus",
+	CodePriorityClassNotFound:              "Priority class not found",
+	CodePriorityClassNameCannotBeEmpty:     "Priority class name cannot be empty",
+	CodePriorityValueMustBeGreaterThanZero: "Priority value must be greater than 0",
+	CodeGroupNameCannotBeEmpty:             "Group name cannot be empty",
+	CodeGroupWeightNotFound:                "Group weight not found",
+	CodeGroupWeightMustBeGreaterThanZero:   "Group weight must be greater than 0",
+	CodeReconcileModeNotSupported:          "Reconcile mode is not supported, optional: report, repair",
+	CodeReconcileFailed:                    "Failed to reconcile with docker",
+	CodePriorityClassNotAllowed:            "The owner or group is not allowed to use the priority class",
+	CodeReconcileBusy:                      "Operations that hold resources are in progress, retry the repair later",
+
+	CodeQueuedRequestNotFound:              "Queued request not found",
+	CodeQueuePositionMustBeGreaterThanZero: "Queue position must be greater than 0",
+	CodeQueueOrderedByFairShare:            "Queue is ordered by fair share, the position can't be changed",
+
+	CodeBookingCreateFailed:      "Failed to create booking",
+	CodeBookingNameCannotBeEmpty: "Booking name cannot be empty",
+	CodeBookingNotFound:          "Booking not found",
+	CodeBookingExisted:           "Booking already exists",
+	CodeBookingTimeInvalid:       "Booking time is invalid, format: 2006-01-02 15:04:05",
+	CodeBookingGpuNotEnough:      "Gpus are booked by others in the window",
+	CodeBookingNotPending:        "Booking has started",
+	CodeBookingUpdateFailed:      "Failed to update booking",
+	CodeBookingNotActive:         "Booking is not in its window",
+	CodeBookingGpuCountIsZero:    "Booking must have at least one gpu",
+	CodeBookingGpuCountExceeded:  "Gpu count exceeds the gpus of the booking",
+
+	CodeQuotaExceeded:                          "Quota exceeded",
+	CodeQuotaNotFound:                          "Quota not found",
+	CodeQuotaKindNotSupported:                  "Quota kind is not supported, optional: user, group",
+	CodeQuotaNameCannotBeEmpty:                 "Quota name cannot be empty",
+	CodeQuotaSizeNotSupported:                  "Quota size is not supported",
+	CodeQuotaLimitMustBeGreaterThanOrEqualZero: "Quota limit must be greater than or equal to 0",
+	CodeQuotaOwnerRequired:                     "Owner or group is required when quotas are set",
+
+	CodeLeaseNotFound:           "Lease not found",
+	CodeLeaseTimeInvalid:        "Lease time is invalid, either ttl e.g. 48h or expiresAt in the future, format: 2006-01-02 15:04:05",
+	CodeLeaseActionNotSupported: "Lease action on expiry is not supported, optional: stop, delete",
+	CodeLeaseExpired:            "Lease has expired, extend it first",
+
+	CodeScheduleNotFound:               "Schedule not found",
+	CodeScheduleReplicaSetNotFound:     "ReplicaSet of the schedule not found",
+	CodeScheduleRulesCannotBeEmpty:     "Schedule rules cannot be empty",
+	CodeScheduleActionNotSupported:     "Schedule action is not supported, optional: stop, continue, restart",
+	CodeScheduleCronInvalid:            "Schedule cron is invalid, format: minute hour day-of-month month day-of-week",
+	CodeScheduleMissedRunsNotSupported: "Schedule missed runs policy is not supported, optional: latest, skip",
+
+	CodeUsageTimeInvalid:         "Usage time is invalid, to must be after from, format: 2006-01-02 15:04:05",
+	CodeUsageGroupByNotSupported: "Usage group by is not supported, optional: owner, replicaSet",
+	CodeUsageFormatNotSupported:  "Usage format is not supported, optional: json, csv",
+	CodeUsageReportFailed:        "Failed to read the usage records",
 }
 
 func (c ResCode) Msg() string {
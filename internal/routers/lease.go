@@ -0,0 +1,99 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/lease"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type LeaseHandler struct{}
+
+func (lh *LeaseHandler) RegisterRoute(g *gin.RouterGroup) {
+	// the leased replicaSets are stopped or deleted when their leases end
+	g.GET("/leases", lh.List)
+	g.GET("/leases/:name", lh.Get)
+	// extend the lease by a ttl or to a new expiresAt
+	g.PATCH("/leases/:name", lh.Extend)
+	// end the lease without stopping the replicaSet, it runs until it is stopped by hand
+	g.DELETE("/leases/:name", lh.Delete)
+}
+
+func (lh *LeaseHandler) List(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"leases": lease.Leases.List(),
+	})
+}
+
+func (lh *LeaseHandler) Get(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get lease, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	l, err := lease.Leases.Get(name)
+	if err != nil {
+		log.Errorf("lease.Get failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeLeaseNotFound)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"lease": l,
+	})
+}
+
+func (lh *LeaseHandler) Extend(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to extend lease, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.LeaseExtend
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to extend lease, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	l, err := lease.Leases.Extend(name, spec)
+	if err != nil {
+		log.Errorf("lease.Extend failed, original error: %T %v", errors.Cause(err), err)
+		if xerrors.IsLeaseNotFoundError(err) {
+			ResponseError(c, CodeLeaseNotFound)
+			return
+		}
+		ResponseError(c, CodeLeaseTimeInvalid)
+		return
+	}
+
+	log.Infof("lease.Extend, the lease of replicaSet: %s is extended to %s", name, l.ExpiresAt)
+	ResponseSuccess(c, gin.H{
+		"lease": l,
+	})
+}
+
+func (lh *LeaseHandler) Delete(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete lease, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	if _, err := lease.Leases.Remove(name); err != nil {
+		log.Errorf("lease.Remove failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeLeaseNotFound)
+		return
+	}
+
+	log.Infof("lease.Delete, the lease of replicaSet: %s is deleted", name)
+	ResponseSuccess(c, nil)
+}
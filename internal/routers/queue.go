@@ -0,0 +1,109 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/queue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type QueueHandler struct{}
+
+func (qh *QueueHandler) RegisterRoute(g *gin.RouterGroup) {
+	// list the run requests waiting for resources in order
+	g.GET("/queue", qh.List)
+	// get the queued request of the replicaSet and its position
+	g.GET("/queue/:name", qh.Get)
+	// move the queued request of the replicaSet to a position, 1 means the head
+	g.PATCH("/queue/:name/position", qh.Move)
+	// cancel the queued request of the replicaSet
+	g.DELETE("/queue/:name", qh.Cancel)
+}
+
+func (qh *QueueHandler) List(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"requests": queue.PendingQueue.List(),
+	})
+}
+
+func (qh *QueueHandler) Get(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get queued request, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	req, err := queue.PendingQueue.Get(name)
+	if err != nil {
+		log.Errorf("queue.Get failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeQueuedRequestNotFound)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"request": req,
+	})
+}
+
+func (qh *QueueHandler) Move(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to move queued request, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.QueueMove
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to move queued request, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if spec.Position <= 0 {
+		log.Errorf("failed to move queued request, position: %d must be greater than 0", spec.Position)
+		ResponseError(c, CodeQueuePositionMustBeGreaterThanZero)
+		return
+	}
+
+	req, err := queue.PendingQueue.Move(name, spec.Position)
+	if err != nil {
+		log.Errorf("queue.Move failed, original error: %T %v", errors.Cause(err), err)
+		if xerrors.IsQueueOrderedByFairShareError(err) {
+			ResponseError(c, CodeQueueOrderedByFairShare)
+			return
+		}
+		ResponseError(c, CodeQueuedRequestNotFound)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"request": req,
+	})
+}
+
+func (qh *QueueHandler) Cancel(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to cancel queued request, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	if err := queue.PendingQueue.Remove(name); err != nil {
+		log.Errorf("queue.Remove failed, original error: %T %v", errors.Cause(err), err)
+		if xerrors.IsQueuedRequestNotFoundError(err) {
+			ResponseError(c, CodeQueuedRequestNotFound)
+			return
+		}
+		ResponseError(c, CodeServeBusy)
+		return
+	}
+
+	log.Infof("queue.Cancel, the queued request of replicaSet: %s is cancelled", name)
+	ResponseSuccess(c, nil)
+}
@@ -0,0 +1,134 @@
+package routers
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/quota"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+)
+
+type QuotaHandler struct{}
+
+var qs services.QuotaService
+
+func (qh *QuotaHandler) RegisterRoute(g *gin.RouterGroup) {
+	// the quotas with the current usage against them
+	g.GET("/quotas", qh.List)
+	g.GET("/quotas/:kind/:name", qh.Get)
+	// set or delete the quota of an owner or a group
+	g.PUT("/admin/quotas", qh.Set)
+	g.DELETE("/admin/quotas/:kind/:name", qh.Delete)
+}
+
+func (qh *QuotaHandler) List(c *gin.Context) {
+	quotas := quota.Quotas.List()
+	resp := make([]models.QuotaStatus, 0, len(quotas))
+	for _, q := range quotas {
+		resp = append(resp, models.QuotaStatus{
+			Quota: q,
+			Usage: qs.Usage(q.Kind, q.Name),
+		})
+	}
+
+	ResponseSuccess(c, gin.H{
+		"quotas": resp,
+	})
+}
+
+func (qh *QuotaHandler) Get(c *gin.Context) {
+	kind, name := c.Param("kind"), c.Param("name")
+	if !validQuotaKind(kind) {
+		log.Errorf("failed to get quota, kind: %s is not supported", kind)
+		ResponseError(c, CodeQuotaKindNotSupported)
+		return
+	}
+
+	q, err := quota.Quotas.Get(kind, name)
+	if err != nil {
+		log.Errorf("quota.Get failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeQuotaNotFound)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"quota": models.QuotaStatus{
+			Quota: q,
+			Usage: qs.Usage(kind, name),
+		},
+	})
+}
+
+func (qh *QuotaHandler) Set(c *gin.Context) {
+	var spec models.Quota
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to set quota, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if !validQuotaKind(spec.Kind) {
+		log.Errorf("failed to set quota, kind: %s is not supported", spec.Kind)
+		ResponseError(c, CodeQuotaKindNotSupported)
+		return
+	}
+
+	if len(spec.Name) == 0 {
+		log.Error("failed to set quota, name is empty")
+		ResponseError(c, CodeQuotaNameCannotBeEmpty)
+		return
+	}
+
+	if spec.MaxGpus < 0 || spec.MaxCpus < 0 || spec.MaxVolumes < 0 || spec.MaxReplicaSets < 0 {
+		log.Errorf("failed to set quota, limits must be greater than or equal to 0, quota: %+v", spec)
+		ResponseError(c, CodeQuotaLimitMustBeGreaterThanOrEqualZero)
+		return
+	}
+
+	for _, size := range []*string{&spec.MaxMemory, &spec.MaxVolumeSize} {
+		if *size == "" {
+			continue
+		}
+		*size = strings.ToUpper(*size)
+		if !validSize(*size) {
+			log.Errorf("failed to set quota, size: %s is not supported", *size)
+			ResponseError(c, CodeQuotaSizeNotSupported)
+			return
+		}
+	}
+
+	quota.Quotas.Set(spec)
+	log.Infof("quota.Set, quota: %+v is set", spec)
+	ResponseSuccess(c, gin.H{
+		"quota": models.QuotaStatus{
+			Quota: spec,
+			Usage: qs.Usage(spec.Kind, spec.Name),
+		},
+	})
+}
+
+func (qh *QuotaHandler) Delete(c *gin.Context) {
+	kind, name := c.Param("kind"), c.Param("name")
+	if !validQuotaKind(kind) {
+		log.Errorf("failed to delete quota, kind: %s is not supported", kind)
+		ResponseError(c, CodeQuotaKindNotSupported)
+		return
+	}
+
+	if err := quota.Quotas.Remove(kind, name); err != nil {
+		log.Errorf("quota.Remove failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeQuotaNotFound)
+		return
+	}
+
+	log.Infof("quota.Delete, quota: %s/%s is deleted", kind, name)
+	ResponseSuccess(c, nil)
+}
+
+func validQuotaKind(kind string) bool {
+	return kind == models.QuotaKindUser || kind == models.QuotaKindGroup
+}
@@ -2,12 +2,20 @@ package routers
 
 import (
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ngaut/log"
 	"github.com/pkg/errors"
 
+	"github.com/mayooot/gpu-docker-api/internal/booking"
+	"github.com/mayooot/gpu-docker-api/internal/lease"
 	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/monitor"
+	"github.com/mayooot/gpu-docker-api/internal/priority"
+	"github.com/mayooot/gpu-docker-api/internal/queue"
+	"github.com/mayooot/gpu-docker-api/internal/schedule"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
 	"github.com/mayooot/gpu-docker-api/internal/services"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
@@ -46,6 +54,8 @@ func (rh *ReplicaSetHandler) RegisterRoute(g *gin.RouterGroup) {
 	// continue to run the current version of the replicaSet container,
 	// it will call `docker restart`.
 	g.PATCH("/replicaSet/:name/continue", rh.Continue)
+	// enable or disable stopping the replicaSet when its gpus have been idle for a long time
+	g.PATCH("/replicaSet/:name/idleStop", rh.IdleStop)
 
 	// get information about the current version of the replicaSet
 	g.GET("/replicaSet/:name", rh.Info)
@@ -72,8 +82,15 @@ func (rh *ReplicaSetHandler) Info(c *gin.Context) {
 		return
 	}
 
+	// the replicaSet may be stopped, so the unhealthy gpus are only a hint
+	unhealthyGpus, err := cs.GetContainerUnhealthyGpus(name)
+	if err != nil {
+		log.Warnf("services.GetContainerUnhealthyGpus failed, name: %s, err: %v", name, err)
+	}
+
 	ResponseSuccess(c, gin.H{
-		"Info": info,
+		"Info":          info,
+		"unhealthyGpus": unhealthyGpus,
 	})
 }
 
@@ -125,12 +142,48 @@ func (rh *ReplicaSetHandler) Run(c *gin.Context) {
 		return
 	}
 
+	if len(spec.Gpus) > 0 {
+		if spec.GpuCount != 0 && spec.GpuCount != len(spec.Gpus) {
+			log.Errorf("failed to create container, gpu count: %d doesn't match pinned gpus: %+v", spec.GpuCount, spec.Gpus)
+			ResponseError(c, CodeGpuCountNotMatchPinnedGpus)
+			return
+		}
+		spec.GpuCount = len(spec.Gpus)
+	}
+
+	if spec.MinGpuMemory != "" {
+		spec.MinGpuMemory = strings.ToUpper(spec.MinGpuMemory)
+		if !validSize(spec.MinGpuMemory) {
+			log.Errorf("failed to create container, min gpu memory: %s is not supported", spec.MinGpuMemory)
+			ResponseError(c, CodeGpuMemorySizeNotSupported)
+			return
+		}
+	}
+
 	if spec.CpuCount < 0 {
 		log.Error("failed to create container, cpu count must be greater than 0")
 		ResponseError(c, CodeCpuCountMustBeGreaterThanOrEqualZero)
 		return
 	}
 
+	if !validCpuPolicy(spec.CpuPolicy) {
+		log.Errorf("failed to create container, cpu policy: %s is not supported", spec.CpuPolicy)
+		ResponseError(c, CodeCpuPolicyNotSupported)
+		return
+	}
+
+	if !validCpuMode(spec.CpuMode) {
+		log.Errorf("failed to create container, cpu mode: %s is not supported", spec.CpuMode)
+		ResponseError(c, CodeCpuModeNotSupported)
+		return
+	}
+
+	if spec.CpuMode == models.CpuModeShared && !schedulers.CpuScheduler.SharedEnabled() {
+		log.Error("failed to create container, shared cpu mode is disabled without -sharedCpus")
+		ResponseError(c, CodeCpuSharedModeDisabled)
+		return
+	}
+
 	if spec.Memory != "" {
 		spec.Memory = strings.ToUpper(spec.Memory)
 		unit := spec.Memory[len(spec.Memory)-2:]
@@ -141,16 +194,108 @@ func (rh *ReplicaSetHandler) Run(c *gin.Context) {
 		}
 	}
 
+	if spec.RootfsSize != "" {
+		spec.RootfsSize = strings.ToUpper(spec.RootfsSize)
+		if !validSize(spec.RootfsSize) {
+			log.Errorf("failed to create container, rootfs size: %s is not supported", spec.RootfsSize)
+			ResponseError(c, CodeContainerRootfsSizeNotSupported)
+			return
+		}
+	}
+
+	for _, port := range spec.ContainerPorts {
+		if _, err := models.ParseContainerPort(port); err != nil {
+			log.Errorf("failed to create container, container port: %s is not supported, err: %v", port, err)
+			ResponseError(c, CodeContainerPortNotSupported)
+			return
+		}
+	}
+
 	if strings.Contains(spec.ReplicaSetName, "-") {
 		log.Error("failed to create container, container name cannot contain dash")
 		ResponseError(c, CodeContainerNameCannotContainDash)
 		return
 	}
 
+	if spec.PriorityClass != "" {
+		if err := priority.Classes.Allowed(spec.PriorityClass, spec.Owner, spec.Group); err != nil {
+			log.Errorf("failed to create container, err: %v", err)
+			if xerrors.IsPriorityClassNotAllowedError(err) {
+				ResponseError(c, CodePriorityClassNotAllowed)
+				return
+			}
+			ResponseError(c, CodePriorityClassNotFound)
+			return
+		}
+	}
+
+	if spec.Booking != "" {
+		b, err := booking.Bookings.Get(spec.Booking)
+		if err != nil {
+			log.Errorf("failed to create container, booking: %s not found", spec.Booking)
+			ResponseError(c, CodeBookingNotFound)
+			return
+		}
+		if b.Status != models.BookingActive {
+			log.Errorf("failed to create container, booking: %s is %s", spec.Booking, b.Status)
+			ResponseError(c, CodeBookingNotActive)
+			return
+		}
+		// use all booked gpus if the gpus are not specified
+		if spec.GpuCount == 0 {
+			spec.Gpus = b.Gpus
+			spec.GpuCount = len(b.Gpus)
+		}
+		if spec.GpuCount > b.GpuCount {
+			log.Errorf("failed to create container, gpu count: %d exceeds the %d gpus of booking: %s", spec.GpuCount, b.GpuCount, spec.Booking)
+			ResponseError(c, CodeBookingGpuCountExceeded)
+			return
+		}
+	}
+
+	if lease.Leased(&spec) {
+		if _, err := lease.Expiry(spec.Ttl, spec.ExpiresAt, time.Now()); err != nil {
+			log.Errorf("failed to create container, err: %v", err)
+			ResponseError(c, CodeLeaseTimeInvalid)
+			return
+		}
+	}
+
+	if !validOnExpiry(spec.OnExpiry) {
+		log.Errorf("failed to create container, on expiry: %s is not supported", spec.OnExpiry)
+		ResponseError(c, CodeLeaseActionNotSupported)
+		return
+	}
+
+	if queue.PendingQueue.Exist(spec.ReplicaSetName) {
+		log.Errorf("failed to create container, replicaSet: %s is already queued", spec.ReplicaSetName)
+		ResponseError(c, CodeContainerAlreadyExist)
+		return
+	}
+
+	// the requests queued earlier go first
+	if spec.Queue && queue.PendingQueue.Len() > 0 {
+		rh.enqueue(c, spec)
+		return
+	}
+
 	_, containerName, err := cs.RunGpuContainer(&spec)
 	if err != nil {
+		if spec.Queue && xerrors.IsResourceNotEnoughError(err) {
+			log.Infof("services.RunGpuContainer, replicaSet: %s is queued, err: %v", spec.ReplicaSetName, err)
+			rh.enqueue(c, spec)
+			return
+		}
 		log.Errorf("services.RunGpuContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsQuotaNoOwnerError(err) {
+			ResponseError(c, CodeQuotaOwnerRequired)
+			return
+		}
+		if xerrors.IsQuotaExceededError(err) {
+			ResponseError(c, CodeQuotaExceeded)
+			return
+		}
 		if xerrors.IsContainerExistedError(err) {
 			ResponseError(c, CodeContainerAlreadyExist)
 			return
@@ -159,23 +304,100 @@ func (rh *ReplicaSetHandler) Run(c *gin.Context) {
 			ResponseError(c, CodeContainerGpuNotEnough)
 			return
 		}
+		if e, ok := xerrors.AsGpuConflictError(err); ok {
+			ResponseErrorWithData(c, CodeContainerGpuConflict, gin.H{
+				"conflicts": e.Holders,
+			})
+			return
+		}
+		if xerrors.IsGpuNotFoundError(err) {
+			ResponseError(c, CodeContainerGpuNotFound)
+			return
+		}
 		if xerrors.IsCpuNotEnoughError(err) {
 			ResponseError(c, CodeContainerCpuNotEnough)
 			return
 		}
+		if xerrors.IsMemoryNotEnoughError(err) {
+			ResponseError(c, CodeContainerMemoryNotEnough)
+			return
+		}
+		if xerrors.IsDiskNotEnoughError(err) {
+			ResponseError(c, CodeContainerDiskNotEnough)
+			return
+		}
 		if xerrors.IsPortNotEnoughError(err) {
 			ResponseError(c, CodeContainerPortNotEnough)
 			return
 		}
+		if xerrors.IsPortConflictError(err) {
+			ResponseError(c, CodeContainerPortConflict)
+			return
+		}
 		ResponseError(c, CodeContainerRunFailed)
 		return
 	}
 
+	if _, err = lease.Leases.Start(&spec); err != nil {
+		log.Errorf("lease.Start failed, original error: %T %v", errors.Cause(err), err)
+	}
+
 	ResponseSuccess(c, gin.H{
 		"name": containerName,
 	})
 }
 
+// enqueue puts the run request into the pending queue, it will be run when resources are given back.
+// A request that can never run is rejected, it would block the ones queued after it.
+func (rh *ReplicaSetHandler) enqueue(c *gin.Context, spec models.ContainerRun) {
+	if err := cs.CheckQueued(&spec); err != nil {
+		log.Errorf("services.CheckQueued failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsQuotaNoOwnerError(err) {
+			ResponseError(c, CodeQuotaOwnerRequired)
+			return
+		}
+		if xerrors.IsQuotaExceededError(err) {
+			ResponseError(c, CodeQuotaExceeded)
+			return
+		}
+		if xerrors.IsContainerExistedError(err) {
+			ResponseError(c, CodeContainerAlreadyExist)
+			return
+		}
+		if xerrors.IsGpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerGpuNotEnough)
+			return
+		}
+		if xerrors.IsGpuNotFoundError(err) {
+			ResponseError(c, CodeContainerGpuNotFound)
+			return
+		}
+		if xerrors.IsCpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerCpuNotEnough)
+			return
+		}
+		if xerrors.IsMemoryNotEnoughError(err) {
+			ResponseError(c, CodeContainerMemoryNotEnough)
+			return
+		}
+		if xerrors.IsDiskNotEnoughError(err) {
+			ResponseError(c, CodeContainerDiskNotEnough)
+			return
+		}
+		ResponseError(c, CodeContainerRunFailed)
+		return
+	}
+
+	req := queue.PendingQueue.Push(spec)
+	// the request may be put at the head by the fair-share policy
+	go queue.Dispatcher.Dispatch()
+	ResponseSuccess(c, gin.H{
+		"queued":   true,
+		"position": req.Position,
+	})
+}
+
 // Commit the latest version of the container as image.
 // The image name is the default image id, or you can specify a new image name.
 func (rh *ReplicaSetHandler) Commit(c *gin.Context) {
@@ -260,12 +482,49 @@ func (rh *ReplicaSetHandler) Patch(c *gin.Context) {
 		return
 	}
 
+	if spec.GpuPatch != nil && len(spec.GpuPatch.Gpus) > 0 {
+		if spec.GpuPatch.GpuCount != 0 && spec.GpuPatch.GpuCount != len(spec.GpuPatch.Gpus) {
+			log.Errorf("failed to patch container, gpu count: %d doesn't match pinned gpus: %+v",
+				spec.GpuPatch.GpuCount, spec.GpuPatch.Gpus)
+			ResponseError(c, CodeGpuCountNotMatchPinnedGpus)
+			return
+		}
+		spec.GpuPatch.GpuCount = len(spec.GpuPatch.Gpus)
+	}
+
+	if spec.GpuPatch != nil && spec.GpuPatch.MinGpuMemory != "" {
+		spec.GpuPatch.MinGpuMemory = strings.ToUpper(spec.GpuPatch.MinGpuMemory)
+		if !validSize(spec.GpuPatch.MinGpuMemory) {
+			log.Errorf("failed to patch container, min gpu memory: %s is not supported", spec.GpuPatch.MinGpuMemory)
+			ResponseError(c, CodeGpuMemorySizeNotSupported)
+			return
+		}
+	}
+
 	if spec.CpuPatch != nil && spec.CpuPatch.CpuCount < 0 {
 		log.Errorf("failed to patch container, cpuCount: %d must be greater than or equal to 0", spec.CpuPatch.CpuCount)
 		ResponseError(c, CodeCpuCountMustBeGreaterThanOrEqualZero)
 		return
 	}
 
+	if spec.CpuPatch != nil && !validCpuPolicy(spec.CpuPatch.CpuPolicy) {
+		log.Errorf("failed to patch container, cpu policy: %s is not supported", spec.CpuPatch.CpuPolicy)
+		ResponseError(c, CodeCpuPolicyNotSupported)
+		return
+	}
+
+	if spec.CpuPatch != nil && !validCpuMode(spec.CpuPatch.CpuMode) {
+		log.Errorf("failed to patch container, cpu mode: %s is not supported", spec.CpuPatch.CpuMode)
+		ResponseError(c, CodeCpuModeNotSupported)
+		return
+	}
+
+	if spec.CpuPatch != nil && spec.CpuPatch.CpuMode == models.CpuModeShared && !schedulers.CpuScheduler.SharedEnabled() {
+		log.Error("failed to patch container, shared cpu mode is disabled without -sharedCpus")
+		ResponseError(c, CodeCpuSharedModeDisabled)
+		return
+	}
+
 	if spec.VolumePatch != nil && (spec.VolumePatch.OldBind.Format() == "" ||
 		spec.VolumePatch.NewBind.Format() == "") {
 		log.Errorf("failed to patch container,volume Patch Info is invalid: %v", spec.VolumePatch)
@@ -283,16 +542,56 @@ func (rh *ReplicaSetHandler) Patch(c *gin.Context) {
 		}
 	}
 
-	_, containerName, err := cs.PatchContainer(name, &spec)
+	if spec.RootfsPatch != nil {
+		spec.RootfsPatch.RootfsSize = strings.ToUpper(spec.RootfsPatch.RootfsSize)
+		if !validSize(spec.RootfsPatch.RootfsSize) {
+			log.Errorf("failed to patch container, rootfs size: %s is not supported", spec.RootfsPatch.RootfsSize)
+			ResponseError(c, CodeContainerRootfsSizeNotSupported)
+			return
+		}
+	}
+
+	_, containerName, changes, err := cs.PatchContainer(name, &spec)
 	if err != nil {
 		log.Errorf("services.PatchContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsQuotaExceededError(err) {
+			ResponseError(c, CodeQuotaExceeded)
+			return
+		}
+		if e, ok := xerrors.AsGpuConflictError(err); ok {
+			ResponseErrorWithData(c, CodeContainerGpuConflict, gin.H{
+				"conflicts": e.Holders,
+			})
+			return
+		}
+		if xerrors.IsGpuNotFoundError(err) {
+			ResponseError(c, CodeContainerGpuNotFound)
+			return
+		}
+		if xerrors.IsMemoryNotEnoughError(err) {
+			ResponseError(c, CodeContainerMemoryNotEnough)
+			return
+		}
+		if xerrors.IsDiskNotEnoughError(err) {
+			ResponseError(c, CodeContainerDiskNotEnough)
+			return
+		}
+		if xerrors.IsPortConflictError(err) {
+			ResponseError(c, CodeContainerPortConflict)
+			return
+		}
+		if xerrors.IsRootfsSizeUsedGreaterThanReduced(err) {
+			ResponseError(c, CodeContainerRootfsSizeUsedGreaterThanReduce)
+			return
+		}
 		ResponseError(c, CodeContainerPatchFailed)
 		return
 	}
 
 	ResponseSuccess(c, gin.H{
 		"containerName": containerName,
+		"changes":       changes,
 	})
 }
 
@@ -318,21 +617,60 @@ func (rh *ReplicaSetHandler) Rollback(c *gin.Context) {
 		return
 	}
 
-	containerName, err := cs.RollbackContainer(name, &spec)
+	containerName, changes, err := cs.RollbackContainer(name, &spec)
 
 	if err != nil {
 		log.Errorf("services.RollbackContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsQuotaExceededError(err) {
+			ResponseError(c, CodeQuotaExceeded)
+			return
+		}
 		if xerrors.IsNoRollbackRequiredError(err) {
 			ResponseError(c, CodeContainerNoNeedRollback)
 			return
 		}
+		if xerrors.IsGpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerGpuNotEnough)
+			return
+		}
+		if e, ok := xerrors.AsGpuConflictError(err); ok {
+			ResponseErrorWithData(c, CodeContainerGpuConflict, gin.H{
+				"conflicts": e.Holders,
+			})
+			return
+		}
+		if xerrors.IsGpuNotFoundError(err) {
+			ResponseError(c, CodeContainerGpuNotFound)
+			return
+		}
+		if xerrors.IsCpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerCpuNotEnough)
+			return
+		}
+		if xerrors.IsMemoryNotEnoughError(err) {
+			ResponseError(c, CodeContainerMemoryNotEnough)
+			return
+		}
+		if xerrors.IsDiskNotEnoughError(err) {
+			ResponseError(c, CodeContainerDiskNotEnough)
+			return
+		}
+		if xerrors.IsPortNotEnoughError(err) {
+			ResponseError(c, CodeContainerPortNotEnough)
+			return
+		}
+		if xerrors.IsPortConflictError(err) {
+			ResponseError(c, CodeContainerPortConflict)
+			return
+		}
 		ResponseError(c, CodeContainerRollbackFailed)
 		return
 	}
 
 	ResponseSuccess(c, gin.H{
 		"containerName": containerName,
+		"changes":       changes,
 	})
 }
 
@@ -366,6 +704,12 @@ func (rh *ReplicaSetHandler) Continue(c *gin.Context) {
 		return
 	}
 
+	if err := lease.Leases.Check(name, time.Now()); err != nil {
+		log.Errorf("failed to startup container, err: %v", err)
+		ResponseError(c, CodeLeaseExpired)
+		return
+	}
+
 	if err := cs.StartupContainer(name); err != nil {
 		log.Errorf("services.StartupContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
@@ -396,6 +740,29 @@ func (rh *ReplicaSetHandler) Stop(c *gin.Context) {
 	ResponseSuccess(c, nil)
 }
 
+// IdleStop the replicaSet opts out when enabled is false, it can be set before the replicaSet is run
+func (rh *ReplicaSetHandler) IdleStop(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to set idle stop, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.IdleStopPatch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to set idle stop, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	monitor.GpuIdleMonitor.SetIdleStop(name, spec.Enabled)
+	log.Infof("replicaSet.IdleStop, replicaSet: %s idle stop enabled: %v", name, spec.Enabled)
+	ResponseSuccess(c, gin.H{
+		"enabled": spec.Enabled,
+	})
+}
+
 // Restart the latest version of the container.
 // It may fail because restart require apply for gpu
 func (rh *ReplicaSetHandler) Restart(c *gin.Context) {
@@ -406,16 +773,61 @@ func (rh *ReplicaSetHandler) Restart(c *gin.Context) {
 		return
 	}
 
-	_, containerName, err := cs.RestartContainer(name)
+	if err := lease.Leases.Check(name, time.Now()); err != nil {
+		log.Errorf("failed to restart container, err: %v", err)
+		ResponseError(c, CodeLeaseExpired)
+		return
+	}
+
+	_, containerName, changes, err := cs.RestartContainer(name)
 	if err != nil {
 		log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsQuotaExceededError(err) {
+			ResponseError(c, CodeQuotaExceeded)
+			return
+		}
+		if xerrors.IsGpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerGpuNotEnough)
+			return
+		}
+		if e, ok := xerrors.AsGpuConflictError(err); ok {
+			ResponseErrorWithData(c, CodeContainerGpuConflict, gin.H{
+				"conflicts": e.Holders,
+			})
+			return
+		}
+		if xerrors.IsGpuNotFoundError(err) {
+			ResponseError(c, CodeContainerGpuNotFound)
+			return
+		}
+		if xerrors.IsCpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerCpuNotEnough)
+			return
+		}
+		if xerrors.IsMemoryNotEnoughError(err) {
+			ResponseError(c, CodeContainerMemoryNotEnough)
+			return
+		}
+		if xerrors.IsDiskNotEnoughError(err) {
+			ResponseError(c, CodeContainerDiskNotEnough)
+			return
+		}
+		if xerrors.IsPortNotEnoughError(err) {
+			ResponseError(c, CodeContainerPortNotEnough)
+			return
+		}
+		if xerrors.IsPortConflictError(err) {
+			ResponseError(c, CodeContainerPortConflict)
+			return
+		}
 		ResponseError(c, CodeContainerRestartFailed)
 		return
 	}
 
 	ResponseSuccess(c, gin.H{
 		"containerName": containerName,
+		"changes":       changes,
 	})
 }
 
@@ -434,6 +846,31 @@ func (rh *ReplicaSetHandler) Delete(c *gin.Context) {
 		ResponseError(c, CodeContainerDeleteFailed)
 		return
 	}
+	// a deleted replicaSet has nothing to expire or schedule
+	_, _ = lease.Leases.Remove(name)
+	_, _ = schedule.Schedules.Remove(name)
 
 	ResponseSuccess(c, nil)
 }
+
+// validOnExpiry checks the action of the lease on expiry, empty means the default stop
+func validOnExpiry(action string) bool {
+	return action == "" || action == models.LeaseActionStop || action == models.LeaseActionDelete
+}
+
+// validSize checks that the size has a number and a supported unit, e.g. 40GB
+func validSize(size string) bool {
+	if len(size) <= 2 {
+		return false
+	}
+	_, ok := models.VolumeSizeMap[size[len(size)-2:]]
+	return ok
+}
+
+func validCpuPolicy(policy string) bool {
+	return policy == "" || policy == models.CpuPolicyNumaPrefer || policy == models.CpuPolicyNumaStrict
+}
+
+func validCpuMode(mode string) bool {
+	return mode == "" || mode == models.CpuModeExclusive || mode == models.CpuModeShared
+}
@@ -3,6 +3,7 @@ package routers
 import (
 	"github.com/gin-gonic/gin"
 
+	"github.com/mayooot/gpu-docker-api/internal/monitor"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
 )
 
@@ -10,22 +11,58 @@ type Resource struct{}
 
 func (gh *Resource) RegisterRoute(g *gin.RouterGroup) {
 	g.GET("/resources/gpus", gh.GetGpus)
+	g.GET("/resources/gpus/health", gh.GetGpuHealth)
+	g.GET("/resources/gpus/idle", gh.GetGpuIdle)
 	g.GET("/resources/cpus", gh.GetCpus)
+	g.GET("/resources/memory", gh.GetMemory)
+	g.GET("/resources/disk", gh.GetDisk)
 	g.GET("resources/ports", gh.GetPorts)
 }
 
-// GetGpus 0 means not used, 1 means used.
+// GetGpus returns the inventory of gpus, status 0 means not used, 1 means used, 2 means unhealthy.
 func (gh *Resource) GetGpus(c *gin.Context) {
-	gpus := schedulers.GpuScheduler.GetGpuStatus()
+	gpus := schedulers.GpuScheduler.GetGpuInventory()
 	ResponseSuccess(c, gin.H{
 		"gpus": gpus,
 	})
 }
 
+// GetGpuHealth returns the unhealthy gpus and the latest health events
+func (gh *Resource) GetGpuHealth(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"unhealthyGpus": schedulers.GpuScheduler.GetUnhealthyGpus(),
+		"events":        monitor.GpuHealthChecker.GetEvents(),
+	})
+}
+
+// GetGpuIdle returns the replicaSets whose gpus are idle now and the replicaSets that are never stopped when idle
+func (gh *Resource) GetGpuIdle(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"idle":   monitor.GpuIdleMonitor.GetIdleStates(),
+		"exempt": monitor.GpuIdleMonitor.GetExempt(),
+	})
+}
+
+// GetCpus returns the exclusive cpus, status 0 means not used, 1 means used, and the shared pool.
 func (gh *Resource) GetCpus(c *gin.Context) {
 	cpus := schedulers.CpuScheduler.GetCpuStatus()
 	ResponseSuccess(c, gin.H{
-		"cpus": cpus,
+		"cpus":   cpus,
+		"shared": schedulers.CpuScheduler.GetSharedCpuStatus(),
+	})
+}
+
+// GetMemory returns the memory that can be handed out and the allocation of each replicaSet, in bytes.
+func (gh *Resource) GetMemory(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"memory": schedulers.MemoryScheduler.GetMemoryStatus(),
+	})
+}
+
+// GetDisk returns the rootfs size that can be promised and the promise of each replicaSet, in bytes.
+func (gh *Resource) GetDisk(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"disk": schedulers.DiskScheduler.GetDiskStatus(),
 	})
 }
 
@@ -20,6 +20,15 @@ func ResponseError(c *gin.Context, code ResCode) {
 	})
 }
 
+// ResponseErrorWithData is used when the caller needs more details than the code, e.g. gpu conflicts
+func ResponseErrorWithData(c *gin.Context, code ResCode, data interface{}) {
+	c.JSON(http.StatusOK, &ResponseData{
+		Code: code,
+		Msg:  code.Msg(),
+		Data: data,
+	})
+}
+
 func ResponseSuccess(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusOK, &ResponseData{
 		Code: CodeSuccess,
@@ -0,0 +1,125 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedule"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+type ScheduleHandler struct{}
+
+func (sh *ScheduleHandler) RegisterRoute(g *gin.RouterGroup) {
+	// stop, continue or restart the replicaSet by cron expressions, e.g. stop at 0 19 * * mon-fri
+	g.GET("/schedules", sh.List)
+	g.GET("/schedules/:name", sh.Get)
+	// create or replace the schedule of the replicaSet
+	g.PUT("/schedules/:name", sh.Set)
+	g.DELETE("/schedules/:name", sh.Delete)
+}
+
+func (sh *ScheduleHandler) List(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"schedules": schedule.Schedules.List(),
+	})
+}
+
+func (sh *ScheduleHandler) Get(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get schedule, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	s, err := schedule.Schedules.Get(name)
+	if err != nil {
+		log.Errorf("schedule.Get failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeScheduleNotFound)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"schedule": s,
+	})
+}
+
+func (sh *ScheduleHandler) Set(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to set schedule, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.Schedule
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to set schedule, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	spec.ReplicaSet = name
+
+	if !cs.ReplicaSetExist(name) {
+		log.Errorf("failed to set schedule, replicaSet: %s not found", name)
+		ResponseError(c, CodeScheduleReplicaSetNotFound)
+		return
+	}
+
+	if len(spec.Rules) == 0 {
+		log.Error("failed to set schedule, rules are empty")
+		ResponseError(c, CodeScheduleRulesCannotBeEmpty)
+		return
+	}
+
+	for _, rule := range spec.Rules {
+		if !validScheduleAction(rule.Action) {
+			log.Errorf("failed to set schedule, action: %s is not supported", rule.Action)
+			ResponseError(c, CodeScheduleActionNotSupported)
+			return
+		}
+		if _, err := utils.ParseCron(rule.Cron); err != nil {
+			log.Errorf("failed to set schedule, err: %v", err)
+			ResponseError(c, CodeScheduleCronInvalid)
+			return
+		}
+	}
+
+	if spec.MissedRuns != "" && spec.MissedRuns != models.MissedRunsLatest && spec.MissedRuns != models.MissedRunsSkip {
+		log.Errorf("failed to set schedule, missed runs: %s is not supported", spec.MissedRuns)
+		ResponseError(c, CodeScheduleMissedRunsNotSupported)
+		return
+	}
+
+	s := schedule.Schedules.Set(spec)
+	log.Infof("schedule.Set, replicaSet: %s schedule of %d rules is set", name, len(s.Rules))
+	ResponseSuccess(c, gin.H{
+		"schedule": s,
+	})
+}
+
+func (sh *ScheduleHandler) Delete(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete schedule, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	if _, err := schedule.Schedules.Remove(name); err != nil {
+		log.Errorf("schedule.Remove failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeScheduleNotFound)
+		return
+	}
+
+	log.Infof("schedule.Delete, replicaSet: %s schedule is deleted", name)
+	ResponseSuccess(c, nil)
+}
+
+func validScheduleAction(action string) bool {
+	return action == models.ScheduleActionStop || action == models.ScheduleActionContinue ||
+		action == models.ScheduleActionRestart
+}
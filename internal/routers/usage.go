@@ -0,0 +1,97 @@
+package routers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/usage"
+)
+
+type UsageHandler struct{}
+
+func (uh *UsageHandler) RegisterRoute(g *gin.RouterGroup) {
+	// gpu-hours, cpu-hours and memory GB-hours in a time range,
+	// e.g. ?from=2024-01-01 00:00:00&to=2024-02-01 00:00:00&groupBy=owner&format=csv
+	g.GET("/usage", uh.Report)
+}
+
+// Report the range defaults to the current month until now, grouped by owner as json
+func (uh *UsageHandler) Report(c *gin.Context) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	if value := c.Query("from"); value != "" {
+		t, err := usage.ParseTime(value)
+		if err != nil {
+			log.Errorf("failed to get usage, from: %s is invalid, err: %v", value, err)
+			ResponseError(c, CodeUsageTimeInvalid)
+			return
+		}
+		from = t
+	}
+	to := now
+	if value := c.Query("to"); value != "" {
+		t, err := usage.ParseTime(value)
+		if err != nil {
+			log.Errorf("failed to get usage, to: %s is invalid, err: %v", value, err)
+			ResponseError(c, CodeUsageTimeInvalid)
+			return
+		}
+		to = t
+	}
+	if !to.After(from) {
+		log.Errorf("failed to get usage, to: %s must be after from: %s", to, from)
+		ResponseError(c, CodeUsageTimeInvalid)
+		return
+	}
+
+	groupBy := c.DefaultQuery("groupBy", models.UsageGroupByOwner)
+	if groupBy != models.UsageGroupByOwner && groupBy != models.UsageGroupByReplicaSet {
+		log.Errorf("failed to get usage, group by: %s is not supported", groupBy)
+		ResponseError(c, CodeUsageGroupByNotSupported)
+		return
+	}
+
+	reports, err := usage.Ledger.Report(from, to, groupBy)
+	if err != nil {
+		log.Errorf("usage.Report failed, original error: %T %v", errors.Cause(err), err)
+		ResponseError(c, CodeUsageReportFailed)
+		return
+	}
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		ResponseSuccess(c, gin.H{
+			"from":    from.Format("2006-01-02 15:04:05"),
+			"to":      to.Format("2006-01-02 15:04:05"),
+			"groupBy": groupBy,
+			"usage":   reports,
+		})
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		_ = w.Write([]string{groupBy, "gpuHours", "cpuHours", "memoryGBHours"})
+		for _, r := range reports {
+			_ = w.Write([]string{
+				r.Key,
+				strconv.FormatFloat(r.GpuHours, 'f', 4, 64),
+				strconv.FormatFloat(r.CpuHours, 'f', 4, 64),
+				strconv.FormatFloat(r.MemoryGBHours, 'f', 4, 64),
+			})
+		}
+		w.Flush()
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s-%s.csv",
+			from.Format("20060102150405"), to.Format("20060102150405")))
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+	default:
+		log.Errorf("failed to get usage, format: %s is not supported", format)
+		ResponseError(c, CodeUsageFormatNotSupported)
+	}
+}
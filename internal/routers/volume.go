@@ -50,6 +50,14 @@ func (vh *VolumeHandler) Create(c *gin.Context) {
 	if err != nil {
 		log.Errorf("services.CreateVolume failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsQuotaNoOwnerError(err) {
+			ResponseError(c, CodeQuotaOwnerRequired)
+			return
+		}
+		if xerrors.IsQuotaExceededError(err) {
+			ResponseError(c, CodeQuotaExceeded)
+			return
+		}
 		if xerrors.IsVolumeExistedError(err) {
 			ResponseError(c, CodeVolumeExisted)
 			return
@@ -93,6 +101,10 @@ func (vh *VolumeHandler) Patch(c *gin.Context) {
 	if err != nil {
 		log.Errorf("services.PatchVolumeSize failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsQuotaExceededError(err) {
+			ResponseError(c, CodeQuotaExceeded)
+			return
+		}
 		if xerrors.IsNoPatchRequiredError(err) {
 			ResponseError(c, CodeVolumeSizeNoNeedPatch)
 			return
@@ -0,0 +1,166 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/lease"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+var (
+	Runner *runner
+
+	cs services.ReplicaSetService
+)
+
+// runner checks the schedules every interval and runs the latest action that is due on each replicaSet,
+// the runs missed while the server was down are found at the first check after it starts.
+type runner struct {
+	sync.Mutex
+
+	interval time.Duration
+}
+
+func InitRunner(interval time.Duration) {
+	Runner = &runner{
+		interval: interval,
+	}
+}
+
+func (r *runner) Loop(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.Run()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run runs the actions that are due since the last check
+func (r *runner) Run() {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for _, s := range Schedules.List() {
+		since, err := time.ParseInLocation(timeLayout, s.CheckTime, time.Local)
+		if err != nil {
+			since = now
+		}
+		action, at := due(s, since, now)
+		Schedules.update(s.ReplicaSet, func(s *models.Schedule) { s.CheckTime = now.Format(timeLayout) })
+		if action == "" {
+			continue
+		}
+
+		// a run is missed if it was not found by the check right after it, one more minute for the cron granularity
+		if now.Sub(at) > r.interval+time.Minute && s.MissedRuns == models.MissedRunsSkip {
+			log.Infof("schedule.Runner, replicaSet: %s skips the %s missed at %s", s.ReplicaSet, action, at.Format(timeLayout))
+			Schedules.update(s.ReplicaSet, func(s *models.Schedule) {
+				s.Message = fmt.Sprintf("%s at %s was missed and skipped", action, at.Format(timeLayout))
+			})
+			continue
+		}
+
+		message, err := r.run(s.ReplicaSet, action)
+		if err != nil {
+			log.Errorf("schedule.Runner, replicaSet: %s failed to %s, original error: %T %v",
+				s.ReplicaSet, action, errors.Cause(err), err)
+			message = err.Error()
+		} else {
+			log.Infof("schedule.Runner, replicaSet: %s %s scheduled at %s, %s", s.ReplicaSet, action, at.Format(timeLayout), message)
+		}
+		Schedules.update(s.ReplicaSet, func(s *models.Schedule) {
+			s.LastAction = action
+			s.LastRun = now.Format(timeLayout)
+			s.Message = message
+		})
+	}
+}
+
+// run does the action on the replicaSet through the services,
+// nothing is done if the replicaSet is already in the state the action leads to.
+func (r *runner) run(name, action string) (string, error) {
+	if !cs.ReplicaSetExist(name) {
+		return "", errors.Errorf("replicaSet: %s not found", name)
+	}
+	running, err := cs.ReplicaSetRunning(name)
+	if err != nil {
+		return "", errors.WithMessage(err, "services.ReplicaSetRunning failed")
+	}
+
+	switch action {
+	case models.ScheduleActionStop:
+		if !running {
+			return "already stopped", nil
+		}
+		if err = cs.StopContainer(name, true, true, true, true); err != nil {
+			return "", errors.WithMessage(err, "services.StopContainer failed")
+		}
+		return "stopped", nil
+	case models.ScheduleActionContinue:
+		if running {
+			return "already running", nil
+		}
+		// the replicaSet stopped by its expired lease is not started again by the schedule
+		if err = lease.Leases.Check(name, time.Now()); err != nil {
+			return "", errors.WithMessage(err, "lease.Check failed")
+		}
+		// the resources given back by the stop are applied again, like restart
+		if cs.ReplicaSetReleased(name) {
+			_, containerName, _, err := cs.RestartContainer(name)
+			if err != nil {
+				return "", errors.WithMessage(err, "services.RestartContainer failed")
+			}
+			return fmt.Sprintf("continued as %s with resources applied again", containerName), nil
+		}
+		if err = cs.StartupContainer(name); err != nil {
+			return "", errors.WithMessage(err, "services.StartupContainer failed")
+		}
+		return "continued", nil
+	case models.ScheduleActionRestart:
+		// the running container is not recreated, the user may be working in it
+		if running {
+			return "already running", nil
+		}
+		if err = lease.Leases.Check(name, time.Now()); err != nil {
+			return "", errors.WithMessage(err, "lease.Check failed")
+		}
+		_, containerName, _, err := cs.RestartContainer(name)
+		if err != nil {
+			return "", errors.WithMessage(err, "services.RestartContainer failed")
+		}
+		return fmt.Sprintf("restarted as %s", containerName), nil
+	}
+	return "", errors.Errorf("action: %s is not supported", action)
+}
+
+// due returns the rule action that ran last in (since, now] and when it ran, empty if none is due
+func due(s *models.Schedule, since, now time.Time) (action string, at time.Time) {
+	for _, rule := range s.Rules {
+		c, err := utils.ParseCron(rule.Cron)
+		if err != nil {
+			continue
+		}
+		var last time.Time
+		for t := c.Next(since); !t.IsZero() && !t.After(now); t = c.Next(t) {
+			last = t
+		}
+		if !last.IsZero() && last.After(at) {
+			action, at = rule.Action, last
+		}
+	}
+	return
+}
@@ -0,0 +1,170 @@
+package schedule
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	// the single key that older versions stored all schedules in
+	scheduleMapKey = "scheduleMapKey"
+	// one etcd key per schedule, e.g. /gpu-docker-api/apis/v1/schedules/schedules/<replicaSet>
+	scheduleDir = "schedules"
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+var Schedules *scheduleMap
+
+// scheduleMap holds the schedules keyed by the replicaSet name
+type scheduleMap struct {
+	sync.RWMutex
+
+	Items map[string]*models.Schedule `json:"items"`
+	store *etcd.Store
+}
+
+func InitSchedules() error {
+	var err error
+	Schedules, err = initScheduleMapFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	return nil
+}
+
+func CloseSchedules() error {
+	return etcd.Stores{Schedules.store}.Sync()
+}
+
+// initScheduleMapFormEtcd reads the keys under the directory, or the blob key of older versions if there is no key yet
+func initScheduleMapFormEtcd() (*scheduleMap, error) {
+	sm := &scheduleMap{
+		Items: make(map[string]*models.Schedule),
+	}
+	sm.store = etcd.NewStore(etcd.Schedules, scheduleDir, sm.items)
+
+	err := etcd.LoadJSON(sm.store, scheduleMapKey, sm.Items, func(blob []byte) error {
+		return json.Unmarshal(blob, sm)
+	})
+	return sm, err
+}
+
+// Set replaces the rules of the replicaSet, the rules only run after now
+func (sm *scheduleMap) Set(s models.Schedule) *models.Schedule {
+	sm.Lock()
+	defer sm.Unlock()
+
+	now := time.Now().Format(timeLayout)
+	if old, ok := sm.Items[s.ReplicaSet]; ok {
+		s.LastAction = old.LastAction
+		s.LastRun = old.LastRun
+		s.Message = old.Message
+		s.CreateTime = old.CreateTime
+	} else {
+		s.LastAction, s.LastRun, s.Message = "", "", ""
+		s.CreateTime = now
+	}
+	if s.MissedRuns == "" {
+		s.MissedRuns = models.MissedRunsLatest
+	}
+	s.CheckTime = now
+	for i := range s.Rules {
+		s.Rules[i].NextRun = ""
+	}
+	sm.Items[s.ReplicaSet] = &s
+
+	go sm.putToEtcd()
+
+	return withNextRuns(&s)
+}
+
+func (sm *scheduleMap) Get(name string) (*models.Schedule, error) {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	s, ok := sm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewScheduleNotFoundError(), "replicaSet: %s", name)
+	}
+	return withNextRuns(s), nil
+}
+
+// List returns all schedules ordered by the replicaSet name
+func (sm *scheduleMap) List() []*models.Schedule {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	schedules := make([]*models.Schedule, 0, len(sm.Items))
+	for _, s := range sm.Items {
+		schedules = append(schedules, withNextRuns(s))
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].ReplicaSet < schedules[j].ReplicaSet
+	})
+	return schedules
+}
+
+func (sm *scheduleMap) Remove(name string) (*models.Schedule, error) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	s, ok := sm.Items[name]
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewScheduleNotFoundError(), "replicaSet: %s", name)
+	}
+	delete(sm.Items, name)
+
+	go sm.putToEtcd()
+
+	return s, nil
+}
+
+// update changes the schedule in place, nothing happens if it has been removed
+func (sm *scheduleMap) update(name string, fn func(s *models.Schedule)) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if s, ok := sm.Items[name]; ok {
+		fn(s)
+		go sm.putToEtcd()
+	}
+}
+
+// items one key per schedule, replicaSet -> schedule
+func (sm *scheduleMap) items() map[string]string {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	return etcd.JSONItems(sm.Items)
+}
+
+func (sm *scheduleMap) putToEtcd() {
+	workQueue.Add(etcd.Stores{sm.store})
+}
+
+// withNextRuns returns a copy of the schedule with the next run of each rule
+func withNextRuns(s *models.Schedule) *models.Schedule {
+	tmp := *s
+	tmp.Rules = make([]models.ScheduleRule, len(s.Rules))
+	now := time.Now()
+	for i, rule := range s.Rules {
+		tmp.Rules[i] = rule
+		if c, err := utils.ParseCron(rule.Cron); err == nil {
+			if next := c.Next(now); !next.IsZero() {
+				tmp.Rules[i].NextRun = next.Format(timeLayout)
+			}
+		}
+	}
+	return &tmp
+}
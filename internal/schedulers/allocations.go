@@ -0,0 +1,152 @@
+package schedulers
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+)
+
+// allocationScheduler hands out bytes to replicaSets, a replicaSet holds at most one allocation no matter how many versions it has.
+// The memory and disk schedulers are built on it, they only differ in how a request is checked.
+type allocationScheduler struct {
+	sync.RWMutex
+
+	// replicaSet name -> bytes
+	Allocations map[string]int64 `json:"allocations"`
+
+	// check rejects a replicaSet that grows from current to bytes while the others use used bytes, it is called under the lock
+	check func(used, current, bytes int64) error
+
+	store *etcd.Store
+}
+
+func newAllocationScheduler(check func(used, current, bytes int64) error) allocationScheduler {
+	return allocationScheduler{
+		Allocations: make(map[string]int64),
+		check:       check,
+	}
+}
+
+// load reads the allocations under the directory of the resource,
+// blob is the single key that older versions stored the whole state in, it is returned if it still exists
+func (as *allocationScheduler) load(resource etcd.Resource, blobKey string) (blob []byte, err error) {
+	as.store = etcd.NewStore(resource, stateDir, as.items)
+
+	items, blob, err := as.store.LoadOrBlob(blobKey)
+	if err != nil {
+		return blob, err
+	}
+	if len(blob) != 0 {
+		err = json.Unmarshal(blob, as)
+	}
+	if err != nil || len(items) == 0 {
+		return blob, err
+	}
+	as.Allocations, err = parseAllocations(items)
+	return blob, err
+}
+
+// Apply sets the allocation of the replicaSet to the bytes,
+// the bytes it already holds are counted as free, so patch and restart don't need to restore first.
+func (as *allocationScheduler) Apply(name string, bytes int64) error {
+	if err := as.apply(name, bytes, nil); err != nil {
+		return err
+	}
+
+	go as.putToEtcd()
+
+	return nil
+}
+
+// apply is Apply without persistence, it is used by the reservation.
+// The allocations of the held replicaSets are restored by the reservation, they are kept but free for the request.
+func (as *allocationScheduler) apply(name string, bytes int64, held map[string]struct{}) error {
+	if bytes <= 0 {
+		return errors.New("bytes must be greater than 0")
+	}
+
+	as.Lock()
+	defer as.Unlock()
+
+	current := as.Allocations[name]
+	used := as.used() - current
+	for other := range held {
+		if other != name {
+			used -= as.Allocations[other]
+		}
+	}
+	if err := as.check(used, current, bytes); err != nil {
+		return err
+	}
+	as.Allocations[name] = bytes
+
+	return nil
+}
+
+// Restore releases the allocation of the replicaSet
+func (as *allocationScheduler) Restore(name string) {
+	if _, ok := as.release(name); !ok {
+		return
+	}
+
+	go as.putToEtcd()
+	signalReleased()
+}
+
+// release is Restore without persistence, it returns the bytes the replicaSet held
+func (as *allocationScheduler) release(name string) (int64, bool) {
+	as.Lock()
+	defer as.Unlock()
+
+	bytes, ok := as.Allocations[name]
+	delete(as.Allocations, name)
+	return bytes, ok
+}
+
+// allocation returns the bytes the replicaSet holds
+func (as *allocationScheduler) allocation(name string) (int64, bool) {
+	as.RLock()
+	defer as.RUnlock()
+
+	bytes, ok := as.Allocations[name]
+	return bytes, ok
+}
+
+// set puts the allocation of the replicaSet back without any check, it undoes an apply or a release
+func (as *allocationScheduler) set(name string, bytes int64, ok bool) {
+	as.Lock()
+	defer as.Unlock()
+
+	if ok {
+		as.Allocations[name] = bytes
+	} else {
+		delete(as.Allocations, name)
+	}
+}
+
+func (as *allocationScheduler) used() int64 {
+	var used int64
+	for _, bytes := range as.Allocations {
+		used += bytes
+	}
+	return used
+}
+
+// items one key per replicaSet, name -> bytes
+func (as *allocationScheduler) items() map[string]string {
+	as.RLock()
+	defer as.RUnlock()
+
+	return allocationItems(as.Allocations)
+}
+
+func (as *allocationScheduler) etcdStore() *etcd.Store {
+	return as.store
+}
+
+func (as *allocationScheduler) putToEtcd() {
+	persist(as)
+}
@@ -0,0 +1,30 @@
+package schedulers
+
+import (
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestApplyCountsTheHeldBytesAsFree(t *testing.T) {
+	ms := newMemoryScheduler()
+	ms.AvailableMemory = 32 << 30
+	ms.Allocations = map[string]int64{"foo": 16 << 30, "bar": 8 << 30}
+
+	// foo grows from 16GB to 24GB, its own 16GB are free for it
+	if err := ms.apply("foo", 24<<30, nil); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := ms.apply("baz", 1<<30, nil); !xerrors.IsMemoryNotEnoughError(err) {
+		t.Fatalf("err = %v, want memory not enough", err)
+	}
+
+	prev, ok := ms.release("foo")
+	if !ok || prev != 24<<30 || ms.used() != 8<<30 {
+		t.Fatalf("released = %d, used = %d, want 24GB released", prev, ms.used())
+	}
+	ms.set("foo", prev, ok)
+	if ms.Allocations["foo"] != 24<<30 {
+		t.Fatalf("allocations = %v, want foo put back", ms.Allocations)
+	}
+}
@@ -0,0 +1,526 @@
+package schedulers
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// ResourceRequest describes the resources a container applies for, the zero values are not applied
+type ResourceRequest struct {
+	// Name is the replicaSet name, memory and disk are held by it
+	Name string
+	Gpu  *GpuRequest
+	// Cpu applies for exclusive cpus, they are aligned with the numa nodes of the gpus if NumaNodes is empty
+	Cpu *CpuRequest
+	// SharedCpus applies for the number of cpus from the shared pool
+	SharedCpus int
+	Memory     int64
+	Disk       int64
+}
+
+// Reservation holds the resources applied and restored by an operation until it is committed or released.
+// Nothing is persisted before Commit, which puts the states of the touched schedulers in a single etcd transaction,
+// and Release undoes every change, so a failed operation never leaves resources marked used.
+type Reservation struct {
+	sync.Mutex
+
+	// the resources applied by Reserve
+	Gpus []string
+	Cpus string
+
+	undo    []func()
+	touched map[Scheduler]struct{}
+	// the resources restored and not applied for again, they stay used until Commit,
+	// so no other reservation takes what this one may still give back
+	held held
+	// whether resources held by containers are given back
+	restored bool
+	// the restored resources are released by KeepRestored, Release no longer gives them back
+	kept bool
+	done bool
+	// the reservation is changed by Preempt, which already holds applyMu
+	preempting bool
+	// the reservation holds openMu until it is done
+	opened bool
+}
+
+// held is changed under applyMu, the undos of the reservation change it too
+type held struct {
+	gpus map[string]struct{}
+	cpus map[string]struct{}
+	// the number of cpus of the shared pool
+	shared int
+	// replicaSet names
+	memory map[string]struct{}
+	disk   map[string]struct{}
+	// the keys returned by PortKey
+	ports map[string]struct{}
+}
+
+var (
+	// applyMu serializes the changes of the reservations with Preempt,
+	// which tries the holdings on the schedulers and must not see the changes of others in between
+	applyMu sync.Mutex
+	// openMu is read-locked by every reservation until it is committed or released,
+	// LockReservations write-locks it, so the schedulers are never rebuilt under a reservation in progress
+	openMu sync.RWMutex
+)
+
+// reservationWait is how often LockReservations checks whether the open reservations are done
+const reservationWait = 100 * time.Millisecond
+
+func NewReservation() *Reservation {
+	openMu.RLock()
+	r := newReservation()
+	r.opened = true
+	return r
+}
+
+// newReservation is NewReservation that doesn't count as open, it is only undone and never committed or released
+func newReservation() *Reservation {
+	return &Reservation{
+		touched: make(map[Scheduler]struct{}),
+		held: held{
+			gpus:   make(map[string]struct{}),
+			cpus:   make(map[string]struct{}),
+			memory: make(map[string]struct{}),
+			disk:   make(map[string]struct{}),
+			ports:  make(map[string]struct{}),
+		},
+	}
+}
+
+// LockReservations waits until no reservation is open and keeps new ones from opening until unlock is called.
+// It gives up after the timeout, the reservations may be held across docker operations that take long.
+func LockReservations(timeout time.Duration) (unlock func(), err error) {
+	deadline := time.Now().Add(timeout)
+	// TryLock never blocks new readers, so an operation that opens a reservation in another one can't deadlock
+	for !openMu.TryLock() {
+		if time.Now().After(deadline) {
+			return nil, errors.Wrapf(xerrors.NewReservationsInProgressError(), "waited %s", timeout)
+		}
+		time.Sleep(reservationWait)
+	}
+	return openMu.Unlock, nil
+}
+
+// Reserve applies for all resources of the request, nothing is held if any of them fails
+func Reserve(req *ResourceRequest) (*Reservation, error) {
+	r := NewReservation()
+	if err := r.Reserve(req); err != nil {
+		r.Release()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reserve applies for all resources of the request in the reservation,
+// the ones applied before an error are held until the reservation is released
+func (r *Reservation) Reserve(req *ResourceRequest) error {
+	if req.Gpu != nil {
+		gpus, err := r.ApplyGpus(req.Gpu)
+		if err != nil {
+			return errors.WithMessage(err, "GpuScheduler.Apply failed")
+		}
+		r.Gpus = gpus
+	}
+
+	if req.Cpu != nil {
+		if len(req.Cpu.NumaNodes) == 0 {
+			req.Cpu.NumaNodes = GpuScheduler.GetNumaNodes(r.Gpus)
+		}
+		cpus, err := r.ApplyCpus(req.Cpu)
+		if err != nil {
+			return errors.WithMessage(err, "CpuScheduler.Apply failed")
+		}
+		r.Cpus = cpus
+	} else if req.SharedCpus > 0 {
+		cpus, err := r.ApplySharedCpus(req.SharedCpus)
+		if err != nil {
+			return errors.WithMessage(err, "CpuScheduler.ApplyShared failed")
+		}
+		r.Cpus = cpus
+	}
+
+	if req.Memory > 0 {
+		if err := r.ApplyMemory(req.Name, req.Memory); err != nil {
+			return errors.WithMessage(err, "MemoryScheduler.Apply failed")
+		}
+	}
+
+	if req.Disk > 0 {
+		if err := r.ApplyDisk(req.Name, req.Disk); err != nil {
+			return errors.WithMessage(err, "DiskScheduler.Apply failed")
+		}
+	}
+
+	return nil
+}
+
+// Fits reports whether the request fits the capacity of the host when nothing is used,
+// a request that doesn't fit can never be reserved however long it waits.
+func Fits(req *ResourceRequest) error {
+	if req.Gpu != nil {
+		if err := GpuScheduler.fits(req.Gpu); err != nil {
+			return errors.WithMessage(err, "GpuScheduler.fits failed")
+		}
+	}
+	if req.Cpu != nil || req.SharedCpus > 0 {
+		if err := CpuScheduler.fits(req.Cpu, req.SharedCpus); err != nil {
+			return errors.WithMessage(err, "CpuScheduler.fits failed")
+		}
+	}
+	if req.Memory > 0 {
+		if err := MemoryScheduler.fits(req.Memory); err != nil {
+			return errors.WithMessage(err, "MemoryScheduler.fits failed")
+		}
+	}
+	if req.Disk > 0 {
+		if err := DiskScheduler.fits(req.Disk); err != nil {
+			return errors.WithMessage(err, "DiskScheduler.fits failed")
+		}
+	}
+	return nil
+}
+
+// Clone copies the request, so that the numa nodes filled by a failed reservation are not kept
+func (req *ResourceRequest) Clone() *ResourceRequest {
+	clone := *req
+	if req.Cpu != nil {
+		cpu := *req.Cpu
+		clone.Cpu = &cpu
+	}
+	return &clone
+}
+
+// ApplyGpus the gpus restored by the reservation are applied for first, they are held again if the reservation is released
+func (r *Reservation) ApplyGpus(req *GpuRequest) ([]string, error) {
+	defer r.lock()()
+
+	gpus, err := GpuScheduler.apply(req, r.held.gpus)
+	if err != nil {
+		return nil, err
+	}
+	fresh, reused := r.reuse(r.held.gpus, gpus)
+	r.record(GpuScheduler, func() {
+		GpuScheduler.release(fresh)
+		r.rehold(r.held.gpus, reused, GpuScheduler.release)
+	})
+	return gpus, nil
+}
+
+// RestoreGpus gives back the gpus held by the old container, they stay used until the reservation is committed
+func (r *Reservation) RestoreGpus(gpus []string) {
+	defer r.lock()()
+
+	if len(gpus) == 0 {
+		return
+	}
+	r.hold(GpuScheduler, r.held.gpus, gpus)
+}
+
+func (r *Reservation) ApplyCpus(req *CpuRequest) (string, error) {
+	defer r.lock()()
+
+	cpuSet, err := CpuScheduler.apply(req, r.held.cpus)
+	if err != nil {
+		return "", err
+	}
+	fresh, reused := r.reuse(r.held.cpus, splitCpuSet(cpuSet))
+	release := func(cpuSet []string) { _ = CpuScheduler.release(cpuSet) }
+	r.record(CpuScheduler, func() {
+		release(fresh)
+		r.rehold(r.held.cpus, reused, release)
+	})
+	return cpuSet, nil
+}
+
+func (r *Reservation) ApplySharedCpus(num int) (string, error) {
+	defer r.lock()()
+
+	cpuSet, reused, err := CpuScheduler.applyShared(num, r.held.shared)
+	if err != nil {
+		return "", err
+	}
+	r.held.shared -= reused
+	r.record(CpuScheduler, func() {
+		CpuScheduler.releaseShared(num - reused)
+		if r.kept {
+			CpuScheduler.releaseShared(reused)
+		} else {
+			r.held.shared += reused
+		}
+	})
+	return cpuSet, nil
+}
+
+func (r *Reservation) RestoreCpus(cpuSet []string) {
+	defer r.lock()()
+
+	if len(cpuSet) == 0 {
+		return
+	}
+	r.hold(CpuScheduler, r.held.cpus, cpuSet)
+}
+
+func (r *Reservation) RestoreSharedCpus(num int) {
+	defer r.lock()()
+
+	// never more than the pool uses, as releaseShared does
+	r.held.shared = min(r.held.shared+num, CpuScheduler.sharedUsed())
+	r.recordRestore(CpuScheduler)
+}
+
+// ApplyMemory replaces the memory held by the replicaSet, the previous one is put back if the reservation is released
+func (r *Reservation) ApplyMemory(name string, bytes int64) error {
+	defer r.lock()()
+
+	return r.applyAllocation(&MemoryScheduler.allocationScheduler, MemoryScheduler, r.held.memory, name, bytes)
+}
+
+func (r *Reservation) RestoreMemory(name string) {
+	defer r.lock()()
+
+	r.hold(MemoryScheduler, r.held.memory, []string{name})
+}
+
+// ApplyDisk replaces the rootfs held by the replicaSet, the previous one is put back if the reservation is released
+func (r *Reservation) ApplyDisk(name string, bytes int64) error {
+	defer r.lock()()
+
+	return r.applyAllocation(&DiskScheduler.allocationScheduler, DiskScheduler, r.held.disk, name, bytes)
+}
+
+func (r *Reservation) RestoreDisk(name string) {
+	defer r.lock()()
+
+	r.hold(DiskScheduler, r.held.disk, []string{name})
+}
+
+// applyAllocation the allocations of the held replicaSets are free for the request,
+// a held replicaSet that applies again keeps its allocation on Commit
+func (r *Reservation) applyAllocation(as *allocationScheduler, s Scheduler, held map[string]struct{}, name string, bytes int64) error {
+	prev, ok := as.allocation(name)
+	if err := as.apply(name, bytes, held); err != nil {
+		return err
+	}
+	_, reused := r.reuse(held, []string{name})
+	r.record(s, func() {
+		as.set(name, prev, ok)
+		r.rehold(held, reused, func(names []string) {
+			for _, name := range names {
+				as.release(name)
+			}
+		})
+	})
+	return nil
+}
+
+func (r *Reservation) ApplyPorts(reqs []PortRequest) ([]string, error) {
+	defer r.lock()()
+
+	ports, err := PortScheduler.apply(reqs, r.held.ports)
+	if err != nil {
+		return nil, err
+	}
+	fresh, reused := r.reuse(r.held.ports, PortKeys(reqs, ports))
+	r.record(PortScheduler, func() {
+		PortScheduler.release(fresh)
+		r.rehold(r.held.ports, reused, PortScheduler.release)
+	})
+	return ports, nil
+}
+
+// RestorePorts the ports are the keys returned by PortKey
+func (r *Reservation) RestorePorts(ports []string) {
+	defer r.lock()()
+
+	if len(ports) == 0 {
+		return
+	}
+	r.hold(PortScheduler, r.held.ports, ports)
+}
+
+// Commit keeps all changes, releases the restored resources that are not applied for again
+// and persists the touched schedulers in a single etcd transaction
+func (r *Reservation) Commit() {
+	defer r.lock()()
+	r.Lock()
+	defer r.Unlock()
+
+	if r.done {
+		return
+	}
+	r.releaseHeld()
+	r.finish()
+	r.persist()
+	if r.restored {
+		signalReleased()
+	}
+}
+
+// Release undoes all changes in reverse order, the restored resources are still held by their containers.
+// It does nothing after Commit, so it can be deferred right after the reservation is created.
+func (r *Reservation) Release() {
+	defer r.lock()()
+	r.Lock()
+	defer r.Unlock()
+
+	if r.done {
+		return
+	}
+	r.finish()
+	r.undoAll()
+	if r.kept {
+		r.releaseHeld()
+	}
+	// other operations may have persisted the changes in the meantime
+	r.persist()
+	if len(r.undo) != 0 || r.kept {
+		signalReleased()
+	}
+}
+
+// KeepRestored releases the holdings restored by Preempt, they are not given back if the reservation is released later,
+// it is called once the containers of the holdings are stopped.
+func (r *Reservation) KeepRestored() {
+	defer r.lock()()
+	r.Lock()
+	defer r.Unlock()
+
+	if r.done || r.kept {
+		return
+	}
+	r.kept = true
+	r.releaseHeld()
+	signalReleased()
+}
+
+// releaseHeld releases the held resources in the schedulers, only the restored ones are touched
+func (r *Reservation) releaseHeld() {
+	h := &r.held
+	if len(h.gpus) != 0 {
+		GpuScheduler.release(drain(h.gpus))
+	}
+	if len(h.cpus) != 0 {
+		_ = CpuScheduler.release(drain(h.cpus))
+	}
+	if h.shared > 0 {
+		CpuScheduler.releaseShared(h.shared)
+		h.shared = 0
+	}
+	for _, name := range drain(h.memory) {
+		MemoryScheduler.release(name)
+	}
+	for _, name := range drain(h.disk) {
+		DiskScheduler.release(name)
+	}
+	if len(h.ports) != 0 {
+		PortScheduler.release(drain(h.ports))
+	}
+}
+
+// hold keeps the restored items in the reservation, the scheduler is persisted by Commit
+func (r *Reservation) hold(s Scheduler, held map[string]struct{}, items []string) {
+	for _, item := range items {
+		held[item] = struct{}{}
+	}
+	r.recordRestore(s)
+}
+
+// reuse splits the applied items into the fresh ones and the held ones, which are no longer held
+func (r *Reservation) reuse(held map[string]struct{}, items []string) (fresh, reused []string) {
+	for _, item := range items {
+		if _, ok := held[item]; ok {
+			delete(held, item)
+			reused = append(reused, item)
+		} else {
+			fresh = append(fresh, item)
+		}
+	}
+	return fresh, reused
+}
+
+// rehold holds the reused items again when an apply is undone, they are released if the restored resources are kept
+func (r *Reservation) rehold(held map[string]struct{}, reused []string, release func([]string)) {
+	if r.kept {
+		release(reused)
+		return
+	}
+	for _, item := range reused {
+		held[item] = struct{}{}
+	}
+}
+
+func drain(items map[string]struct{}) []string {
+	drained := make([]string, 0, len(items))
+	for item := range items {
+		drained = append(drained, item)
+		delete(items, item)
+	}
+	return drained
+}
+
+// finish marks the reservation done, it is no longer open
+func (r *Reservation) finish() {
+	r.done = true
+	if r.opened {
+		openMu.RUnlock()
+	}
+}
+
+// undoAll puts the schedulers back to the state before the reservation
+func (r *Reservation) undoAll() {
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		r.undo[i]()
+	}
+}
+
+// lock takes applyMu for a change of the reservation and returns the unlock
+func (r *Reservation) lock() func() {
+	if r.preempting {
+		return func() {}
+	}
+	applyMu.Lock()
+	return applyMu.Unlock
+}
+
+func (r *Reservation) recordRestore(s Scheduler) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.touched[s] = struct{}{}
+	r.restored = true
+}
+
+func (r *Reservation) record(s Scheduler, undo func()) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.undo = append(r.undo, undo)
+	r.touched[s] = struct{}{}
+}
+
+func (r *Reservation) persist() {
+	if len(r.touched) == 0 {
+		return
+	}
+	schedulers := make([]Scheduler, 0, len(r.touched))
+	for s := range r.touched {
+		schedulers = append(schedulers, s)
+	}
+	// queued before Commit or Release returns, so the operation that follows sees its state queued first
+	persist(schedulers...)
+}
+
+func splitCpuSet(cpuSet string) []string {
+	if cpuSet == "" {
+		return nil
+	}
+	return strings.Split(cpuSet, ",")
+}
@@ -0,0 +1,47 @@
+package schedulers
+
+import (
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestLockReservationsWaitsForTheOpenReservations(t *testing.T) {
+	res := NewReservation()
+	if _, err := LockReservations(2 * reservationWait); !xerrors.IsReservationsInProgressError(err) {
+		t.Fatalf("err = %v, want reservations in progress", err)
+	}
+
+	res.Release()
+	unlock, err := LockReservations(reservationWait)
+	if err != nil {
+		t.Fatalf("LockReservations after the release: %v", err)
+	}
+	unlock()
+
+	// the reservations open again once the lock is given back
+	NewReservation().Release()
+}
+
+func TestRestoredGpusAreHeldUntilCommit(t *testing.T) {
+	newTestSchedulers(t, "gpu0", "gpu1")
+
+	res := NewReservation()
+	res.RestoreGpus([]string{"gpu0"})
+
+	// another reservation in between can't take what the first may still give back
+	if _, err := Reserve(&ResourceRequest{Name: "new", Gpu: &GpuRequest{Count: 1}}); !xerrors.IsGpuNotEnoughError(err) {
+		t.Fatalf("err = %v, want gpu not enough", err)
+	}
+	res.Release()
+	if usedGpus() != 2 {
+		t.Fatalf("used = %d, want gpu0 held by its container", usedGpus())
+	}
+
+	res = NewReservation()
+	res.RestoreGpus([]string{"gpu0"})
+	res.Commit()
+	if usedGpus() != 1 || GpuScheduler.GpuStatusMap["gpu0"] != GpuFree {
+		t.Fatalf("status = %v, want gpu0 free after the commit", GpuScheduler.GpuStatusMap)
+	}
+}
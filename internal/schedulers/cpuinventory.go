@@ -0,0 +1,155 @@
+package schedulers
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// the files that describe which cpus can be used, they are variables so that fixtures can be used
+var (
+	cpuOnlinePath   = "/sys/devices/system/cpu/online"
+	cpuIsolatedPath = "/sys/devices/system/cpu/isolated"
+	procCmdlinePath = "/proc/cmdline"
+	procCgroupPath  = "/proc/self/cgroup"
+	cgroupRootPath  = "/sys/fs/cgroup"
+)
+
+// getUsableCpus returns the cpus that can be handed out to containers:
+// online cpus, limited by the cpuset of the cgroup this process runs in,
+// without the cpus isolated by isolcpus and the cpus reserved for the system.
+func getUsableCpus(reservedCpus string) ([]string, error) {
+	online, err := readCpuListFile(cpuOnlinePath)
+	if err != nil {
+		return nil, errors.WithMessage(err, "read online cpus failed")
+	}
+
+	cpuset, err := readCgroupCpuset()
+	if err != nil {
+		return nil, errors.WithMessage(err, "read cgroup cpuset failed")
+	}
+
+	isolated, err := readIsolatedCpus()
+	if err != nil {
+		return nil, errors.WithMessage(err, "read isolated cpus failed")
+	}
+
+	reserved, err := utils.ParseCpuList(reservedCpus)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse reserved cpus failed")
+	}
+
+	excluded := make(map[int]struct{}, len(isolated)+len(reserved))
+	for _, cpu := range isolated {
+		excluded[cpu] = struct{}{}
+	}
+	for _, cpu := range reserved {
+		excluded[cpu] = struct{}{}
+	}
+	var allowed map[int]struct{}
+	if cpuset != nil {
+		allowed = make(map[int]struct{}, len(cpuset))
+		for _, cpu := range cpuset {
+			allowed[cpu] = struct{}{}
+		}
+	}
+
+	cpus := make([]string, 0, len(online))
+	for _, cpu := range online {
+		if _, ok := excluded[cpu]; ok {
+			continue
+		}
+		if _, ok := allowed[cpu]; allowed != nil && !ok {
+			continue
+		}
+		cpus = append(cpus, strconv.Itoa(cpu))
+	}
+	return cpus, nil
+}
+
+func readCpuListFile(path string) ([]int, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.ReadFile failed, path: %s", path)
+	}
+	return utils.ParseCpuList(string(bytes))
+}
+
+// readCgroupCpuset returns nil if the process is not limited by a cpuset
+func readCgroupCpuset() ([]int, error) {
+	bytes, err := os.ReadFile(procCgroupPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "os.ReadFile failed, path: %s", procCgroupPath)
+	}
+
+	// e.g. 0::/system.slice/gpu-docker-api.service for cgroup v2,
+	// 3:cpuset:/docker/<id> for cgroup v1
+	var candidates []string
+	for _, line := range strings.Split(string(bytes), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			candidates = append(candidates,
+				filepath.Join(cgroupRootPath, fields[2], "cpuset.cpus.effective"),
+				filepath.Join(cgroupRootPath, "cpuset.cpus.effective"))
+		case strings.Contains(","+fields[1]+",", ",cpuset,"):
+			candidates = append(candidates,
+				filepath.Join(cgroupRootPath, "cpuset", fields[2], "cpuset.effective_cpus"),
+				filepath.Join(cgroupRootPath, "cpuset", "cpuset.effective_cpus"))
+		}
+	}
+
+	for _, path := range candidates {
+		bytes, err := os.ReadFile(path)
+		if err != nil || strings.TrimSpace(string(bytes)) == "" {
+			continue
+		}
+		return utils.ParseCpuList(string(bytes))
+	}
+	return nil, nil
+}
+
+// readIsolatedCpus prefers sysfs, and falls back to the isolcpus kernel parameter on old kernels
+func readIsolatedCpus() ([]int, error) {
+	if cpus, err := readCpuListFile(cpuIsolatedPath); err == nil {
+		return cpus, nil
+	}
+
+	bytes, err := os.ReadFile(procCmdlinePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int{}, nil
+		}
+		return nil, errors.Wrapf(err, "os.ReadFile failed, path: %s", procCmdlinePath)
+	}
+	return parseIsolcpus(string(bytes))
+}
+
+// parseIsolcpus parses isolcpus=[flag,...]<cpu list>, e.g. isolcpus=nohz,domain,2-5
+func parseIsolcpus(cmdline string) ([]int, error) {
+	for _, param := range strings.Fields(cmdline) {
+		value, ok := strings.CutPrefix(param, "isolcpus=")
+		if !ok {
+			continue
+		}
+		var list []string
+		for _, part := range strings.Split(value, ",") {
+			if part != "" && part[0] >= '0' && part[0] <= '9' {
+				list = append(list, part)
+			}
+		}
+		return utils.ParseCpuList(strings.Join(list, ","))
+	}
+	return []int{}, nil
+}
@@ -0,0 +1,23 @@
+package schedulers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIsolcpus(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    []int
+	}{
+		{"BOOT_IMAGE=/vmlinuz root=/dev/sda1 quiet", []int{}},
+		{"quiet isolcpus=2-5,8 nohz_full=2-5", []int{2, 3, 4, 5, 8}},
+		{"isolcpus=nohz,domain,managed_irq,2-3", []int{2, 3}},
+	}
+	for _, tt := range tests {
+		got, err := parseIsolcpus(tt.cmdline)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIsolcpus(%q) = %v, %v, want %v", tt.cmdline, got, err, tt.want)
+		}
+	}
+}
@@ -7,74 +7,168 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/commander-cli/cmd"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
-	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+	"github.com/ngaut/log"
 	"github.com/pkg/errors"
 )
 
 const (
-	allCpuProcessorsCommand = "cat /proc/cpuinfo | grep 'processor' | wc -l"
-
+	// the single key that older versions stored the whole state in
 	cpuStatusMapKey = "cpuStatusMapKey"
+	// the etcd key of SharedCpuUsed, the other keys are the cpu ids
+	sharedCpuUsedKey = "sharedCpuUsed"
 )
 
 var CpuScheduler *cpuScheduler
 
+// CpuRequest describes the cpus to apply for
+type CpuRequest struct {
+	Count int
+	// NumaNodes are preferred, e.g. the nodes that the allocated gpus are attached to
+	NumaNodes []int
+	// Strict only uses cpus in NumaNodes
+	Strict bool
+	// Prefer are used first if they are free, e.g. the cpus used by the previous version of the container
+	Prefer []string
+}
+
+// SharedCpuStatus describes the shared pool, the capacity is the number of cpus multiplied by the overcommit ratio
+type SharedCpuStatus struct {
+	Cpus     []string `json:"cpus"`
+	Capacity int      `json:"capacity"`
+	Used     int      `json:"used"`
+}
+
 type cpuScheduler struct {
 	sync.RWMutex
 
 	AvailableCpuNums int             `json:"availableCpuNums"`
 	CpuStatusMap     map[string]byte `json:"cpuStatusMap"`
+	// the number of cpus that are used by containers in shared mode
+	SharedCpuUsed int `json:"sharedCpuUsed"`
+
+	// cpu id -> numa node, it is read from the host every time the program starts
+	cpuNodes map[string]int
+	// the cpus that can be handed out, it is read from the host every time the program starts
+	usableCpus map[string]struct{}
+	// the cpus that are shared by containers in shared mode, they are never handed out exclusively
+	sharedCpus     []string
+	sharedCapacity int
+
+	store *etcd.Store
 }
 
-func InitCpuScheduler() error {
-	var err error
-	CpuScheduler, err = initCpuFormEtcd()
+// InitCpuScheduler the reserved cpus are used by the system, e.g. dockerd and monitoring agents,
+// they will never be handed out to containers.
+// The shared cpus form a pool for containers in shared mode, which can be overcommitted by the ratio.
+func InitCpuScheduler(reservedCpus, sharedCpus string, overcommitRatio float64) error {
+	var (
+		blob []byte
+		err  error
+	)
+	CpuScheduler, blob, err = initCpuFormEtcd()
 	if err != nil {
 		return errors.Wrap(err, "initFormEtcd failed")
 	}
 
-	if CpuScheduler.AvailableCpuNums == 0 || len(CpuScheduler.CpuStatusMap) == 0 {
-		// if it has not been initialized
-		cpus, err := getAllCpuProcessors()
-		if err != nil {
-			return errors.Wrap(err, "getAllCpuProcessors failed")
-		}
+	cpus, err := getUsableCpus(reservedCpus)
+	if err != nil {
+		return errors.Wrap(err, "getUsableCpus failed")
+	}
+	if len(cpus) == 0 {
+		return errors.New("no cpu can be used by containers")
+	}
 
-		CpuScheduler.AvailableCpuNums = len(cpus)
-		for i := 0; i < len(cpus); i++ {
-			CpuScheduler.CpuStatusMap[cpus[i]] = 0
+	shared, err := utils.ParseCpuList(sharedCpus)
+	if err != nil {
+		return errors.Wrap(err, "parse shared cpus failed")
+	}
+	if overcommitRatio < 1 {
+		return errors.Errorf("cpu overcommit ratio: %v must be greater than or equal to 1", overcommitRatio)
+	}
+	cpus, CpuScheduler.sharedCpus = splitSharedCpus(cpus, shared)
+	if len(CpuScheduler.sharedCpus) != len(shared) {
+		return errors.Errorf("shared cpus: %s must be online and not isolated or reserved", sharedCpus)
+	}
+	CpuScheduler.sharedCapacity = int(float64(len(CpuScheduler.sharedCpus)) * overcommitRatio)
+
+	// cpus that are offline, isolated or reserved since last time are retired once they are free
+	CpuScheduler.usableCpus = make(map[string]struct{}, len(cpus))
+	for _, cpu := range cpus {
+		CpuScheduler.usableCpus[cpu] = struct{}{}
+		if _, ok := CpuScheduler.CpuStatusMap[cpu]; !ok {
+			CpuScheduler.CpuStatusMap[cpu] = 0
 		}
 	}
-	return nil
-}
-
-func CloseCpuScheduler() error {
-	return etcd.Put(etcd.Cpus, cpuStatusMapKey, CpuScheduler.serialize())
-}
+	for cpu, status := range CpuScheduler.CpuStatusMap {
+		if _, ok := CpuScheduler.usableCpus[cpu]; !ok && status == 0 {
+			delete(CpuScheduler.CpuStatusMap, cpu)
+		}
+	}
+	CpuScheduler.AvailableCpuNums = len(cpus)
 
-func initCpuFormEtcd() (c *cpuScheduler, err error) {
-	bytes, err := etcd.GetValue(etcd.Cpus, cpuStatusMapKey)
+	CpuScheduler.cpuNodes, err = topologyReader.CpuNodes()
 	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
-			err = nil
-		} else {
-			return c, err
-		}
+		log.Warnf("topologyReader.CpuNodes failed, cpus will not be aligned with gpus, err: %v", err)
+		CpuScheduler.cpuNodes = map[string]int{}
 	}
 
+	if err = migrate(CpuScheduler, cpuStatusMapKey, blob); err != nil {
+		return errors.WithMessage(err, "migrate failed")
+	}
+	return nil
+}
+
+func initCpuFormEtcd() (c *cpuScheduler, blob []byte, err error) {
 	c = &cpuScheduler{
 		CpuStatusMap: make(map[string]byte),
 	}
-	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &c)
+	c.store = etcd.NewStore(etcd.Cpus, stateDir, c.items)
+
+	items, blob, err := c.store.LoadOrBlob(cpuStatusMapKey)
+	if err != nil {
+		return c, blob, err
 	}
-	return c, err
+	if len(blob) != 0 {
+		err = json.Unmarshal(blob, &c)
+	}
+	for key, value := range items {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return c, blob, errors.Wrapf(err, "strconv.Atoi failed, key: %s, value: %s", key, value)
+		}
+		if key == sharedCpuUsedKey {
+			c.SharedCpuUsed = n
+			continue
+		}
+		c.CpuStatusMap[key] = byte(n)
+	}
+	return c, blob, err
 }
 
 func (cs *cpuScheduler) Apply(num int) (string, error) {
+	return cs.ApplyRequest(&CpuRequest{Count: num})
+}
+
+// ApplyRequest applies for the lowest free cpus,
+// the cpus in the preferred numa nodes are used first.
+func (cs *cpuScheduler) ApplyRequest(req *CpuRequest) (string, error) {
+	cpuSet, err := cs.apply(req, nil)
+	if err != nil {
+		return "", err
+	}
+
+	go cs.putToEtcd()
+
+	return cpuSet, nil
+}
+
+// apply is ApplyRequest without persistence, it is used by the reservation.
+// The held cpus are restored by the reservation, they are still used but free for the request.
+func (cs *cpuScheduler) apply(req *CpuRequest, held map[string]struct{}) (cpuSet string, err error) {
+	num := req.Count
 	if num <= 0 || num > cs.AvailableCpuNums {
 		return "", errors.New("num must be greater than 0 and less than " + strconv.Itoa(cs.AvailableCpuNums))
 	}
@@ -82,6 +176,23 @@ func (cs *cpuScheduler) Apply(num int) (string, error) {
 	cs.Lock()
 	defer cs.Unlock()
 
+	// the held cpus are free for the request, the ones that are not applied for are used again
+	lent := make(map[string]struct{}, len(held))
+	for cpu := range held {
+		if _, ok := cs.usableCpus[cpu]; ok && cs.CpuStatusMap[cpu] == 1 {
+			cs.CpuStatusMap[cpu] = 0
+			lent[cpu] = struct{}{}
+		}
+	}
+	defer func() {
+		for _, cpu := range splitCpuSet(cpuSet) {
+			delete(lent, cpu)
+		}
+		for cpu := range lent {
+			cs.CpuStatusMap[cpu] = 1
+		}
+	}()
+
 	keys := make([]int, 0, len(cs.CpuStatusMap))
 	for k := range cs.CpuStatusMap {
 		ki, _ := strconv.Atoi(k)
@@ -90,33 +201,140 @@ func (cs *cpuScheduler) Apply(num int) (string, error) {
 
 	sort.Ints(keys)
 
-	var applyCpus []string
-	for k := range keys {
+	// local cpus first, then the others unless it is strict
+	preferred := make(map[int]struct{}, len(req.NumaNodes))
+	for _, node := range req.NumaNodes {
+		preferred[node] = struct{}{}
+	}
+	var local, remote []string
+	for _, k := range keys {
 		ks := strconv.Itoa(k)
-		v := cs.CpuStatusMap[ks]
-		if v == 0 {
-			cs.CpuStatusMap[ks] = 1
-			applyCpus = append(applyCpus, ks)
-			if len(applyCpus) == num {
-				break
-			}
+		if cs.CpuStatusMap[ks] != 0 {
+			continue
+		}
+		node, ok := cs.cpuNodes[ks]
+		if _, isLocal := preferred[node]; len(preferred) == 0 || (ok && isLocal) {
+			local = append(local, ks)
+		} else {
+			remote = append(remote, ks)
 		}
 	}
+	candidates := local
+	if !req.Strict || len(preferred) == 0 {
+		candidates = append(candidates, remote...)
+	}
+	candidates = preferFirst(candidates, req.Prefer)
 
-	if len(applyCpus) < num {
-		cs.restore(applyCpus)
+	if len(candidates) < num {
+		if req.Strict && len(preferred) != 0 {
+			return "", errors.Wrapf(xerrors.NewCpuNotEnoughError(), "numa nodes: %+v", req.NumaNodes)
+		}
 		return "", xerrors.NewCpuNotEnoughError()
 	}
 
-	cpuSet := strings.Trim(strings.Join(applyCpus, ","), ",")
+	applyCpus := candidates[:num]
+	for _, cpu := range applyCpus {
+		cs.CpuStatusMap[cpu] = 1
+	}
+
+	return strings.Trim(strings.Join(applyCpus, ","), ","), nil
+}
+
+// ApplyShared applies for the number of cpus from the shared pool,
+// it returns the cpus of the pool, the container should be limited by NanoCPUs.
+func (cs *cpuScheduler) ApplyShared(num int) (string, error) {
+	cpuSet, _, err := cs.applyShared(num, 0)
+	if err != nil {
+		return "", err
+	}
 
 	go cs.putToEtcd()
 
 	return cpuSet, nil
 }
 
+// applyShared is ApplyShared without persistence, it is used by the reservation.
+// The held cpus are restored by the reservation, they are still used but free for the request,
+// reused is how many of them are applied for.
+func (cs *cpuScheduler) applyShared(num, held int) (cpuSet string, reused int, err error) {
+	if num <= 0 {
+		return "", 0, errors.New("num must be greater than 0")
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	used := cs.SharedCpuUsed - held
+	if used+num > cs.sharedCapacity {
+		return "", 0, errors.Wrapf(xerrors.NewCpuNotEnoughError(), "shared cpus, capacity: %d, used: %d",
+			cs.sharedCapacity, used)
+	}
+	reused = min(num, held)
+	cs.SharedCpuUsed += num - reused
+
+	return strings.Join(cs.sharedCpus, ","), reused, nil
+}
+
+// fits reports whether the request fits the cpus of the host when nothing is used
+func (cs *cpuScheduler) fits(req *CpuRequest, shared int) error {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	if req != nil && req.Count > cs.AvailableCpuNums {
+		return errors.Wrapf(xerrors.NewCpuNotEnoughError(), "available: %d, apply: %d", cs.AvailableCpuNums, req.Count)
+	}
+	if shared > cs.sharedCapacity {
+		return errors.Wrapf(xerrors.NewCpuNotEnoughError(), "shared cpus, capacity: %d, apply: %d", cs.sharedCapacity, shared)
+	}
+	return nil
+}
+
+// SharedEnabled reports whether the shared pool has cpus, shared mode is disabled without -sharedCpus
+func (cs *cpuScheduler) SharedEnabled() bool {
+	return len(cs.sharedCpus) != 0
+}
+
+// RestoreShared returns the number of cpus to the shared pool
+func (cs *cpuScheduler) RestoreShared(num int) {
+	cs.releaseShared(num)
+
+	go cs.putToEtcd()
+	signalReleased()
+}
+
+// releaseShared is RestoreShared without persistence, it returns the number of cpus actually returned
+func (cs *cpuScheduler) releaseShared(num int) int {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if num > cs.SharedCpuUsed {
+		num = cs.SharedCpuUsed
+	}
+	cs.SharedCpuUsed -= num
+	return num
+}
+
+// sharedUsed returns the number of cpus of the shared pool that are used
+func (cs *cpuScheduler) sharedUsed() int {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	return cs.SharedCpuUsed
+}
+
 func (cs *cpuScheduler) Restore(cpuSet []string) error {
+	err := cs.release(cpuSet)
+	if err != nil {
+		return err
+	}
+	go cs.putToEtcd()
+	signalReleased()
 
+	return nil
+}
+
+// release is Restore without persistence, it is used by the reservation
+func (cs *cpuScheduler) release(cpuSet []string) error {
 	cs.Lock()
 	defer cs.Unlock()
 
@@ -124,26 +342,36 @@ func (cs *cpuScheduler) Restore(cpuSet []string) error {
 	if err != nil {
 		return errors.Wrap(err, "restore failed")
 	}
-	go cs.putToEtcd()
-
 	return nil
 }
 
 func (cs *cpuScheduler) restore(cpuSet []string) error {
 	for _, cpu := range cpuSet {
+		if _, ok := cs.CpuStatusMap[cpu]; !ok {
+			continue
+		}
+		if _, ok := cs.usableCpus[cpu]; !ok {
+			// the cpu went offline or was reserved while it was in use
+			delete(cs.CpuStatusMap, cpu)
+			continue
+		}
 		cs.CpuStatusMap[cpu] = 0
 	}
 
 	return nil
 }
 
-func (cs *cpuScheduler) serialize() *string {
+// items one key per cpu, cpu id -> 0 or 1, and the key of SharedCpuUsed
+func (cs *cpuScheduler) items() map[string]string {
 	cs.RLock()
 	defer cs.RUnlock()
 
-	bytes, _ := json.Marshal(cs)
-	tmp := string(bytes)
-	return &tmp
+	items := make(map[string]string, len(cs.CpuStatusMap)+1)
+	for cpu, status := range cs.CpuStatusMap {
+		items[cpu] = strconv.Itoa(int(status))
+	}
+	items[sharedCpuUsedKey] = strconv.Itoa(cs.SharedCpuUsed)
+	return items
 }
 
 func (cs *cpuScheduler) GetCpuStatus() map[string]byte {
@@ -158,29 +386,61 @@ func (cs *cpuScheduler) GetCpuStatus() map[string]byte {
 	return copyMap
 }
 
-func (cs *cpuScheduler) putToEtcd() {
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Cpus,
-		Key:      cpuStatusMapKey,
-		Value:    CpuScheduler.serialize(),
+func (cs *cpuScheduler) GetSharedCpuStatus() SharedCpuStatus {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	return SharedCpuStatus{
+		Cpus:     append([]string{}, cs.sharedCpus...),
+		Capacity: cs.sharedCapacity,
+		Used:     cs.SharedCpuUsed,
 	}
 }
 
-func getAllCpuProcessors() ([]string, error) {
-	c := cmd.NewCommand(allCpuProcessorsCommand)
-	err := c.Execute()
-	if err != nil {
-		return nil, errors.Wrap(err, "cmd.Execute failed")
+// preferFirst moves the preferred cpus to the front and keeps the order of the others
+func preferFirst(candidates, prefer []string) []string {
+	if len(prefer) == 0 {
+		return candidates
+	}
+	isPreferred := make(map[string]struct{}, len(prefer))
+	for _, cpu := range prefer {
+		isPreferred[cpu] = struct{}{}
+	}
+	sorted := make([]string, 0, len(candidates))
+	for _, cpu := range candidates {
+		if _, ok := isPreferred[cpu]; ok {
+			sorted = append(sorted, cpu)
+		}
+	}
+	for _, cpu := range candidates {
+		if _, ok := isPreferred[cpu]; !ok {
+			sorted = append(sorted, cpu)
+		}
 	}
+	return sorted
+}
 
-	var cpuList []string
-	cpuNum, err := strconv.Atoi(strings.Trim(c.Stdout(), "\n"))
-	if err != nil {
-		return nil, errors.Wrap(err, "strconv.Atoi failed")
+// splitSharedCpus moves the shared cpus out of the usable cpus,
+// the shared cpus that are not usable are dropped.
+func splitSharedCpus(cpus []string, shared []int) (exclusive, pool []string) {
+	isShared := make(map[string]struct{}, len(shared))
+	for _, cpu := range shared {
+		isShared[strconv.Itoa(cpu)] = struct{}{}
 	}
-	for i := 0; i < cpuNum; i++ {
-		cpuList = append(cpuList, strconv.Itoa(i))
+	for _, cpu := range cpus {
+		if _, ok := isShared[cpu]; ok {
+			pool = append(pool, cpu)
+		} else {
+			exclusive = append(exclusive, cpu)
+		}
 	}
+	return
+}
 
-	return cpuList, nil
+func (cs *cpuScheduler) etcdStore() *etcd.Store {
+	return cs.store
+}
+
+func (cs *cpuScheduler) putToEtcd() {
+	persist(cs)
 }
@@ -0,0 +1,139 @@
+package schedulers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/moby/moby/client"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// the single key that older versions stored the whole state in
+const diskStatusKey = "diskStatusKey"
+
+var DiskScheduler *diskScheduler
+
+// diskScheduler tracks the rootfs size promised to containers against the filesystem of docker's data root
+type diskScheduler struct {
+	// the rootfs bytes of the replicaSets, the rootfs is held until the replicaSet is deleted
+	allocationScheduler
+
+	// bytes that can be promised, it is the size of the filesystem minus the reserved disk
+	AvailableDisk int64 `json:"availableDisk"`
+	ReservedDisk  int64 `json:"reservedDisk"`
+
+	rootDir string
+}
+
+// DiskStatus all values are in bytes
+type DiskStatus struct {
+	RootDir     string           `json:"rootDir"`
+	Available   int64            `json:"available"`
+	Reserved    int64            `json:"reserved"`
+	Used        int64            `json:"used"`
+	Free        int64            `json:"free"`
+	Allocations map[string]int64 `json:"allocations"`
+}
+
+// InitDiskScheduler the reserved disk is used by images, logs and volumes, it will never be promised to containers
+func InitDiskScheduler(reservedDisk string) error {
+	var (
+		blob []byte
+		err  error
+	)
+	DiskScheduler, blob, err = initDiskFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+
+	reserved, err := utils.ToBytes(strings.ToUpper(reservedDisk))
+	if err != nil {
+		return errors.Wrapf(err, "utils.ToBytes failed, reservedDisk: %s", reservedDisk)
+	}
+
+	info, err := docker.Cli.Info(context.Background(), client.InfoOptions{})
+	if err != nil {
+		return errors.Wrap(err, "docker.Info failed")
+	}
+	DiskScheduler.rootDir = info.Info.DockerRootDir
+
+	total, _, err := utils.DiskUsage(DiskScheduler.rootDir)
+	if err != nil {
+		return errors.Wrap(err, "utils.DiskUsage failed")
+	}
+	if reserved >= total {
+		return errors.Errorf("reserved disk: %s must be less than the size of %s: %d bytes", reservedDisk, DiskScheduler.rootDir, total)
+	}
+
+	DiskScheduler.ReservedDisk = reserved
+	DiskScheduler.AvailableDisk = total - reserved
+
+	if err = migrate(DiskScheduler, diskStatusKey, blob); err != nil {
+		return errors.WithMessage(err, "migrate failed")
+	}
+	return nil
+}
+
+func initDiskFormEtcd() (*diskScheduler, []byte, error) {
+	d := newDiskScheduler()
+	blob, err := d.load(etcd.Disks, diskStatusKey)
+	return d, blob, err
+}
+
+func newDiskScheduler() *diskScheduler {
+	d := &diskScheduler{}
+	d.allocationScheduler = newAllocationScheduler(d.check)
+	return d
+}
+
+// check the promised sizes must fit in the disk, and the growth must fit in the free space right now
+func (ds *diskScheduler) check(used, current, bytes int64) error {
+	if used+bytes > ds.AvailableDisk {
+		return errors.Wrapf(xerrors.NewDiskNotEnoughError(), "available: %d, used: %d, apply: %d",
+			ds.AvailableDisk, used, bytes)
+	}
+	if bytes <= current {
+		return nil
+	}
+	_, free, err := utils.DiskUsage(ds.rootDir)
+	if err != nil {
+		return errors.Wrap(err, "utils.DiskUsage failed")
+	}
+	// the reserve is already kept out of AvailableDisk above
+	if bytes-current > free {
+		return errors.Wrapf(xerrors.NewDiskNotEnoughError(), "free: %d, apply: %d",
+			free, bytes-current)
+	}
+	return nil
+}
+
+// fits reports whether the bytes fit the disk when nothing is promised, the free space right now is not checked
+func (ds *diskScheduler) fits(bytes int64) error {
+	ds.RLock()
+	defer ds.RUnlock()
+
+	if bytes > ds.AvailableDisk {
+		return errors.Wrapf(xerrors.NewDiskNotEnoughError(), "available: %d, apply: %d", ds.AvailableDisk, bytes)
+	}
+	return nil
+}
+
+func (ds *diskScheduler) GetDiskStatus() DiskStatus {
+	ds.RLock()
+	defer ds.RUnlock()
+
+	_, free, _ := utils.DiskUsage(ds.rootDir)
+	return DiskStatus{
+		RootDir:     ds.rootDir,
+		Available:   ds.AvailableDisk,
+		Reserved:    ds.ReservedDisk,
+		Used:        ds.used(),
+		Free:        free,
+		Allocations: copyAllocations(ds.Allocations),
+	}
+}
@@ -1,99 +1,299 @@
-//go:build !mock
-
 package schedulers
 
 import (
 	"encoding/json"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/commander-cli/cmd"
+	"github.com/ngaut/log"
 	"github.com/pkg/errors"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
-	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
 const (
-	allGpuUUIDCommand = "nvidia-smi --query-gpu=index,uuid --format=csv,noheader,nounits"
-
+	// the single key that older versions stored the whole state in
 	gpuStatusMapKey = "gpuStatusMapKey"
 )
 
+// the status of a gpu in GpuStatusMap
+const (
+	GpuFree      byte = 0
+	GpuUsed      byte = 1
+	GpuUnhealthy byte = 2
+)
+
 var GpuScheduler *gpuScheduler
 
-type gpu struct {
-	Index int     `json:"index"`
-	UUID  *string `json:"uuid"`
+// GpuInfo is the attributes of a gpu recorded at discovery time
+type GpuInfo struct {
+	Index             int     `json:"index"`
+	UUID              *string `json:"uuid"`
+	Model             string  `json:"model"`
+	MemoryTotal       int64   `json:"memoryTotal"` // MiB
+	ComputeCapability string  `json:"computeCapability"`
+	DriverVersion     string  `json:"driverVersion"`
+	NumaNode          int     `json:"numaNode"` // -1 means unknown
+}
+
+// GpuStatus is an item of the gpu inventory
+type GpuStatus struct {
+	*GpuInfo
+	Status byte       `json:"status"`
+	Health *GpuHealth `json:"health,omitempty"`
+}
+
+// GpuHealth records why a gpu was excluded from scheduling
+type GpuHealth struct {
+	Reason    string `json:"reason"`
+	Since     string `json:"since"`
+	CheckedAt string `json:"checkedAt"`
+}
+
+// GpuRequest describes the gpus to apply for,
+// pinned gpus and excluded gpus can be specified by index or uuid.
+type GpuRequest struct {
+	Count    int
+	Gpus     []string
+	Excludes []string
+	// Model matches the words of the model name case-insensitively, e.g. A100-80GB matches NVIDIA A100-SXM4-80GB but A100 doesn't match A1000
+	Model string
+	// MinMemory is the minimum total memory in bytes
+	MinMemory int64
+	// Prefer are used first if they are free, e.g. the gpus used by the previous version of the container
+	Prefer []string
+	// Booking is the booking that the request belongs to, only the gpus held for it can be applied
+	Booking string
+}
+
+// match reports whether the gpu satisfies the model and memory selectors
+func (r *GpuRequest) match(info *GpuInfo) bool {
+	if r.Model == "" && r.MinMemory == 0 {
+		return true
+	}
+	if info == nil {
+		return false
+	}
+	if r.MinMemory > 0 && info.MemoryTotal<<20 < r.MinMemory {
+		return false
+	}
+	tokens := make(map[string]struct{})
+	for _, token := range modelTokens(info.Model) {
+		tokens[token] = struct{}{}
+	}
+	for _, token := range modelTokens(r.Model) {
+		if _, ok := tokens[token]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// modelTokens splits the model name into lower case words, e.g. NVIDIA A100-SXM4-80GB is nvidia, a100, sxm4 and 80gb
+func modelTokens(model string) []string {
+	return strings.FieldsFunc(strings.ToLower(model), func(r rune) bool {
+		return r == '-' || r == ' ' || r == '_'
+	})
 }
 
 type gpuScheduler struct {
 	sync.RWMutex
 
-	AvailableGpuNums int             `json:"availableGpuNums"`
-	GpuStatusMap     map[string]byte `json:"gpuStatusMap"`
+	AvailableGpuNums int                   `json:"availableGpuNums"`
+	GpuStatusMap     map[string]byte       `json:"gpuStatusMap"`
+	UnhealthyGpuMap  map[string]*GpuHealth `json:"unhealthyGpuMap"`
+	// uuid -> the gpu discovered, it is used to look up a gpu by index
+	GpuInfoMap map[string]*GpuInfo `json:"gpuInfoMap"`
+	// uuid -> the booking that holds the gpu, it is derived from the bookings and never persisted
+	bookedGpuMap map[string]string
+
+	store *etcd.Store
+}
+
+// gpuState is the value of the etcd key of a gpu
+type gpuState struct {
+	Status byte       `json:"status"`
+	Health *GpuHealth `json:"health,omitempty"`
+	Info   *GpuInfo   `json:"info,omitempty"`
 }
 
 func InitGPuScheduler() error {
-	var err error
-	GpuScheduler, err = initGpuFormEtcd()
+	var (
+		blob []byte
+		err  error
+	)
+	GpuScheduler, blob, err = initGpuFormEtcd()
 	if err != nil {
 		return errors.Wrap(err, "initFormEtcd failed")
 	}
 
 	if GpuScheduler.AvailableGpuNums == 0 || len(GpuScheduler.GpuStatusMap) == 0 {
 		// if it has not been initialized
-		gpus, err := getAllGpuUUID()
+		gpus, err := discoverGpus()
 		if err != nil {
-			return errors.Wrap(err, "getAllGpuUUID failed")
+			return errors.Wrap(err, "discoverGpus failed")
 		}
 
 		GpuScheduler.AvailableGpuNums = len(gpus)
 		for i := 0; i < len(gpus); i++ {
-			GpuScheduler.GpuStatusMap[*gpus[i].UUID] = 0
+			GpuScheduler.GpuStatusMap[*gpus[i].UUID] = GpuFree
+			GpuScheduler.GpuInfoMap[*gpus[i].UUID] = gpus[i]
+		}
+	} else {
+		// attributes such as the driver version change after an upgrade,
+		// and the state saved by an older version has no attributes at all
+		gpus, err := discoverGpus()
+		if err != nil {
+			log.Warnf("discoverGpus failed, gpu attributes may be stale, err: %v", err)
+		}
+		for i := 0; i < len(gpus); i++ {
+			if _, ok := GpuScheduler.GpuStatusMap[*gpus[i].UUID]; ok {
+				GpuScheduler.GpuInfoMap[*gpus[i].UUID] = gpus[i]
+			}
 		}
 	}
-	return nil
-}
 
-func CloseGpuScheduler() error {
-	return etcd.Put(etcd.Gpus, gpuStatusMapKey, GpuScheduler.serialize())
+	if err = migrate(GpuScheduler, gpuStatusMapKey, blob); err != nil {
+		return errors.WithMessage(err, "migrate failed")
+	}
+	return nil
 }
 
-func initGpuFormEtcd() (s *gpuScheduler, err error) {
-	bytes, err := etcd.GetValue(etcd.Gpus, gpuStatusMapKey)
+// discoverGpus returns all gpus of the host with their numa nodes
+func discoverGpus() ([]*GpuInfo, error) {
+	gpus, err := getAllGpuUUID()
 	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
-			err = nil
-		} else {
-			return s, err
-		}
+		return nil, errors.Wrap(err, "getAllGpuUUID failed")
 	}
+	fillGpuNumaNodes(gpus)
+	return gpus, nil
+}
 
+func initGpuFormEtcd() (s *gpuScheduler, blob []byte, err error) {
 	s = &gpuScheduler{
-		GpuStatusMap: make(map[string]byte),
+		GpuStatusMap:    make(map[string]byte),
+		UnhealthyGpuMap: make(map[string]*GpuHealth),
+		GpuInfoMap:      make(map[string]*GpuInfo),
+		bookedGpuMap:    make(map[string]string),
+	}
+	s.store = etcd.NewStore(etcd.Gpus, stateDir, s.items)
+
+	items, blob, err := s.store.LoadOrBlob(gpuStatusMapKey)
+	if err != nil {
+		return s, blob, err
 	}
-	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &s)
+	if len(blob) != 0 {
+		err = json.Unmarshal(blob, &s)
+	}
+	if s.UnhealthyGpuMap == nil {
+		s.UnhealthyGpuMap = make(map[string]*GpuHealth)
+	}
+	if s.GpuInfoMap == nil {
+		s.GpuInfoMap = make(map[string]*GpuInfo)
+	}
+	if err != nil || len(items) == 0 {
+		return s, blob, err
+	}
+
+	for uuid, value := range items {
+		var state gpuState
+		if err = json.Unmarshal([]byte(value), &state); err != nil {
+			return s, blob, errors.Wrapf(err, "json.Unmarshal failed, gpu: %s", uuid)
+		}
+		s.GpuStatusMap[uuid] = state.Status
+		if state.Health != nil {
+			s.UnhealthyGpuMap[uuid] = state.Health
+		}
+		if state.Info != nil {
+			s.GpuInfoMap[uuid] = state.Info
+		}
 	}
-	return s, err
+	s.AvailableGpuNums = len(s.GpuStatusMap)
+	return s, blob, nil
 }
 
 // Apply for a specified number of gpus
 func (gs *gpuScheduler) Apply(num int) ([]string, error) {
-	if num <= 0 || num > gs.AvailableGpuNums {
-		return nil, errors.New("num must be greater than 0 and less than " + strconv.Itoa(gs.AvailableGpuNums))
+	return gs.ApplyRequest(&GpuRequest{Count: num})
+}
+
+// ApplyRequest applies for exactly the pinned gpus if there are any,
+// otherwise applies for the specified number of gpus except the excluded ones.
+func (gs *gpuScheduler) ApplyRequest(req *GpuRequest) ([]string, error) {
+	gpus, err := gs.apply(req, nil)
+	if err != nil {
+		return nil, err
 	}
 
+	go gs.putToEtcd()
+
+	return gpus, nil
+}
+
+// apply is ApplyRequest without persistence, it is used by the reservation.
+// The held gpus are restored by the reservation, they are still used but free for the request.
+func (gs *gpuScheduler) apply(req *GpuRequest, held map[string]struct{}) (gpus []string, err error) {
 	gs.Lock()
 	defer gs.Unlock()
 
+	// the held gpus are free for the request, the ones that are not applied for are used again
+	lent := make(map[string]struct{}, len(held))
+	for gpu := range held {
+		if _, ok := gs.UnhealthyGpuMap[gpu]; !ok && gs.GpuStatusMap[gpu] == GpuUsed {
+			gs.GpuStatusMap[gpu] = GpuFree
+			lent[gpu] = struct{}{}
+		}
+	}
+	defer func() {
+		for _, gpu := range gpus {
+			delete(lent, gpu)
+		}
+		for gpu := range lent {
+			gs.GpuStatusMap[gpu] = GpuUsed
+		}
+	}()
+
+	if len(req.Gpus) != 0 {
+		return gs.applyPinned(req)
+	}
+	return gs.applyCount(req)
+}
+
+// applyCount is called under the lock, AvailableGpuNums is changed by Rescan under it
+func (gs *gpuScheduler) applyCount(req *GpuRequest) ([]string, error) {
+	num := req.Count
+	if num <= 0 || num > gs.AvailableGpuNums {
+		return nil, errors.New("num must be greater than 0 and less than " + strconv.Itoa(gs.AvailableGpuNums))
+	}
+
+	excludes, err := gs.resolve(req.Excludes)
+	if err != nil {
+		return nil, errors.WithMessage(err, "resolve excluded gpus failed")
+	}
+
+	candidates := make([]string, 0, len(req.Prefer)+len(gs.GpuStatusMap))
+	candidates = append(candidates, req.Prefer...)
+	for k := range gs.GpuStatusMap {
+		candidates = append(candidates, k)
+	}
+
 	var availableGpus []string
-	for k, v := range gs.GpuStatusMap {
-		if v == 0 {
-			gs.GpuStatusMap[k] = 1
+	for _, k := range candidates {
+		if _, ok := excludes[k]; ok {
+			continue
+		}
+		if !req.match(gs.GpuInfoMap[k]) {
+			continue
+		}
+		if !gs.bookedFor(k, req.Booking) {
+			continue
+		}
+		if v, ok := gs.GpuStatusMap[k]; ok && v == GpuFree {
+			gs.GpuStatusMap[k] = GpuUsed
 			availableGpus = append(availableGpus, k)
 			if len(availableGpus) == num {
 				break
@@ -106,44 +306,315 @@ func (gs *gpuScheduler) Apply(num int) ([]string, error) {
 		return nil, xerrors.NewGpuNotEnoughError()
 	}
 
-	go gs.putToEtcd()
-
 	return availableGpus, nil
 }
 
+// bookedFor reports whether the request of the booking can apply for the gpu,
+// a booked gpu is only for its booking and a request of a booking only gets the gpus booked for it
+func (gs *gpuScheduler) bookedFor(uuid, booking string) bool {
+	return gs.bookedGpuMap[uuid] == booking
+}
+
+// applyPinned is called under the lock
+func (gs *gpuScheduler) applyPinned(req *GpuRequest) ([]string, error) {
+	pinned, err := gs.resolve(req.Gpus)
+	if err != nil {
+		return nil, errors.WithMessage(err, "resolve pinned gpus failed")
+	}
+	if len(pinned) != len(req.Gpus) {
+		return nil, errors.Errorf("duplicate gpus: %+v", req.Gpus)
+	}
+	excludes, err := gs.resolve(req.Excludes)
+	if err != nil {
+		return nil, errors.WithMessage(err, "resolve excluded gpus failed")
+	}
+
+	uuids := make([]string, 0, len(pinned))
+	var conflicts []string
+	for uuid := range pinned {
+		if _, ok := excludes[uuid]; ok {
+			return nil, errors.Errorf("gpu: %s is both pinned and excluded", uuid)
+		}
+		if !req.match(gs.GpuInfoMap[uuid]) {
+			return nil, errors.Wrapf(xerrors.NewGpuNotFoundError(), "gpu: %s doesn't match model: %s, min memory: %d",
+				uuid, req.Model, req.MinMemory)
+		}
+		if !gs.bookedFor(uuid, req.Booking) {
+			if booking, ok := gs.bookedGpuMap[uuid]; ok {
+				return nil, errors.Wrapf(xerrors.NewGpuNotEnoughError(), "gpu: %s is booked by %s", uuid, booking)
+			}
+			return nil, errors.Wrapf(xerrors.NewGpuNotEnoughError(), "gpu: %s is not booked by %s", uuid, req.Booking)
+		}
+		switch gs.GpuStatusMap[uuid] {
+		case GpuUsed:
+			conflicts = append(conflicts, uuid)
+		case GpuUnhealthy:
+			return nil, errors.Wrapf(xerrors.NewGpuNotEnoughError(), "gpu: %s is unhealthy", uuid)
+		}
+		uuids = append(uuids, uuid)
+	}
+	if len(conflicts) != 0 {
+		sort.Strings(conflicts)
+		return nil, xerrors.NewGpuConflictError(conflicts)
+	}
+
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		gs.GpuStatusMap[uuid] = GpuUsed
+	}
+
+	return uuids, nil
+}
+
+// fits reports whether the request fits the gpus of the host when none of them is used,
+// the unhealthy gpus are counted, they may recover
+func (gs *gpuScheduler) fits(req *GpuRequest) error {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	if len(req.Gpus) != 0 {
+		pinned, err := gs.resolve(req.Gpus)
+		if err != nil {
+			return errors.WithMessage(err, "resolve pinned gpus failed")
+		}
+		for uuid := range pinned {
+			if !req.match(gs.GpuInfoMap[uuid]) {
+				return errors.Wrapf(xerrors.NewGpuNotFoundError(), "gpu: %s doesn't match model: %s, min memory: %d",
+					uuid, req.Model, req.MinMemory)
+			}
+			if !gs.bookedFor(uuid, req.Booking) {
+				return errors.Wrapf(xerrors.NewGpuNotEnoughError(), "gpu: %s is not booked by %s", uuid, req.Booking)
+			}
+		}
+		return nil
+	}
+
+	excludes, err := gs.resolve(req.Excludes)
+	if err != nil {
+		return errors.WithMessage(err, "resolve excluded gpus failed")
+	}
+	var matched int
+	for uuid := range gs.GpuStatusMap {
+		if _, ok := excludes[uuid]; ok {
+			continue
+		}
+		if req.match(gs.GpuInfoMap[uuid]) && gs.bookedFor(uuid, req.Booking) {
+			matched++
+		}
+	}
+	if matched < req.Count {
+		return errors.Wrapf(xerrors.NewGpuNotEnoughError(), "only %d gpus match model: %s, min memory: %d, apply: %d",
+			matched, req.Model, req.MinMemory, req.Count)
+	}
+	return nil
+}
+
+// Resolve converts gpu indexes or uuids to the names used in GpuStatusMap
+func (gs *gpuScheduler) Resolve(ids []string) ([]string, error) {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	resolved, err := gs.resolve(ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolved) != len(ids) {
+		return nil, errors.Errorf("duplicate gpus: %+v", ids)
+	}
+	uuids := make([]string, 0, len(resolved))
+	for uuid := range resolved {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+// resolve converts gpu indexes or uuids to the names used in GpuStatusMap
+func (gs *gpuScheduler) resolve(ids []string) (map[string]struct{}, error) {
+	uuids := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := gs.GpuStatusMap[id]; ok {
+			uuids[id] = struct{}{}
+			continue
+		}
+		if _, ok := gs.GpuStatusMap[GpuDeviceName(id)]; ok {
+			uuids[GpuDeviceName(id)] = struct{}{}
+			continue
+		}
+
+		found := false
+		if index, err := strconv.Atoi(id); err == nil {
+			for uuid, g := range gs.GpuInfoMap {
+				if g.Index == index {
+					uuids[uuid] = struct{}{}
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return nil, errors.Wrapf(xerrors.NewGpuNotFoundError(), "gpu: %s", id)
+		}
+	}
+	return uuids, nil
+}
+
 // Restore a specified number of gpu
 func (gs *gpuScheduler) Restore(gpus []string) {
-	if len(gpus) <= 0 || len(gpus) > gs.AvailableGpuNums {
+	if len(gpus) == 0 {
 		return
 	}
 
+	gs.release(gpus)
+
+	go gs.putToEtcd()
+	signalReleased()
+}
+
+// release is Restore without persistence, it is used by the reservation
+func (gs *gpuScheduler) release(gpus []string) {
 	gs.Lock()
 	defer gs.Unlock()
 
 	gs.restore(gpus)
-
-	go gs.putToEtcd()
 }
 
+// restore an unhealthy gpu goes back to the unhealthy state instead of the free pool
 func (gs *gpuScheduler) restore(gpus []string) {
 	if len(gpus) <= 0 || len(gpus) > gs.AvailableGpuNums {
 		return
 	}
 
 	for _, gpu := range gpus {
-		gs.GpuStatusMap[gpu] = 0
+		// the gpu may have been retired by rescan
+		if _, ok := gs.GpuStatusMap[gpu]; !ok {
+			continue
+		}
+		if _, ok := gs.UnhealthyGpuMap[gpu]; ok {
+			gs.GpuStatusMap[gpu] = GpuUnhealthy
+			continue
+		}
+		gs.GpuStatusMap[gpu] = GpuFree
+	}
+}
+
+// MarkUnhealthy excludes a gpu from scheduling.
+// A gpu that is in use keeps its used state until it is restored,
+// it returns true if the gpu was healthy before.
+func (gs *gpuScheduler) MarkUnhealthy(uuid, reason string) bool {
+	gs.Lock()
+	defer gs.Unlock()
+
+	status, ok := gs.GpuStatusMap[uuid]
+	if !ok {
+		return false
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	health, unhealthy := gs.UnhealthyGpuMap[uuid]
+	if unhealthy {
+		health.Reason = reason
+		health.CheckedAt = now
+	} else {
+		gs.UnhealthyGpuMap[uuid] = &GpuHealth{
+			Reason:    reason,
+			Since:     now,
+			CheckedAt: now,
+		}
+	}
+	if status == GpuFree {
+		gs.GpuStatusMap[uuid] = GpuUnhealthy
+	}
+
+	go gs.putToEtcd()
+
+	return !unhealthy
+}
+
+// MarkHealthy returns an unhealthy gpu to the free pool,
+// it returns true if the gpu was unhealthy before.
+func (gs *gpuScheduler) MarkHealthy(uuid string) bool {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if _, ok := gs.UnhealthyGpuMap[uuid]; !ok {
+		return false
+	}
+	delete(gs.UnhealthyGpuMap, uuid)
+	if gs.GpuStatusMap[uuid] == GpuUnhealthy {
+		gs.GpuStatusMap[uuid] = GpuFree
 	}
+
+	go gs.putToEtcd()
+	signalReleased()
+
+	return true
 }
 
-func (gs *gpuScheduler) serialize() *string {
+// Rescan discovers the gpus again and reconciles them with GpuStatusMap,
+// new gpus are added to the free pool and vanished gpus are retired even if they are in use.
+func (gs *gpuScheduler) Rescan() (added, retired []string, err error) {
+	gpus, err := discoverGpus()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "discoverGpus failed")
+	}
+	if len(gpus) == 0 {
+		// nvidia-smi reports nothing while the driver is being upgraded,
+		// retiring every gpu is never what we want
+		return nil, nil, errors.New("no gpu discovered")
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	discovered := make(map[string]struct{}, len(gpus))
+	for _, g := range gpus {
+		discovered[*g.UUID] = struct{}{}
+		gs.GpuInfoMap[*g.UUID] = g
+		if _, ok := gs.GpuStatusMap[*g.UUID]; !ok {
+			gs.GpuStatusMap[*g.UUID] = GpuFree
+			added = append(added, *g.UUID)
+		}
+	}
+	for uuid := range gs.GpuStatusMap {
+		if _, ok := discovered[uuid]; !ok {
+			delete(gs.GpuStatusMap, uuid)
+			delete(gs.UnhealthyGpuMap, uuid)
+			delete(gs.GpuInfoMap, uuid)
+			retired = append(retired, uuid)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(retired)
+	gs.AvailableGpuNums = len(gs.GpuStatusMap)
+
+	// the index of a gpu may change even if the uuid does not
+	go gs.putToEtcd()
+	if len(added) != 0 {
+		signalReleased()
+	}
+
+	return added, retired, nil
+}
+
+// items one key per gpu, uuid -> gpuState
+func (gs *gpuScheduler) items() map[string]string {
 	gs.RLock()
 	defer gs.RUnlock()
 
-	bytes, _ := json.Marshal(gs)
-	tmp := string(bytes)
-	return &tmp
+	items := make(map[string]string, len(gs.GpuStatusMap))
+	for uuid, status := range gs.GpuStatusMap {
+		bytes, _ := json.Marshal(gpuState{
+			Status: status,
+			Health: gs.UnhealthyGpuMap[uuid],
+			Info:   gs.GpuInfoMap[uuid],
+		})
+		items[uuid] = string(bytes)
+	}
+	return items
 }
 
+// GetGpuStatus 0 means not used, 1 means used, 2 means unhealthy.
 func (gs *gpuScheduler) GetGpuStatus() map[string]byte {
 	gs.RLock()
 	defer gs.RUnlock()
@@ -156,48 +627,103 @@ func (gs *gpuScheduler) GetGpuStatus() map[string]byte {
 	return copyMap
 }
 
-func (gs *gpuScheduler) putToEtcd() {
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Gpus,
-		Key:      gpuStatusMapKey,
-		Value:    GpuScheduler.serialize(),
+// GetGpuInventory returns all gpus sorted by index
+func (gs *gpuScheduler) GetGpuInventory() []*GpuStatus {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	inventory := make([]*GpuStatus, 0, len(gs.GpuStatusMap))
+	for uuid, status := range gs.GpuStatusMap {
+		info := &GpuInfo{Index: -1, UUID: &uuid}
+		if gi, ok := gs.GpuInfoMap[uuid]; ok {
+			tmp := *gi
+			info = &tmp
+		}
+		item := &GpuStatus{
+			GpuInfo: info,
+			Status:  status,
+		}
+		if health, ok := gs.UnhealthyGpuMap[uuid]; ok {
+			tmp := *health
+			item.Health = &tmp
+		}
+		inventory = append(inventory, item)
 	}
+	sort.Slice(inventory, func(i, j int) bool {
+		if inventory[i].Index != inventory[j].Index {
+			return inventory[i].Index < inventory[j].Index
+		}
+		return *inventory[i].UUID < *inventory[j].UUID
+	})
+
+	return inventory
 }
 
-func getAllGpuUUID() ([]*gpu, error) {
-	c := cmd.NewCommand(allGpuUUIDCommand)
-	err := c.Execute()
-	if err != nil {
-		return nil, errors.Wrap(err, "cmd.Execute failed")
-	}
+// GetNumaNodes returns the numa nodes that the gpus are attached to
+func (gs *gpuScheduler) GetNumaNodes(uuids []string) []int {
+	gs.RLock()
+	defer gs.RUnlock()
 
-	gpuList, err := parseOutput(c.Stdout())
-	if err != nil {
-		return nil, errors.Wrap(err, "parseOutput failed")
+	nodes := make(map[int]struct{})
+	for _, uuid := range uuids {
+		if info, ok := gs.GpuInfoMap[uuid]; ok && info.NumaNode != unknownNumaNode {
+			nodes[info.NumaNode] = struct{}{}
+		}
 	}
-	return gpuList, nil
+	return sortedNodes(nodes)
 }
 
-func parseOutput(output string) (gpuList []*gpu, err error) {
-	lines := strings.Split(output, "\n")
-	gpuList = make([]*gpu, 0, len(lines))
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
+// SetBookedGpus replaces the gpus held for bookings, they are only applied by the requests of the same booking
+func (gs *gpuScheduler) SetBookedGpus(booked map[string]string) {
+	gs.Lock()
+	defer gs.Unlock()
 
-		fields := strings.Split(line, ", ")
-		if len(fields) == 2 {
-			index, err := strconv.Atoi(fields[0])
-			if err != nil {
-				return gpuList, errors.Errorf("invaild index: %s, ", fields[0])
-			}
-			uuid := "nvidia.com/gpu=" + fields[1]
-			gpuList = append(gpuList, &gpu{
-				Index: index,
-				UUID:  &uuid,
-			})
+	unbooked := false
+	for uuid := range gs.bookedGpuMap {
+		if _, ok := booked[uuid]; !ok {
+			unbooked = true
+			break
 		}
 	}
-	return
+	gs.bookedGpuMap = make(map[string]string, len(booked))
+	for uuid, booking := range booked {
+		gs.bookedGpuMap[uuid] = booking
+	}
+
+	if unbooked {
+		signalReleased()
+	}
+}
+
+// GetBookedGpus returns the gpus held for bookings, uuid -> booking
+func (gs *gpuScheduler) GetBookedGpus() map[string]string {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	copyMap := make(map[string]string, len(gs.bookedGpuMap))
+	for k, v := range gs.bookedGpuMap {
+		copyMap[k] = v
+	}
+
+	return copyMap
+}
+
+func (gs *gpuScheduler) GetUnhealthyGpus() map[string]GpuHealth {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	copyMap := make(map[string]GpuHealth, len(gs.UnhealthyGpuMap))
+	for k, v := range gs.UnhealthyGpuMap {
+		copyMap[k] = *v
+	}
+
+	return copyMap
+}
+
+func (gs *gpuScheduler) etcdStore() *etcd.Store {
+	return gs.store
+}
+
+func (gs *gpuScheduler) putToEtcd() {
+	persist(gs)
 }
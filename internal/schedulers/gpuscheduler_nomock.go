@@ -0,0 +1,73 @@
+//go:build !mock
+
+package schedulers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/commander-cli/cmd"
+	"github.com/pkg/errors"
+)
+
+const (
+	allGpuUUIDCommand = "nvidia-smi --query-gpu=index,uuid,name,memory.total,compute_cap,driver_version --format=csv,noheader,nounits"
+
+	cdiGpuPrefix = "nvidia.com/gpu="
+)
+
+// GpuDeviceName converts the uuid reported by nvidia-smi to the name used in GpuStatusMap
+func GpuDeviceName(uuid string) string {
+	return cdiGpuPrefix + uuid
+}
+
+func getAllGpuUUID() ([]*GpuInfo, error) {
+	c := cmd.NewCommand(allGpuUUIDCommand)
+	err := c.Execute()
+	if err != nil {
+		return nil, errors.Wrap(err, "cmd.Execute failed")
+	}
+
+	gpuList, err := parseOutput(c.Stdout())
+	if err != nil {
+		return nil, errors.Wrap(err, "parseOutput failed")
+	}
+	return gpuList, nil
+}
+
+// parseOutput parses the output of allGpuUUIDCommand,
+// e.g. 0, GPU-b7fa6b8c-..., NVIDIA A100-SXM4-80GB, 81920, 8.0, 550.54.15
+func parseOutput(output string) (gpuList []*GpuInfo, err error) {
+	lines := strings.Split(output, "\n")
+	gpuList = make([]*GpuInfo, 0, len(lines))
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ", ")
+		if len(fields) < 2 {
+			continue
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return gpuList, errors.Errorf("invaild index: %s, ", fields[0])
+		}
+		uuid := GpuDeviceName(fields[1])
+		info := &GpuInfo{
+			Index: index,
+			UUID:  &uuid,
+		}
+		// old drivers don't support some of the fields, which are reported as [N/A]
+		if len(fields) == 6 {
+			info.Model = fields[2]
+			info.MemoryTotal, _ = strconv.ParseInt(fields[3], 10, 64)
+			info.DriverVersion = fields[5]
+			if fields[4] != "[N/A]" {
+				info.ComputeCapability = fields[4]
+			}
+		}
+		gpuList = append(gpuList, info)
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package schedulers
+
+import (
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// newTestGpuScheduler replaces the gpu scheduler with one of the free gpus
+func newTestGpuScheduler(t *testing.T, gpus ...string) {
+	t.Helper()
+	gs := GpuScheduler
+	t.Cleanup(func() { GpuScheduler = gs })
+
+	GpuScheduler = &gpuScheduler{
+		AvailableGpuNums: len(gpus),
+		GpuStatusMap:     make(map[string]byte),
+		UnhealthyGpuMap:  make(map[string]*GpuHealth),
+		GpuInfoMap:       make(map[string]*GpuInfo),
+		bookedGpuMap:     make(map[string]string),
+	}
+	for _, gpu := range gpus {
+		GpuScheduler.GpuStatusMap[gpu] = GpuFree
+	}
+}
+
+func TestApplyKeepsBookingsToTheirGpus(t *testing.T) {
+	newTestGpuScheduler(t, "gpu0", "gpu1", "gpu2")
+	GpuScheduler.bookedGpuMap = map[string]string{"gpu0": "foo", "gpu1": "bar"}
+
+	// a request of a booking only gets the gpus booked for it
+	if _, err := GpuScheduler.apply(&GpuRequest{Count: 2, Booking: "foo"}, nil); !xerrors.IsGpuNotEnoughError(err) {
+		t.Fatalf("err = %v, want not enough gpus", err)
+	}
+	if _, err := GpuScheduler.apply(&GpuRequest{Count: 1, Gpus: []string{"gpu2"}, Booking: "foo"}, nil); !xerrors.IsGpuNotEnoughError(err) {
+		t.Fatalf("err = %v, want the unbooked gpu refused", err)
+	}
+	gpus, err := GpuScheduler.apply(&GpuRequest{Count: 1, Booking: "foo"}, nil)
+	if err != nil || len(gpus) != 1 || gpus[0] != "gpu0" {
+		t.Fatalf("gpus = %v, err = %v, want gpu0", gpus, err)
+	}
+
+	// the others never get the booked gpus
+	gpus, err = GpuScheduler.apply(&GpuRequest{Count: 1}, nil)
+	if err != nil || len(gpus) != 1 || gpus[0] != "gpu2" {
+		t.Fatalf("gpus = %v, err = %v, want gpu2", gpus, err)
+	}
+}
+
+func TestGpuRequestMatchesWholeWords(t *testing.T) {
+	a100 := &GpuInfo{Model: "NVIDIA A100-SXM4-80GB", MemoryTotal: 81920}
+	a1000 := &GpuInfo{Model: "NVIDIA RTX A1000", MemoryTotal: 8192}
+
+	tests := []struct {
+		req  GpuRequest
+		info *GpuInfo
+		want bool
+	}{
+		{GpuRequest{}, nil, true},
+		{GpuRequest{Model: "A100-80GB"}, a100, true},
+		{GpuRequest{Model: "a100 sxm4"}, a100, true},
+		{GpuRequest{Model: "A100"}, a1000, false},
+		{GpuRequest{Model: "A10"}, a100, false},
+		{GpuRequest{Model: "A100-40GB"}, a100, false},
+		{GpuRequest{MinMemory: 16 << 30}, a1000, false},
+		{GpuRequest{Model: "A100", MinMemory: 80 << 30}, a100, true},
+		{GpuRequest{Model: "A100"}, nil, false},
+	}
+	for _, tt := range tests {
+		if got := tt.req.match(tt.info); got != tt.want {
+			t.Errorf("%+v matches %+v = %v, want %v", tt.req, tt.info, got, tt.want)
+		}
+	}
+}
+
+func TestFitsCountsTheUsedGpusButNotTheUnmatched(t *testing.T) {
+	newTestGpuScheduler(t, "gpu0", "gpu1")
+	GpuScheduler.GpuStatusMap["gpu0"] = GpuUsed
+	GpuScheduler.GpuInfoMap["gpu0"] = &GpuInfo{Model: "NVIDIA A100-SXM4-80GB", MemoryTotal: 81920}
+	GpuScheduler.GpuInfoMap["gpu1"] = &GpuInfo{Model: "NVIDIA A100-SXM4-40GB", MemoryTotal: 40960}
+
+	// gpu0 is used now, but it is given back sooner or later
+	if err := GpuScheduler.fits(&GpuRequest{Count: 2}); err != nil {
+		t.Fatalf("fits: %v", err)
+	}
+	if err := GpuScheduler.fits(&GpuRequest{Count: 2, MinMemory: 80 << 30}); !xerrors.IsGpuNotEnoughError(err) {
+		t.Fatalf("err = %v, want only one gpu matched", err)
+	}
+	if err := GpuScheduler.fits(&GpuRequest{Count: 1, MinMemory: 96 << 30}); !xerrors.IsGpuNotEnoughError(err) {
+		t.Fatalf("err = %v, want no gpu matched", err)
+	}
+}
@@ -0,0 +1,138 @@
+package schedulers
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// the single key that older versions stored the whole state in
+const memoryStatusKey = "memoryStatusKey"
+
+var (
+	MemoryScheduler *memoryScheduler
+
+	procMeminfoPath = "/proc/meminfo"
+)
+
+type memoryScheduler struct {
+	// the allocations of the replicaSets, in bytes
+	allocationScheduler
+
+	// bytes that can be handed out, it is the total memory of the host minus the reserved memory
+	AvailableMemory int64 `json:"availableMemory"`
+	ReservedMemory  int64 `json:"reservedMemory"`
+}
+
+// MemoryStatus all values are in bytes
+type MemoryStatus struct {
+	Available   int64            `json:"available"`
+	Reserved    int64            `json:"reserved"`
+	Used        int64            `json:"used"`
+	Allocations map[string]int64 `json:"allocations"`
+}
+
+// InitMemoryScheduler the reserved memory is used by the system and will never be handed out to containers
+func InitMemoryScheduler(reservedMemory string) error {
+	var (
+		blob []byte
+		err  error
+	)
+	MemoryScheduler, blob, err = initMemoryFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+
+	reserved, err := utils.ToBytes(strings.ToUpper(reservedMemory))
+	if err != nil {
+		return errors.Wrapf(err, "utils.ToBytes failed, reservedMemory: %s", reservedMemory)
+	}
+	total, err := getTotalMemory()
+	if err != nil {
+		return errors.Wrap(err, "getTotalMemory failed")
+	}
+	if reserved >= total {
+		return errors.Errorf("reserved memory: %s must be less than the total memory: %d bytes", reservedMemory, total)
+	}
+
+	// the host may have been resized, so it is read every time the program starts
+	MemoryScheduler.ReservedMemory = reserved
+	MemoryScheduler.AvailableMemory = total - reserved
+
+	if err = migrate(MemoryScheduler, memoryStatusKey, blob); err != nil {
+		return errors.WithMessage(err, "migrate failed")
+	}
+	return nil
+}
+
+func initMemoryFormEtcd() (*memoryScheduler, []byte, error) {
+	m := newMemoryScheduler()
+	blob, err := m.load(etcd.Memory, memoryStatusKey)
+	return m, blob, err
+}
+
+func newMemoryScheduler() *memoryScheduler {
+	m := &memoryScheduler{}
+	m.allocationScheduler = newAllocationScheduler(m.check)
+	return m
+}
+
+// check the memory a replicaSet already holds is counted as free
+func (ms *memoryScheduler) check(used, _, bytes int64) error {
+	if used+bytes > ms.AvailableMemory {
+		return errors.Wrapf(xerrors.NewMemoryNotEnoughError(), "available: %d, used: %d, apply: %d",
+			ms.AvailableMemory, used, bytes)
+	}
+	return nil
+}
+
+// fits reports whether the bytes fit the memory of the host when nothing is used
+func (ms *memoryScheduler) fits(bytes int64) error {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return ms.check(0, 0, bytes)
+}
+
+func (ms *memoryScheduler) GetMemoryStatus() MemoryStatus {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return MemoryStatus{
+		Available:   ms.AvailableMemory,
+		Reserved:    ms.ReservedMemory,
+		Used:        ms.used(),
+		Allocations: copyAllocations(ms.Allocations),
+	}
+}
+
+// getTotalMemory returns MemTotal in /proc/meminfo in bytes
+func getTotalMemory() (int64, error) {
+	f, err := os.Open(procMeminfoPath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "os.Open failed, path: %s", procMeminfoPath)
+	}
+	defer f.Close()
+
+	// e.g. MemTotal:       527994952 kB
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "strconv.ParseInt failed, line: %s", scanner.Text())
+		}
+		return kb << 10, nil
+	}
+	return 0, errors.Errorf("MemTotal not found in %s", procMeminfoPath)
+}
@@ -3,6 +3,7 @@ package schedulers
 import (
 	"encoding/json"
 	"math/rand/v2"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
@@ -11,26 +12,70 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
-	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
-const usedPortSetKey = "usedPortSetKey"
+const (
+	// the single key that older versions stored the whole state in
+	usedPortSetKey = "usedPortSetKey"
+	// the etcd keys of the port range and NextPort, the other keys are the used ports
+	portRangeKey = "range"
+	nextPortKey  = "nextPort"
+
+	// PortStrategyRandom picks random free ports in the range, it is the default strategy
+	PortStrategyRandom = "random"
+	// PortStrategySequential picks the free ports after the last allocated one, and wraps around
+	PortStrategySequential = "sequential"
+	// PortStrategyLowestFree picks the lowest free ports in the range
+	PortStrategyLowestFree = "lowest-free"
+
+	// the random ports tried before the range is scanned from a random port
+	randomPortAttempts = 32
+)
 
 var PortScheduler *portScheduler
 
+// PortRequest applies for one host port, a specific host port is requested if HostPort is not empty
+type PortRequest struct {
+	Protocol string
+	HostPort string
+	// Prefer is used if it is free, otherwise a port is picked by the strategy
+	Prefer string
+}
+
 type portScheduler struct {
 	sync.RWMutex
 
 	StartPort      int
 	EndPort        int
 	AvailableCount int
-	UsedPortSet    map[string]struct{}
+	// the keys are port/protocol, e.g. 40022/tcp, a tcp and an udp port of the same number are both used
+	UsedPortSet map[string]struct{}
+	// the port after the last allocated one, it is used by the sequential strategy
+	NextPort int
+
+	// they are read from the flags every time the program starts,
+	// a reserved port is never handed out whatever the protocol
+	Strategy      string
+	ReservedPorts map[string]struct{}
+
+	store *etcd.Store
 }
 
-func InitPortScheduler(portRange string) error {
-	var err error
-	PortScheduler, err = initPortFormEtcd()
+// portRangeState is the value of portRangeKey, the range is kept even if the flag changes
+type portRangeState struct {
+	StartPort      int `json:"startPort"`
+	EndPort        int `json:"endPort"`
+	AvailableCount int `json:"availableCount"`
+}
+
+// InitPortScheduler the reserved ports will never be handed out, e.g. 22,80,443,8000-8100
+func InitPortScheduler(portRange, strategy, reservedPorts string) error {
+	var (
+		blob []byte
+		err  error
+	)
+	PortScheduler, blob, err = initPortFormEtcd()
 	if err != nil {
 		return errors.Wrap(err, "initFormEtcd failed")
 	}
@@ -46,91 +91,297 @@ func InitPortScheduler(portRange string) error {
 		PortScheduler.AvailableCount = PortScheduler.EndPort - PortScheduler.StartPort + 1
 	}
 
+	if strategy != PortStrategyRandom && strategy != PortStrategySequential && strategy != PortStrategyLowestFree {
+		return errors.Errorf("port strategy: %s is not supported", strategy)
+	}
+	PortScheduler.Strategy = strategy
+
+	PortScheduler.ReservedPorts, err = parsePortList(reservedPorts)
+	if err != nil {
+		return errors.WithMessagef(err, "parsePortList failed, reservedPorts: %s", reservedPorts)
+	}
+
+	if err = migrate(PortScheduler, usedPortSetKey, blob); err != nil {
+		return errors.WithMessage(err, "migrate failed")
+	}
 	return nil
 }
 
-func ClosePortScheduler() error {
-	return etcd.Put(etcd.Ports, usedPortSetKey, PortScheduler.serialize())
-}
+func initPortFormEtcd() (s *portScheduler, blob []byte, err error) {
+	s = &portScheduler{
+		UsedPortSet: make(map[string]struct{}),
+	}
+	s.store = etcd.NewStore(etcd.Ports, stateDir, s.items)
 
-func initPortFormEtcd() (s *portScheduler, err error) {
-	bytes, err := etcd.GetValue(etcd.Ports, usedPortSetKey)
+	items, blob, err := s.store.LoadOrBlob(usedPortSetKey)
 	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
-			err = nil
-		} else {
-			return s, err
+		return s, blob, err
+	}
+	if len(blob) != 0 {
+		err = json.Unmarshal(blob, &s)
+	}
+	for key, value := range items {
+		switch key {
+		case portRangeKey:
+			var r portRangeState
+			if err = json.Unmarshal([]byte(value), &r); err != nil {
+				return s, blob, errors.Wrapf(err, "json.Unmarshal failed, key: %s", key)
+			}
+			s.StartPort, s.EndPort, s.AvailableCount = r.StartPort, r.EndPort, r.AvailableCount
+		case nextPortKey:
+			if s.NextPort, err = strconv.Atoi(value); err != nil {
+				return s, blob, errors.Wrapf(err, "strconv.Atoi failed, key: %s, value: %s", key, value)
+			}
+		default:
+			// older versions stored the tcp ports without the protocol
+			s.UsedPortSet[PortKey(key, "tcp")] = struct{}{}
 		}
 	}
+	return s, blob, err
+}
 
-	s = &portScheduler{
-		UsedPortSet: make(map[string]struct{}),
+// Apply for a specified number of tcp ports
+func (ps *portScheduler) Apply(num int) ([]string, error) {
+	reqs := make([]PortRequest, num)
+	for i := range reqs {
+		reqs[i].Protocol = "tcp"
 	}
-	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &s)
+	return ps.ApplyRequest(reqs)
+}
+
+// ApplyRequest applies for a host port for each request, the returned ports are in the same order.
+// The specific ports are applied first, the others are picked from the range by the strategy,
+// and ports that are already bound on the host outside the api are skipped.
+func (ps *portScheduler) ApplyRequest(reqs []PortRequest) ([]string, error) {
+	ports, err := ps.apply(reqs, nil)
+	if err != nil {
+		return nil, err
 	}
-	return s, err
+
+	go ps.putToEtcd()
+
+	return ports, nil
 }
 
-// Apply for a specified number of ports
-func (ps *portScheduler) Apply(num int) ([]string, error) {
-	if num <= 0 || num > ps.AvailableCount {
+// apply is ApplyRequest without persistence, it is used by the reservation.
+// The held ports are restored by the reservation, they are still used but free for the requests.
+func (ps *portScheduler) apply(reqs []PortRequest, held map[string]struct{}) ([]string, error) {
+	if len(reqs) <= 0 || len(reqs) > ps.AvailableCount {
 		return nil, errors.New("num must be greater than 0 and less than or equal to " + strconv.Itoa(ps.AvailableCount))
 	}
 
 	ps.Lock()
 	defer ps.Unlock()
 
-	// 检查剩余可用端口数是否足够
-	availablePortCount := ps.EndPort - ps.StartPort + 1 - len(ps.UsedPortSet)
-	if num > availablePortCount {
-		return nil, xerrors.NewPortNotEnoughError()
+	// the held ports that are not applied for are used again
+	lent := make(map[string]struct{}, len(held))
+	for key := range held {
+		if _, ok := ps.UsedPortSet[key]; ok {
+			delete(ps.UsedPortSet, key)
+			lent[key] = struct{}{}
+		}
 	}
+	ports := make([]string, len(reqs))
+	var err error
+	defer func() {
+		if err != nil {
+			ps.restore(PortKeys(reqs, ports))
+		} else {
+			for _, key := range PortKeys(reqs, ports) {
+				delete(lent, key)
+			}
+		}
+		for key := range lent {
+			ps.UsedPortSet[key] = struct{}{}
+		}
+	}()
 
-	var availablePorts []string
-	portRange := ps.EndPort - ps.StartPort + 1
+	var num int
+	for i, req := range reqs {
+		if req.HostPort == "" {
+			continue
+		}
+		if err = ps.applySpecific(req); err != nil {
+			return nil, err
+		}
+		ports[i] = req.HostPort
+	}
+	for i, req := range reqs {
+		if req.HostPort != "" {
+			continue
+		}
+		if req.Prefer != "" && ps.applySpecific(PortRequest{Protocol: req.Protocol, HostPort: req.Prefer}) == nil {
+			ports[i] = req.Prefer
+			continue
+		}
+		num++
+	}
 
-	for len(availablePorts) < num {
-		randomPort := rand.IntN(portRange) + ps.StartPort
-		portStr := strconv.Itoa(randomPort)
-		if _, ok := ps.UsedPortSet[portStr]; !ok {
-			ps.UsedPortSet[portStr] = struct{}{}
-			availablePorts = append(availablePorts, portStr)
+	if num > 0 {
+		// the ports bound on the host are skipped until the request is done
+		bound := make(map[string]struct{})
+		for i, req := range reqs {
+			if ports[i] != "" {
+				continue
+			}
+			port, ok := ps.pick(req.Protocol, bound)
+			if !ok {
+				err = xerrors.NewPortNotEnoughError()
+				return nil, err
+			}
+			ports[i] = strconv.Itoa(port)
+			ps.UsedPortSet[PortKey(ports[i], req.Protocol)] = struct{}{}
+			ps.NextPort = port + 1
 		}
 	}
 
-	go ps.putToEtcd()
+	return ports, nil
+}
 
-	return availablePorts, nil
+func (ps *portScheduler) applySpecific(req PortRequest) error {
+	port, err := strconv.Atoi(req.HostPort)
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.Errorf("invalid host port: %s", req.HostPort)
+	}
+	if _, ok := ps.ReservedPorts[req.HostPort]; ok {
+		return errors.Wrapf(xerrors.NewPortConflictError(), "port: %s is reserved", req.HostPort)
+	}
+	key := PortKey(req.HostPort, req.Protocol)
+	if _, ok := ps.UsedPortSet[key]; ok {
+		return errors.Wrapf(xerrors.NewPortConflictError(), "port: %s is used by other containers", key)
+	}
+	if portInUse(port, req.Protocol) {
+		return errors.Wrapf(xerrors.NewPortConflictError(), "port: %s is bound on the host", key)
+	}
+	ps.UsedPortSet[key] = struct{}{}
+	return nil
 }
 
-// Restore a specified number of ports
+// pick returns a free port of the protocol in the range by the strategy, the ports bound on the host are added to bound.
+// The range is scanned in place from the first port of the strategy, so nothing is allocated per port.
+func (ps *portScheduler) pick(protocol string, bound map[string]struct{}) (int, bool) {
+	size := ps.EndPort - ps.StartPort + 1
+	if size <= 0 {
+		return 0, false
+	}
+
+	var first int
+	switch ps.Strategy {
+	case PortStrategySequential:
+		first = ps.NextPort
+	case PortStrategyLowestFree:
+		first = ps.StartPort
+	default:
+		// most of the range is free usually, a few random tries find a port before a scan is needed
+		for i := 0; i < randomPortAttempts; i++ {
+			port := ps.StartPort + rand.IntN(size)
+			if ps.free(port, protocol, bound) {
+				return port, true
+			}
+		}
+		first = ps.StartPort + rand.IntN(size)
+	}
+	if first < ps.StartPort || first > ps.EndPort {
+		first = ps.StartPort
+	}
+
+	for i := 0; i < size; i++ {
+		port := ps.StartPort + (first-ps.StartPort+i)%size
+		if ps.free(port, protocol, bound) {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// free reports whether the port can be handed out, a port bound on the host is added to bound and not probed again
+func (ps *portScheduler) free(port int, protocol string, bound map[string]struct{}) bool {
+	number := strconv.Itoa(port)
+	key := PortKey(number, protocol)
+	if _, ok := ps.UsedPortSet[key]; ok {
+		return false
+	}
+	if _, ok := ps.ReservedPorts[number]; ok {
+		return false
+	}
+	if _, ok := bound[key]; ok {
+		return false
+	}
+	if portInUse(port, protocol) {
+		bound[key] = struct{}{}
+		return false
+	}
+	return true
+}
+
+// Restore a specified number of ports, they are the keys returned by PortKey
 func (ps *portScheduler) Restore(ports []string) {
 	if len(ports) <= 0 || len(ports) > ps.AvailableCount {
 		return
 	}
 
+	ps.release(ports)
+
+	go ps.putToEtcd()
+	signalReleased()
+}
+
+// release is Restore without persistence, it is used by the reservation
+func (ps *portScheduler) release(ports []string) {
 	ps.Lock()
 	defer ps.Unlock()
 
 	ps.restore(ports)
-
-	go ps.putToEtcd()
 }
 
 func (ps *portScheduler) restore(ports []string) {
 	for _, port := range ports {
-		delete(ps.UsedPortSet, port)
+		if port != "" {
+			delete(ps.UsedPortSet, PortKey(port, "tcp"))
+		}
+	}
+}
+
+// PortKey returns the key of a host port in UsedPortSet, e.g. 40022/tcp,
+// the port is returned as it is if it already has a protocol
+func PortKey(port, protocol string) string {
+	if strings.Contains(port, "/") {
+		return port
+	}
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	return port + "/" + protocol
+}
+
+// PortKeys returns the key of each host port applied for the requests, the empty ports are kept empty
+func PortKeys(reqs []PortRequest, ports []string) []string {
+	keys := make([]string, len(ports))
+	for i, port := range ports {
+		if port != "" {
+			keys[i] = PortKey(port, reqs[i].Protocol)
+		}
 	}
+	return keys
 }
 
-func (ps *portScheduler) serialize() *string {
+// items one key per used port, and the keys of the port range and NextPort
+func (ps *portScheduler) items() map[string]string {
 	ps.RLock()
 	defer ps.RUnlock()
 
-	bytes, _ := json.Marshal(ps)
-	tmp := string(bytes)
-	return &tmp
+	items := make(map[string]string, len(ps.UsedPortSet)+2)
+	for port := range ps.UsedPortSet {
+		items[port] = "used"
+	}
+	bytes, _ := json.Marshal(portRangeState{
+		StartPort:      ps.StartPort,
+		EndPort:        ps.EndPort,
+		AvailableCount: ps.AvailableCount,
+	})
+	items[portRangeKey] = string(bytes)
+	items[nextPortKey] = strconv.Itoa(ps.NextPort)
+	return items
 }
 
 // GetPortStatus get all ports status
@@ -142,6 +393,12 @@ func (ps *portScheduler) GetPortStatus() *portScheduler {
 		StartPort:      ps.StartPort,
 		EndPort:        ps.EndPort,
 		AvailableCount: ps.AvailableCount,
+		NextPort:       ps.NextPort,
+		Strategy:       ps.Strategy,
+		ReservedPorts:  make(map[string]struct{}, len(ps.ReservedPorts)),
+	}
+	for k := range ps.ReservedPorts {
+		copyPS.ReservedPorts[k] = struct{}{}
 	}
 
 	// sort
@@ -160,12 +417,12 @@ func (ps *portScheduler) GetPortStatus() *portScheduler {
 	return copyPS
 }
 
+func (ps *portScheduler) etcdStore() *etcd.Store {
+	return ps.store
+}
+
 func (ps *portScheduler) putToEtcd() {
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Gpus,
-		Key:      gpuStatusMapKey,
-		Value:    GpuScheduler.serialize(),
-	}
+	persist(ps)
 }
 
 func splitPortRange(portRange string) (startPort, endPort int, err error) {
@@ -190,3 +447,53 @@ func splitPortRange(portRange string) (startPort, endPort int, err error) {
 
 	return
 }
+
+// parsePortList parses the reserved ports, e.g. 22,80,443,8000-8100
+func parsePortList(list string) (map[string]struct{}, error) {
+	ports := make(map[string]struct{})
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		start, end := 0, 0
+		if strings.Contains(part, "-") {
+			var err error
+			if start, end, err = splitPortRange(part); err != nil {
+				return nil, err
+			}
+		} else {
+			port, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, errors.Errorf("invalid port: %s", part)
+			}
+			start, end = port, port
+		}
+		if start <= 0 || end > 65535 {
+			return nil, errors.Errorf("invalid port values, startPort: %d, endPort: %d", start, end)
+		}
+		for port := start; port <= end; port++ {
+			ports[strconv.Itoa(port)] = struct{}{}
+		}
+	}
+	return ports, nil
+}
+
+// portInUse probes whether the port is bound on the host by a process outside the api
+func portInUse(port int, protocol string) bool {
+	address := net.JoinHostPort("", strconv.Itoa(port))
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return true
+		}
+		_ = conn.Close()
+		return false
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return true
+	}
+	_ = l.Close()
+	return false
+}
@@ -0,0 +1,87 @@
+package schedulers
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParsePortList(t *testing.T) {
+	ports, err := parsePortList(" 22, 80,8000-8002,,80")
+	if err != nil {
+		t.Fatalf("parsePortList: %v", err)
+	}
+	if len(ports) != 5 {
+		t.Fatalf("ports = %v, want 22, 80 and 8000-8002", ports)
+	}
+	for _, port := range []string{"22", "80", "8000", "8001", "8002"} {
+		if _, ok := ports[port]; !ok {
+			t.Fatalf("port %s is missing in %v", port, ports)
+		}
+	}
+
+	for _, list := range []string{"0", "65536", "ssh", "8100-8000", "1-2-3"} {
+		if _, err := parsePortList(list); err == nil {
+			t.Errorf("parsePortList(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestApplyKeepsProtocolsApart(t *testing.T) {
+	ps := &portScheduler{
+		StartPort:      41000,
+		EndPort:        41009,
+		AvailableCount: 10,
+		UsedPortSet:    map[string]struct{}{"41000/tcp": {}},
+		Strategy:       PortStrategyLowestFree,
+		ReservedPorts:  map[string]struct{}{"41001": {}},
+	}
+
+	// the udp port of a used tcp port is free, a reserved port is never handed out
+	ports, err := ps.apply([]PortRequest{{Protocol: "udp"}, {Protocol: "tcp"}}, nil)
+	if err != nil || ports[0] != "41000" || ports[1] != "41002" {
+		t.Fatalf("ports = %v, err = %v, want 41000 and 41002", ports, err)
+	}
+	if _, err = ps.apply([]PortRequest{{Protocol: "udp", HostPort: "41000"}}, nil); err == nil {
+		t.Fatal("the used udp port is applied again")
+	}
+
+	ps.restore(PortKeys([]PortRequest{{Protocol: "udp"}, {Protocol: "tcp"}}, ports))
+	if _, ok := ps.UsedPortSet["41000/tcp"]; !ok || len(ps.UsedPortSet) != 1 {
+		t.Fatalf("used ports = %v, want only 41000/tcp", ps.UsedPortSet)
+	}
+}
+
+func TestPickFollowsTheStrategy(t *testing.T) {
+	ps := &portScheduler{
+		StartPort:   42000,
+		EndPort:     42009,
+		UsedPortSet: map[string]struct{}{"42008/tcp": {}},
+		NextPort:    42008,
+		Strategy:    PortStrategySequential,
+	}
+	if port, ok := ps.pick("tcp", make(map[string]struct{})); !ok || port != 42009 {
+		t.Fatalf("port = %d, want 42009 after the used 42008", port)
+	}
+
+	// the range is full
+	for port := 42000; port <= 42009; port++ {
+		ps.UsedPortSet[PortKey(strconv.Itoa(port), "tcp")] = struct{}{}
+	}
+	ps.Strategy = PortStrategyRandom
+	if port, ok := ps.pick("tcp", make(map[string]struct{})); ok {
+		t.Fatalf("port = %d, want none in the full range", port)
+	}
+}
+
+func TestPortKey(t *testing.T) {
+	for _, tt := range []struct{ port, protocol, want string }{
+		{"40022", "tcp", "40022/tcp"},
+		{"40022", "udp", "40022/udp"},
+		{"40022", "", "40022/tcp"},
+		{"40022/udp", "tcp", "40022/udp"},
+	} {
+		if got := PortKey(tt.port, tt.protocol); got != tt.want {
+			t.Errorf("PortKey(%s, %s) = %s, want %s", tt.port, tt.protocol, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package schedulers
+
+// Holding is the resources a running container gives back when it is stopped,
+// the memory is held by the replicaSet and the rootfs is kept until it is deleted
+type Holding struct {
+	// Name is the replicaSet name
+	Name       string
+	Gpus       []string
+	Cpus       []string
+	SharedCpus int
+	Ports      []string
+}
+
+// Restore gives back the resources of the holding, they stay used until the reservation is committed
+func (r *Reservation) Restore(h Holding) {
+	r.RestoreGpus(h.Gpus)
+	r.RestoreCpus(h.Cpus)
+	if h.SharedCpus > 0 {
+		r.RestoreSharedCpus(h.SharedCpus)
+	}
+	r.RestoreMemory(h.Name)
+	r.RestorePorts(h.Ports)
+}
+
+// Preempt finds the fewest holdings that must be given back for the request to fit,
+// then restores them and reserves the request in a single reservation,
+// so the freed resources are never seen by others before the request holds them.
+// The holdings are tried in order, the ones the request fits without are left out,
+// so a holding without the scarce resource is never chosen.
+// chosen are the indexes of the restored holdings, nothing is changed if the request doesn't fit with all of them.
+// The holdings are not released if the reservation is, unless KeepRestored is called after they are stopped.
+func Preempt(req *ResourceRequest, holdings []Holding) (res *Reservation, chosen []int, err error) {
+	// opened before applyMu is held, it waits while the schedulers are rebuilt
+	res = NewReservation()
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	all := make([]int, 0, len(holdings))
+	for i := range holdings {
+		all = append(all, i)
+	}
+	if err = tryHoldings(req, holdings, all); err != nil {
+		res.finish()
+		return nil, nil, err
+	}
+
+	// the shortest prefix, the holdings of the lowest priority come first
+	for n := 0; n <= len(all); n++ {
+		if tryHoldings(req, holdings, all[:n]) == nil {
+			chosen = append(chosen, all[:n]...)
+			break
+		}
+	}
+	// leave out the ones that are not needed by the others, from the highest priority
+	for i := len(chosen) - 1; i >= 0; i-- {
+		without := append(append([]int(nil), chosen[:i]...), chosen[i+1:]...)
+		if tryHoldings(req, holdings, without) == nil {
+			chosen = without
+		}
+	}
+
+	res.preempting = true
+	defer func() { res.preempting = false }()
+	for _, i := range chosen {
+		res.Restore(holdings[i])
+	}
+	if err = res.Reserve(req.Clone()); err != nil {
+		res.undoAll()
+		res.finish()
+		return nil, nil, err
+	}
+	return res, chosen, nil
+}
+
+// tryHoldings reports whether the request fits after the holdings are given back, the schedulers are left unchanged
+func tryHoldings(req *ResourceRequest, holdings []Holding, chosen []int) error {
+	trial := newReservation()
+	trial.preempting = true
+	defer trial.undoAll()
+
+	for _, i := range chosen {
+		trial.Restore(holdings[i])
+	}
+	return trial.Reserve(req.Clone())
+}
@@ -0,0 +1,104 @@
+package schedulers
+
+import (
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// newTestSchedulers replaces the gpu and memory schedulers with ones of the gpus all used
+func newTestSchedulers(t *testing.T, gpus ...string) {
+	t.Helper()
+	gs, ms := GpuScheduler, MemoryScheduler
+	t.Cleanup(func() { GpuScheduler, MemoryScheduler = gs, ms })
+
+	GpuScheduler = &gpuScheduler{
+		AvailableGpuNums: len(gpus),
+		GpuStatusMap:     make(map[string]byte),
+		UnhealthyGpuMap:  make(map[string]*GpuHealth),
+		GpuInfoMap:       make(map[string]*GpuInfo),
+	}
+	for _, gpu := range gpus {
+		GpuScheduler.GpuStatusMap[gpu] = GpuUsed
+	}
+	MemoryScheduler = newMemoryScheduler()
+	MemoryScheduler.AvailableMemory = 64 << 30
+	MemoryScheduler.Allocations = map[string]int64{"foo": 16 << 30, "bar": 16 << 30, "baz": 16 << 30, "qux": 16 << 30}
+}
+
+func usedGpus() int {
+	var used int
+	for _, status := range GpuScheduler.GpuStatusMap {
+		if status == GpuUsed {
+			used++
+		}
+	}
+	return used
+}
+
+func TestPreemptChoosesTheFewestHoldings(t *testing.T) {
+	newTestSchedulers(t, "gpu0", "gpu1", "gpu2", "gpu3")
+	holdings := []Holding{
+		// no gpus, it doesn't help
+		{Name: "foo"},
+		{Name: "bar", Gpus: []string{"gpu0"}},
+		{Name: "baz", Gpus: []string{"gpu1", "gpu2"}},
+		{Name: "qux", Gpus: []string{"gpu3"}},
+	}
+
+	res, chosen, err := Preempt(&ResourceRequest{Name: "new", Gpu: &GpuRequest{Count: 2}}, holdings)
+	if err != nil {
+		t.Fatalf("Preempt: %v", err)
+	}
+	if len(chosen) != 1 || chosen[0] != 2 {
+		t.Fatalf("chosen = %v, want only baz", chosen)
+	}
+	if len(res.Gpus) != 2 || usedGpus() != 4 {
+		t.Fatalf("gpus = %v, used = %d, want the 2 gpus of baz held by the request", res.Gpus, usedGpus())
+	}
+	if _, ok := MemoryScheduler.Allocations["baz"]; !ok {
+		t.Fatal("the memory of baz is given back before baz is stopped")
+	}
+
+	// the victims are stopped, only the request is undone
+	res.KeepRestored()
+	if _, ok := MemoryScheduler.Allocations["baz"]; ok {
+		t.Fatal("the memory of baz is not given back")
+	}
+	if _, ok := MemoryScheduler.Allocations["foo"]; !ok {
+		t.Fatal("the memory of foo is given back, but foo is not chosen")
+	}
+	res.undoAll()
+	res.finish()
+	if usedGpus() != 2 {
+		t.Fatalf("used = %d, want the gpus of baz free", usedGpus())
+	}
+}
+
+func TestPreemptReleaseTakesTheHoldingsBack(t *testing.T) {
+	newTestSchedulers(t, "gpu0", "gpu1")
+	holdings := []Holding{{Name: "foo", Gpus: []string{"gpu0"}}, {Name: "bar", Gpus: []string{"gpu1"}}}
+
+	res, chosen, err := Preempt(&ResourceRequest{Name: "new", Gpu: &GpuRequest{Count: 2}}, holdings)
+	if err != nil || len(chosen) != 2 {
+		t.Fatalf("chosen = %v, err = %v, want both", chosen, err)
+	}
+	res.undoAll()
+	res.finish()
+	if usedGpus() != 2 || MemoryScheduler.Allocations["foo"] == 0 {
+		t.Fatalf("used = %d, allocations = %v, want the holdings taken back", usedGpus(), MemoryScheduler.Allocations)
+	}
+}
+
+func TestPreemptChangesNothingIfTheRequestNeverFits(t *testing.T) {
+	newTestSchedulers(t, "gpu0", "gpu1")
+	holdings := []Holding{{Name: "foo", Gpus: []string{"gpu0"}}}
+
+	_, _, err := Preempt(&ResourceRequest{Name: "new", Gpu: &GpuRequest{Count: 2}}, holdings)
+	if !xerrors.IsGpuNotEnoughError(err) {
+		t.Fatalf("err = %v, want gpu not enough", err)
+	}
+	if usedGpus() != 2 || len(MemoryScheduler.Allocations) != 4 {
+		t.Fatalf("used = %d, allocations = %v, want nothing changed", usedGpus(), MemoryScheduler.Allocations)
+	}
+}
@@ -0,0 +1,199 @@
+package schedulers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	DriftGpu       = "gpu"
+	DriftCpu       = "cpu"
+	DriftSharedCpu = "sharedCpu"
+	DriftMemory    = "memory"
+	DriftDisk      = "disk"
+	DriftPort      = "port"
+)
+
+// Holdings are the resources actually held by the containers, they are rebuilt from docker by the reconciler
+type Holdings struct {
+	// uuid -> container
+	Gpus map[string]string
+	// cpu id -> container
+	Cpus map[string]string
+	// the number of cpus of the shared pool used by containers in shared mode
+	SharedCpus int
+	// replicaSet name -> bytes
+	Memory map[string]int64
+	// replicaSet name -> rootfs bytes
+	Disk map[string]int64
+	// host port/protocol -> container
+	Ports map[string]string
+}
+
+func NewHoldings() *Holdings {
+	return &Holdings{
+		Gpus:   make(map[string]string),
+		Cpus:   make(map[string]string),
+		Memory: make(map[string]int64),
+		Disk:   make(map[string]int64),
+		Ports:  make(map[string]string),
+	}
+}
+
+// Drift is a resource whose state recorded by the scheduler differs from the holdings
+type Drift struct {
+	Resource string `json:"resource"`
+	ID       string `json:"id"`
+	Recorded string `json:"recorded"`
+	Actual   string `json:"actual"`
+	Holder   string `json:"holder,omitempty"`
+}
+
+// Diff returns the drifts between the schedulers and the holdings, ordered by resource and id
+func Diff(h *Holdings) []Drift {
+	var drifts []Drift
+
+	GpuScheduler.RLock()
+	for uuid, status := range GpuScheduler.GpuStatusMap {
+		holder, held := h.Gpus[uuid]
+		if status == GpuUsed && !held {
+			drifts = append(drifts, Drift{Resource: DriftGpu, ID: uuid, Recorded: "used", Actual: "free"})
+		} else if status != GpuUsed && held {
+			drifts = append(drifts, Drift{Resource: DriftGpu, ID: uuid, Recorded: gpuStatusName(status), Actual: "used", Holder: holder})
+		}
+	}
+	for uuid, holder := range h.Gpus {
+		if _, ok := GpuScheduler.GpuStatusMap[uuid]; !ok {
+			drifts = append(drifts, Drift{Resource: DriftGpu, ID: uuid, Recorded: "unknown", Actual: "used", Holder: holder})
+		}
+	}
+	GpuScheduler.RUnlock()
+
+	CpuScheduler.RLock()
+	for cpu, status := range CpuScheduler.CpuStatusMap {
+		holder, held := h.Cpus[cpu]
+		if status == 1 && !held {
+			drifts = append(drifts, Drift{Resource: DriftCpu, ID: cpu, Recorded: "used", Actual: "free"})
+		} else if status != 1 && held {
+			drifts = append(drifts, Drift{Resource: DriftCpu, ID: cpu, Recorded: "free", Actual: "used", Holder: holder})
+		}
+	}
+	for cpu, holder := range h.Cpus {
+		if _, ok := CpuScheduler.CpuStatusMap[cpu]; !ok {
+			drifts = append(drifts, Drift{Resource: DriftCpu, ID: cpu, Recorded: "unknown", Actual: "used", Holder: holder})
+		}
+	}
+	if CpuScheduler.SharedCpuUsed != h.SharedCpus {
+		drifts = append(drifts, Drift{Resource: DriftSharedCpu, ID: "used",
+			Recorded: strconv.Itoa(CpuScheduler.SharedCpuUsed), Actual: strconv.Itoa(h.SharedCpus)})
+	}
+	CpuScheduler.RUnlock()
+
+	MemoryScheduler.RLock()
+	drifts = append(drifts, diffAllocations(DriftMemory, MemoryScheduler.Allocations, h.Memory)...)
+	MemoryScheduler.RUnlock()
+
+	DiskScheduler.RLock()
+	drifts = append(drifts, diffAllocations(DriftDisk, DiskScheduler.Allocations, h.Disk)...)
+	DiskScheduler.RUnlock()
+
+	PortScheduler.RLock()
+	for port := range PortScheduler.UsedPortSet {
+		if _, held := h.Ports[port]; !held {
+			drifts = append(drifts, Drift{Resource: DriftPort, ID: port, Recorded: "used", Actual: "free"})
+		}
+	}
+	for port, holder := range h.Ports {
+		if _, ok := PortScheduler.UsedPortSet[port]; !ok {
+			drifts = append(drifts, Drift{Resource: DriftPort, ID: port, Recorded: "free", Actual: "used", Holder: holder})
+		}
+	}
+	PortScheduler.RUnlock()
+
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].Resource != drifts[j].Resource {
+			return drifts[i].Resource < drifts[j].Resource
+		}
+		return drifts[i].ID < drifts[j].ID
+	})
+	return drifts
+}
+
+// Rebuild replaces the used resources of all schedulers with the holdings,
+// a gpu or cpu that the schedulers don't know is left out.
+func Rebuild(h *Holdings) {
+	GpuScheduler.Lock()
+	for uuid := range GpuScheduler.GpuStatusMap {
+		if _, held := h.Gpus[uuid]; held {
+			GpuScheduler.GpuStatusMap[uuid] = GpuUsed
+			continue
+		}
+		GpuScheduler.restore([]string{uuid})
+	}
+	GpuScheduler.Unlock()
+
+	CpuScheduler.Lock()
+	for cpu := range CpuScheduler.CpuStatusMap {
+		if _, held := h.Cpus[cpu]; held {
+			CpuScheduler.CpuStatusMap[cpu] = 1
+			continue
+		}
+		_ = CpuScheduler.restore([]string{cpu})
+	}
+	CpuScheduler.SharedCpuUsed = h.SharedCpus
+	CpuScheduler.Unlock()
+
+	MemoryScheduler.Lock()
+	MemoryScheduler.Allocations = copyAllocations(h.Memory)
+	MemoryScheduler.Unlock()
+
+	DiskScheduler.Lock()
+	DiskScheduler.Allocations = copyAllocations(h.Disk)
+	DiskScheduler.Unlock()
+
+	PortScheduler.Lock()
+	PortScheduler.UsedPortSet = make(map[string]struct{}, len(h.Ports))
+	for port := range h.Ports {
+		PortScheduler.UsedPortSet[port] = struct{}{}
+	}
+	PortScheduler.Unlock()
+
+	persist(GpuScheduler, CpuScheduler, MemoryScheduler, DiskScheduler, PortScheduler)
+	signalReleased()
+}
+
+func diffAllocations(resource string, recorded, actual map[string]int64) []Drift {
+	var drifts []Drift
+	for name, bytes := range recorded {
+		if held, ok := actual[name]; !ok {
+			drifts = append(drifts, Drift{Resource: resource, ID: name, Recorded: fmt.Sprint(bytes), Actual: "0"})
+		} else if held != bytes {
+			drifts = append(drifts, Drift{Resource: resource, ID: name, Recorded: fmt.Sprint(bytes), Actual: fmt.Sprint(held), Holder: name})
+		}
+	}
+	for name, held := range actual {
+		if _, ok := recorded[name]; !ok {
+			drifts = append(drifts, Drift{Resource: resource, ID: name, Recorded: "0", Actual: fmt.Sprint(held), Holder: name})
+		}
+	}
+	return drifts
+}
+
+func copyAllocations(allocations map[string]int64) map[string]int64 {
+	copyMap := make(map[string]int64, len(allocations))
+	for k, v := range allocations {
+		copyMap[k] = v
+	}
+	return copyMap
+}
+
+func gpuStatusName(status byte) string {
+	switch status {
+	case GpuUsed:
+		return "used"
+	case GpuUnhealthy:
+		return "unhealthy"
+	}
+	return "free"
+}
@@ -1,9 +1,100 @@
 package schedulers
 
+import (
+	"strconv"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+)
+
+// the directory of the keys of each scheduler, e.g. /gpu-docker-api/apis/v1/gpus/state/<uuid>
+const stateDir = "state"
+
+// Scheduler is implemented by all resource schedulers,
+// the states of the schedulers touched by a reservation are persisted together in a single etcd transaction.
 type Scheduler interface {
-	Apply(int) ([]string, error)
-	Restore([]string)
-	serialize() *string
+	// etcdStore returns the store that mirrors the state of the scheduler to one etcd key per item
+	etcdStore() *etcd.Store
+	// items returns the state of the scheduler, etcd key -> value
+	items() map[string]string
 	putToEtcd()
-	restore([]string)
+}
+
+var (
+	_ Scheduler = (*gpuScheduler)(nil)
+	_ Scheduler = (*cpuScheduler)(nil)
+	_ Scheduler = (*memoryScheduler)(nil)
+	_ Scheduler = (*diskScheduler)(nil)
+	_ Scheduler = (*portScheduler)(nil)
+)
+
+// released is signaled when resources are given back, the pending queue waits for it
+var released = make(chan struct{}, 1)
+
+// Released returns the channel that is signaled when resources are given back
+func Released() <-chan struct{} {
+	return released
+}
+
+func signalReleased() {
+	select {
+	case released <- struct{}{}:
+	default:
+	}
+}
+
+// CloseSchedulers syncs the states of all schedulers to etcd in a single transaction
+func CloseSchedulers() error {
+	return stores(GpuScheduler, CpuScheduler, MemoryScheduler, DiskScheduler, PortScheduler).Sync()
+}
+
+// persist queues a sync of the states of the schedulers to etcd in a single transaction,
+// the states are read when it is queued, so a later call always queues a later state.
+// It must not be called while holding the lock of a scheduler.
+func persist(schedulers ...Scheduler) {
+	workQueue.Add(stores(schedulers...))
+}
+
+func stores(schedulers ...Scheduler) etcd.Stores {
+	ss := make(etcd.Stores, 0, len(schedulers))
+	for _, s := range schedulers {
+		ss = append(ss, s.etcdStore())
+	}
+	return ss
+}
+
+// migrate writes the state initialized at startup to the keys of the scheduler and deletes the blob key of older versions,
+// nothing is written if the state was loaded from the keys and has not changed.
+func migrate(s Scheduler, blobKey string, blob []byte) error {
+	if err := s.etcdStore().Migrate(blobKey); err != nil {
+		return err
+	}
+	if len(blob) != 0 {
+		log.Infof("the state in %s is migrated to one etcd key per item", blobKey)
+	}
+	return nil
+}
+
+// allocationItems converts the allocations of the memory and disk schedulers to the etcd keys, name -> bytes
+func allocationItems(allocations map[string]int64) map[string]string {
+	items := make(map[string]string, len(allocations))
+	for name, bytes := range allocations {
+		items[name] = strconv.FormatInt(bytes, 10)
+	}
+	return items
+}
+
+func parseAllocations(items map[string]string) (map[string]int64, error) {
+	allocations := make(map[string]int64, len(items))
+	for name, value := range items {
+		bytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return allocations, errors.Wrapf(err, "strconv.ParseInt failed, key: %s, value: %s", name, value)
+		}
+		allocations[name] = bytes
+	}
+	return allocations, nil
 }
@@ -0,0 +1,147 @@
+package schedulers
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	sysNodePath        = "/sys/devices/system/node"
+	gpuTopologyCommand = "nvidia-smi topo -m"
+
+	// unknownNumaNode is used when the host has no numa information
+	unknownNumaNode = -1
+)
+
+var topologyReader = newTopologyReader()
+
+// TopologyReader reads the numa topology of the host,
+// it is an interface so that fixtures can be used instead of the real host.
+type TopologyReader interface {
+	// CpuNodes returns cpu id -> numa node
+	CpuNodes() (map[string]int, error)
+	// GpuNodes returns gpu index -> numa node
+	GpuNodes() (map[int]int, error)
+}
+
+// SetTopologyReader replaces the topology reader, it must be called before the schedulers are initialized
+func SetTopologyReader(reader TopologyReader) {
+	topologyReader = reader
+}
+
+// SysfsTopologyReader reads the cpus of each node from sysfs and the gpu affinity from nvidia-smi,
+// both NodePath and Runner can point to fixtures.
+type SysfsTopologyReader struct {
+	NodePath string
+	Runner   utils.CommandRunner
+}
+
+func (r *SysfsTopologyReader) CpuNodes() (map[string]int, error) {
+	entries, err := os.ReadDir(r.NodePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// not a numa machine
+			return map[string]int{}, nil
+		}
+		return nil, errors.Wrapf(err, "os.ReadDir failed, path: %s", r.NodePath)
+	}
+
+	cpuNodes := make(map[string]int)
+	for _, entry := range entries {
+		node, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "node"))
+		if err != nil || !strings.HasPrefix(entry.Name(), "node") {
+			continue
+		}
+		bytes, err := os.ReadFile(filepath.Join(r.NodePath, entry.Name(), "cpulist"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "os.ReadFile failed, node: %s", entry.Name())
+		}
+		cpus, err := utils.ParseCpuList(string(bytes))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "utils.ParseCpuList failed, node: %s", entry.Name())
+		}
+		for _, cpu := range cpus {
+			cpuNodes[strconv.Itoa(cpu)] = node
+		}
+	}
+	return cpuNodes, nil
+}
+
+func (r *SysfsTopologyReader) GpuNodes() (map[int]int, error) {
+	output, err := r.Runner.Run(gpuTopologyCommand)
+	if err != nil {
+		return nil, errors.WithMessage(err, "query gpu topology failed")
+	}
+	return parseGpuTopology(output), nil
+}
+
+// parseGpuTopology parses the NUMA Affinity column of `nvidia-smi topo -m`, e.g.
+//
+//		GPU0	GPU1	CPU Affinity	NUMA Affinity	GPU NUMA ID
+//	GPU0	 X 	NV12	0-63	0		N/A
+//	GPU1	NV12	 X 	64-127	1		N/A
+func parseGpuTopology(output string) map[int]int {
+	gpuNodes := make(map[int]int)
+	column := -1
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if column == -1 {
+			for i := range fields {
+				if strings.TrimSpace(fields[i]) == "NUMA Affinity" {
+					column = i
+					break
+				}
+			}
+			continue
+		}
+
+		label := strings.TrimSpace(fields[0])
+		if !strings.HasPrefix(label, "GPU") || len(fields) <= column {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(label, "GPU"))
+		if err != nil {
+			continue
+		}
+		// the affinity may be a range such as 0-1, the first node is the closest one
+		affinity := strings.SplitN(strings.TrimSpace(fields[column]), "-", 2)[0]
+		node, err := strconv.Atoi(affinity)
+		if err != nil {
+			continue
+		}
+		gpuNodes[index] = node
+	}
+	return gpuNodes
+}
+
+// fillGpuNumaNodes sets the numa node of the gpus discovered
+func fillGpuNumaNodes(gpus []*GpuInfo) {
+	gpuNodes, err := topologyReader.GpuNodes()
+	if err != nil {
+		log.Warnf("topologyReader.GpuNodes failed, cpus will not be aligned with gpus, err: %v", err)
+	}
+	for _, g := range gpus {
+		g.NumaNode = unknownNumaNode
+		if node, ok := gpuNodes[g.Index]; ok {
+			g.NumaNode = node
+		}
+	}
+}
+
+// sortedNodes returns the unique numa nodes in ascending order
+func sortedNodes(nodes map[int]struct{}) []int {
+	resp := make([]int, 0, len(nodes))
+	for node := range nodes {
+		resp = append(resp, node)
+	}
+	sort.Ints(resp)
+	return resp
+}
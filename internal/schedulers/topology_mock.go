@@ -0,0 +1,44 @@
+//go:build mock
+
+package schedulers
+
+import (
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// mockTopologyReader reads the cpus from the real host,
+// and pretends that half of the mock gpus are attached to the last numa node.
+type mockTopologyReader struct {
+	SysfsTopologyReader
+}
+
+func newTopologyReader() TopologyReader {
+	return &mockTopologyReader{
+		SysfsTopologyReader: SysfsTopologyReader{
+			NodePath: sysNodePath,
+			Runner:   utils.ShellRunner{},
+		},
+	}
+}
+
+func (r *mockTopologyReader) GpuNodes() (map[int]int, error) {
+	cpuNodes, err := r.CpuNodes()
+	if err != nil {
+		return nil, err
+	}
+	last := 0
+	for _, node := range cpuNodes {
+		if node > last {
+			last = node
+		}
+	}
+
+	gpuNodes := make(map[int]int, 8)
+	for i := 0; i < 8; i++ {
+		gpuNodes[i] = 0
+		if i >= 4 {
+			gpuNodes[i] = last
+		}
+	}
+	return gpuNodes, nil
+}
@@ -0,0 +1,14 @@
+//go:build !mock
+
+package schedulers
+
+import (
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+func newTopologyReader() TopologyReader {
+	return &SysfsTopologyReader{
+		NodePath: sysNodePath,
+		Runner:   utils.ShellRunner{},
+	}
+}
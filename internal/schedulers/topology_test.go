@@ -0,0 +1,23 @@
+package schedulers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGpuTopology(t *testing.T) {
+	output := "\tGPU0\tGPU1\tGPU2\tNIC0\tCPU Affinity\tNUMA Affinity\tGPU NUMA ID\n" +
+		"GPU0\t X \tNV12\tSYS\tNODE\t0-63\t0\t\tN/A\n" +
+		"GPU1\tNV12\t X \tSYS\tSYS\t64-127\t1\t\tN/A\n" +
+		"GPU2\tSYS\tSYS\t X \tSYS\t0-127\t0-1\t\tN/A\n" +
+		"NIC0\tNODE\tSYS\tSYS\t X \n" +
+		"\n" +
+		"Legend:\n" +
+		"\n" +
+		"  X    = Self\n"
+
+	want := map[int]int{0: 0, 1: 1, 2: 0}
+	if got := parseGpuTopology(output); !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseGpuTopology = %v, want %v", got, want)
+	}
+}
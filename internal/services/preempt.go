@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/moby/moby/client"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/priority"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// preemptionVictim is a running replicaSet that can be stopped for a request of higher priority
+type preemptionVictim struct {
+	name      string
+	container string
+	owner     string
+	class     models.PriorityClass
+	holding   schedulers.Holding
+}
+
+// preempt stops the fewest preemptible replicaSets of lower priority that the request needs,
+// the lower priority is chosen first. The resources of the victims are held for the request in the returned reservation
+// before any of them is stopped, so nobody else can take them. cause is the error of the first reservation,
+// it is returned if the request doesn't fit even if all victims are stopped.
+func (rs *ReplicaSetService) preempt(spec *models.ContainerRun, req *schedulers.ResourceRequest, cause error) (*schedulers.Reservation, error) {
+	class, err := priority.Classes.Get(spec.PriorityClass)
+	if err != nil || class.Value <= 0 {
+		return nil, cause
+	}
+	// the class may be restricted after the request is queued
+	if err = priority.Classes.Allowed(spec.PriorityClass, spec.Owner, spec.Group); err != nil {
+		log.Warnf("services.preempt, replicaSet: %s can't preempt, err: %v", spec.ReplicaSetName, err)
+		return nil, cause
+	}
+
+	victims := rs.preemptionVictims(spec.ReplicaSetName, class.Value)
+	if len(victims) == 0 {
+		return nil, cause
+	}
+	holdings := make([]schedulers.Holding, 0, len(victims))
+	for _, victim := range victims {
+		holdings = append(holdings, victim.holding)
+	}
+
+	res, chosen, err := schedulers.Preempt(req, holdings)
+	if err != nil {
+		if xerrors.IsResourceNotEnoughError(err) {
+			return nil, cause
+		}
+		return nil, errors.WithMessage(err, "schedulers.Preempt failed")
+	}
+
+	var stopped []preemptionVictim
+	for _, i := range chosen {
+		if err = rs.preemptReplicaSet(victims[i], spec.ReplicaSetName); err != nil {
+			res.Release()
+			rs.releaseStopped(stopped)
+			return nil, errors.WithMessagef(err, "preempt replicaSet: %s failed", victims[i].name)
+		}
+		stopped = append(stopped, victims[i])
+	}
+	// the victims are stopped, their resources are not taken back even if the request fails later
+	res.KeepRestored()
+	return res, nil
+}
+
+// preemptionVictims returns the running replicaSets whose priority class is preemptible and lower than the value,
+// with the resources they hold, the lower priority comes first
+func (rs *ReplicaSetService) preemptionVictims(exclude string, value int) []preemptionVictim {
+	var victims []preemptionVictim
+	ctx := context.Background()
+	for name, version := range vmap.ContainerVersionMap.Snapshot() {
+		if name == exclude {
+			continue
+		}
+		ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+		resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName, client.ContainerInspectOptions{})
+		if err != nil || !resp.Container.State.Running || resp.Container.Config == nil || resp.Container.HostConfig == nil {
+			continue
+		}
+		labels := resp.Container.Config.Labels
+		class, err := priority.Classes.Get(labels[models.PriorityClassLabel])
+		if err != nil || !class.Preemptible || class.Value >= value {
+			continue
+		}
+
+		resources := &resp.Container.HostConfig.Resources
+		holding := schedulers.Holding{
+			Name:  name,
+			Gpus:  inspectDeviceIDs(&resp.Container),
+			Cpus:  exclusiveCpus(resources),
+			Ports: hostPorts(resp.Container.HostConfig),
+		}
+		if resources.NanoCPUs > 0 {
+			holding.SharedCpus = cpuCount(resources)
+		}
+		victims = append(victims, preemptionVictim{
+			name:      name,
+			container: ctrVersionName,
+			owner:     labels[models.OwnerLabel],
+			class:     class,
+			holding:   holding,
+		})
+	}
+
+	sort.Slice(victims, func(i, j int) bool {
+		if victims[i].class.Value != victims[j].class.Value {
+			return victims[i].class.Value < victims[j].class.Value
+		}
+		return victims[i].name < victims[j].name
+	})
+	return victims
+}
+
+// preemptReplicaSet commits the replicaSet first if its class asks for it, then stops it and notifies the owner.
+// Its resources are already given back in the reservation of the request, so they are not restored here.
+func (rs *ReplicaSetService) preemptReplicaSet(victim preemptionVictim, by string) error {
+	var imageName string
+	if victim.class.CommitOnPreempt {
+		var err error
+		imageName, err = rs.CommitContainer(victim.name, models.ContainerCommit{
+			NewImageName: fmt.Sprintf("%s:preempted-%s", victim.name, time.Now().Format("20060102150405")),
+		})
+		if err != nil {
+			return errors.WithMessage(err, "services.CommitContainer failed")
+		}
+	}
+
+	// the resources are given back in the reservation, the victim is released like a stopped replicaSet
+	if err := rs.stopContainer(victim.container, true); err != nil {
+		return errors.WithMessagef(err, "services.stopContainer failed, name: %s", victim.container)
+	}
+
+	message := fmt.Sprintf("stopped for replicaSet %s of a higher priority", by)
+	if imageName != "" {
+		message += fmt.Sprintf(", the state is committed as image %s", imageName)
+	}
+	notify.Notifier.Notify(models.NotificationPreempted, victim.name, victim.owner, message)
+	log.Infof("services.preemptReplicaSet, replicaSet: %s of priority class: %s is preempted by replicaSet: %s",
+		victim.name, victim.class.Name, by)
+	return nil
+}
+
+// releaseStopped gives back the resources of the victims that were stopped before the preemption failed
+func (rs *ReplicaSetService) releaseStopped(victims []preemptionVictim) {
+	if len(victims) == 0 {
+		return
+	}
+	res := schedulers.NewReservation()
+	for _, victim := range victims {
+		res.Restore(victim.holding)
+	}
+	res.Commit()
+}
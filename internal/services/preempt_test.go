@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/client"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/usage"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+// emptyEtcd is an etcd that has no keys, the state is loaded from it and the writes are queued in the work queue
+type emptyEtcd struct {
+	etcdserverpb.UnimplementedKVServer
+}
+
+func (*emptyEtcd) Range(context.Context, *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	return &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func newTestEtcd(t *testing.T) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	etcdserverpb.RegisterKVServer(s, &emptyEtcd{})
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	if err = etcd.InitEtcdClient(lis.Addr().String()); err != nil {
+		t.Fatalf("etcd.InitEtcdClient: %v", err)
+	}
+	t.Cleanup(func() { _ = etcd.CloseEtcdClient() })
+}
+
+// newTestDocker is a docker daemon that stops the containers, the stopped ones are sent to the channel
+func newTestDocker(t *testing.T) <-chan string {
+	t.Helper()
+	stopped := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/stop") {
+			parts := strings.Split(r.URL.Path, "/")
+			stopped <- parts[len(parts)-2]
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithAPIVersion("1.52"))
+	if err != nil {
+		t.Fatalf("client.NewClientWithOpts: %v", err)
+	}
+	docker.Cli = cli
+	return stopped
+}
+
+func TestPreemptedVictimIsReleased(t *testing.T) {
+	newTestEtcd(t)
+	stopped := newTestDocker(t)
+	if err := vmap.InitVersionMap(); err != nil {
+		t.Fatalf("InitVersionMap: %v", err)
+	}
+	if err := InitStoppedContainers(); err != nil {
+		t.Fatalf("InitStoppedContainers: %v", err)
+	}
+	if err := usage.InitUsageLedger(time.Hour); err != nil {
+		t.Fatalf("InitUsageLedger: %v", err)
+	}
+	notify.InitNotifier("")
+	vmap.ContainerVersionMap.Set("foo", 2)
+
+	rs := new(ReplicaSetService)
+	victim := preemptionVictim{name: "foo", container: "foo-2", class: models.PriorityClass{Name: "low", Preemptible: true}}
+	if err := rs.preemptReplicaSet(victim, "bar"); err != nil {
+		t.Fatalf("preemptReplicaSet: %v", err)
+	}
+	if name := <-stopped; name != "foo-2" {
+		t.Fatalf("stopped = %s, want foo-2", name)
+	}
+
+	// the preemptor holds the resources now, restarting the victim must apply for them again
+	if !rs.ReplicaSetReleased("foo") {
+		t.Fatal("the preempted replicaSet is not released")
+	}
+	if rs.holdsResources("foo-2", false, false) {
+		t.Fatal("the preempted container still holds its resources")
+	}
+}
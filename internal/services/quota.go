@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/moby/moby/client"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/quota"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// quotaMu serializes the quota checks, so that concurrent requests can't pass the same quota together
+var quotaMu sync.Mutex
+
+// pendingDemands are the demands that passed the quota check but are not running in docker yet,
+// kind/name -> replicaSet/<name> or volume/<name> -> the demand, they are counted in the checks of others.
+var pendingDemands = make(map[string]map[string]*models.QuotaUsage)
+
+type QuotaService struct{}
+
+// Usage returns the resources used by the owner or the group
+func (qs *QuotaService) Usage(kind, name string) models.QuotaUsage {
+	var total models.QuotaUsage
+	for _, u := range qs.usage(kind, name) {
+		total = total.Add(u)
+	}
+	return total
+}
+
+// usage returns the resources used by the owner or the group, replicaSet/<name> or volume/<name> -> the usage
+func (qs *QuotaService) usage(kind, name string) map[string]models.QuotaUsage {
+	label := models.OwnerLabel
+	if kind == models.QuotaKindGroup {
+		label = models.GroupLabel
+	}
+
+	usages := make(map[string]models.QuotaUsage)
+	var rs ReplicaSetService
+	ctx := context.Background()
+	for rsName, version := range vmap.ContainerVersionMap.Snapshot() {
+		ctrVersionName := fmt.Sprintf("%s-%d", rsName, version)
+		resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName, client.ContainerInspectOptions{})
+		if err != nil || !resp.Container.State.Running || resp.Container.Config == nil {
+			continue
+		}
+		if resp.Container.Config.Labels[label] != name {
+			continue
+		}
+		uuids, _ := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+		usages[demandKey(rsName, "")] = models.QuotaUsage{
+			Gpus:        len(uuids),
+			Cpus:        cpuCount(&resp.Container.HostConfig.Resources),
+			Memory:      resp.Container.HostConfig.Memory,
+			ReplicaSets: 1,
+		}
+	}
+
+	var vs VolumeService
+	for volName := range vmap.VolumeVersionMap.Snapshot() {
+		info, err := vs.GetVolumeInfo(volName)
+		if err != nil || info.Opt == nil || info.Opt.Labels[label] != name {
+			continue
+		}
+		size, _ := utils.ToBytes(info.Opt.DriverOpts["size"])
+		usages[demandKey("", volName)] = models.QuotaUsage{
+			Volumes:    1,
+			VolumeSize: size,
+		}
+	}
+	return usages
+}
+
+func demandKey(replicaSet, volume string) string {
+	if volume != "" {
+		return "volume/" + volume
+	}
+	return "replicaSet/" + replicaSet
+}
+
+// checkQuota checks the demand of the replicaSet or the volume against the quotas of the owner and the group.
+// The demand is pending until the returned done is called after the operation, the pending demands of others
+// replace what they use in docker, so the checks don't wait for the docker operations of each other.
+func checkQuota(owner, group, replicaSet, volume string, demand models.QuotaUsage) (done func(), err error) {
+	var quotas []models.Quota
+	for kind, name := range map[string]string{models.QuotaKindUser: owner, models.QuotaKindGroup: group} {
+		if q, err := quota.Quotas.Get(kind, name); err == nil && name != "" {
+			quotas = append(quotas, q)
+		}
+	}
+	if len(quotas) == 0 {
+		return func() {}, nil
+	}
+
+	var qs QuotaService
+	self := demandKey(replicaSet, volume)
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	for _, q := range quotas {
+		usages := qs.usage(q.Kind, q.Name)
+		for k, pending := range pendingDemands[q.Kind+"/"+q.Name] {
+			usages[k] = *pending
+		}
+		current := usages[self]
+		delete(usages, self)
+		var others models.QuotaUsage
+		for _, u := range usages {
+			others = others.Add(u)
+		}
+		if err = quota.Check(q, others, current, demand); err != nil {
+			return func() {}, errors.WithMessage(err, "quota.Check failed")
+		}
+	}
+
+	pending := &demand
+	for _, q := range quotas {
+		principal := q.Kind + "/" + q.Name
+		if pendingDemands[principal] == nil {
+			pendingDemands[principal] = make(map[string]*models.QuotaUsage)
+		}
+		pendingDemands[principal][self] = pending
+	}
+	return func() {
+		quotaMu.Lock()
+		defer quotaMu.Unlock()
+
+		for _, q := range quotas {
+			principal := q.Kind + "/" + q.Name
+			// another operation of the same replicaSet or volume may have replaced it
+			if pendingDemands[principal][self] == pending {
+				delete(pendingDemands[principal], self)
+			}
+			if len(pendingDemands[principal]) == 0 {
+				delete(pendingDemands, principal)
+			}
+		}
+	}, nil
+}
+
+// checkContainerQuota checks the container that will be created from the info against the quotas of its labels
+func (rs *ReplicaSetService) checkContainerQuota(name string, info *models.EtcdContainerInfo) (unlock func(), err error) {
+	if info.Config == nil || info.Config.Labels == nil {
+		return func() {}, nil
+	}
+	return checkQuota(info.Config.Labels[models.OwnerLabel], info.Config.Labels[models.GroupLabel], name, "",
+		models.QuotaUsage{
+			Gpus:        len(rs.infoDeviceIDs(info)),
+			Cpus:        cpuCount(&info.HostConfig.Resources),
+			Memory:      info.HostConfig.Memory,
+			ReplicaSets: 1,
+		})
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+const (
+	// ReconcileModeReport only reports the drifts, nothing is changed
+	ReconcileModeReport = "report"
+	// ReconcileModeRepair fixes the version map and rebuilds the schedulers from docker
+	ReconcileModeRepair = "repair"
+)
+
+// e.g. foo-3, the replicaSet name can't contain a dash
+var containerVersionRegexp = regexp.MustCompile(`^([^-]+)-(\d+)$`)
+
+// reconcileMu prevents two reconciliations from rebuilding the schedulers at the same time
+var reconcileMu sync.Mutex
+
+// repairTimeout is how long the repair waits for the open reservations
+const repairTimeout = 30 * time.Second
+
+// ReconcileReport is the difference between the state loaded from etcd and the containers in docker
+type ReconcileReport struct {
+	Mode      string                `json:"mode"`
+	Time      string                `json:"time"`
+	Versions  []VersionDrift        `json:"versions"`
+	Orphans   []OrphanContainer     `json:"orphans"`
+	Resources []schedulers.Drift    `json:"resources"`
+	Holdings  *schedulers.Holdings  `json:"-"`
+	latest    map[string]managedCtr `json:"-"`
+}
+
+// VersionDrift is a replicaSet whose latest version in the version map is not the one in docker,
+// actual 0 means the replicaSet has no container at all.
+type VersionDrift struct {
+	ReplicaSet string `json:"replicaSet"`
+	Recorded   int64  `json:"recorded"`
+	Actual     int64  `json:"actual"`
+}
+
+// OrphanContainer is a container created by the api that is not the latest version of a replicaSet,
+// the ones of unknown replicaSets are adopted in repair mode, the older versions are left for the admin.
+type OrphanContainer struct {
+	Name       string `json:"name"`
+	ReplicaSet string `json:"replicaSet"`
+	Version    int64  `json:"version"`
+	State      string `json:"state"`
+	Adopted    bool   `json:"adopted"`
+}
+
+type managedCtr struct {
+	name    string
+	version int64
+	resp    container.InspectResponse
+}
+
+func (c managedCtr) active() bool {
+	return c.resp.State != nil && (c.resp.State.Running || c.resp.State.Paused || c.resp.State.Restarting)
+}
+
+// holding reports whether the container holds its resources, an active one always does,
+// the latest version that exited by itself does too, only the stop through the api gives them back.
+func (c managedCtr) holding(latest bool) bool {
+	if c.active() {
+		return true
+	}
+	return latest && c.resp.State != nil && c.resp.State.Status == container.StateExited && !StoppedContainers.Has(c.name)
+}
+
+// Reconcile compares the version map and the schedulers with the containers in docker,
+// the resources are rebuilt from the HostConfig of the containers in repair mode.
+// The repair waits for the open reservations and keeps new ones from opening until the schedulers are rebuilt.
+func (rs *ReplicaSetService) Reconcile(mode string) (*ReconcileReport, error) {
+	if mode != ReconcileModeReport && mode != ReconcileModeRepair {
+		return nil, errors.Errorf("reconcile mode: %s is not supported", mode)
+	}
+
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	if mode == ReconcileModeRepair {
+		unlock, err := schedulers.LockReservations(repairTimeout)
+		if err != nil {
+			return nil, errors.WithMessage(err, "schedulers.LockReservations failed")
+		}
+		defer unlock()
+	}
+
+	managed, err := rs.managedContainers()
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.managedContainers failed")
+	}
+
+	report := &ReconcileReport{
+		Mode:      mode,
+		Time:      time.Now().Format("2006-01-02 15:04:05"),
+		Versions:  make([]VersionDrift, 0),
+		Orphans:   make([]OrphanContainer, 0),
+		Resources: make([]schedulers.Drift, 0),
+		latest:    make(map[string]managedCtr),
+	}
+	recorded := vmap.ContainerVersionMap.Snapshot()
+
+	for name, version := range recorded {
+		versions := managed[name]
+		if len(versions) == 0 {
+			report.Versions = append(report.Versions, VersionDrift{ReplicaSet: name, Recorded: version})
+			continue
+		}
+		latest := pickLatest(versions, version)
+		report.latest[name] = latest
+		if latest.version != version {
+			report.Versions = append(report.Versions, VersionDrift{ReplicaSet: name, Recorded: version, Actual: latest.version})
+		}
+	}
+	for name, versions := range managed {
+		latest, known := report.latest[name]
+		if !known {
+			latest = pickLatest(versions, 0)
+			report.latest[name] = latest
+		}
+		for _, c := range versions {
+			if known && c.version == latest.version {
+				continue
+			}
+			report.Orphans = append(report.Orphans, OrphanContainer{
+				Name:       c.name,
+				ReplicaSet: name,
+				Version:    c.version,
+				State:      string(c.resp.State.Status),
+				Adopted:    !known && c.version == latest.version,
+			})
+		}
+	}
+
+	report.Holdings = rs.holdings(managed, report.latest)
+	report.Resources = append(report.Resources, schedulers.Diff(report.Holdings)...)
+
+	sort.Slice(report.Versions, func(i, j int) bool {
+		return report.Versions[i].ReplicaSet < report.Versions[j].ReplicaSet
+	})
+	sort.Slice(report.Orphans, func(i, j int) bool {
+		return report.Orphans[i].Name < report.Orphans[j].Name
+	})
+
+	if mode == ReconcileModeRepair {
+		rs.repair(report, managed)
+	}
+	return report, nil
+}
+
+// repair points the version map to the containers in docker and rebuilds the schedulers
+func (rs *ReplicaSetService) repair(report *ReconcileReport, managed map[string][]managedCtr) {
+	for _, drift := range report.Versions {
+		if drift.Actual == 0 {
+			vmap.ContainerVersionMap.Remove(drift.ReplicaSet)
+			log.Infof("services.Reconcile, replicaSet: %s has no container, it is removed from the version map", drift.ReplicaSet)
+			continue
+		}
+		vmap.ContainerVersionMap.Set(drift.ReplicaSet, drift.Actual)
+		log.Infof("services.Reconcile, replicaSet: %s version is fixed from %d to %d", drift.ReplicaSet, drift.Recorded, drift.Actual)
+	}
+	for _, orphan := range report.Orphans {
+		if orphan.Adopted {
+			vmap.ContainerVersionMap.Set(orphan.ReplicaSet, orphan.Version)
+			log.Infof("services.Reconcile, container: %s is adopted as the latest version of replicaSet: %s", orphan.Name, orphan.ReplicaSet)
+		}
+	}
+
+	if len(report.Resources) > 0 {
+		schedulers.Rebuild(report.Holdings)
+		log.Infof("services.Reconcile, %d drifted resources are rebuilt from docker", len(report.Resources))
+	}
+	// the adopted containers and the fixed versions may run without a usage record
+	rs.SyncUsage()
+
+	// the containers removed outside the api are no longer stopped
+	exists := make(map[string]struct{})
+	for _, versions := range managed {
+		for _, c := range versions {
+			exists[c.name] = struct{}{}
+		}
+	}
+	StoppedContainers.Retain(func(container string) bool {
+		_, ok := exists[container]
+		return ok
+	})
+}
+
+// managedContainers returns the containers created by the api grouped by the replicaSet,
+// a container is created by the api if its name is name-version and its env has the same CONTAINER_VERSION.
+func (rs *ReplicaSetService) managedContainers() (map[string][]managedCtr, error) {
+	ctx := context.Background()
+	list, err := docker.Cli.ContainerList(ctx, client.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "docker.ContainerList failed")
+	}
+
+	managed := make(map[string][]managedCtr)
+	for _, item := range list.Items {
+		for _, n := range item.Names {
+			matches := containerVersionRegexp.FindStringSubmatch(n[1:])
+			if len(matches) != 3 {
+				continue
+			}
+			version, err := strconv.ParseInt(matches[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			resp, err := docker.Cli.ContainerInspect(ctx, item.ID, client.ContainerInspectOptions{})
+			if err != nil {
+				log.Warnf("services.managedContainers, inspect container: %s failed, err: %v", n, err)
+				continue
+			}
+			if !hasEnv(resp.Container.Config, fmt.Sprintf("CONTAINER_VERSION=%d", version)) {
+				continue
+			}
+			managed[matches[1]] = append(managed[matches[1]], managedCtr{
+				name:    n[1:],
+				version: version,
+				resp:    resp.Container,
+			})
+		}
+	}
+	return managed, nil
+}
+
+// holdings rebuilds the resources held by the containers,
+// gpus, cpus and ports are held by any container that is running and by the latest version until it is stopped,
+// memory is held by the latest version until it is stopped and disk until the replicaSet is deleted.
+func (rs *ReplicaSetService) holdings(managed map[string][]managedCtr, latest map[string]managedCtr) *schedulers.Holdings {
+	h := schedulers.NewHoldings()
+	for name, versions := range managed {
+		for _, c := range versions {
+			if !c.holding(c.name == latest[name].name) || c.resp.HostConfig == nil {
+				continue
+			}
+			for _, uuid := range inspectDeviceIDs(&c.resp) {
+				h.Gpus[uuid] = c.name
+			}
+			resources := &c.resp.HostConfig.Resources
+			if resources.NanoCPUs > 0 {
+				h.SharedCpus += cpuCount(resources)
+			}
+			for _, cpu := range exclusiveCpus(resources) {
+				h.Cpus[cpu] = c.name
+			}
+			for _, port := range hostPorts(c.resp.HostConfig) {
+				h.Ports[port] = c.name
+			}
+		}
+	}
+	for name, c := range latest {
+		if c.resp.HostConfig == nil {
+			continue
+		}
+		if c.holding(true) && c.resp.HostConfig.Memory > 0 {
+			h.Memory[name] = c.resp.HostConfig.Memory
+		}
+		if size, ok := c.resp.HostConfig.StorageOpt["size"]; ok {
+			if bytes, err := rootfsBytes(size); err == nil {
+				h.Disk[name] = bytes
+			}
+		}
+	}
+	return h
+}
+
+// pickLatest returns the recorded version if it exists and no newer version is running,
+// otherwise the newest running version, or the newest version if none is running.
+func pickLatest(versions []managedCtr, recorded int64) managedCtr {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].version > versions[j].version
+	})
+	for _, c := range versions {
+		if c.version == recorded {
+			return c
+		}
+		if c.version > recorded && c.active() {
+			return c
+		}
+	}
+	for _, c := range versions {
+		if c.active() {
+			return c
+		}
+	}
+	return versions[0]
+}
+
+func hasEnv(config *container.Config, env string) bool {
+	if config == nil {
+		return false
+	}
+	for _, e := range config.Env {
+		if e == env {
+			return true
+		}
+	}
+	return false
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
 	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/quota"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
 	vmap "github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
@@ -64,8 +66,11 @@ func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, con
 	}
 
 	// limit rootfs
+	if spec.RootfsSize == "" {
+		spec.RootfsSize = models.DefaultRootfsSize
+	}
 	hostConfig.StorageOpt = map[string]string{
-		"size": "30G",
+		"size": spec.RootfsSize,
 	}
 	shmSize, _ := utils.ToBytes("256GB")
 	hostConfig.ShmSize = shmSize
@@ -74,54 +79,92 @@ func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, con
 		Name: "unless-stopped",
 	}
 
-	// bind port
+	// bind port, the host ports are applied in the `runContainer`
+	config.Labels = make(map[string]string)
 	if len(spec.ContainerPorts) > 0 {
 		hostConfig.PortBindings = make(network.PortMap, len(spec.ContainerPorts))
 		config.ExposedPorts = make(network.PortSet, len(spec.ContainerPorts))
-		for _, port := range spec.ContainerPorts {
-			p, _ := network.ParsePort(port + "/tcp")
+		var fixed []string
+		for _, origin := range spec.ContainerPorts {
+			cp, err := models.ParseContainerPort(origin)
+			if err != nil {
+				return id, containerName, errors.WithMessagef(err, "models.ParseContainerPort failed, spec: %+v", spec)
+			}
+			p, _ := network.ParsePort(cp.Port + "/" + cp.Protocol)
 			config.ExposedPorts[p] = struct{}{}
 			hostConfig.PortBindings[p] = nil
+			if cp.HostPort != "" {
+				hostConfig.PortBindings[p] = []network.PortBinding{{HostPort: cp.HostPort}}
+				fixed = append(fixed, p.String())
+			}
+		}
+		if len(fixed) > 0 {
+			config.Labels[models.FixedPortsLabel] = strings.Join(fixed, ",")
 		}
 	}
 
-	// bind gpu resource
-	var uuids []string
+	// gpus, cpus, memory and rootfs are reserved together, and released if the container fails to run
+	req, err := newResourceRequest(spec)
+	if err != nil {
+		return id, containerName, err
+	}
 	if spec.GpuCount > 0 {
-		uuids, err = schedulers.GpuScheduler.Apply(spec.GpuCount)
-		if err != nil {
-			return id, containerName, errors.Wrapf(err, "GpuScheduler.Apply failed, spec: %+v", spec)
-		}
-		hostConfig.Resources = rs.newContainerResource(uuids)
-		log.Infof("services.RunGpuContainer, container: %s apply %d gpus, uuids: %+v", spec.ReplicaSetName+"-0", len(uuids), uuids)
+		rs.setGpuSelectors(config.Labels, spec.GpuModel, spec.MinGpuMemory)
+	}
+	if spec.CpuPolicy != "" {
+		config.Labels[models.CpuPolicyLabel] = spec.CpuPolicy
+	}
+	if spec.CpuMode != "" {
+		config.Labels[models.CpuModeLabel] = spec.CpuMode
 	}
 
-	// bind cpu resource
-	if spec.CpuCount > 0 {
-		cpusets, err := schedulers.CpuScheduler.Apply(spec.CpuCount)
-		if err != nil {
-			if spec.GpuCount > 0 {
-				schedulers.GpuScheduler.Restore(uuids)
-			}
-			return id, containerName, errors.Wrapf(err, "CpuScheduler.Apply failed, spec: %+v", spec)
-		}
-		hostConfig.Resources.CpusetCpus = cpusets
+	if spec.PriorityClass != "" {
+		config.Labels[models.PriorityClassLabel] = spec.PriorityClass
+	}
+	if spec.Owner != "" {
+		config.Labels[models.OwnerLabel] = spec.Owner
+	}
+	if spec.Booking != "" {
+		config.Labels[models.BookingLabel] = spec.Booking
+	}
+	if spec.Group != "" {
+		config.Labels[models.GroupLabel] = spec.Group
 	}
 
-	// bind memory resource
-	if spec.Memory != "" {
-		memory, err := utils.ToBytes(spec.Memory)
-		if err != nil {
-			if spec.GpuCount > 0 {
-				schedulers.GpuScheduler.Restore(uuids)
-			}
-			if spec.CpuCount > 0 {
-				schedulers.CpuScheduler.Restore(strings.Split(hostConfig.Resources.CpusetCpus, ","))
-			}
-			return id, containerName, errors.Wrapf(err, "MemoryGetBytes failed, spec: %+v", spec)
-		}
-		hostConfig.Resources.Memory = memory
+	// check the quotas before anything is reserved or preempted
+	if err = quota.Quotas.RequireOwner(spec.Owner, spec.Group); err != nil {
+		return id, containerName, errors.WithMessagef(err, "quota.RequireOwner failed, spec: %+v", spec)
+	}
+	done, err := checkQuota(spec.Owner, spec.Group, spec.ReplicaSetName, "", models.QuotaUsage{
+		Gpus:        spec.GpuCount,
+		Cpus:        spec.CpuCount,
+		Memory:      req.Memory,
+		ReplicaSets: 1,
+	})
+	if err != nil {
+		return id, containerName, errors.WithMessagef(err, "checkQuota failed, spec: %+v", spec)
+	}
+	defer done()
+
+	res, err := schedulers.Reserve(req.Clone())
+	if err != nil && spec.PriorityClass != "" && xerrors.IsResourceNotEnoughError(err) {
+		res, err = rs.preempt(spec, req, err)
+	}
+	if err != nil {
+		rs.fillGpuConflictHolders(err)
+		return id, containerName, errors.Wrapf(err, "schedulers.Reserve failed, spec: %+v", spec)
 	}
+	defer res.Release()
+
+	if len(res.Gpus) > 0 {
+		hostConfig.Resources = rs.newContainerResource(res.Gpus)
+		log.Infof("services.RunGpuContainer, container: %s apply %d gpus, uuids: %+v", spec.ReplicaSetName+"-0", len(res.Gpus), res.Gpus)
+	}
+	hostConfig.Resources.CpusetCpus = res.Cpus
+	if req.SharedCpus > 0 {
+		hostConfig.Resources.NanoCPUs = int64(req.SharedCpus) * 1e9
+	}
+	hostConfig.Resources.Memory = req.Memory
 
 	// bind volume
 	hostConfig.Binds = make([]string, 0, len(spec.Binds)+len(lxcfsBind))
@@ -132,25 +175,23 @@ func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, con
 	hostConfig.Binds = append(hostConfig.Binds, lxcfsBind...)
 
 	// create and start
-	id, containerName, kv, err := rs.runContainer(ctx, spec.ReplicaSetName, &models.EtcdContainerInfo{
+	id, containerName, kv, err := rs.runContainer(ctx, res, spec.ReplicaSetName, &models.EtcdContainerInfo{
 		Config:           &config,
 		HostConfig:       &hostConfig,
 		NetworkingConfig: &networkingConfig,
 		Platform:         &platform,
 	}, false)
 	if err != nil {
-		if len(hostConfig.Resources.DeviceRequests) > 0 {
-			schedulers.GpuScheduler.Restore(hostConfig.Resources.DeviceRequests[0].DeviceIDs)
-		}
-		schedulers.CpuScheduler.Restore(strings.Split(hostConfig.Resources.CpusetCpus, ","))
 		return id, containerName, errors.Wrapf(err, "serivce.runContainer failed, spec: %+v", spec)
 	}
+	res.Commit()
+	rs.openUsage(spec.ReplicaSetName, containerName)
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Add(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 	return
 }
 
@@ -172,32 +213,42 @@ func (rs *ReplicaSetService) DeleteContainer(name string) error {
 		return errors.WithMessage(err, "services.containerStatusPaused failed")
 	}
 
-	if running || pause {
+	// the resources are taken back if the container fails to be removed
+	res := schedulers.NewReservation()
+	defer res.Release()
+
+	if rs.holdsResources(ctrVersionName, running, pause) {
 		uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
 		if err != nil {
 			return errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
 		}
-		schedulers.GpuScheduler.Restore(uuids)
+		res.RestoreGpus(uuids)
 		log.Infof("services.DeleteContainer, container: %s restore %d gpus, uuids: %+v",
 			name, len(uuids), uuids)
 
-		cpusets, err := rs.containerCpusetCpus(ctrVersionName)
+		resources, err := rs.containerResources(ctrVersionName)
 		if err != nil {
-			return errors.WithMessage(err, "services.containerCpusetCpus failed")
+			return errors.WithMessage(err, "services.containerResources failed")
 		}
-		schedulers.CpuScheduler.Restore(cpusets)
-		log.Infof("services.DeleteContainer, container: %s restore %d cpus, cpusets: %+v",
-			name, len(cpusets), cpusets)
+		rs.restoreCpus(res, resources)
+		log.Infof("services.DeleteContainer, container: %s restore %d cpus, cpusets: %s",
+			name, cpuCount(resources), resources.CpusetCpus)
+
+		res.RestoreMemory(name)
+		log.Infof("services.DeleteContainer, container: %s restore %d bytes memory", name, resources.Memory)
 
 		ports, err := rs.containerPortBindings(ctrVersionName)
 		if err != nil {
 			return errors.WithMessage(err, "services.containerPortBindings failed")
 		}
-		schedulers.PortScheduler.Restore(ports)
+		res.RestorePorts(ports)
 		log.Infof("services.DeleteContainer, container: %s restore %d ports: %+v",
 			name, len(ports), ports)
 	}
 
+	// the rootfs is held until the container is deleted, even if it is stopped
+	res.RestoreDisk(name)
+
 	err = deleteMergeMap(name)
 	if err != nil {
 		return errors.WithMessage(err, "deleteMergeMap failed")
@@ -205,10 +256,10 @@ func (rs *ReplicaSetService) DeleteContainer(name string) error {
 
 	// delete the version number and asynchronously delete the container info in etcd
 	vmap.ContainerVersionMap.Remove(strings.Split(name, "-")[0])
-	workQueue.Queue <- etcd.DelKey{
+	workQueue.Add(etcd.DelKey{
 		Resource: etcd.Containers,
 		Key:      name,
-	}
+	})
 
 	_, err = docker.Cli.ContainerRemove(context.TODO(),
 		fmt.Sprintf("%s-%d", name, version),
@@ -216,6 +267,9 @@ func (rs *ReplicaSetService) DeleteContainer(name string) error {
 	if err != nil {
 		return errors.WithMessage(err, "docker.Cli.ContainerRemove failed")
 	}
+	res.Commit()
+	StoppedContainers.Remove(ctrVersionName)
+	rs.closeUsage(name)
 
 	log.Infof("services.DeleteContainer, container: %s delete successfully", fmt.Sprintf("%s-%d", name, version))
 	log.Infof("services.DeleteContainer, container: %s will be del etcd info and version record", name)
@@ -264,11 +318,11 @@ func (rs *ReplicaSetService) ExecuteContainer(name string, exec *models.Containe
 	return
 }
 
-func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchRequest) (id, newContainerName string, err error) {
+func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchRequest) (id, newContainerName string, changes *models.ResourceChanges, err error) {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
-		return id, newContainerName, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+		return id, newContainerName, changes, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 
@@ -276,176 +330,231 @@ func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchReque
 	ctx := context.Background()
 	infoBytes, err := etcd.GetValue(etcd.Containers, name)
 	if err != nil {
-		return id, newContainerName, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return id, newContainerName, changes, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
 	}
 	info := &models.EtcdContainerInfo{}
 	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "json.Unmarshal failed")
 	}
 
+	// the resources are given back to the old container if anything fails before the new one starts
+	res := schedulers.NewReservation()
+	defer res.Release()
+
 	// update gpu info
-	info, err = rs.patchGpu(ctrVersionName, spec.GpuPatch, info)
+	info, err = rs.patchGpu(res, ctrVersionName, spec.GpuPatch, info)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "patchGpu failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "patchGpu failed")
 	}
 
 	// update cpu info
-	info, err = rs.patchCpu(ctrVersionName, spec.CpuPatch, info)
+	info, err = rs.patchCpu(res, ctrVersionName, spec.CpuPatch, info)
 	if err != nil {
-		if len(info.HostConfig.Resources.DeviceRequests) > 0 {
-			schedulers.GpuScheduler.Restore(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
-		}
-		return id, newContainerName, errors.WithMessage(err, "patchCpu failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "patchCpu failed")
 	}
 
-	// update memory info
-	info, err = rs.patchMemory(ctrVersionName, spec.MemoryPatch, info)
+	// update memory info, the memory is checked against the capacity of the host
+	info, err = rs.patchMemory(res, ctrVersionName, spec.MemoryPatch, info)
 	if err != nil {
-		if len(info.HostConfig.Resources.DeviceRequests) > 0 {
-			schedulers.GpuScheduler.Restore(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
-		}
-		schedulers.CpuScheduler.Restore(strings.Split(info.HostConfig.Resources.CpusetCpus, ","))
-		return id, newContainerName, errors.WithMessage(err, "patchMemory failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "patchMemory failed")
+	}
+
+	// update rootfs size, the files in the upper dir are copied to the new container below
+	info, err = rs.patchRootfs(res, ctrVersionName, spec.RootfsPatch, info)
+	if err != nil {
+		return id, newContainerName, changes, errors.WithMessage(err, "patchRootfs failed")
 	}
 
 	// update volume info
 	info, err = rs.patchVolume(spec.VolumePatch, info)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "patchVolume failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "patchVolume failed")
 	}
 
+	done, err := rs.checkContainerQuota(name, info)
+	if err != nil {
+		return id, newContainerName, changes, errors.WithMessage(err, "checkContainerQuota failed")
+	}
+	defer done()
+
 	// create a new container to replace the old one
-	id, newContainerName, kv, err := rs.runContainer(ctx, name, info, true)
+	id, newContainerName, kv, err := rs.runContainer(ctx, res, name, info, true)
 	if err != nil {
-		if len(info.HostConfig.Resources.DeviceRequests) > 0 {
-			schedulers.GpuScheduler.Restore(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
-		}
-		schedulers.CpuScheduler.Restore(strings.Split(info.HostConfig.Resources.CpusetCpus, ","))
-		return id, newContainerName, errors.WithMessage(err, "runContainer failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "runContainer failed")
 	}
 
 	err = rs.containerRemoveBallastStone(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "removeContainerBallastStone failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "removeContainerBallastStone failed")
 	}
 
 	// copy the old container's merged files to the new container
 	err = utils.CopyOldMergedToNewContainerMerged(ctrVersionName, newContainerName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+	}
+
+	changes, err = rs.resourceChanges(ctrVersionName, newContainerName)
+	if err != nil {
+		return id, newContainerName, changes, errors.WithMessage(err, "resourceChanges failed")
+	}
+
+	stopped, err := rs.stopForTakeover(ctrVersionName, newContainerName)
+	if err != nil {
+		return id, newContainerName, changes, errors.WithMessage(err, "stopForTakeover failed")
 	}
 
 	err = rs.startContainer(ctx, id, newContainerName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "startContainer failed")
+		rs.resumeAfterTakeover(ctrVersionName, stopped)
+		return id, newContainerName, changes, errors.WithMessage(err, "startContainer failed")
 	}
+	res.Commit()
+	rs.openUsage(name, newContainerName)
 
 	// delete the old container
 	// no gpu resources are returned because they are already returned when the gpu is lowered
 	// or when upgrading the gpu, the original gpu will be used.
 	err = setToMergeMap(ctrVersionName, version)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "setToMergeMap failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "setToMergeMap failed")
 	}
 	err = rs.DeleteContainerForUpdate(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "DeleteContainerForUpdate failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Add(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
 	log.Infof("services.PatchContainer, container: %s patch configuration successfully", name)
 	return
 }
 
-func (rs *ReplicaSetService) RollbackContainer(name string, spec *models.RollbackRequest) (string, error) {
+func (rs *ReplicaSetService) RollbackContainer(name string, spec *models.RollbackRequest) (string, *models.ResourceChanges, error) {
 	// check that the version to be rolled back is the same as the current version
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
-		return "", errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+		return "", nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 	if spec.Version == version {
-		return "", xerrors.NewNoRollbackRequiredError()
+		return "", nil, xerrors.NewNoRollbackRequiredError()
 	}
 
 	// get revision info form etcd
 	value, err := etcd.GetRevision(etcd.Containers, name, spec.Version)
 	if err != nil {
-		return "", errors.WithMessage(err, "etcd.GetRevisionRange failed")
+		return "", nil, errors.WithMessage(err, "etcd.GetRevisionRange failed")
 	}
 	info := &models.EtcdContainerInfo{}
 	if err = json.Unmarshal(value, &info); err != nil {
-		return "", errors.WithMessage(err, "json.Unmarshal failed")
+		return "", nil, errors.WithMessage(err, "json.Unmarshal failed")
 	}
 
+	// the resources are given back to the old container if anything fails before the new one starts
+	res := schedulers.NewReservation()
+	defer res.Release()
+
 	// compare gpu info
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 	gpucount := 0
 	if len(info.HostConfig.Resources.DeviceRequests) > 0 {
 		gpucount = len(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
 	}
-	info, err = rs.patchGpu(ctrVersionName, &models.GpuPatch{
+	info, err = rs.patchGpu(res, ctrVersionName, &models.GpuPatch{
 		GpuCount: gpucount,
 	}, info)
 	if err != nil {
-		return "", errors.WithMessage(err, "patchGpu failed")
+		return "", nil, errors.WithMessage(err, "patchGpu failed")
 	}
 
 	// compare cpu info
-	info, err = rs.patchCpu(ctrVersionName, &models.CpuPatch{
-		CpuCount: len(strings.Split(info.HostConfig.Resources.CpusetCpus, ",")),
+	info, err = rs.patchCpu(res, ctrVersionName, &models.CpuPatch{
+		CpuCount: cpuCount(&info.HostConfig.Resources),
+		CpuMode:  rs.cpuMode(info),
 	}, info)
 	if err != nil {
-		return "", errors.WithMessage(err, "patchCpu failed")
+		return "", nil, errors.WithMessage(err, "patchCpu failed")
 	}
 
 	// compare memory info
-	info, err = rs.patchMemory(ctrVersionName, &models.MemoryPatch{
-		Memory: fmt.Sprintf("%dGB", info.HostConfig.Resources.Memory/1024/1024),
+	info, err = rs.patchMemory(res, ctrVersionName, &models.MemoryPatch{
+		Memory: fmt.Sprintf("%dKB", info.HostConfig.Resources.Memory/1024),
+	}, info)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "patchMemory failed")
+	}
+
+	// compare rootfs size
+	info, err = rs.patchRootfs(res, ctrVersionName, &models.RootfsPatch{
+		RootfsSize: info.HostConfig.StorageOpt["size"],
 	}, info)
 	if err != nil {
-		return "", errors.WithMessage(err, "patchMemory failed")
+		return "", nil, errors.WithMessage(err, "patchRootfs failed")
 	}
 
+	done, err := rs.checkContainerQuota(name, info)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "checkContainerQuota failed")
+	}
+	defer done()
+
 	// create a new container to replace the old one
-	_, newContainerName, kv, err := rs.runContainer(context.TODO(), name, info, false)
+	id, newContainerName, kv, err := rs.runContainer(context.TODO(), res, name, info, true)
 	if err != nil {
-		return "", errors.WithMessage(err, "runContainer failed")
+		return "", nil, errors.WithMessage(err, "runContainer failed")
 	}
 
 	// copy the old container's merged files to the new container
 	err = utils.CopyOldMergedToNewContainerMerged(ctrVersionName, newContainerName)
 	if err != nil {
-		return "", errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		return "", nil, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+	}
+
+	// start the new container after the old one releases the fixed ports
+	changes, err := rs.resourceChanges(ctrVersionName, newContainerName)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "resourceChanges failed")
 	}
 
+	stopped, err := rs.stopForTakeover(ctrVersionName, newContainerName)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "stopForTakeover failed")
+	}
+	err = rs.startContainer(context.TODO(), id, newContainerName)
+	if err != nil {
+		rs.resumeAfterTakeover(ctrVersionName, stopped)
+		return "", nil, errors.WithMessage(err, "startContainer failed")
+	}
+	res.Commit()
+	rs.openUsage(name, newContainerName)
+
 	// delete the old container
 	// no gpu resources are returned because they are already returned when the gpu is lowered
 	// or when upgrading the gpu, the original gpu will be used.
 	err = setToMergeMap(ctrVersionName, version)
 	if err != nil {
-		return "", errors.WithMessage(err, "setToMergeMap failed")
+		return "", nil, errors.WithMessage(err, "setToMergeMap failed")
 	}
 	err = rs.DeleteContainerForUpdate(ctrVersionName)
 	if err != nil {
-		return "", errors.WithMessage(err, "DeleteContainerForUpdate failed")
+		return "", nil, errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Add(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
 	log.Infof("services.RollbackContainer, container: %s patch configuration successfully", ctrVersionName)
-	return newContainerName, nil
+	return newContainerName, changes, nil
 }
 
-func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+func (rs *ReplicaSetService) patchGpu(res *schedulers.Reservation, name string, spec *models.GpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
 	running, err := rs.containerStatusRunning(name)
 	if err != nil {
 		return info, errors.WithMessage(err, "services.containerStatusRunning failed")
@@ -461,7 +570,9 @@ func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *
 	}
 
 	if spec != nil {
-		if len(uuids) == spec.GpuCount && (running || pause) {
+		// pinned, excluded or selected gpus may differ from the current ones even if the count is the same
+		if len(uuids) == spec.GpuCount && rs.holdsResources(name, running, pause) && len(spec.Gpus) == 0 && len(spec.ExcludeGpus) == 0 &&
+			spec.GpuModel == "" && spec.MinGpuMemory == "" {
 			return info, nil
 		}
 	}
@@ -472,8 +583,8 @@ func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *
 		}
 	}
 
-	if running || pause {
-		schedulers.GpuScheduler.Restore(uuids)
+	if rs.holdsResources(name, running, pause) {
+		res.RestoreGpus(uuids)
 		log.Infof("services.PatchContainerGpuInfo, container: %s restore %d gpus, uuids: %+v",
 			name, len(uuids), uuids)
 	}
@@ -482,19 +593,37 @@ func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *
 			Memory: info.HostConfig.Memory,
 		}
 	} else {
-		uuids, err = schedulers.GpuScheduler.Apply(spec.GpuCount)
+		model, minMemory := spec.GpuModel, spec.MinGpuMemory
+		if model == "" && minMemory == "" && len(spec.Gpus) == 0 {
+			// keep the kind of gpus asked before
+			model, minMemory = rs.gpuSelectors(info)
+		} else if info.Config != nil {
+			if info.Config.Labels == nil {
+				info.Config.Labels = make(map[string]string)
+			}
+			rs.setGpuSelectors(info.Config.Labels, spec.GpuModel, spec.MinGpuMemory)
+		}
+		req, err := newGpuRequest(spec.GpuCount, spec.Gpus, spec.ExcludeGpus, model, minMemory)
 		if err != nil {
+			return info, errors.WithMessage(err, "newGpuRequest failed")
+		}
+		// keep the same gpus as before if they are still free
+		req.Prefer = uuids
+		req.Booking = rs.booking(info)
+		applied, err := res.ApplyGpus(req)
+		if err != nil {
+			rs.fillGpuConflictHolders(err)
 			return info, errors.WithMessage(err, "GpuScheduler.Apply failed")
 		}
-		log.Infof("services.PatchContainerGpuInfo, container: %s apply %d gpus, uuids: %+v", name, spec.GpuCount, uuids)
-		cr := rs.newContainerResource(uuids)
+		log.Infof("services.PatchContainerGpuInfo, container: %s apply %d gpus, uuids: %+v", name, len(applied), applied)
+		cr := rs.newContainerResource(applied)
 		info.HostConfig.Resources.DeviceRequests = cr.DeviceRequests
 	}
 
 	return info, nil
 }
 
-func (rs *ReplicaSetService) patchCpu(name string, spec *models.CpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+func (rs *ReplicaSetService) patchCpu(res *schedulers.Reservation, name string, spec *models.CpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
 	running, err := rs.containerStatusRunning(name)
 	if err != nil {
 		return info, errors.WithMessage(err, "services.containerStatusRunning failed")
@@ -504,63 +633,127 @@ func (rs *ReplicaSetService) patchCpu(name string, spec *models.CpuPatch, info *
 		return info, errors.WithMessage(err, "services.containerStatusPaused failed")
 	}
 
-	cpuset, err := rs.containerCpusetCpus(name)
+	resources, err := rs.containerResources(name)
 	if err != nil {
-		return info, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+		return info, errors.WithMessage(err, "services.containerResources failed")
+	}
+	count, mode := cpuCount(resources), models.CpuModeExclusive
+	if resources.NanoCPUs > 0 {
+		mode = models.CpuModeShared
 	}
 
 	if spec != nil {
-		if len(cpuset) == spec.CpuCount && (running || pause) {
+		if count == spec.CpuCount && rs.holdsResources(name, running, pause) &&
+			(spec.CpuPolicy == "" || spec.CpuPolicy == rs.cpuPolicy(info)) &&
+			(spec.CpuMode == "" || spec.CpuMode == mode) {
 			return info, nil
 		}
 	}
 
 	if spec == nil {
 		spec = &models.CpuPatch{
-			CpuCount: len(cpuset),
+			CpuCount: count,
 		}
 	}
+	if info.Config.Labels == nil {
+		info.Config.Labels = make(map[string]string)
+	}
+	if spec.CpuPolicy != "" {
+		info.Config.Labels[models.CpuPolicyLabel] = spec.CpuPolicy
+	}
+	if spec.CpuMode != "" {
+		info.Config.Labels[models.CpuModeLabel] = spec.CpuMode
+	}
 
-	if running || pause {
-		schedulers.CpuScheduler.Restore(cpuset)
-		log.Infof("services.PatchContainerCpuInfo, container: %s restore %d cpus, cpusets: %+v",
-			name, len(cpuset), cpuset)
+	if rs.holdsResources(name, running, pause) {
+		rs.restoreCpus(res, resources)
+		log.Infof("services.PatchContainerCpuInfo, container: %s restore %d cpus, cpusets: %s",
+			name, count, resources.CpusetCpus)
 	}
-	cpusets, err := schedulers.CpuScheduler.Apply(spec.CpuCount)
+	err = rs.applyCpus(res, &info.HostConfig.Resources, spec.CpuCount, rs.cpuMode(info), rs.cpuPolicy(info), rs.infoDeviceIDs(info),
+		exclusiveCpus(resources))
 	if err != nil {
-		return info, errors.WithMessage(err, "CpuScheduler.Apply failed")
+		return info, errors.WithMessage(err, "services.applyCpus failed")
 	}
-	log.Infof("services.PatchContainerCpuInfo, container: %s apply %d cpus, cpusets: %+v", name, spec.CpuCount, cpusets)
-	info.HostConfig.Resources.CpusetCpus = strings.TrimLeft(strings.Trim(cpusets, ","), ",")
-	log.Infof("services.PatchContainerCpuInfo, container: %s upgrad %d cpu configuration, now use %d cpus, cpusets: %+v",
-		name, len(cpuset), len(strings.Split(info.HostConfig.Resources.CpusetCpus, ",")), info.HostConfig.Resources.CpusetCpus)
+	log.Infof("services.PatchContainerCpuInfo, container: %s upgrad %d %s cpu configuration, now use %d cpus, cpusets: %s",
+		name, count, rs.cpuMode(info), spec.CpuCount, info.HostConfig.Resources.CpusetCpus)
 
 	return info, nil
 }
 
-func (rs *ReplicaSetService) patchMemory(name string, spec *models.MemoryPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+func (rs *ReplicaSetService) patchMemory(res *schedulers.Reservation, name string, spec *models.MemoryPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	applymemory := info.HostConfig.Resources.Memory
+	if spec != nil {
+		var err error
+		applymemory, err = utils.ToBytes(spec.Memory)
+		if err != nil {
+			return info, errors.WithMessage(err, "models.MemoryGetBytes failed")
+		}
+	}
+
+	// apply even if the memory is unchanged, because a stopped container has released it
+	if applymemory == 0 {
+		res.RestoreMemory(strings.Split(name, "-")[0])
+	} else if err := res.ApplyMemory(strings.Split(name, "-")[0], applymemory); err != nil {
+		return info, errors.WithMessage(err, "MemoryScheduler.Apply failed")
+	}
+
+	info.HostConfig.Resources.Memory = applymemory
+
+	return info, nil
+}
+
+func (rs *ReplicaSetService) patchRootfs(res *schedulers.Reservation, name string, spec *models.RootfsPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
 	if spec == nil {
 		return info, nil
 	}
-	memory, err := rs.containerMemory(name)
-	if err != nil {
-		return info, errors.WithMessage(err, "services.containerMemory failed")
-	}
 
-	applymemory, err := utils.ToBytes(spec.Memory)
+	preSizeBytes, _ := rootfsBytes(info.HostConfig.StorageOpt["size"])
+	patchSizeBytes, err := rootfsBytes(spec.RootfsSize)
 	if err != nil {
-		return info, errors.WithMessage(err, "models.MemoryGetBytes failed")
+		return info, errors.WithMessage(err, "services.rootfsBytes failed")
 	}
 
-	if memory == applymemory {
-		return info, nil
+	// check whether the size after shrink is larger than used size
+	if patchSizeBytes < preSizeBytes {
+		upperDir, err := utils.GetContainerMergedLayer(name)
+		if err != nil {
+			return info, errors.WithMessage(err, "utils.GetContainerMergedLayer failed")
+		}
+		usedSize, err := utils.DirSize(upperDir)
+		if err != nil {
+			return info, errors.Wrapf(err, "utils.DirSize failed, container: %s, upperDir: %s", name, upperDir)
+		}
+		if usedSize > patchSizeBytes {
+			return info, errors.Wrapf(xerrors.NewRootfsSizeUsedGreaterThanReduced(),
+				"container: %s, usedSize: %d, patchSize: %d", name, usedSize, patchSizeBytes)
+		}
 	}
 
-	info.HostConfig.Resources.Memory = applymemory
+	if err = res.ApplyDisk(strings.Split(name, "-")[0], patchSizeBytes); err != nil {
+		return info, errors.WithMessage(err, "DiskScheduler.Apply failed")
+	}
+	if info.HostConfig.StorageOpt == nil {
+		info.HostConfig.StorageOpt = make(map[string]string)
+	}
+	info.HostConfig.StorageOpt["size"] = spec.RootfsSize
 
 	return info, nil
 }
 
+// rootfsBytes also accepts the sizes of containers created before, e.g. 30G
+func rootfsBytes(size string) (int64, error) {
+	size = strings.ToUpper(size)
+	if strings.HasSuffix(size, "K") || strings.HasSuffix(size, "M") ||
+		strings.HasSuffix(size, "G") || strings.HasSuffix(size, "T") {
+		size += "B"
+	}
+	if len(size) <= 2 {
+		return 0, errors.Errorf("invalid rootfs size: %s", size)
+	}
+	return utils.ToBytes(size)
+}
+
 func (rs *ReplicaSetService) patchVolume(spec *models.VolumePatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
 	if spec == nil {
 		return info, nil
@@ -580,8 +773,6 @@ func (rs *ReplicaSetService) patchVolume(spec *models.VolumePatch, info *models.
 }
 
 func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restoreCpu, restorePort, isLatest bool) error {
-	var err error
-
 	if isLatest {
 		// get the latest version number
 		version, ok := vmap.ContainerVersionMap.Get(name)
@@ -591,28 +782,33 @@ func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restoreCpu,
 		name = fmt.Sprintf("%s-%d", name, version)
 	}
 
+	// the resources are taken back if the container fails to stop
+	res := schedulers.NewReservation()
+	defer res.Release()
+
 	// whether to restore gpu resources
-	var uuids []string
 	if restoreGpu {
-		uuids, err = rs.containerDeviceRequestsDeviceIDs(name)
+		uuids, err := rs.containerDeviceRequestsDeviceIDs(name)
 		if err != nil {
 			return errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
 		}
-		schedulers.GpuScheduler.Restore(uuids)
+		res.RestoreGpus(uuids)
 		log.Infof("services.StopContainer, container: %s restore %d gpus, uuids: %+v",
 			name, len(uuids), uuids)
 	}
 
 	// whether to restore cpu resources
-	var cpusets []string
 	if restoreCpu {
-		cpusets, err = rs.containerCpusetCpus(name)
+		resources, err := rs.containerResources(name)
 		if err != nil {
-			return errors.WithMessage(err, "services.containerCpusetCpus failed")
+			return errors.WithMessage(err, "services.containerResources failed")
 		}
-		schedulers.CpuScheduler.Restore(cpusets)
-		log.Infof("services.StopContainer, container: %s restore %d cpus, cpusets: %+v",
-			name, len(cpusets), cpusets)
+		rs.restoreCpus(res, resources)
+		log.Infof("services.StopContainer, container: %s restore %d cpus, cpusets: %s",
+			name, cpuCount(resources), resources.CpusetCpus)
+
+		res.RestoreMemory(strings.Split(name, "-")[0])
+		log.Infof("services.StopContainer, container: %s restore %d bytes memory", name, resources.Memory)
 	}
 
 	// whether to restore port resources
@@ -621,23 +817,34 @@ func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restoreCpu,
 		if err != nil {
 			return errors.WithMessage(err, "services.containerPortBindings failed")
 		}
-		schedulers.PortScheduler.Restore(ports)
+		res.RestorePorts(ports)
 		log.Infof("services.StopContainer, container: %s restore %d ports: %+v",
 			name, len(ports), ports)
 	}
 
 	// stop container
-	ctx := context.Background()
-	if _, err := docker.Cli.ContainerStop(ctx, name, client.ContainerStopOptions{}); err != nil {
-		schedulers.GpuScheduler.Restore(uuids)
-		schedulers.CpuScheduler.Restore(cpusets)
-		return errors.WithMessage(err, "docker.ContainerStop failed")
+	if err := rs.stopContainer(name, restoreGpu || restoreCpu); err != nil {
+		return err
 	}
+	res.Commit()
 
 	log.Infof("services.StopContainer, container: %s stop successfully", name)
 	return nil
 }
 
+// stopContainer stops the container, released tells whether its resources are given back by the caller.
+// A released container is recorded as stopped, so it is no longer counted as holding them.
+func (rs *ReplicaSetService) stopContainer(name string, released bool) error {
+	if _, err := docker.Cli.ContainerStop(context.Background(), name, client.ContainerStopOptions{}); err != nil {
+		return errors.WithMessage(err, "docker.ContainerStop failed")
+	}
+	if released {
+		StoppedContainers.Add(name)
+		rs.closeUsage(strings.Split(name, "-")[0])
+	}
+	return nil
+}
+
 func (rs *ReplicaSetService) PauseContainer(name string) error {
 	var err error
 
@@ -658,12 +865,23 @@ func (rs *ReplicaSetService) PauseContainer(name string) error {
 }
 
 func (rs *ReplicaSetService) DeleteContainerForUpdate(name string) error {
-	// restore port resources
+	// restore port resources, except the fixed ports taken over by the latest version
 	ports, err := rs.containerPortBindings(name)
 	if err != nil {
 		return errors.WithMessage(err, "services.containerPortBindings failed")
 	}
-	schedulers.PortScheduler.Restore(ports)
+	if version, ok := vmap.ContainerVersionMap.Get(strings.Split(name, "-")[0]); ok {
+		latest := fmt.Sprintf("%s-%d", strings.Split(name, "-")[0], version)
+		if latest != name {
+			if latestPorts, err := rs.containerPortBindings(latest); err == nil {
+				ports = subtractPorts(ports, latestPorts)
+			}
+		}
+	}
+	// the ports are taken back if the container fails to be removed
+	res := schedulers.NewReservation()
+	defer res.Release()
+	res.RestorePorts(ports)
 	log.Infof("services.DeleteContainerForUpdate, container: %s restore %d ports: %+v",
 		name, len(ports), ports)
 
@@ -674,6 +892,8 @@ func (rs *ReplicaSetService) DeleteContainerForUpdate(name string) error {
 	if err != nil {
 		return errors.WithMessage(err, "docker.ContainerRemove failed")
 	}
+	res.Commit()
+	StoppedContainers.Remove(name)
 
 	return nil
 }
@@ -727,135 +947,165 @@ func (rs *ReplicaSetService) StartupContainer(name string) error {
 	if err != nil {
 		return errors.WithMessagef(err, "docker.ContainerRestart failed, name: %s", name)
 	}
+	StoppedContainers.Remove(fmt.Sprintf("%s-%d", name, version))
 
 	return nil
 }
 
 // RestartContainer will reapply gpu and port,
 // but the logic for applying port is in the runContainer function
-func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName string, err error) {
+func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName string, changes *models.ResourceChanges, err error) {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
-		return id, newContainerName, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+		return id, newContainerName, changes, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 
 	running, err := rs.containerStatusRunning(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "services.containerStatusRunning failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "services.containerStatusRunning failed")
 	}
 	pause, err := rs.containerStatusPaused(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "services.containerStatusPaused failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "services.containerStatusPaused failed")
 	}
 
 	// get info about used gpus
 	ctx := context.Background()
 	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
 	}
 
 	// get info about used cpus
-	cpus, err := rs.containerCpusetCpus(ctrVersionName)
+	resources, err := rs.containerResources(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "services.containerCpusetCpus failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "services.containerResources failed")
 	}
 
 	// get memory info
 	memory, err := rs.containerMemory(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "services.containerMemory failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "services.containerMemory failed")
 	}
 
 	// get creation info from etcd
 	infoBytes, err := etcd.GetValue(etcd.Containers, name)
 	if err != nil {
-		return id, newContainerName, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return id, newContainerName, changes, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
 	}
 	info := &models.EtcdContainerInfo{}
 	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "json.Unmarshal failed")
 	}
 
+	// the resources are given back to the old container if anything fails before the new one starts
+	res := schedulers.NewReservation()
+	defer res.Release()
+
 	// check whether the container is using gpu
 	if len(uuids) != 0 {
-		if running || pause {
-			schedulers.GpuScheduler.Restore(uuids)
+		if rs.holdsResources(ctrVersionName, running, pause) {
+			res.RestoreGpus(uuids)
+		}
+		// apply for the kind of gpus asked before, the same gpus are used if they are still free
+		model, minMemory := rs.gpuSelectors(info)
+		req, err := newGpuRequest(len(uuids), nil, nil, model, minMemory)
+		if err != nil {
+			return id, newContainerName, changes, errors.WithMessage(err, "newGpuRequest failed")
 		}
-		// apply for gpu
-		availableGpus, err := schedulers.GpuScheduler.Apply(len(uuids))
+		req.Prefer = uuids
+		req.Booking = rs.booking(info)
+		availableGpus, err := res.ApplyGpus(req)
 		if err != nil {
-			return id, newContainerName, errors.WithMessage(err, "GpuScheduler.Apply failed")
+			return id, newContainerName, changes, errors.WithMessage(err, "GpuScheduler.Apply failed")
 		}
 		log.Infof("services.RestartContainer, container: %s apply %d gpus, uuids: %+v", ctrVersionName, len(availableGpus), availableGpus)
 		info.HostConfig.Resources = rs.newContainerResource(availableGpus)
 	}
 
 	// check whether the container is using cpu
-	if len(cpus) != 0 {
-		if running || pause {
-			schedulers.CpuScheduler.Restore(cpus)
+	if count := cpuCount(resources); count != 0 {
+		if rs.holdsResources(ctrVersionName, running, pause) {
+			rs.restoreCpus(res, resources)
 		}
-		// apply for cpu
-		availableCpus, err := schedulers.CpuScheduler.Apply(len(cpus))
+		// apply for cpu in the same mode, prefer the same cpus and then the cpus local to the gpus
+		err = rs.applyCpus(res, &info.HostConfig.Resources, count, rs.cpuMode(info), rs.cpuPolicy(info), rs.infoDeviceIDs(info),
+			exclusiveCpus(resources))
 		if err != nil {
-			return id, newContainerName, errors.WithMessage(err, "CpuScheduler.Apply failed")
+			return id, newContainerName, changes, errors.WithMessage(err, "services.applyCpus failed")
 		}
-		log.Infof("services.RestartContainer, container: %s apply %d cpus, cpusets: %+v", ctrVersionName, len(strings.Split(availableCpus, ",")), availableCpus)
-		info.HostConfig.Resources.CpusetCpus = availableCpus
+		log.Infof("services.RestartContainer, container: %s apply %d %s cpus, cpusets: %s",
+			ctrVersionName, count, rs.cpuMode(info), info.HostConfig.Resources.CpusetCpus)
 	}
 
 	// check whether the container is using memory
 	if memory != 0 {
+		if err = res.ApplyMemory(name, memory); err != nil {
+			return id, newContainerName, changes, errors.WithMessage(err, "MemoryScheduler.Apply failed")
+		}
 		info.HostConfig.Resources.Memory = memory
 	}
 
+	done, err := rs.checkContainerQuota(name, info)
+	if err != nil {
+		return id, newContainerName, changes, errors.WithMessage(err, "checkContainerQuota failed")
+	}
+	defer done()
+
 	//  create a container to replace the old one
-	id, newContainerName, kv, err := rs.runContainer(ctx, name, info, true)
+	id, newContainerName, kv, err := rs.runContainer(ctx, res, name, info, true)
 	if err != nil {
-		if len(info.HostConfig.Resources.DeviceRequests) > 0 {
-			schedulers.GpuScheduler.Restore(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
-		}
-		schedulers.CpuScheduler.Restore(strings.Split(info.HostConfig.Resources.CpusetCpus, ","))
-		return id, newContainerName, errors.WithMessage(err, "services.runContainer failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "services.runContainer failed")
 	}
 
 	err = rs.containerRemoveBallastStone(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "removeContainerBallastStone failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "removeContainerBallastStone failed")
 	}
 
 	// copy the old container's merged files to the new container
 	err = utils.CopyOldMergedToNewContainerMerged(ctrVersionName, newContainerName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
 	}
 
 	// start the new container
+	changes, err = rs.resourceChanges(ctrVersionName, newContainerName)
+	if err != nil {
+		return id, newContainerName, changes, errors.WithMessage(err, "resourceChanges failed")
+	}
+
+	stopped, err := rs.stopForTakeover(ctrVersionName, newContainerName)
+	if err != nil {
+		return id, newContainerName, changes, errors.WithMessage(err, "stopForTakeover failed")
+	}
 	err = rs.startContainer(ctx, id, newContainerName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "startContainer failed")
+		rs.resumeAfterTakeover(ctrVersionName, stopped)
+		return id, newContainerName, changes, errors.WithMessage(err, "startContainer failed")
 	}
+	res.Commit()
+	rs.openUsage(name, newContainerName)
 
 	// delete the old container
 	// no gpu resources are returned because they are already returned when the gpu is lowered
 	// or when upgrading the gpu, the original gpu will be used.
 	err = setToMergeMap(ctrVersionName, version)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "setToMergeMap failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "setToMergeMap failed")
 	}
 	err = rs.DeleteContainerForUpdate(ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "DeleteContainerForUpdate failed")
+		return id, newContainerName, changes, errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Add(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
 	log.Infof("services.RestartContainer, container restart successfully, "+
 		"old container name: %s, new container name: %s, ",
@@ -905,6 +1155,350 @@ func (rs *ReplicaSetService) GetContainerInfo(name string) (info models.EtcdCont
 	return
 }
 
+// GetContainerUnhealthyGpus returns the unhealthy gpus used by the latest version of the replicaSet
+func (rs *ReplicaSetService) GetContainerUnhealthyGpus(name string) (map[string]schedulers.GpuHealth, error) {
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(fmt.Sprintf("%s-%d", name, version))
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+
+	unhealthyGpus := schedulers.GpuScheduler.GetUnhealthyGpus()
+	resp := make(map[string]schedulers.GpuHealth)
+	for _, uuid := range uuids {
+		if health, ok := unhealthyGpus[uuid]; ok {
+			resp[uuid] = health
+		}
+	}
+	return resp, nil
+}
+
+// newCpuRequest aligns the cpus with the numa nodes of the gpus
+func (rs *ReplicaSetService) newCpuRequest(count int, policy string, uuids []string) *schedulers.CpuRequest {
+	return &schedulers.CpuRequest{
+		Count:     count,
+		NumaNodes: schedulers.GpuScheduler.GetNumaNodes(uuids),
+		Strict:    policy == models.CpuPolicyNumaStrict,
+	}
+}
+
+// cpuPolicy returns the cpu policy saved in the labels of the container
+func (rs *ReplicaSetService) cpuPolicy(info *models.EtcdContainerInfo) string {
+	if info.Config == nil || info.Config.Labels == nil {
+		return ""
+	}
+	return info.Config.Labels[models.CpuPolicyLabel]
+}
+
+// cpuMode returns the cpu mode saved in the labels of the container
+func (rs *ReplicaSetService) cpuMode(info *models.EtcdContainerInfo) string {
+	if info.Config == nil || info.Config.Labels == nil || info.Config.Labels[models.CpuModeLabel] == "" {
+		return models.CpuModeExclusive
+	}
+	return info.Config.Labels[models.CpuModeLabel]
+}
+
+// booking returns the booking saved in the labels of the container while its gpus are held,
+// the container applies for the gpus that are not booked once the booking is over
+func (rs *ReplicaSetService) booking(info *models.EtcdContainerInfo) string {
+	if info.Config == nil || info.Config.Labels == nil {
+		return ""
+	}
+	name := info.Config.Labels[models.BookingLabel]
+	for _, booking := range schedulers.GpuScheduler.GetBookedGpus() {
+		if booking == name {
+			return name
+		}
+	}
+	return ""
+}
+
+// applyCpus binds the number of cpus to the resources,
+// exclusive cpus are pinned by CpusetCpus, shared cpus are limited by NanoCPUs on the shared pool.
+// The preferred cpus are used first if they are free.
+func (rs *ReplicaSetService) applyCpus(res *schedulers.Reservation, resources *container.Resources, count int, mode, policy string, uuids, prefer []string) error {
+	resources.CpusetCpus = ""
+	resources.NanoCPUs = 0
+	if count == 0 {
+		return nil
+	}
+
+	if mode == models.CpuModeShared {
+		cpusets, err := res.ApplySharedCpus(count)
+		if err != nil {
+			return errors.WithMessage(err, "CpuScheduler.ApplyShared failed")
+		}
+		resources.CpusetCpus = cpusets
+		resources.NanoCPUs = int64(count) * 1e9
+		return nil
+	}
+
+	req := rs.newCpuRequest(count, policy, uuids)
+	req.Prefer = prefer
+	cpusets, err := res.ApplyCpus(req)
+	if err != nil {
+		return errors.WithMessage(err, "CpuScheduler.Apply failed")
+	}
+	resources.CpusetCpus = cpusets
+	return nil
+}
+
+// exclusiveCpus returns the cpus that are bound to the resources exclusively
+func exclusiveCpus(resources *container.Resources) []string {
+	if resources.NanoCPUs > 0 || resources.CpusetCpus == "" {
+		return nil
+	}
+	return strings.Split(resources.CpusetCpus, ",")
+}
+
+// restoreCpus returns the cpus bound to the resources to the scheduler
+func (rs *ReplicaSetService) restoreCpus(res *schedulers.Reservation, resources *container.Resources) {
+	if resources.NanoCPUs > 0 {
+		res.RestoreSharedCpus(cpuCount(resources))
+		return
+	}
+	res.RestoreCpus(exclusiveCpus(resources))
+}
+
+// cpuCount returns the number of cpus bound to the resources
+func cpuCount(resources *container.Resources) int {
+	if resources.NanoCPUs > 0 {
+		return int(resources.NanoCPUs / 1e9)
+	}
+	if resources.CpusetCpus == "" {
+		return 0
+	}
+	return len(strings.Split(resources.CpusetCpus, ","))
+}
+
+// CheckQueued rejects a run request that can never run, otherwise it would block the pending queue.
+// The name, the quotas and the capacity of the host are checked, the resources in use by others are not,
+// they are given back sooner or later.
+func (rs *ReplicaSetService) CheckQueued(spec *models.ContainerRun) error {
+	if rs.existContainer(spec.ReplicaSetName) {
+		return errors.Wrapf(xerrors.NewContainerExistedError(), "container %s", spec.ReplicaSetName)
+	}
+
+	req, err := newResourceRequest(spec)
+	if err != nil {
+		return err
+	}
+
+	if err = quota.Quotas.RequireOwner(spec.Owner, spec.Group); err != nil {
+		return errors.WithMessagef(err, "quota.RequireOwner failed, spec: %+v", spec)
+	}
+	done, err := checkQuota(spec.Owner, spec.Group, spec.ReplicaSetName, "", models.QuotaUsage{
+		Gpus:        spec.GpuCount,
+		Cpus:        spec.CpuCount,
+		Memory:      req.Memory,
+		ReplicaSets: 1,
+	})
+	if err != nil {
+		return errors.WithMessagef(err, "checkQuota failed, spec: %+v", spec)
+	}
+	done()
+
+	if err = schedulers.Fits(req); err != nil {
+		return errors.WithMessagef(err, "schedulers.Fits failed, spec: %+v", spec)
+	}
+	return nil
+}
+
+// newResourceRequest returns the resources that the run request applies for
+func newResourceRequest(spec *models.ContainerRun) (req *schedulers.ResourceRequest, err error) {
+	req = &schedulers.ResourceRequest{Name: spec.ReplicaSetName}
+	if spec.GpuCount > 0 {
+		req.Gpu, err = newGpuRequest(spec.GpuCount, spec.Gpus, spec.ExcludeGpus, spec.GpuModel, spec.MinGpuMemory)
+		if err != nil {
+			return nil, errors.Wrapf(err, "newGpuRequest failed, spec: %+v", spec)
+		}
+		req.Gpu.Booking = spec.Booking
+	}
+
+	// bind cpu resource, prefer the cpus local to the gpus
+	if spec.CpuCount > 0 {
+		if spec.CpuMode == models.CpuModeShared {
+			req.SharedCpus = spec.CpuCount
+		} else {
+			req.Cpu = &schedulers.CpuRequest{
+				Count:  spec.CpuCount,
+				Strict: spec.CpuPolicy == models.CpuPolicyNumaStrict,
+			}
+		}
+	}
+
+	// bind memory resource, it is checked against the capacity of the host
+	if spec.Memory != "" {
+		req.Memory, err = utils.ToBytes(spec.Memory)
+		if err != nil {
+			return nil, errors.Wrapf(err, "utils.ToBytes failed, spec: %+v", spec)
+		}
+	}
+
+	// promise rootfs on the disk of docker's data root
+	rootfsSize := spec.RootfsSize
+	if rootfsSize == "" {
+		rootfsSize = models.DefaultRootfsSize
+	}
+	req.Disk, err = utils.ToBytes(rootfsSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "utils.ToBytes failed, spec: %+v", spec)
+	}
+	return req, nil
+}
+
+func newGpuRequest(count int, gpus, excludes []string, model, minMemory string) (*schedulers.GpuRequest, error) {
+	req := &schedulers.GpuRequest{
+		Count:    count,
+		Gpus:     gpus,
+		Excludes: excludes,
+		Model:    model,
+	}
+	if minMemory != "" {
+		bytes, err := utils.ToBytes(minMemory)
+		if err != nil {
+			return nil, errors.Wrapf(err, "utils.ToBytes failed, minGpuMemory: %s", minMemory)
+		}
+		req.MinMemory = bytes
+	}
+	return req, nil
+}
+
+// gpuSelectors returns the gpu model and min memory saved in the labels of the container
+func (rs *ReplicaSetService) gpuSelectors(info *models.EtcdContainerInfo) (model, minMemory string) {
+	if info.Config == nil || info.Config.Labels == nil {
+		return "", ""
+	}
+	return info.Config.Labels[models.GpuModelLabel], info.Config.Labels[models.MinGpuMemoryLabel]
+}
+
+// setGpuSelectors saves the gpu selectors in the labels, the ones not asked are removed
+func (rs *ReplicaSetService) setGpuSelectors(labels map[string]string, model, minMemory string) {
+	delete(labels, models.GpuModelLabel)
+	delete(labels, models.MinGpuMemoryLabel)
+	if model != "" {
+		labels[models.GpuModelLabel] = model
+	}
+	if minMemory != "" {
+		labels[models.MinGpuMemoryLabel] = minMemory
+	}
+}
+
+// fillGpuConflictHolders finds out which replicaSets hold the conflicting gpus
+func (rs *ReplicaSetService) fillGpuConflictHolders(err error) {
+	e, ok := xerrors.AsGpuConflictError(err)
+	if !ok {
+		return
+	}
+	for _, uuid := range e.Gpus {
+		e.Holders[uuid] = rs.ReplicaSetsUsingGpu(uuid)
+	}
+}
+
+// ReplicaSetsUsingGpu returns the replicaSets whose latest version of the container uses the gpu
+func (rs *ReplicaSetService) ReplicaSetsUsingGpu(uuid string) []string {
+	var replicaSets []string
+	for name, version := range vmap.ContainerVersionMap.Snapshot() {
+		uuids, err := rs.containerDeviceRequestsDeviceIDs(fmt.Sprintf("%s-%d", name, version))
+		if err != nil {
+			continue
+		}
+		for i := range uuids {
+			if uuids[i] == uuid {
+				replicaSets = append(replicaSets, name)
+				break
+			}
+		}
+	}
+	return replicaSets
+}
+
+// ReplicaSetExist reports whether the replicaSet has a container that is not deleted
+func (rs *ReplicaSetService) ReplicaSetExist(name string) bool {
+	return vmap.ContainerVersionMap.Exist(name)
+}
+
+// ReplicaSetRunning reports whether the latest version of the container is running
+func (rs *ReplicaSetService) ReplicaSetRunning(name string) (bool, error) {
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return false, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	return rs.containerStatusRunning(fmt.Sprintf("%s-%d", name, version))
+}
+
+// ReplicaSetReleased reports whether the latest version of the container is stopped with its resources given back,
+// it must be restarted to apply for them again, `docker restart` would use them without holding them.
+func (rs *ReplicaSetService) ReplicaSetReleased(name string) bool {
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return false
+	}
+	return StoppedContainers.Has(fmt.Sprintf("%s-%d", name, version))
+}
+
+// RunningReplicaSetsWithLabel returns the replicaSets whose latest version of the container is running with the label
+func (rs *ReplicaSetService) RunningReplicaSetsWithLabel(key, value string) []string {
+	var replicaSets []string
+	ctx := context.Background()
+	for name, version := range vmap.ContainerVersionMap.Snapshot() {
+		resp, err := docker.Cli.ContainerInspect(ctx, fmt.Sprintf("%s-%d", name, version), client.ContainerInspectOptions{})
+		if err != nil || !resp.Container.State.Running || resp.Container.Config == nil {
+			continue
+		}
+		if resp.Container.Config.Labels[key] == value {
+			replicaSets = append(replicaSets, name)
+		}
+	}
+	sort.Strings(replicaSets)
+	return replicaSets
+}
+
+// RunningGpuReplicaSets returns the replicaSets whose latest version of the container is running with gpus
+func (rs *ReplicaSetService) RunningGpuReplicaSets() []models.ReplicaSetGpus {
+	return rs.gpuReplicaSets(func(ctrVersionName string, state *container.State) bool {
+		return state.Running
+	})
+}
+
+// GpuHoldingReplicaSets returns the replicaSets whose latest version of the container holds gpus,
+// including the ones that are paused or exited by themselves.
+func (rs *ReplicaSetService) GpuHoldingReplicaSets() []models.ReplicaSetGpus {
+	return rs.gpuReplicaSets(func(ctrVersionName string, state *container.State) bool {
+		return rs.holdsResources(ctrVersionName, state.Running, state.Paused)
+	})
+}
+
+func (rs *ReplicaSetService) gpuReplicaSets(filter func(ctrVersionName string, state *container.State) bool) []models.ReplicaSetGpus {
+	var replicaSets []models.ReplicaSetGpus
+	ctx := context.Background()
+	for name, version := range vmap.ContainerVersionMap.Snapshot() {
+		ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+		resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName, client.ContainerInspectOptions{})
+		if err != nil || resp.Container.State == nil || !filter(ctrVersionName, resp.Container.State) || resp.Container.Config == nil {
+			continue
+		}
+		uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+		if err != nil || len(uuids) == 0 {
+			continue
+		}
+		replicaSets = append(replicaSets, models.ReplicaSetGpus{
+			Name:    name,
+			Owner:   resp.Container.Config.Labels[models.OwnerLabel],
+			Booking: resp.Container.Config.Labels[models.BookingLabel],
+			Gpus:    uuids,
+		})
+	}
+	sort.Slice(replicaSets, func(i, j int) bool {
+		return replicaSets[i].Name < replicaSets[j].Name
+	})
+	return replicaSets
+}
+
 func (rs *ReplicaSetService) GetContainerHistory(name string) ([]*models.ContainerHistoryItem, error) {
 	replicaSet, err := etcd.GetRevisionRange(etcd.Containers, name)
 	if err != nil {
@@ -976,6 +1570,12 @@ func (rs *ReplicaSetService) containerStatusPaused(name string) (bool, error) {
 	return resp.Container.State.Paused, nil
 }
 
+// holdsResources reports whether the resources of the container are still held in the schedulers,
+// only the containers stopped through the api give them back, the ones exited by themselves still hold them.
+func (rs *ReplicaSetService) holdsResources(name string, running, pause bool) bool {
+	return running || pause || !StoppedContainers.Has(name)
+}
+
 func (rs *ReplicaSetService) containerPortBindings(name string) ([]string, error) {
 	ctx := context.Background()
 	resp, err := docker.Cli.ContainerInspect(ctx, name, client.ContainerInspectOptions{})
@@ -985,20 +1585,217 @@ func (rs *ReplicaSetService) containerPortBindings(name string) ([]string, error
 	if resp.Container.HostConfig.PortBindings == nil {
 		return []string{}, nil
 	}
+	return hostPorts(resp.Container.HostConfig), nil
+}
+
+// hostPorts returns the host ports bound by the container, they are the keys of the port scheduler, e.g. 40022/tcp
+func hostPorts(hostConfig *container.HostConfig) []string {
 	var ports []string
-	for _, v := range resp.Container.HostConfig.PortBindings {
-		ports = append(ports, v[0].HostPort)
+	for k, v := range hostConfig.PortBindings {
+		if len(v) > 0 && v[0].HostPort != "" {
+			ports = append(ports, schedulers.PortKey(v[0].HostPort, string(k.Proto())))
+		}
+	}
+	return ports
+}
+
+// applyPorts applies for a host port for each container port through the reservation.
+// The host ports are sticky: the ones held by the previous version are taken over instead of applied,
+// the others are applied again if they are free, fixed ones must be free and the rest fall back to new ports.
+func (rs *ReplicaSetService) applyPorts(res *schedulers.Reservation, name string, version int64, info *models.EtcdContainerInfo) error {
+	if len(info.HostConfig.PortBindings) == 0 {
+		return nil
+	}
+
+	fixed := make(map[string]struct{})
+	if info.Config.Labels != nil && info.Config.Labels[models.FixedPortsLabel] != "" {
+		for _, port := range strings.Split(info.Config.Labels[models.FixedPortsLabel], ",") {
+			fixed[port] = struct{}{}
+		}
+	}
+	held := make(map[string]struct{})
+	if version > 1 {
+		previous := fmt.Sprintf("%s-%d", name, version-1)
+		running, _ := rs.containerStatusRunning(previous)
+		pause, _ := rs.containerStatusPaused(previous)
+		if rs.holdsResources(previous, running, pause) {
+			ports, _ := rs.containerPortBindings(previous)
+			for _, port := range ports {
+				held[port] = struct{}{}
+			}
+		}
+	}
+
+	keys := make([]network.Port, 0, len(info.HostConfig.PortBindings))
+	for k := range info.HostConfig.PortBindings {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	var (
+		reqs    []schedulers.PortRequest
+		reqKeys []network.Port
+	)
+	for _, k := range keys {
+		req := schedulers.PortRequest{Protocol: string(k.Proto())}
+		if len(info.HostConfig.PortBindings[k]) > 0 && info.HostConfig.PortBindings[k][0].HostPort != "" {
+			hostPort := info.HostConfig.PortBindings[k][0].HostPort
+			if _, ok := held[schedulers.PortKey(hostPort, req.Protocol)]; ok {
+				continue
+			}
+			if _, ok := fixed[k.String()]; ok {
+				req.HostPort = hostPort
+			} else {
+				req.Prefer = hostPort
+			}
+		}
+		reqs = append(reqs, req)
+		reqKeys = append(reqKeys, k)
+	}
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	ports, err := res.ApplyPorts(reqs)
+	if err != nil {
+		return errors.WithMessagef(err, "PortScheduler.ApplyRequest failed, name: %s", name)
+	}
+	for i, k := range reqKeys {
+		info.HostConfig.PortBindings[k] = []network.PortBinding{{
+			HostPort: ports[i],
+		}}
+	}
+	return nil
+}
+
+// stopForTakeover stops the old container if the new one takes over its host ports,
+// otherwise the new one can't be started. It reports whether the old container is stopped.
+func (rs *ReplicaSetService) stopForTakeover(oldName, newName string) (bool, error) {
+	oldPorts, err := rs.containerPortBindings(oldName)
+	if err != nil {
+		return false, errors.WithMessage(err, "services.containerPortBindings failed")
+	}
+	newPorts, err := rs.containerPortBindings(newName)
+	if err != nil {
+		return false, errors.WithMessage(err, "services.containerPortBindings failed")
+	}
+	if len(subtractPorts(oldPorts, newPorts)) == len(oldPorts) {
+		return false, nil
+	}
+
+	if _, err = docker.Cli.ContainerStop(context.Background(), oldName, client.ContainerStopOptions{}); err != nil {
+		return false, errors.Wrapf(err, "docker.ContainerStop failed, name: %s", oldName)
+	}
+	log.Infof("services.stopForTakeover, container: %s stopped, its host ports are taken over by: %s", oldName, newName)
+	return true, nil
+}
+
+// resumeAfterTakeover starts the old container again if the new one failed to start after the takeover
+func (rs *ReplicaSetService) resumeAfterTakeover(oldName string, stopped bool) {
+	if !stopped {
+		return
+	}
+	if _, err := docker.Cli.ContainerStart(context.Background(), oldName, client.ContainerStartOptions{}); err != nil {
+		log.Errorf("services.resumeAfterTakeover failed, name: %s, err: %v", oldName, err)
+		return
+	}
+	log.Infof("services.resumeAfterTakeover, container: %s started again", oldName)
+}
+
+// resourceChanges compares the gpus, cpus and host ports of the old and new containers
+func (rs *ReplicaSetService) resourceChanges(oldName, newName string) (*models.ResourceChanges, error) {
+	changes := &models.ResourceChanges{}
+
+	oldGpus, err := rs.containerDeviceRequestsDeviceIDs(oldName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	newGpus, err := rs.containerDeviceRequestsDeviceIDs(newName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	if before, after := strings.Join(oldGpus, ","), strings.Join(newGpus, ","); before != after {
+		changes.Gpus = &models.ResourceChange{Before: before, After: after}
+	}
+
+	oldResources, err := rs.containerResources(oldName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerResources failed")
+	}
+	newResources, err := rs.containerResources(newName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerResources failed")
+	}
+	if oldResources.CpusetCpus != newResources.CpusetCpus {
+		changes.Cpus = &models.ResourceChange{Before: oldResources.CpusetCpus, After: newResources.CpusetCpus}
+	}
+
+	oldPorts, err := rs.containerPortMap(oldName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerPortMap failed")
+	}
+	newPorts, err := rs.containerPortMap(newName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerPortMap failed")
+	}
+	for port, after := range newPorts {
+		if before := oldPorts[port]; before != after {
+			if changes.Ports == nil {
+				changes.Ports = make(map[string]*models.ResourceChange)
+			}
+			changes.Ports[port] = &models.ResourceChange{Before: before, After: after}
+		}
+	}
+	for port, before := range oldPorts {
+		if _, ok := newPorts[port]; !ok {
+			if changes.Ports == nil {
+				changes.Ports = make(map[string]*models.ResourceChange)
+			}
+			changes.Ports[port] = &models.ResourceChange{Before: before}
+		}
+	}
+	return changes, nil
+}
+
+// containerPortMap returns the host port bound to each container port, e.g. 22/tcp -> 40022
+func (rs *ReplicaSetService) containerPortMap(name string) (map[string]string, error) {
+	resp, err := docker.Cli.ContainerInspect(context.Background(), name, client.ContainerInspectOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+	}
+	ports := make(map[string]string, len(resp.Container.HostConfig.PortBindings))
+	for k, v := range resp.Container.HostConfig.PortBindings {
+		if len(v) > 0 && v[0].HostPort != "" {
+			ports[k.String()] = v[0].HostPort
+		}
 	}
 	return ports, nil
 }
 
-func (rs *ReplicaSetService) containerCpusetCpus(name string) ([]string, error) {
+// subtractPorts returns the ports that are not in the others
+func subtractPorts(ports, others []string) []string {
+	set := make(map[string]struct{}, len(others))
+	for _, port := range others {
+		set[port] = struct{}{}
+	}
+	resp := make([]string, 0, len(ports))
+	for _, port := range ports {
+		if _, ok := set[port]; !ok {
+			resp = append(resp, port)
+		}
+	}
+	return resp
+}
+
+func (rs *ReplicaSetService) containerResources(name string) (*container.Resources, error) {
 	ctx := context.Background()
 	resp, err := docker.Cli.ContainerInspect(ctx, name, client.ContainerInspectOptions{})
 	if err != nil {
-		return []string{}, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
 	}
-	return strings.Split(resp.Container.HostConfig.Resources.CpusetCpus, ","), nil
+	return &resp.Container.HostConfig.Resources, nil
 }
 
 func (rs *ReplicaSetService) containerMemory(name string) (int64, error) {
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/moby/moby/api/types/container"
-	"github.com/moby/moby/api/types/network"
 	"github.com/moby/moby/client"
 	"github.com/ngaut/log"
 	"github.com/pkg/errors"
@@ -22,11 +21,12 @@ import (
 )
 
 // It will only be executed based on the `docker.client.ContainerCreate`
-func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info *models.EtcdContainerInfo, onlyCreate bool) (string, string, etcd.PutKeyValue, error) {
+func (rs *ReplicaSetService) runContainer(ctx context.Context, res *schedulers.Reservation, name string, info *models.EtcdContainerInfo, onlyCreate bool) (string, string, etcd.PutKeyValue, error) {
 	// set the version number
-	version, _ := vmap.ContainerVersionMap.Get(name)
-	version = version + 1
-	vmap.ContainerVersionMap.Set(name, version)
+	version, err := vmap.ContainerVersionMap.Next(name)
+	if err != nil {
+		return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "ContainerVersionMap.Next failed")
+	}
 
 	// add the version number to the env
 	isExist := false
@@ -59,31 +59,18 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 		info.HostConfig.Resources.DeviceRequests = nil
 	}
 
-	var err error
 	defer func() {
 		// if run container failed, clear the version number
 		if err != nil {
-			if version == 1 {
-				vmap.ContainerVersionMap.Remove(name)
-			} else {
-				vmap.ContainerVersionMap.Set(name, version-1)
-			}
+			vmap.ContainerVersionMap.Rollback(name, version)
 		}
 	}()
 
 	// apply for some host port
-	if info.HostConfig.PortBindings != nil && len(info.HostConfig.PortBindings) > 0 {
-		availableOSPorts, err := schedulers.PortScheduler.Apply(len(info.HostConfig.PortBindings))
-		if err != nil {
-			return "", "", etcd.PutKeyValue{}, errors.Wrapf(err, "Portscheduler.Apply failed, info: %+v", info)
-		}
-		var index int
-		for k := range info.HostConfig.PortBindings {
-			info.HostConfig.PortBindings[k] = []network.PortBinding{{
-				HostPort: availableOSPorts[index],
-			}}
-			index++
-		}
+	err = rs.applyPorts(res, name, version, info)
+	if err != nil {
+		info.HostConfig.Resources.DeviceRequests = deviceRequest
+		return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "services.applyPorts failed")
 	}
 
 	// generate container name with version and save creation time
@@ -150,6 +137,33 @@ func (rs *ReplicaSetService) containerDeviceRequestsDeviceIDs(name string) ([]st
 	return uuids, nil
 }
 
+// inspectDeviceIDs returns the gpus of the inspected container, they are recorded in the env of the mock container
+func inspectDeviceIDs(resp *container.InspectResponse) []string {
+	if resp.Config == nil {
+		return []string{}
+	}
+	for _, env := range resp.Config.Env {
+		if strings.HasPrefix(env, "MOCK_GPU_UUID=") && env != "MOCK_GPU_UUID=" {
+			return strings.Split(strings.TrimPrefix(env, "MOCK_GPU_UUID="), ",")
+		}
+	}
+	return []string{}
+}
+
+// infoDeviceIDs returns the gpus recorded in the creation info,
+// the device requests are removed before the mock container is created, so the env is used instead.
+func (rs *ReplicaSetService) infoDeviceIDs(info *models.EtcdContainerInfo) []string {
+	if len(info.HostConfig.Resources.DeviceRequests) != 0 {
+		return info.HostConfig.Resources.DeviceRequests[0].DeviceIDs
+	}
+	for i := range info.Config.Env {
+		if strings.HasPrefix(info.Config.Env[i], "MOCK_GPU_UUID=") {
+			return strings.Split(strings.TrimPrefix(info.Config.Env[i], "MOCK_GPU_UUID="), ",")
+		}
+	}
+	return []string{}
+}
+
 func (rs *ReplicaSetService) newContainerResource(uuids []string) container.Resources {
 	return container.Resources{
 		DeviceRequests: []container.DeviceRequest{
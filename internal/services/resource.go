@@ -0,0 +1,41 @@
+package services
+
+import (
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+)
+
+type ResourceService struct{}
+
+// RescanGpus picks up gpus that are replaced, added or renamed by a driver upgrade,
+// and reports the replicaSets that still use the retired gpus.
+func (s *ResourceService) RescanGpus() (*models.GpuRescanResult, error) {
+	added, retired, err := schedulers.GpuScheduler.Rescan()
+	if err != nil {
+		return nil, errors.WithMessage(err, "GpuScheduler.Rescan failed")
+	}
+
+	var rs ReplicaSetService
+	resp := &models.GpuRescanResult{
+		Added:   added,
+		Retired: retired,
+		Pinned:  make(map[string][]string),
+	}
+	for _, uuid := range retired {
+		if replicaSets := rs.ReplicaSetsUsingGpu(uuid); len(replicaSets) != 0 {
+			resp.Pinned[uuid] = replicaSets
+		}
+	}
+
+	if len(added) != 0 || len(retired) != 0 {
+		log.Infof("services.RescanGpus, added %d gpus: %+v, retired %d gpus: %+v, pinned replicaSets: %+v",
+			len(added), added, len(retired), retired, resp.Pinned)
+	}
+	for uuid, replicaSets := range resp.Pinned {
+		log.Warnf("services.RescanGpus, gpu: %s is retired but still used by replicaSets: %+v", uuid, replicaSets)
+	}
+	return resp, nil
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+)
+
+// one etcd key per stopped container, e.g. /gpu-docker-api/apis/v1/stopped/containers/foo-3
+const stoppedDir = "containers"
+
+// StoppedContainers are the containers stopped through the api, whose resources are given back to the schedulers.
+// An exited container that is not one of them exited by itself, so the reconciler counts its resources as still held.
+var StoppedContainers *stoppedSet
+
+type stoppedSet struct {
+	sync.RWMutex
+
+	// container -> the time it was stopped
+	items map[string]string
+	store *etcd.Store
+}
+
+func InitStoppedContainers() error {
+	StoppedContainers = &stoppedSet{}
+	StoppedContainers.store = etcd.NewStore(etcd.Stopped, stoppedDir, StoppedContainers.snapshot)
+
+	items, err := StoppedContainers.store.Load()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	StoppedContainers.items = items
+	return nil
+}
+
+func CloseStoppedContainers() error {
+	return etcd.Stores{StoppedContainers.store}.Sync()
+}
+
+// Add records that the container is stopped and its resources are given back
+func (ss *stoppedSet) Add(container string) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	ss.items[container] = time.Now().Format("2006-01-02 15:04:05")
+
+	go ss.putToEtcd()
+}
+
+// Remove forgets the container once it is started again or removed
+func (ss *stoppedSet) Remove(container string) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if _, ok := ss.items[container]; !ok {
+		return
+	}
+	delete(ss.items, container)
+
+	go ss.putToEtcd()
+}
+
+func (ss *stoppedSet) Has(container string) bool {
+	ss.RLock()
+	defer ss.RUnlock()
+
+	_, ok := ss.items[container]
+	return ok
+}
+
+// Retain forgets the containers that no longer exist
+func (ss *stoppedSet) Retain(exists func(container string) bool) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	var changed bool
+	for container := range ss.items {
+		if !exists(container) {
+			delete(ss.items, container)
+			changed = true
+		}
+	}
+	if changed {
+		go ss.putToEtcd()
+	}
+}
+
+// snapshot one key per container, container -> the time it was stopped
+func (ss *stoppedSet) snapshot() map[string]string {
+	ss.RLock()
+	defer ss.RUnlock()
+
+	items := make(map[string]string, len(ss.items))
+	for k, v := range ss.items {
+		items[k] = v
+	}
+	return items
+}
+
+func (ss *stoppedSet) putToEtcd() {
+	workQueue.Add(etcd.Stores{ss.store})
+}
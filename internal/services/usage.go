@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/moby/moby/client"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/usage"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+// openUsage opens a usage record of the resources allocated to the container,
+// it is called after the resources of a new version are committed.
+func (rs *ReplicaSetService) openUsage(name, ctrVersionName string) {
+	record, err := rs.usageRecord(name, ctrVersionName)
+	if err != nil {
+		log.Errorf("services.openUsage failed, container: %s, err: %v", ctrVersionName, err)
+		return
+	}
+	usage.Ledger.Open(record)
+}
+
+// closeUsage closes the usage record of the replicaSet, it is called after its resources are restored
+func (rs *ReplicaSetService) closeUsage(name string) {
+	usage.Ledger.Close(name)
+}
+
+func (rs *ReplicaSetService) usageRecord(name, ctrVersionName string) (models.UsageRecord, error) {
+	resp, err := docker.Cli.ContainerInspect(context.Background(), ctrVersionName, client.ContainerInspectOptions{})
+	if err != nil {
+		return models.UsageRecord{}, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", ctrVersionName)
+	}
+	record := models.UsageRecord{
+		ReplicaSet: name,
+		Container:  ctrVersionName,
+	}
+	if resp.Container.Config != nil {
+		record.Owner = resp.Container.Config.Labels[models.OwnerLabel]
+		record.Group = resp.Container.Config.Labels[models.GroupLabel]
+	}
+	record.Gpus = len(inspectDeviceIDs(&resp.Container))
+	if resp.Container.HostConfig != nil {
+		resources := &resp.Container.HostConfig.Resources
+		record.Cpus = cpuCount(resources)
+		record.Memory = resources.Memory
+	}
+	return record, nil
+}
+
+// SyncUsage opens the usage records of the running replicaSets that have none,
+// e.g. the ones that were running before the ledger was added.
+func (rs *ReplicaSetService) SyncUsage() {
+	ctx := context.Background()
+	for name, version := range vmap.ContainerVersionMap.Snapshot() {
+		if usage.Ledger.IsOpen(name) {
+			continue
+		}
+		ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+		resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName, client.ContainerInspectOptions{})
+		if err != nil || !resp.Container.State.Running {
+			continue
+		}
+		log.Infof("services.SyncUsage, container: %s is running without a usage record, open one", ctrVersionName)
+		rs.openUsage(name, ctrVersionName)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
 	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/quota"
 	vmap "github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
@@ -33,38 +34,56 @@ func (vs *VolumeService) CreateVolume(spec *models.VolumeCreate) (resp volume.Vo
 	if len(spec.Name) != 0 {
 		opt.Name = spec.Name
 	}
+	var size int64
 	if len(spec.Size) != 0 {
 		opt.DriverOpts = map[string]string{"size": spec.Size}
+		size, _ = utils.ToBytes(spec.Size)
 	}
+	opt.Labels = make(map[string]string)
+	if spec.Owner != "" {
+		opt.Labels[models.OwnerLabel] = spec.Owner
+	}
+	if spec.Group != "" {
+		opt.Labels[models.GroupLabel] = spec.Group
+	}
+
+	if err = quota.Quotas.RequireOwner(spec.Owner, spec.Group); err != nil {
+		return resp, errors.WithMessagef(err, "quota.RequireOwner failed, spec: %+v", spec)
+	}
+	done, err := checkQuota(spec.Owner, spec.Group, "", spec.Name, models.QuotaUsage{
+		Volumes:    1,
+		VolumeSize: size,
+	})
+	if err != nil {
+		return resp, errors.WithMessagef(err, "checkQuota failed, spec: %+v", spec)
+	}
+	defer done()
 
 	resp, kv, err := vs.createVolume(ctx, spec.Name, models.EtcdVolumeInfo{Opt: &opt})
 	if err != nil {
 		return resp, errors.WithMessage(err, "services.createVolume failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Add(etcd.PutKeyValue{
 		Resource: etcd.Volumes,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 	return
 }
 
 // It will only be executed based on the `docker.client.ContainerCreate`
 func (vs *VolumeService) createVolume(ctx context.Context, name string, info models.EtcdVolumeInfo) (resp volume.Volume, kv etcd.PutKeyValue, err error) {
 	// set the version number
-	version, _ := vmap.VolumeVersionMap.Get(name)
-	version = version + 1
-	vmap.VolumeVersionMap.Set(name, version)
+	version, err := vmap.VolumeVersionMap.Next(name)
+	if err != nil {
+		return resp, kv, errors.WithMessage(err, "VolumeVersionMap.Next failed")
+	}
 
 	defer func() {
-		// if run container failed, clear the version number
+		// if create volume failed, clear the version number
 		if err != nil {
-			if version == 1 {
-				vmap.VolumeVersionMap.Remove(name)
-			} else {
-				vmap.VolumeVersionMap.Set(name, version-1)
-			}
+			vmap.VolumeVersionMap.Rollback(name, version)
 		}
 	}()
 
@@ -141,6 +160,16 @@ func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (
 
 	info.Opt.DriverOpts["size"] = patchSize
 
+	done, err := checkQuota(info.Opt.Labels[models.OwnerLabel], info.Opt.Labels[models.GroupLabel], "", name,
+		models.QuotaUsage{
+			Volumes:    1,
+			VolumeSize: patchSizeBytes,
+		})
+	if err != nil {
+		return resp, errors.WithMessage(err, "checkQuota failed")
+	}
+	defer done()
+
 	// create a new volume to replace the old one
 	resp, kv, err := vs.createVolume(ctx, name, info)
 	if err != nil {
@@ -158,11 +187,11 @@ func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (
 	// 	return resp, errors.WithMessage(err, "services.DeleteVolume failed")
 	// }
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Add(etcd.PutKeyValue{
 		Resource: etcd.Volumes,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
 	log.Infof("services.PatchVolumeSize, volume size patched successfully, old name: %s, old size: %s, new name: %s, new size: %s",
 		name, preSize, resp.Name, patchSize)
@@ -183,10 +212,10 @@ func (vs *VolumeService) DeleteVolume(name string, isLatest, deleteRecord bool)
 	if deleteRecord {
 		log.Infof("services.DeleteVolume, volume: %s will be del etcd info and version record", name)
 		vmap.VolumeVersionMap.Remove(strings.Split(name, "-")[0])
-		workQueue.Queue <- etcd.DelKey{
+		workQueue.Add(etcd.DelKey{
 			Resource: etcd.Volumes,
 			Key:      name,
-		}
+		})
 	}
 
 	_, err := docker.Cli.VolumeRemove(context.TODO(), name, client.VolumeRemoveOptions{Force: true})
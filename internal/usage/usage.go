@@ -0,0 +1,328 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// the single key that older versions stored the whole ledger in
+	usageLedgerKey = "usageLedgerKey"
+
+	// one etcd key per open record, e.g. /gpu-docker-api/apis/v1/usage/open/<replicaSet>
+	openDir = "open"
+	// one etcd key per closed record ordered by the end time,
+	// e.g. /gpu-docker-api/apis/v1/usage/records/20240102T150405-<replicaSet>-20240101T080000
+	recordDir = "records"
+
+	timeLayout    = "2006-01-02 15:04:05"
+	keyTimeLayout = "20060102T150405"
+
+	compactInterval = 24 * time.Hour
+)
+
+var Ledger *ledger
+
+// ledger records the intervals that the resources are allocated to the replicaSets,
+// a replicaSet has at most one open record, the one of its latest version.
+// Only the open records are kept in memory, the closed ones are read from etcd by the time range.
+type ledger struct {
+	sync.RWMutex
+
+	// replicaSet -> the open record
+	open map[string]*models.UsageRecord
+
+	// the closed records that ended before it are deleted, 0 means they are kept forever
+	retention time.Duration
+}
+
+func InitUsageLedger(retention time.Duration) error {
+	var err error
+	Ledger, err = initLedgerFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	Ledger.retention = retention
+	return nil
+}
+
+// CloseUsageLedger writes the open records, the closed ones have been written when they were closed
+func CloseUsageLedger() error {
+	Ledger.RLock()
+	defer Ledger.RUnlock()
+
+	for name, r := range Ledger.open {
+		if err := etcd.Put(etcd.Usage, openKey(name), marshal(r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initLedgerFormEtcd reads the open records, the blob key of older versions is split into one key per record and deleted
+func initLedgerFormEtcd() (*ledger, error) {
+	l := &ledger{
+		open: make(map[string]*models.UsageRecord),
+	}
+
+	kvs, err := etcd.GetRange(etcd.Usage, openDir, "", "")
+	if err != nil {
+		return l, err
+	}
+	for _, kv := range kvs {
+		var r models.UsageRecord
+		if err = json.Unmarshal(kv.Value, &r); err != nil {
+			return l, errors.Wrapf(err, "json.Unmarshal failed, key: %s", kv.Key)
+		}
+		l.open[r.ReplicaSet] = &r
+	}
+
+	bytes, err := etcd.GetValue(etcd.Usage, usageLedgerKey)
+	if err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			return l, nil
+		}
+		return l, err
+	}
+	var blob struct {
+		Records []*models.UsageRecord `json:"records"`
+	}
+	if err = json.Unmarshal(bytes, &blob); err != nil {
+		return l, err
+	}
+	for _, r := range blob.Records {
+		if r.EndTime == "" {
+			l.open[r.ReplicaSet] = r
+			err = etcd.Put(etcd.Usage, openKey(r.ReplicaSet), marshal(r))
+		} else {
+			err = etcd.Put(etcd.Usage, recordKey(r), marshal(r))
+		}
+		if err != nil {
+			return l, err
+		}
+	}
+	log.Infof("usage.Ledger, %d records are migrated from %s", len(blob.Records), usageLedgerKey)
+	return l, etcd.Del(etcd.Usage, usageLedgerKey)
+}
+
+// ParseTime parses the time format of the ledger in the local time zone
+func ParseTime(value string) (time.Time, error) {
+	return time.ParseInLocation(timeLayout, value, time.Local)
+}
+
+// Loop deletes the records older than the retention once a day
+func (l *ledger) Loop(ctx context.Context) {
+	if l.retention <= 0 {
+		return
+	}
+
+	l.compact()
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.compact()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *ledger) compact() {
+	before := time.Now().Add(-l.retention)
+	deleted, err := etcd.DelRange(etcd.Usage, recordDir, "", before.Format(keyTimeLayout))
+	if err != nil {
+		log.Errorf("usage.Ledger, compact failed, original error: %T %v", errors.Cause(err), err)
+		return
+	}
+	if deleted != 0 {
+		log.Infof("usage.Ledger, %d records that ended before %s are deleted", deleted, before.Format(timeLayout))
+	}
+}
+
+// Open starts a record from now, the open record of the replicaSet is closed first
+func (l *ledger) Open(record models.UsageRecord) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now().Format(timeLayout)
+	l.close(record.ReplicaSet, now)
+	record.StartTime = now
+	record.EndTime = ""
+	l.open[record.ReplicaSet] = &record
+
+	// added under the lock, so the writes of the key are queued in the order they happen
+	_ = workQueue.Add(etcd.PutKeyValue{
+		Resource: etcd.Usage,
+		Key:      openKey(record.ReplicaSet),
+		Value:    marshal(&record),
+	})
+}
+
+// Close ends the open record of the replicaSet at now, nothing happens if there is none
+func (l *ledger) Close(replicaSet string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.close(replicaSet, time.Now().Format(timeLayout))
+}
+
+// close writes the closed record to its own key and deletes the open key,
+// the closed record is written right away so the reports see it, and queued if etcd fails.
+func (l *ledger) close(replicaSet, now string) {
+	r, ok := l.open[replicaSet]
+	if !ok {
+		return
+	}
+	delete(l.open, replicaSet)
+	r.EndTime = now
+
+	key, value := recordKey(r), marshal(r)
+	if err := etcd.Put(etcd.Usage, key, value); err != nil {
+		log.Errorf("usage.Ledger, put record failed, queue it, original error: %T %v", errors.Cause(err), err)
+		_ = workQueue.Add(etcd.PutKeyValue{Resource: etcd.Usage, Key: key, Value: value})
+	}
+	_ = workQueue.Add(etcd.DelKey{Resource: etcd.Usage, Key: openKey(replicaSet)})
+}
+
+// IsOpen reports whether the replicaSet has an open record
+func (l *ledger) IsOpen(replicaSet string) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	_, ok := l.open[replicaSet]
+	return ok
+}
+
+// Records returns the records that overlap [from, to), the open ones are the last ones.
+// Only the closed records that end after from are read, they are ordered by the end time in etcd.
+func (l *ledger) Records(from, to time.Time) ([]models.UsageRecord, error) {
+	kvs, err := etcd.GetRange(etcd.Usage, recordDir, from.Format(keyTimeLayout), "")
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]models.UsageRecord, 0, len(kvs))
+	for _, kv := range kvs {
+		var r models.UsageRecord
+		if err = json.Unmarshal(kv.Value, &r); err != nil {
+			log.Warnf("usage.Ledger, skip a broken record, key: %s, err: %v", kv.Key, err)
+			continue
+		}
+		if start, err := ParseTime(r.StartTime); err != nil || !start.Before(to) {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+	open := make([]models.UsageRecord, 0, len(l.open))
+	for _, r := range l.open {
+		if start, err := ParseTime(r.StartTime); err == nil && start.Before(to) {
+			open = append(open, *r)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].ReplicaSet < open[j].ReplicaSet
+	})
+	return append(records, open...), nil
+}
+
+// Report sums the resources used in [from, to) by owner or replicaSet, the most gpu-hours is the first one.
+// The open records are counted until now.
+func (l *ledger) Report(from, to time.Time, groupBy string) ([]models.UsageReport, error) {
+	records, err := l.Records(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return Report(records, from, to, time.Now(), groupBy), nil
+}
+
+// Report sums the resources of the records used in [from, to), the open records are counted until now
+func Report(records []models.UsageRecord, from, to, now time.Time, groupBy string) []models.UsageReport {
+	reports := make(map[string]*models.UsageReport)
+	for _, r := range records {
+		start, end, ok := Clip(r, from, to, now)
+		if !ok {
+			continue
+		}
+
+		key := r.ReplicaSet
+		if groupBy == models.UsageGroupByOwner {
+			key = r.Owner
+		}
+		report, ok := reports[key]
+		if !ok {
+			report = &models.UsageReport{Key: key}
+			reports[key] = report
+		}
+		hours := end.Sub(start).Hours()
+		report.GpuHours += float64(r.Gpus) * hours
+		report.CpuHours += float64(r.Cpus) * hours
+		report.MemoryGBHours += float64(r.Memory) / (1 << 30) * hours
+	}
+
+	resp := make([]models.UsageReport, 0, len(reports))
+	for _, report := range reports {
+		resp = append(resp, *report)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].GpuHours != resp[j].GpuHours {
+			return resp[i].GpuHours > resp[j].GpuHours
+		}
+		return resp[i].Key < resp[j].Key
+	})
+	return resp
+}
+
+// Clip returns the part of the record in [from, to), the open record ends at now,
+// ok is false if the record is broken or does not overlap the range.
+func Clip(r models.UsageRecord, from, to, now time.Time) (start, end time.Time, ok bool) {
+	start, err := ParseTime(r.StartTime)
+	if err != nil {
+		return start, end, false
+	}
+	end = now
+	if r.EndTime != "" {
+		if end, err = ParseTime(r.EndTime); err != nil {
+			return start, end, false
+		}
+	}
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	return start, end, end.After(start)
+}
+
+func openKey(replicaSet string) string {
+	return openDir + "/" + replicaSet
+}
+
+// recordKey orders the closed records by the end time, the names of replicaSets can't contain dash
+func recordKey(r *models.UsageRecord) string {
+	start, _ := ParseTime(r.StartTime)
+	end, _ := ParseTime(r.EndTime)
+	return recordDir + "/" + end.Format(keyTimeLayout) + "-" + r.ReplicaSet + "-" + start.Format(keyTimeLayout)
+}
+
+func marshal(r *models.UsageRecord) *string {
+	bytes, _ := json.Marshal(r)
+	tmp := string(bytes)
+	return &tmp
+}
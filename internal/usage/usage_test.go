@@ -0,0 +1,116 @@
+package usage
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+func mustParse(t *testing.T, value string) time.Time {
+	t.Helper()
+	tm, err := ParseTime(value)
+	if err != nil {
+		t.Fatalf("ParseTime(%s): %v", value, err)
+	}
+	return tm
+}
+
+func TestReport(t *testing.T) {
+	records := []models.UsageRecord{
+		// 2 gpus for 2 hours, half of it before from
+		{ReplicaSet: "foo", Owner: "alice", Gpus: 2, Cpus: 4, Memory: 8 << 30,
+			StartTime: "2024-01-01 07:00:00", EndTime: "2024-01-01 09:00:00"},
+		// 1 gpu, still open, counted until now
+		{ReplicaSet: "bar", Owner: "alice", Gpus: 1, StartTime: "2024-01-01 10:00:00"},
+		// ends before from
+		{ReplicaSet: "baz", Owner: "bob", Gpus: 8, StartTime: "2024-01-01 00:00:00", EndTime: "2024-01-01 08:00:00"},
+		// broken start time
+		{ReplicaSet: "qux", Owner: "bob", Gpus: 8, StartTime: "yesterday", EndTime: "2024-01-01 12:00:00"},
+	}
+	from := mustParse(t, "2024-01-01 08:00:00")
+	to := mustParse(t, "2024-01-02 00:00:00")
+	now := mustParse(t, "2024-01-01 13:00:00")
+
+	byOwner := Report(records, from, to, now, models.UsageGroupByOwner)
+	if len(byOwner) != 1 || byOwner[0].Key != "alice" {
+		t.Fatalf("report by owner = %+v, want only alice", byOwner)
+	}
+	if got := byOwner[0].GpuHours; math.Abs(got-5) > 1e-9 {
+		t.Fatalf("gpu hours = %v, want 2*1 + 1*3 = 5", got)
+	}
+	if got := byOwner[0].CpuHours; math.Abs(got-4) > 1e-9 {
+		t.Fatalf("cpu hours = %v, want 4", got)
+	}
+	if got := byOwner[0].MemoryGBHours; math.Abs(got-8) > 1e-9 {
+		t.Fatalf("memory GB hours = %v, want 8", got)
+	}
+
+	byReplicaSet := Report(records, from, to, now, models.UsageGroupByReplicaSet)
+	if len(byReplicaSet) != 2 || byReplicaSet[0].Key != "bar" || byReplicaSet[1].Key != "foo" {
+		t.Fatalf("report by replicaSet = %+v, want bar (3h) before foo (2h)", byReplicaSet)
+	}
+}
+
+func TestClip(t *testing.T) {
+	from := mustParse(t, "2024-01-01 08:00:00")
+	to := mustParse(t, "2024-01-01 10:00:00")
+	now := mustParse(t, "2024-01-01 12:00:00")
+
+	tests := []struct {
+		name       string
+		record     models.UsageRecord
+		start, end string
+		ok         bool
+	}{
+		{"inside", models.UsageRecord{StartTime: "2024-01-01 08:30:00", EndTime: "2024-01-01 09:00:00"},
+			"2024-01-01 08:30:00", "2024-01-01 09:00:00", true},
+		{"across both ends", models.UsageRecord{StartTime: "2024-01-01 07:00:00", EndTime: "2024-01-01 11:00:00"},
+			"2024-01-01 08:00:00", "2024-01-01 10:00:00", true},
+		{"open", models.UsageRecord{StartTime: "2024-01-01 09:00:00"},
+			"2024-01-01 09:00:00", "2024-01-01 10:00:00", true},
+		{"after", models.UsageRecord{StartTime: "2024-01-01 10:00:00", EndTime: "2024-01-01 11:00:00"}, "", "", false},
+		{"broken end", models.UsageRecord{StartTime: "2024-01-01 09:00:00", EndTime: "soon"}, "", "", false},
+	}
+	for _, tt := range tests {
+		start, end, ok := Clip(tt.record, from, to, now)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && (!start.Equal(mustParse(t, tt.start)) || !end.Equal(mustParse(t, tt.end))) {
+			t.Errorf("%s: [%s, %s), want [%s, %s)", tt.name, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestRecordKeysAreOrderedByEndTime(t *testing.T) {
+	records := []*models.UsageRecord{
+		{ReplicaSet: "foo", StartTime: "2024-01-01 08:00:00", EndTime: "2024-03-01 00:00:00"},
+		{ReplicaSet: "bar", StartTime: "2024-02-01 08:00:00", EndTime: "2024-02-02 00:00:00"},
+		{ReplicaSet: "baz", StartTime: "2023-12-01 08:00:00", EndTime: "2024-01-01 00:00:00"},
+	}
+	keys := make([]string, 0, len(records))
+	for _, r := range records {
+		keys = append(keys, recordKey(r))
+	}
+	sort.Strings(keys)
+
+	want := []string{
+		"records/20240101T000000-baz-20231201T080000",
+		"records/20240202T000000-bar-20240201T080000",
+		"records/20240301T000000-foo-20240101T080000",
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("keys = %v, want %v", keys, want)
+		}
+	}
+	// the records that end after from sort after the key of from
+	from := mustParse(t, "2024-02-01 00:00:00").Format(keyTimeLayout)
+	if !(recordDir+"/"+from < keys[1]) || !(keys[0] < recordDir+"/"+from) {
+		t.Fatalf("from key %s is not between %s and %s", from, keys[0], keys[1])
+	}
+}
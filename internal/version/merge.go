@@ -2,18 +2,34 @@ package version
 
 import (
 	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
-	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 )
 
 var ContainerMergeMap *mergeMap
 
-const containerMergeMapKey = "containerMergeMapKey"
+const (
+	// the single key that older versions stored the whole map in
+	containerMergeMapKey = "containerMergeMapKey"
+
+	// one etcd key per version, e.g. /gpu-docker-api/apis/v1/merges/containers/<version>
+	containerMergeDir = "containers"
+)
 
 type mergePath = string
 
-type mergeMap map[version]mergePath
+// mergeMap holds the merged layer path of each container version, it is safe for concurrent use
+type mergeMap struct {
+	sync.RWMutex
+
+	paths map[version]mergePath
+	store *etcd.Store
+}
 
 func InitMergedMap() error {
 	var err error
@@ -26,54 +42,84 @@ func InitMergedMap() error {
 }
 
 func CloseMergedMap() error {
-	if err := etcd.Put(etcd.Merges, containerMergeMapKey, ContainerMergeMap.serialize()); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (mm *mergeMap) serialize() *string {
-	bytes, _ := json.Marshal(mm)
-	tmp := string(bytes)
-	return &tmp
+	return etcd.Stores{ContainerMergeMap.store}.Sync()
 }
 
 func (mm *mergeMap) Set(key version, value mergePath) {
-	(*mm)[key] = value
+	mm.Lock()
+	defer mm.Unlock()
+
+	mm.paths[key] = value
+
+	go mm.putToEtcd()
 }
 
 func (mm *mergeMap) Get(key version) (mergePath, bool) {
-	value, ok := (*mm)[key]
+	mm.RLock()
+	defer mm.RUnlock()
+
+	value, ok := mm.paths[key]
 	return value, ok
 }
 
 func (mm *mergeMap) Exist(key version) bool {
-	_, ok := (*mm)[key]
+	mm.RLock()
+	defer mm.RUnlock()
+
+	_, ok := mm.paths[key]
 	return ok
 }
 
 func (mm *mergeMap) Remove(key version) {
-	delete(*mm, key)
+	mm.Lock()
+	defer mm.Unlock()
+
+	delete(mm.paths, key)
+
+	go mm.putToEtcd()
+}
+
+// items one key per version, version -> merged path
+func (mm *mergeMap) items() map[string]string {
+	mm.RLock()
+	defer mm.RUnlock()
+
+	items := make(map[string]string, len(mm.paths))
+	for k, v := range mm.paths {
+		items[strconv.FormatInt(k, 10)] = v
+	}
+	return items
+}
+
+func (mm *mergeMap) putToEtcd() {
+	workQueue.Add(etcd.Stores{mm.store})
 }
 
-func initMergeMapFormEtcd() (mm *mergeMap, err error) {
-	bytes, err := etcd.GetValue(etcd.Merges, containerMergeMapKey)
+// initMergeMapFormEtcd reads the keys under the directory, or the blob key if there is no key yet,
+// the blob key is migrated to the keys and deleted.
+func initMergeMapFormEtcd() (*mergeMap, error) {
+	mm := &mergeMap{
+		paths: make(map[version]mergePath),
+	}
+	mm.store = etcd.NewStore(etcd.Merges, containerMergeDir, mm.items)
+
+	items, blob, err := mm.store.LoadOrBlob(containerMergeMapKey)
 	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
-			err = nil
-		} else {
-			return mm, err
+		return mm, err
+	}
+	for k, v := range items {
+		version, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return mm, errors.Wrapf(err, "strconv.ParseInt failed, key: %s", k)
 		}
+		mm.paths[version] = v
 	}
-
-	mm = newMergedMap()
-	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &mm)
+	if len(blob) == 0 {
+		return mm, nil
 	}
-	return mm, err
-}
 
-func newMergedMap() *mergeMap {
-	m := make(mergeMap)
-	return &m
+	if err = json.Unmarshal(blob, &mm.paths); err != nil {
+		return mm, err
+	}
+	return mm, mm.store.Migrate(containerMergeMapKey)
 }
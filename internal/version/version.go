@@ -2,10 +2,10 @@ package version
 
 import (
 	"encoding/json"
+	"sync"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
-	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
 var (
@@ -14,8 +14,13 @@ var (
 )
 
 const (
+	// the single keys that older versions stored the whole maps in
 	containerVersionMapKey = "containerVersionMapKey"
 	volumeVersionMapKey    = "volumeVersionMapKey"
+
+	// one etcd key per name, e.g. /gpu-docker-api/apis/v1/versions/containers/<name>
+	containerVersionDir = "containers"
+	volumeVersionDir    = "volumes"
 )
 
 type (
@@ -23,16 +28,24 @@ type (
 	version = int64
 )
 
-type versionMap map[name]version
+// versionMap holds the latest version of each name, it is safe for concurrent use.
+// The next version is handed out by Next, which increases it in etcd first,
+// so two requests never get the same version even if the server crashes in between.
+type versionMap struct {
+	sync.RWMutex
+
+	versions map[name]version
+	store    *etcd.Store
+}
 
 func InitVersionMap() error {
 	var err error
-	ContainerVersionMap, err = initVersionMapFormEtcd(containerVersionMapKey)
+	ContainerVersionMap, err = initVersionMapFormEtcd(containerVersionDir, containerVersionMapKey)
 	if err != nil {
 		return err
 	}
 
-	VolumeVersionMap, err = initVersionMapFormEtcd(volumeVersionMapKey)
+	VolumeVersionMap, err = initVersionMapFormEtcd(volumeVersionDir, volumeVersionMapKey)
 	if err != nil {
 		return err
 	}
@@ -41,74 +54,112 @@ func InitVersionMap() error {
 }
 
 func CloseVersionMap() error {
-	if err := etcd.Put(etcd.Versions, containerVersionMapKey, ContainerVersionMap.serialize()); err != nil {
-		return err
+	return etcd.Stores{ContainerVersionMap.store, VolumeVersionMap.store}.Sync()
+}
+
+// Next increases the version of the name by one and returns it, it is 1 if the name has no version.
+// The version is written to etcd before it is returned.
+func (vm *versionMap) Next(key name) (version, error) {
+	vm.RLock()
+	current := vm.versions[key]
+	vm.RUnlock()
+
+	return vm.store.Increment(key, current, func(next int64) {
+		vm.Lock()
+		defer vm.Unlock()
+
+		if next > vm.versions[key] {
+			vm.versions[key] = next
+		}
+	})
+}
+
+// Rollback undoes Next when nothing is created with the version,
+// it does nothing if a later version has been handed out in the meantime.
+func (vm *versionMap) Rollback(key name, value version) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	if vm.versions[key] != value {
+		return
 	}
-	if err := etcd.Put(etcd.Versions, volumeVersionMapKey, VolumeVersionMap.serialize()); err != nil {
-		return err
+	if value <= 1 {
+		delete(vm.versions, key)
+	} else {
+		vm.versions[key] = value - 1
 	}
-	return nil
-}
 
-func (vm *versionMap) serialize() *string {
-	bytes, _ := json.Marshal(vm)
-	tmp := string(bytes)
-	return &tmp
+	go vm.putToEtcd()
 }
 
 func (vm *versionMap) Set(key name, value version) {
-	(*vm)[key] = value
+	vm.Lock()
+	defer vm.Unlock()
+
+	vm.versions[key] = value
 
 	go vm.putToEtcd()
 }
 
 func (vm *versionMap) Get(key name) (version, bool) {
-	v, ok := (*vm)[key]
+	vm.RLock()
+	defer vm.RUnlock()
+
+	v, ok := vm.versions[key]
 	return v, ok
 }
 
 func (vm *versionMap) Exist(key name) bool {
-	_, ok := (*vm)[key]
+	vm.RLock()
+	defer vm.RUnlock()
+
+	_, ok := vm.versions[key]
 	return ok
 }
 
+// Snapshot returns a copy of all names and their latest version
+func (vm *versionMap) Snapshot() map[name]version {
+	vm.RLock()
+	defer vm.RUnlock()
+
+	copyMap := make(map[name]version, len(vm.versions))
+	for k, v := range vm.versions {
+		copyMap[k] = v
+	}
+	return copyMap
+}
+
 func (vm *versionMap) Remove(key name) {
-	delete(*vm, key)
+	vm.Lock()
+	defer vm.Unlock()
+
+	delete(vm.versions, key)
 
 	go vm.putToEtcd()
 }
 
+// items one key per name, name -> version
+func (vm *versionMap) items() map[string]string {
+	vm.RLock()
+	defer vm.RUnlock()
+
+	return etcd.JSONItems(vm.versions)
+}
+
 func (vm *versionMap) putToEtcd() {
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Versions,
-		Key:      containerVersionMapKey,
-		Value:    ContainerVersionMap.serialize(),
-	}
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Versions,
-		Key:      volumeVersionMapKey,
-		Value:    VolumeVersionMap.serialize(),
-	}
+	workQueue.Add(etcd.Stores{vm.store})
 }
 
-func initVersionMapFormEtcd(key string) (vm *versionMap, err error) {
-	bytes, err := etcd.GetValue(etcd.Versions, key)
-	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
-			err = nil
-		} else {
-			return vm, err
-		}
+// initVersionMapFormEtcd reads the keys under the directory, or the blob key if there is no key yet,
+// the blob key is migrated to the keys and deleted.
+func initVersionMapFormEtcd(dir, blobKey string) (*versionMap, error) {
+	vm := &versionMap{
+		versions: make(map[name]version),
 	}
+	vm.store = etcd.NewStore(etcd.Versions, dir, vm.items)
 
-	vm = newVersionMap()
-	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &vm)
-	}
+	err := etcd.LoadJSON(vm.store, blobKey, vm.versions, func(blob []byte) error {
+		return json.Unmarshal(blob, &vm.versions)
+	})
 	return vm, err
 }
-
-func newVersionMap() *versionMap {
-	m := make(versionMap)
-	return &m
-}
@@ -0,0 +1,189 @@
+package workQueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+)
+
+const (
+	opPut  = "put"
+	opDel  = "del"
+	opSync = "sync"
+	// opDone marks the record of the same seq as written to etcd
+	opDone = "done"
+
+	// the wal is rewritten with the pending records once it grows beyond it
+	walCompactBytes = 16 << 20
+
+	// the records that can't be replayed are moved to the file next to the wal for the operators
+	deadLetterSuffix = ".dead"
+)
+
+// record is a line of the wal, a put, delete or sync that is not done yet is replayed at startup
+type record struct {
+	Seq      uint64            `json:"seq"`
+	Op       string            `json:"op"`
+	Resource etcd.Resource     `json:"resource,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	Value    *string           `json:"value,omitempty"`
+	States   []etcd.StoreState `json:"states,omitempty"`
+}
+
+// wal is the write-ahead log of the work queue, every item is appended and synced to the disk before it is queued
+type wal struct {
+	path string
+	f    *os.File
+	size int64
+}
+
+// openWal opens the wal and returns the records that are not done in the order they were queued
+func openWal(path string) (*wal, []record, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, nil, errors.Wrapf(err, "os.MkdirAll failed, dir: %s", dir)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "os.OpenFile failed, path: %s", path)
+	}
+
+	pending := make(map[uint64]record)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) != 0 {
+			var r record
+			if jsonErr := json.Unmarshal(line, &r); jsonErr != nil {
+				// the last line may be cut off by a crash
+				log.Warnf("workQueue.openWal, move a broken record in %s to %s, err: %v", path, deadLetterPath(path), jsonErr)
+				if dlErr := deadLetter(path, line); dlErr != nil {
+					log.Errorf("workQueue.deadLetter failed, original error: %T %v", errors.Cause(dlErr), dlErr)
+				}
+			} else if r.Op == opDone {
+				delete(pending, r.Seq)
+			} else {
+				pending[r.Seq] = r
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = f.Close()
+			return nil, nil, errors.Wrapf(err, "read wal failed, path: %s", path)
+		}
+	}
+
+	records := make([]record, 0, len(pending))
+	for _, r := range pending {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, errors.Wrapf(err, "f.Stat failed, path: %s", path)
+	}
+	return &wal{path: path, f: f, size: info.Size()}, records, nil
+}
+
+// append writes the records and syncs them to the disk
+func (w *wal) append(records ...record) error {
+	var buf []byte
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return errors.Wrapf(err, "json.Marshal failed, seq: %d", r.Seq)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	n, err := w.f.Write(buf)
+	w.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "write wal failed, path: %s", w.path)
+	}
+	return w.f.Sync()
+}
+
+// rewrite replaces the wal with the pending records, it is empty if nothing is pending
+func (w *wal) rewrite(records []record) error {
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "os.OpenFile failed, path: %s", tmp)
+	}
+	next := &wal{path: tmp, f: f}
+	if len(records) != 0 {
+		if err = next.append(records...); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "f.Close failed, path: %s", tmp)
+	}
+	if err = os.Rename(tmp, w.path); err != nil {
+		return errors.Wrapf(err, "os.Rename failed, from: %s, to: %s", tmp, w.path)
+	}
+
+	_ = w.f.Close()
+	if w.f, err = os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return errors.Wrapf(err, "os.OpenFile failed, path: %s", w.path)
+	}
+	w.size = next.size
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
+
+func deadLetterPath(walPath string) string {
+	return walPath + deadLetterSuffix
+}
+
+// deadLetter appends the lines to the dead-letter file of the wal, they are never replayed
+func deadLetter(walPath string, lines ...[]byte) error {
+	path := deadLetterPath(walPath)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "os.OpenFile failed, path: %s", path)
+	}
+	defer f.Close()
+
+	for _, line := range lines {
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+		if _, err = f.Write(line); err != nil {
+			return errors.Wrapf(err, "write dead letter failed, path: %s", path)
+		}
+	}
+	return f.Sync()
+}
+
+func deadLetterRecords(walPath string, records ...record) error {
+	lines := make([][]byte, 0, len(records))
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return errors.Wrapf(err, "json.Marshal failed, seq: %d", r.Seq)
+		}
+		lines = append(lines, line)
+	}
+	return deadLetter(walPath, lines...)
+}
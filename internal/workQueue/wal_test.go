@@ -0,0 +1,131 @@
+package workQueue
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestOpenWalReturnsPendingRecordsInOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "workqueue.wal")
+	w, records, err := openWal(path)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("records of a new wal = %d, want 0", len(records))
+	}
+
+	err = w.append(
+		record{Seq: 3, Op: opPut, Resource: "containers", Key: "foo", Value: strPtr("3")},
+		record{Seq: 1, Op: opPut, Resource: "containers", Key: "foo", Value: strPtr("1")},
+		record{Seq: 2, Op: opDel, Resource: "volumes", Key: "bar"},
+		record{Seq: 1, Op: opDone},
+	)
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	_ = w.close()
+
+	_, records, err = openWal(path)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	var seqs []uint64
+	for _, r := range records {
+		seqs = append(seqs, r.Seq)
+	}
+	if len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 3 {
+		t.Fatalf("pending seqs = %v, want [2 3]", seqs)
+	}
+	if *records[1].Value != "3" {
+		t.Fatalf("value of seq 3 = %s, want 3", *records[1].Value)
+	}
+}
+
+func TestOpenWalMovesBrokenRecordsToDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workqueue.wal")
+	// a line longer than any buffer of bufio.Scanner, and a line cut off by a crash
+	long := `{"seq":1,"op":"put","key":"foo","value":"` + strings.Repeat("x", 20<<20) + `"}`
+	content := long + "\n" + `{"seq":2,"op":"del","key":"bar"}` + "\n" + `{"seq":3,"op":"pu`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	w, records, err := openWal(path)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	defer w.close()
+	if len(records) != 2 || records[0].Seq != 1 || records[1].Seq != 2 {
+		t.Fatalf("records = %+v, want seq 1 and 2", records)
+	}
+
+	dead, err := os.ReadFile(deadLetterPath(path))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(dead) != `{"seq":3,"op":"pu`+"\n" {
+		t.Fatalf("dead letters = %q", dead)
+	}
+}
+
+func TestRewriteCompactsWal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workqueue.wal")
+	w, _, err := openWal(path)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	for seq := uint64(1); seq <= 10; seq++ {
+		if err = w.append(record{Seq: seq, Op: opPut, Key: "foo", Value: strPtr("bar")}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	before := w.size
+
+	if err = w.rewrite([]record{{Seq: 10, Op: opPut, Key: "foo", Value: strPtr("bar")}}); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	if w.size >= before {
+		t.Fatalf("size after rewrite = %d, want less than %d", w.size, before)
+	}
+	// the wal is still appendable after it is replaced
+	if err = w.append(record{Seq: 11, Op: opDel, Key: "foo"}); err != nil {
+		t.Fatalf("append after rewrite: %v", err)
+	}
+	_ = w.close()
+
+	_, records, err := openWal(path)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	if len(records) != 2 || records[0].Seq != 10 || records[1].Seq != 11 {
+		t.Fatalf("records = %+v, want seq 10 and 11", records)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("tmp file is left behind, err: %v", err)
+	}
+}
+
+func TestDeadLetterRecordsAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workqueue.wal")
+	if err := deadLetterRecords(path, record{Seq: 1, Op: opDel, Key: "a"}); err != nil {
+		t.Fatalf("deadLetterRecords: %v", err)
+	}
+	if err := deadLetterRecords(path, record{Seq: 2, Op: opDel, Key: "b"}); err != nil {
+		t.Fatalf("deadLetterRecords: %v", err)
+	}
+	dead, err := os.ReadFile(deadLetterPath(path))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if lines := bytes.Count(dead, []byte("\n")); lines != 2 {
+		t.Fatalf("dead letters have %d lines, want 2", lines)
+	}
+}
@@ -2,57 +2,488 @@ package workQueue
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
-const _maxContainerCount = 110
+const (
+	// the first retry of a failed item waits for minBackoff, and the wait doubles up to maxBackoff
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = time.Minute
 
-var Queue chan interface{}
+	// how many times an item in the wal is tried at startup before the program gives up
+	replayAttempts = 5
+)
+
+var q *workQueue
+
+// workQueue writes the puts, deletes and syncs to etcd in the background.
+// The items of the same key are written in the order they were added, a pending put is replaced by a later put of the same key,
+// a failed item is retried with exponential backoff, and every item is logged in the wal until it is written,
+// so nothing is lost if the program crashes.
+type workQueue struct {
+	sync.Mutex
+
+	wal *wal
+	seq uint64
+	// key -> the pending items of the key in order, an item runs when it is the first one of all its keys
+	keys  map[string][]*item
+	items map[uint64]*item
+	wake  chan struct{}
+	// nothing can be added once the wal is closed
+	closed bool
+
+	processed   uint64
+	failures    uint64
+	coalesced   uint64
+	deadLetters uint64
+}
+
+type item struct {
+	record  record
+	keys    []string
+	value   interface{}
+	added   time.Time
+	retries int
+	retryAt time.Time
+	running bool
+}
+
+// Stats are the metrics of the work queue
+type Stats struct {
+	// Depth is the number of pending items
+	Depth int `json:"depth"`
+	// Keys is the number of keys that have pending items
+	Keys int `json:"keys"`
+	// Retrying is the number of items waiting for the backoff after they failed
+	Retrying int `json:"retrying"`
+	// OldestAge is how long the oldest pending item has been waiting in seconds
+	OldestAge float64 `json:"oldestAge"`
+	Processed uint64  `json:"processed"`
+	Failures  uint64  `json:"failures"`
+	Coalesced uint64  `json:"coalesced"`
+	// DeadLetters is the number of items that are moved to the dead-letter file instead of being written
+	DeadLetters uint64 `json:"deadLetters"`
+	WalBytes    int64  `json:"walBytes"`
+}
+
+// InitWorkQueue replays the items left in the wal by the last run before anything is loaded from etcd,
+// an item that still fails after a few attempts is moved to the dead-letter file so the server can start.
+func InitWorkQueue(walPath string) error {
+	w, records, err := openWal(walPath)
+	if err != nil {
+		return errors.WithMessage(err, "openWal failed")
+	}
+
+	var dead uint64
+	for _, r := range records {
+		for attempt := 1; ; attempt++ {
+			if err = apply(r); err == nil {
+				break
+			}
+			if attempt == replayAttempts || permanent(err) {
+				dead++
+				log.Errorf("workQueue, replay seq: %d op: %s failed, it is moved to %s, original error: %T %v",
+					r.Seq, r.Op, deadLetterPath(walPath), errors.Cause(err), err)
+				if err = deadLetterRecords(walPath, r); err != nil {
+					_ = w.close()
+					return errors.WithMessage(err, "deadLetter failed")
+				}
+				break
+			}
+			time.Sleep(backoff(attempt))
+		}
+	}
+	if err = w.rewrite(nil); err != nil {
+		_ = w.close()
+		return errors.WithMessage(err, "wal.rewrite failed")
+	}
+	if len(records) != 0 {
+		log.Infof("%d items left in the work queue are replayed from %s, %d of them are dead letters", len(records), walPath, dead)
+	}
 
-func InitWorkQueue() {
-	Queue = make(chan interface{}, _maxContainerCount)
+	var seq uint64
+	if len(records) != 0 {
+		seq = records[len(records)-1].Seq
+	}
+	q = &workQueue{
+		wal:   w,
+		seq:   seq,
+		keys:  make(map[string][]*item),
+		items: make(map[uint64]*item),
+		wake:  make(chan struct{}, 1),
+
+		deadLetters: dead,
+	}
+	return nil
 }
 
+// Add queues an etcd.PutKeyValue, etcd.DelKey or etcd.Stores, it returns after the item is logged in the wal.
+// A put that is larger than etcd accepts is refused, instead of being retried forever.
+// The snapshot of etcd.Stores reads the maps, Add must not be called while holding the lock of such a map.
+// It fails if the work queue is not initialized or is already closed.
+func Add(v interface{}) error {
+	if q == nil {
+		return errors.New("the work queue is not initialized")
+	}
+	// the snapshot of the stores is taken under the lock, so a later item always holds a later state
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		log.Warnf("workQueue.Add, %T is added after the work queue is closed", v)
+		return errors.New("the work queue is closed")
+	}
+
+	r, keys, ok := recordOf(v)
+	if !ok {
+		log.Warnf("workQueue.Add, %T is not supported", v)
+		return errors.Errorf("%T is not supported", v)
+	}
+	if r.Op == opPut {
+		if err := etcd.CheckSize(r.Resource, r.Key, *r.Value); err != nil {
+			log.Errorf("workQueue.Add, put is refused, original error: %T %v", errors.Cause(err), err)
+			return err
+		}
+	}
+
+	q.seq++
+	r.Seq = q.seq
+	records := []record{r}
+	if tail := q.tail(keys); tail != nil && !tail.running && coalescible(tail.value, v) {
+		// the later one takes the place of the pending one
+		delete(q.items, tail.record.Seq)
+		records = append(records, record{Seq: tail.record.Seq, Op: opDone})
+		tail.record, tail.value = r, v
+		q.items[r.Seq] = tail
+		q.coalesced++
+	} else {
+		it := &item{record: r, keys: keys, value: v, added: time.Now()}
+		q.items[r.Seq] = it
+		for _, key := range keys {
+			q.keys[key] = append(q.keys[key], it)
+		}
+	}
+	if err := q.wal.append(records...); err != nil {
+		// the item is still written by the queue, it is only lost if the program crashes before that
+		log.Errorf("workQueue.Add, wal.append failed, original error: %T %v", errors.Cause(err), err)
+	}
+
+	q.signal()
+	return nil
+}
+
+// SyncLoop writes the items in the background until ctx is done.
+// The loop is added to wg before SyncLoop returns, and so is every item it runs,
+// so wg.Wait returns after the loop and all running items are done.
 func SyncLoop(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.loop(ctx, wg)
+	}()
+}
+
+func (q *workQueue) loop(ctx context.Context, wg *sync.WaitGroup) {
+	timer := time.NewTimer(maxBackoff)
+	defer timer.Stop()
 	for {
-		select {
-		case v := <-Queue:
-			switch v := v.(type) {
-			case etcd.PutKeyValue:
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := etcd.Put(v.Resource, v.Key, v.Value); err != nil {
-						log.Error(err.Error())
-						Queue <- v
-						return
-					}
-					log.Infof("put to etcd successfully, resource %s, key: %s, value: %s", v.Resource, v.Key, *v.Value)
-				}()
-			case etcd.DelKey:
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := etcd.Del(v.Resource, v.Key); err != nil {
-						log.Error(err.Error())
-						Queue <- v
-						return
-					}
-					log.Infof("delete etcd key successfully, resource %s, key: %s", v.Resource, v.Key)
-				}()
+		items, next := q.take(time.Now())
+		for _, it := range items {
+			wg.Add(1)
+			go func(it *item) {
+				defer wg.Done()
+				q.done(it, apply(it.record, it.value))
+			}(it)
+		}
+
+		wait := maxBackoff
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
 			default:
-				//	nothing to do
 			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-q.wake:
+		case <-timer.C:
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// GetStats returns the depth and the age of the work queue
+func GetStats() Stats {
+	q.Lock()
+	defer q.Unlock()
+
+	stats := Stats{
+		Depth:     len(q.items),
+		Keys:      len(q.keys),
+		Processed: q.processed,
+		Failures:  q.failures,
+		Coalesced: q.coalesced,
+
+		DeadLetters: q.deadLetters,
+		WalBytes:    q.wal.size,
+	}
+	now := time.Now()
+	for _, it := range q.items {
+		if it.retries > 0 && !it.running {
+			stats.Retrying++
+		}
+		if age := now.Sub(it.added).Seconds(); age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+	return stats
+}
+
+// Close tries the pending items once more in the order they were added and closes the wal,
+// the items that still fail are replayed at the next start.
+// It must be called after the SyncLoop is done, Add fails after it.
 func Close() {
-	close(Queue)
+	q.Lock()
+	items := make([]*item, 0, len(q.items))
+	for _, it := range q.items {
+		if !it.running {
+			items = append(items, it)
+		}
+	}
+	q.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].record.Seq < items[j].record.Seq
+	})
+	for _, it := range items {
+		q.Lock()
+		runnable := !it.running && q.first(it)
+		it.running = runnable
+		q.Unlock()
+		if runnable {
+			q.done(it, apply(it.record, it.value))
+		}
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	if len(q.items) != 0 {
+		log.Warnf("workQueue.Close, %d items are not written to etcd, they will be replayed at the next start", len(q.items))
+	}
+	_ = q.wal.close()
+}
+
+// take marks the items that can run now as running,
+// next is when the earliest item waiting for the backoff can run, it is zero if there is none.
+func (q *workQueue) take(now time.Time) (items []*item, next time.Time) {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, it := range q.items {
+		if it.running || !q.first(it) {
+			continue
+		}
+		if it.retryAt.After(now) {
+			if next.IsZero() || it.retryAt.Before(next) {
+				next = it.retryAt
+			}
+			continue
+		}
+		it.running = true
+		items = append(items, it)
+	}
+	return items, next
+}
+
+// done removes the item if it has been written, otherwise it is retried after the backoff
+func (q *workQueue) done(it *item, err error) {
+	q.Lock()
+	defer q.Unlock()
+
+	it.running = false
+	dead := err != nil && permanent(err)
+	if dead {
+		// retrying never helps, the item is moved aside so the items after it can run
+		log.Errorf("workQueue, %s %s can never be written, it is moved to %s, original error: %T %v",
+			it.record.Op, it.keys, deadLetterPath(q.wal.path), errors.Cause(err), err)
+		if dlErr := deadLetterRecords(q.wal.path, it.record); dlErr != nil {
+			log.Errorf("workQueue.deadLetter failed, original error: %T %v", errors.Cause(dlErr), dlErr)
+		}
+		q.deadLetters++
+		err = nil
+	}
+	if err != nil {
+		it.retries++
+		it.retryAt = time.Now().Add(backoff(it.retries))
+		q.failures++
+		log.Errorf("workQueue, %s %s failed %d times, retry after %s, original error: %T %v",
+			it.record.Op, it.keys, it.retries, backoff(it.retries), errors.Cause(err), err)
+		q.signal()
+		return
+	}
+
+	delete(q.items, it.record.Seq)
+	for _, key := range it.keys {
+		pending := q.keys[key][1:]
+		if len(pending) == 0 {
+			delete(q.keys, key)
+			continue
+		}
+		q.keys[key] = pending
+	}
+	if !dead {
+		q.processed++
+		log.Infof("%s etcd successfully, keys: %s", it.record.Op, it.keys)
+	}
+
+	if err = q.compact(it.record.Seq); err != nil {
+		log.Errorf("workQueue, compact wal failed, original error: %T %v", errors.Cause(err), err)
+	}
+	q.signal()
+}
+
+// compact marks the record done, and rewrites the wal with the pending records if it is empty or too large
+func (q *workQueue) compact(seq uint64) error {
+	if len(q.items) != 0 && q.wal.size < walCompactBytes {
+		return q.wal.append(record{Seq: seq, Op: opDone})
+	}
+
+	records := make([]record, 0, len(q.items))
+	for _, it := range q.items {
+		records = append(records, it.record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	return q.wal.rewrite(records)
+}
+
+// first reports whether the item is the first pending one of all its keys
+func (q *workQueue) first(it *item) bool {
+	for _, key := range it.keys {
+		if pending := q.keys[key]; len(pending) == 0 || pending[0] != it {
+			return false
+		}
+	}
+	return true
+}
+
+// tail returns the last pending item if it is the last one of exactly the keys
+func (q *workQueue) tail(keys []string) *item {
+	var tail *item
+	for _, key := range keys {
+		pending := q.keys[key]
+		if len(pending) == 0 {
+			return nil
+		}
+		if last := pending[len(pending)-1]; tail == nil {
+			tail = last
+		} else if last != tail {
+			return nil
+		}
+	}
+	if tail == nil || len(tail.keys) != len(keys) {
+		return nil
+	}
+	return tail
+}
+
+func (q *workQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// coalescible reports whether the pending item can be replaced by the later one,
+// a put to a resource that keeps the history is only replaced by the same value.
+func coalescible(pending, later interface{}) bool {
+	switch later := later.(type) {
+	case etcd.PutKeyValue:
+		pending, ok := pending.(etcd.PutKeyValue)
+		if !ok {
+			return false
+		}
+		return !etcd.KeepsHistory(later.Resource) || *pending.Value == *later.Value
+	case etcd.DelKey:
+		_, ok := pending.(etcd.DelKey)
+		return ok
+	case etcd.Stores:
+		// the stores are synced with the state when the sync runs, so one is as good as the other
+		_, ok := pending.(etcd.Stores)
+		return ok
+	}
+	return false
+}
+
+// recordOf returns the wal record and the keys of the item,
+// the states of the stores are logged so the sync can be replayed even though the stores are only synced when it runs.
+func recordOf(v interface{}) (record, []string, bool) {
+	switch v := v.(type) {
+	case etcd.PutKeyValue:
+		return record{Op: opPut, Resource: v.Resource, Key: v.Key, Value: v.Value},
+			[]string{etcd.ResourcePrefix(v.Resource, v.Key)}, true
+	case etcd.DelKey:
+		return record{Op: opDel, Resource: v.Resource, Key: v.Key},
+			[]string{etcd.ResourcePrefix(v.Resource, v.Key)}, true
+	case etcd.Stores:
+		return record{Op: opSync, States: v.States()}, v.Prefixes(), true
+	}
+	return record{}, nil, false
+}
+
+// apply writes the item to etcd, the record is used if the item is replayed from the wal
+func apply(r record, v ...interface{}) error {
+	if len(v) != 0 {
+		if stores, ok := v[0].(etcd.Stores); ok {
+			return stores.Sync()
+		}
+	}
+
+	switch r.Op {
+	case opPut:
+		return etcd.Put(r.Resource, r.Key, r.Value)
+	case opDel:
+		return etcd.Del(r.Resource, r.Key)
+	case opSync:
+		for _, state := range r.States {
+			if err := state.Restore(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("op: %s is not supported", r.Op)
+}
+
+// permanent reports whether the error is returned however many times the item is retried
+func permanent(err error) bool {
+	return xerrors.IsEtcdTooLargeError(err) || errors.Cause(err) == rpctypes.ErrRequestTooLarge
+}
+
+// backoff is minBackoff doubled for each retry, at most maxBackoff
+func backoff(retries int) time.Duration {
+	d := minBackoff
+	for i := 1; i < retries && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
 }
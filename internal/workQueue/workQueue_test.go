@@ -0,0 +1,172 @@
+package workQueue
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func newTestQueue(t *testing.T) *workQueue {
+	t.Helper()
+	w, _, err := openWal(filepath.Join(t.TempDir(), "workqueue.wal"))
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	t.Cleanup(func() { _ = w.close() })
+	q = &workQueue{
+		wal:   w,
+		keys:  make(map[string][]*item),
+		items: make(map[uint64]*item),
+		wake:  make(chan struct{}, 1),
+	}
+	return q
+}
+
+func TestAddCoalescesPutsOfTheSameKey(t *testing.T) {
+	q := newTestQueue(t)
+	for _, v := range []string{"1", "2", "3"} {
+		if err := Add(etcd.PutKeyValue{Resource: etcd.Quotas, Key: "quotas", Value: strPtr(v)}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if len(q.items) != 1 || q.coalesced != 2 {
+		t.Fatalf("items = %d coalesced = %d, want 1 and 2", len(q.items), q.coalesced)
+	}
+	for _, it := range q.items {
+		if *it.record.Value != "3" {
+			t.Fatalf("value = %s, want the latest 3", *it.record.Value)
+		}
+	}
+}
+
+func TestAddKeepsEveryValueOfHistoryResources(t *testing.T) {
+	q := newTestQueue(t)
+	for _, v := range []string{"1", "2", "2"} {
+		_ = Add(etcd.PutKeyValue{Resource: etcd.Containers, Key: "foo", Value: strPtr(v)})
+	}
+	// the revisions of containers are the history, only the identical put is coalesced
+	if len(q.items) != 2 || q.coalesced != 1 {
+		t.Fatalf("items = %d coalesced = %d, want 2 and 1", len(q.items), q.coalesced)
+	}
+}
+
+func TestAddRefusesOversizedValues(t *testing.T) {
+	q := newTestQueue(t)
+	err := Add(etcd.PutKeyValue{Resource: etcd.Usage, Key: "ledger", Value: strPtr(strings.Repeat("x", etcd.MaxRequestBytes))})
+	if !xerrors.IsEtcdTooLargeError(err) {
+		t.Fatalf("err = %v, want too large", err)
+	}
+	if len(q.items) != 0 || q.wal.size != 0 {
+		t.Fatalf("items = %d wal = %d bytes, want nothing queued", len(q.items), q.wal.size)
+	}
+}
+
+func TestSyncLoopIsWaitedAndAddFailsAfterClose(t *testing.T) {
+	newTestQueue(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	SyncLoop(ctx, &wg)
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the sync loop is still running after the context is cancelled")
+	}
+
+	Close()
+	if err := Add(etcd.PutKeyValue{Resource: etcd.Quotas, Key: "quotas", Value: strPtr("1")}); err == nil {
+		t.Fatal("Add succeeded after Close")
+	}
+}
+
+func TestTakeRunsOnlyTheFirstItemOfAKey(t *testing.T) {
+	q := newTestQueue(t)
+	_ = Add(etcd.PutKeyValue{Resource: etcd.Containers, Key: "foo", Value: strPtr("1")})
+	_ = Add(etcd.DelKey{Resource: etcd.Containers, Key: "foo"})
+	_ = Add(etcd.PutKeyValue{Resource: etcd.Volumes, Key: "bar", Value: strPtr("1")})
+
+	items, _ := q.take(time.Now())
+	if len(items) != 2 {
+		t.Fatalf("runnable items = %d, want 2", len(items))
+	}
+	for _, it := range items {
+		if it.record.Op == opDel {
+			t.Fatal("the delete runs before the put of the same key")
+		}
+	}
+	if again, _ := q.take(time.Now()); len(again) != 0 {
+		t.Fatalf("running items are taken again: %d", len(again))
+	}
+
+	for _, it := range items {
+		q.done(it, nil)
+	}
+	items, _ = q.take(time.Now())
+	if len(items) != 1 || items[0].record.Op != opDel {
+		t.Fatalf("items after the put = %+v, want the delete", items)
+	}
+}
+
+func TestDoneBacksOffFailedItems(t *testing.T) {
+	q := newTestQueue(t)
+	_ = Add(etcd.DelKey{Resource: etcd.Containers, Key: "foo"})
+
+	items, _ := q.take(time.Now())
+	q.done(items[0], xerrors.NewEtcdConflictError())
+	now := time.Now()
+	items, next := q.take(now)
+	if len(items) != 0 {
+		t.Fatal("a failed item is retried without backoff")
+	}
+	if next.Sub(now) <= 0 || next.Sub(now) > minBackoff {
+		t.Fatalf("next retry in %s, want within %s", next.Sub(now), minBackoff)
+	}
+	if stats := GetStats(); stats.Retrying != 1 || stats.Failures != 1 || stats.Depth != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestDoneMovesPermanentFailuresToDeadLetters(t *testing.T) {
+	q := newTestQueue(t)
+	_ = Add(etcd.DelKey{Resource: etcd.Containers, Key: "foo"})
+	_ = Add(etcd.PutKeyValue{Resource: etcd.Containers, Key: "foo", Value: strPtr("1")})
+
+	items, _ := q.take(time.Now())
+	q.done(items[0], xerrors.NewEtcdTooLargeError())
+	if stats := GetStats(); stats.DeadLetters != 1 || stats.Depth != 1 || stats.Processed != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	// the item behind it is no longer blocked
+	if items, _ = q.take(time.Now()); len(items) != 1 || items[0].record.Op != opPut {
+		t.Fatalf("items = %+v, want the put", items)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		retries int
+		want    time.Duration
+	}{
+		{1, minBackoff},
+		{2, 2 * minBackoff},
+		{4, 8 * minBackoff},
+		{100, maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.retries); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.retries, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	bookingNotFound     = "booking not found"
+	bookingExisted      = "booking existed"
+	bookingNotPending   = "booking not pending"
+	bookingGpuNotEnough = "booking gpu not enough"
+)
+
+func NewBookingNotFoundError() error {
+	return errors.New(bookingNotFound)
+}
+
+func IsBookingNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == bookingNotFound
+}
+
+func NewBookingExistedError() error {
+	return errors.New(bookingExisted)
+}
+
+func IsBookingExistedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == bookingExisted
+}
+
+func NewBookingNotPendingError() error {
+	return errors.New(bookingNotPending)
+}
+
+func IsBookingNotPendingError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == bookingNotPending
+}
+
+// NewBookingGpuNotEnoughError means the gpus are booked by others in the window
+func NewBookingGpuNotEnoughError() error {
+	return errors.New(bookingGpuNotEnough)
+}
+
+func IsBookingGpuNotEnoughError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == bookingGpuNotEnough
+}
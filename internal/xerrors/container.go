@@ -4,7 +4,10 @@ import (
 	"github.com/pkg/errors"
 )
 
-const containerExisted = "container existed"
+const (
+	containerExisted                 = "container existed"
+	rootfsSizeUsedGreaterThanReduced = "rootfs the used size is greater than the reduced size"
+)
 
 func NewContainerExistedError() error {
 	return errors.New(containerExisted)
@@ -16,3 +19,14 @@ func IsContainerExistedError(err error) bool {
 	}
 	return errors.Cause(err).Error() == containerExisted
 }
+
+func NewRootfsSizeUsedGreaterThanReduced() error {
+	return errors.New(rootfsSizeUsedGreaterThanReduced)
+}
+
+func IsRootfsSizeUsedGreaterThanReduced(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == rootfsSizeUsedGreaterThanReduced
+}
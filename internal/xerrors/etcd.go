@@ -6,6 +6,8 @@ import (
 
 const (
 	notExistInEtcd = "not exist in etcd"
+	etcdConflict   = "etcd keys were modified by others"
+	etcdTooLarge   = "value is larger than the max request size of etcd"
 )
 
 func NewNotExistInEtcdError() error {
@@ -18,3 +20,25 @@ func IsNotExistInEtcdError(err error) bool {
 	}
 	return errors.Cause(err).Error() == notExistInEtcd
 }
+
+func NewEtcdConflictError() error {
+	return errors.New(etcdConflict)
+}
+
+func IsEtcdConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == etcdConflict
+}
+
+func NewEtcdTooLargeError() error {
+	return errors.New(etcdTooLarge)
+}
+
+func IsEtcdTooLargeError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == etcdTooLarge
+}
@@ -0,0 +1,33 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	groupWeightNotFound     = "group weight not found"
+	queueOrderedByFairShare = "queue ordered by fair share"
+)
+
+func NewGroupWeightNotFoundError() error {
+	return errors.New(groupWeightNotFound)
+}
+
+func IsGroupWeightNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == groupWeightNotFound
+}
+
+// NewQueueOrderedByFairShareError means the position of a queued request can't be changed by hand
+func NewQueueOrderedByFairShareError() error {
+	return errors.New(queueOrderedByFairShare)
+}
+
+func IsQueueOrderedByFairShareError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == queueOrderedByFairShare
+}
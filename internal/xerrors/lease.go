@@ -0,0 +1,32 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	leaseNotFound = "lease not found"
+	leaseExpired  = "lease expired"
+)
+
+func NewLeaseNotFoundError() error {
+	return errors.New(leaseNotFound)
+}
+
+func IsLeaseNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == leaseNotFound
+}
+
+func NewLeaseExpiredError() error {
+	return errors.New(leaseExpired)
+}
+
+func IsLeaseExpiredError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == leaseExpired
+}
@@ -0,0 +1,32 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	priorityClassNotFound   = "priority class not found"
+	priorityClassNotAllowed = "priority class not allowed"
+)
+
+func NewPriorityClassNotFoundError() error {
+	return errors.New(priorityClassNotFound)
+}
+
+func IsPriorityClassNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == priorityClassNotFound
+}
+
+func NewPriorityClassNotAllowedError() error {
+	return errors.New(priorityClassNotAllowed)
+}
+
+func IsPriorityClassNotAllowedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == priorityClassNotAllowed
+}
@@ -0,0 +1,20 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	queuedRequestNotFound = "queued request not found"
+)
+
+func NewQueuedRequestNotFoundError() error {
+	return errors.New(queuedRequestNotFound)
+}
+
+func IsQueuedRequestNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == queuedRequestNotFound
+}
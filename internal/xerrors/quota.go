@@ -0,0 +1,44 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	quotaExceeded = "quota exceeded"
+	quotaNotFound = "quota not found"
+	quotaNoOwner  = "owner or group is required by the quotas"
+)
+
+func NewQuotaExceededError() error {
+	return errors.New(quotaExceeded)
+}
+
+func IsQuotaExceededError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == quotaExceeded
+}
+
+func NewQuotaNotFoundError() error {
+	return errors.New(quotaNotFound)
+}
+
+func IsQuotaNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == quotaNotFound
+}
+
+func NewQuotaNoOwnerError() error {
+	return errors.New(quotaNoOwner)
+}
+
+func IsQuotaNoOwnerError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == quotaNoOwner
+}
@@ -0,0 +1,20 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	scheduleNotFound = "schedule not found"
+)
+
+func NewScheduleNotFoundError() error {
+	return errors.New(scheduleNotFound)
+}
+
+func IsScheduleNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == scheduleNotFound
+}
@@ -7,7 +7,13 @@ import (
 const (
 	gpuNotEnough  = "gpu not enough"
 	portNotEnough = "port not enough"
+	portConflict  = "port conflict"
 	cpuNotEnough  = "cpu not enough"
+
+	memoryNotEnough = "memory not enough"
+	diskNotEnough   = "disk not enough"
+
+	reservationsInProgress = "reservations in progress"
 )
 
 func NewGpuNotEnoughError() error {
@@ -32,6 +38,17 @@ func IsPortNotEnoughError(err error) bool {
 	return errors.Cause(err).Error() == portNotEnough
 }
 
+func NewPortConflictError() error {
+	return errors.New(portConflict)
+}
+
+func IsPortConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == portConflict
+}
+
 func NewCpuNotEnoughError() error {
 	return errors.New(cpuNotEnough)
 }
@@ -42,3 +59,92 @@ func IsCpuNotEnoughError(err error) bool {
 	}
 	return errors.Cause(err).Error() == cpuNotEnough
 }
+
+func NewMemoryNotEnoughError() error {
+	return errors.New(memoryNotEnough)
+}
+
+func IsMemoryNotEnoughError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == memoryNotEnough
+}
+
+func NewDiskNotEnoughError() error {
+	return errors.New(diskNotEnough)
+}
+
+func IsDiskNotEnoughError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == diskNotEnough
+}
+
+// IsResourceNotEnoughError reports whether the request may succeed later when resources are given back
+func IsResourceNotEnoughError(err error) bool {
+	return IsGpuNotEnoughError(err) || IsCpuNotEnoughError(err) || IsMemoryNotEnoughError(err) ||
+		IsDiskNotEnoughError(err) || IsPortNotEnoughError(err)
+}
+
+const (
+	gpuConflict = "gpu conflict"
+	gpuNotFound = "gpu not found"
+)
+
+// GpuConflictError is returned when the pinned gpus are held by other replicaSets
+type GpuConflictError struct {
+	Gpus []string `json:"gpus"`
+	// gpu -> replicaSets that currently hold it
+	Holders map[string][]string `json:"holders"`
+}
+
+func (e *GpuConflictError) Error() string {
+	return gpuConflict
+}
+
+func NewGpuConflictError(gpus []string) error {
+	return &GpuConflictError{
+		Gpus:    gpus,
+		Holders: make(map[string][]string, len(gpus)),
+	}
+}
+
+func IsGpuConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuConflict
+}
+
+// AsGpuConflictError returns the GpuConflictError wrapped in err
+func AsGpuConflictError(err error) (*GpuConflictError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	e, ok := errors.Cause(err).(*GpuConflictError)
+	return e, ok
+}
+
+func NewGpuNotFoundError() error {
+	return errors.New(gpuNotFound)
+}
+
+func IsGpuNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuNotFound
+}
+
+func NewReservationsInProgressError() error {
+	return errors.New(reservationsInProgress)
+}
+
+func IsReservationsInProgressError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == reservationsInProgress
+}
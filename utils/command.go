@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/commander-cli/cmd"
+	"github.com/pkg/errors"
+)
+
+const commandTimeout = 30 * time.Second
+
+// CommandRunner executes a shell command and returns its stdout,
+// it is an interface so that the output of tools such as nvidia-smi can be mocked.
+type CommandRunner interface {
+	Run(command string) (string, error)
+}
+
+type ShellRunner struct{}
+
+// Run returns the stdout even if the command exits with a non-zero code,
+// because nvidia-smi still prints the healthy gpus when one of them is lost.
+func (ShellRunner) Run(command string) (string, error) {
+	c := cmd.NewCommand(command, cmd.WithTimeout(commandTimeout))
+	if err := c.Execute(); err != nil {
+		return "", errors.Wrapf(err, "cmd.Execute failed, command: %s", command)
+	}
+	if c.ExitCode() != 0 {
+		return c.Stdout(), errors.Errorf("command: %s exit with code %d, stderr: %s", command, c.ExitCode(), c.Stderr())
+	}
+	return c.Stdout(), nil
+}
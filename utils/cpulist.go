@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseCpuList parses the cpu list format used by the kernel, e.g. 0-3,8-11,16
+func ParseCpuList(list string) ([]int, error) {
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return []int{}, nil
+	}
+
+	seen := make(map[int]struct{})
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid cpu list: %s", list)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+				return nil, errors.Errorf("invalid cpu list: %s", list)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			seen[cpu] = struct{}{}
+		}
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCpuList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []int
+	}{
+		{"", []int{}},
+		{"0-3,8-9,16", []int{0, 1, 2, 3, 8, 9, 16}},
+		{" 4, 2-3 ,2,", []int{2, 3, 4}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCpuList(tt.list)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCpuList(%q) = %v, %v, want %v", tt.list, got, err, tt.want)
+		}
+	}
+
+	for _, list := range []string{"a", "3-1", "1-b", "-1"} {
+		if _, err := ParseCpuList(list); err == nil {
+			t.Errorf("ParseCpuList(%q) succeeded, want an error", list)
+		}
+	}
+}
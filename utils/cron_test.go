@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronRefusesInvalidFields(t *testing.T) {
+	for _, expr := range []string{
+		"0 19 * *",
+		"60 * * * *",
+		"0 19 * * mon-foo",
+		"*/0 * * * *",
+		"0 5-1 * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// wednesday
+	from := time.Date(2024, 1, 10, 19, 30, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 19 * * mon-fri", time.Date(2024, 1, 11, 19, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 10, 19, 45, 0, 0, time.UTC)},
+		// friday to sunday, 7 is sunday too
+		{"0 8 * * fri,7", time.Date(2024, 1, 12, 8, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week matches
+		{"0 0 1 * mon", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -22,6 +22,9 @@ func DirSize(path string) (int64, error) {
 }
 
 func ToBytes(origin string) (int64, error) {
+	if len(origin) < 3 {
+		return 0, fmt.Errorf("invalid size: %s", origin)
+	}
 	sizeStr := origin[:len(origin)-2]
 	unit := origin[len(origin)-2:]
 
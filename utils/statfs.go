@@ -0,0 +1,19 @@
+//go:build !windows
+
+package utils
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// DiskUsage returns the total and free bytes of the filesystem that the path is on,
+// the free bytes are the ones available to unprivileged users.
+func DiskUsage(path string) (total, free int64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, errors.Wrapf(err, "syscall.Statfs failed, path: %s", path)
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
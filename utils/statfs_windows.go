@@ -0,0 +1,9 @@
+package utils
+
+import (
+	"github.com/pkg/errors"
+)
+
+func DiskUsage(path string) (total, free int64, err error) {
+	return 0, 0, errors.Errorf("disk usage is not supported on windows, path: %s", path)
+}